@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//--------------AUTHENTICATION================
+
+// Setting AUTH_SECRET turns authentication on: reads stay open, but
+// every other request needs an Authorization: Bearer header with a
+// token from POST /auth/login. Tokens are JWTs signed with HS256 using
+// AUTH_SECRET, so they all stop working if the secret changes.
+//
+// The accounts that can log in come from AUTH_USERS, a comma
+// separated list of name:password pairs, e.g. "alice:s3cret,bob:pw".
+// Both are read from the environment rather than flags so they don't
+// show up in ps.
+//
+// ADMIN_USERS names the ones among them, comma separated, who may use
+// the /admin/backup and /admin/restore endpoints and set the
+// /admin/status banner.
+
+var tokenTTL = flag.Duration("token-ttl", time.Hour, "how long tokens from /auth/login are valid")
+
+var (
+	authSecret = []byte(os.Getenv("AUTH_SECRET"))
+	authUsers  = parseAuthUsers(os.Getenv("AUTH_USERS"))
+	adminUsers = parseAdminUsers(os.Getenv("ADMIN_USERS"))
+)
+
+func authEnabled() bool {
+	return len(authSecret) > 0
+}
+
+func parseAuthUsers(v string) map[string]string {
+	users := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		name, password, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && name != "" {
+			users[name] = password
+		}
+	}
+	return users
+}
+
+func parseAdminUsers(v string) map[string]bool {
+	admins := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			admins[name] = true
+		}
+	}
+	return admins
+}
+
+// withAdmin only lets users named in ADMIN_USERS through. Without
+// authentication there's no telling who's asking, so nobody is.
+func withAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !authEnabled() || len(adminUsers) == 0:
+			writeError(w, r, http.StatusForbidden, "Admin endpoints need AUTH_SECRET and ADMIN_USERS to be set")
+		case userOf(r) == "":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="posts"`)
+			writeError(w, r, http.StatusUnauthorized, "Authentication required")
+		case !adminUsers[userOf(r)]:
+			writeError(w, r, http.StatusForbidden, "Only admins may do this")
+		default:
+			h(w, r)
+		}
+	}
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// handleLogin swaps a username and password for a token.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := decodeJSON(r, r.Body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+		return
+	}
+
+	// Compare against something even for unknown users, so the time
+	// taken doesn't tell which usernames exist.
+	password, known := authUsers[req.Username]
+	match := subtle.ConstantTimeCompare([]byte(password), []byte(req.Password)) == 1
+	if !known || !match {
+		writeError(w, r, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+
+	now := time.Now()
+	token := signToken(tokenClaims{
+		Subject:   req.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(*tokenTTL).Unix(),
+	})
+	respond(w, r, http.StatusOK, loginResponse{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresIn: int(tokenTTL.Seconds()),
+	})
+}
+
+type userKey struct{}
+
+// withAuth refuses unauthenticated requests that could change
+// anything. Safe methods and logging in are let through; the user of
+// a valid token is available to handlers from userOf.
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(r)
+		if err == nil && user != "" {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		}
+		// /graphql and gRPC check writes themselves, since reads are
+		// POSTed too.
+		if writeAllowed(r, err) || r.URL.Path == "/auth/login" || r.URL.Path == "/graphql" || isGRPC(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err == errNoToken {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="posts"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="posts", error="invalid_token"`)
+		}
+		writeError(w, r, http.StatusUnauthorized, "Authentication required: "+err.Error())
+	})
+}
+
+// writeAllowed reports whether r may change things, given the result
+// of authenticate. Reads are always allowed.
+func writeAllowed(r *http.Request, authErr error) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return mayWrite(authErr)
+}
+
+// mayWrite reports whether a client may make changes, given the result
+// of authenticating it.
+func mayWrite(authErr error) bool {
+	return !authEnabled() || authErr == nil
+}
+
+// userOf returns the user the request was authenticated as, if any.
+func userOf(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+var (
+	errNoToken      = errors.New("no bearer token")
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+)
+
+// authenticate checks r's bearer token and returns its user.
+func authenticate(r *http.Request) (string, error) {
+	if !authEnabled() {
+		return "", nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", errNoToken
+	}
+	claims, err := verifyToken(token, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+//--------------JWT================
+
+// Only as much of JWT (RFC 7519) as we need: HS256 tokens with a
+// subject and an expiry.
+
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// tokenHeader is the same for every token we issue, and the only one
+// we accept, so a token can't pick a weaker algorithm (or "none").
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func signToken(c tokenClaims) string {
+	payload, _ := json.Marshal(c)
+	signingInput := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(signingInput))
+}
+
+func verifyToken(token string, now time.Time) (tokenClaims, error) {
+	var c tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return c, errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, tokenMAC(parts[0]+"."+parts[1])) {
+		return c, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &c) != nil {
+		return c, errInvalidToken
+	}
+	if now.Unix() >= c.ExpiresAt {
+		return c, errExpiredToken
+	}
+	return c, nil
+}
+
+func tokenMAC(signingInput string) []byte {
+	mac := hmac.New(sha256.New, authSecret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+//--------------CAPABILITIES================
+
+type capabilities struct {
+	Authenticated bool `json:"authenticated"`
+	CanCreate     bool `json:"can_create"`
+	CanUpdate     bool `json:"can_update"`
+	CanDelete     bool `json:"can_delete"`
+	ReadOnly      bool `json:"read_only"`
+}
+
+// handleCapabilities tells a client what it may do, so a UI can hide
+// what it can't. It asks mayWrite, the same check withAuth uses.
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticate(r)
+	write := mayWrite(err)
+	respond(w, r, http.StatusOK, capabilities{
+		Authenticated: authEnabled() && err == nil && user != "",
+		CanCreate:     write,
+		CanUpdate:     write,
+		CanDelete:     write,
+		ReadOnly:      !write,
+	})
+}
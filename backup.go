@@ -0,0 +1,571 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//--------------BACKUP AND RESTORE================
+
+// GET /admin/backup sends a snapshot of everything the server keeps:
+// users, and for every tenant its posts, trashed ones included, with
+// their comments and revisions. POST /admin/restore loads one back,
+// into this server or another. Both are for the users named in
+// ADMIN_USERS only; see withAdmin in auth.go.
+//
+// A backup is a single JSON document, or with ?format=tar.gz a gzipped
+// tar of one JSON file per resource:
+//
+//	backup.json                  version and when it was made
+//	users.json
+//	tenants/0/tenant.json        the tenant's name and next post ID
+//	tenants/0/posts.json
+//	tenants/0/comments.json
+//	tenants/0/revisions.json
+//	tenants/1/...
+//
+// Restoring takes either, telling them apart by the gzip magic bytes,
+// and skips files it doesn't know, so backups with resources added
+// later can still be restored in part.
+//
+// ?mode=merge, the default, adds the backup's posts and users to what's
+// there, skipping posts whose ID is in use and users whose ID or name
+// is. ?mode=replace deletes every post and user first, so the server
+// ends up holding just the backup. Either way the next post ID only
+// ever goes up, so IDs handed out before aren't handed out again.
+
+// backupVersion is the version of the format written, and the only
+// one restored.
+const backupVersion = 1
+
+// maxRestoreBytes caps how much a restore reads, after decompressing,
+// so a small gzip bomb can't fill memory.
+const maxRestoreBytes = 1 << 30
+
+type backup struct {
+	Version    int            `json:"version"`
+	CreatedAt  time.Time      `json:"created_at"`
+	NextUserID int            `json:"next_user_id"`
+	Users      []User         `json:"users"`
+	Tenants    []tenantBackup `json:"tenants"`
+}
+
+type tenantBackup struct {
+	Tenant    string     `json:"tenant"`
+	NextID    int        `json:"next_id"`
+	Posts     []Post     `json:"posts"`
+	Comments  []Comment  `json:"comments"`
+	Revisions []Revision `json:"revisions"`
+}
+
+type restoreResult struct {
+	Mode    string `json:"mode"`
+	Posts   int    `json:"posts"`
+	Skipped int    `json:"skipped"`
+	Users   int    `json:"users"`
+}
+
+//--------------BACKUP================
+
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "tar.gz" {
+		writeError(w, r, http.StatusBadRequest, "format must be json or tar.gz")
+		return
+	}
+
+	b := takeBackup()
+	name := "backup-" + b.CreatedAt.Format("20060102T150405Z") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	var err error
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		err = writeBackupJSON(w, b)
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		err = writeBackupTar(w, b)
+	}
+	if err != nil {
+		// The 200 and part of the backup are already out, so breaking
+		// off the response is the only way left to tell the client
+		// it's short, rather than have it keep a truncated backup.
+		slog.Error("writing backup", "format", format, "err", err, "request_id", requestIDOf(r))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// takeBackup copies everything a backup holds, so it can be written
+// out without keeping the locks while the client reads it.
+func takeBackup() backup {
+	b := backup{Version: backupVersion, CreatedAt: time.Now().UTC()}
+
+	postsMu.RLock()
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := tenants[name]
+		tb := tenantBackup{Tenant: name, NextID: s.nextID}
+		tb.Posts = append(s.store.List(), s.store.ListTrashed()...)
+		sortByID(tb.Posts)
+		tb.Comments, tb.Revisions = []Comment{}, []Revision{}
+		for _, p := range tb.Posts {
+			tb.Comments = append(tb.Comments, s.store.Comments(p.ID)...)
+			tb.Revisions = append(tb.Revisions, s.store.Revisions(p.ID)...)
+		}
+		b.Tenants = append(b.Tenants, tb)
+	}
+	postsMu.RUnlock()
+
+	usersMu.Lock()
+	b.NextUserID = nextUserID
+	b.Users = make([]User, 0, len(users))
+	for _, u := range users {
+		b.Users = append(b.Users, u)
+	}
+	usersMu.Unlock()
+	sort.Slice(b.Users, func(i, j int) bool { return b.Users[i].ID < b.Users[j].ID })
+	return b
+}
+
+// writeBackupJSON writes b a tenant at a time rather than encoding it
+// all into one buffer first.
+func writeBackupJSON(w io.Writer, b backup) error {
+	head, err := json.Marshal(struct {
+		Version    int       `json:"version"`
+		CreatedAt  time.Time `json:"created_at"`
+		NextUserID int       `json:"next_user_id"`
+		Users      []User    `json:"users"`
+	}{b.Version, b.CreatedAt, b.NextUserID, b.Users})
+	if err != nil {
+		return err
+	}
+	// Reopen the object to add the tenants.
+	if _, err := fmt.Fprintf(w, "%s,\"tenants\":[", head[:len(head)-1]); err != nil {
+		return err
+	}
+	for i, tb := range b.Tenants {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		data, err := json.Marshal(tb)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+func writeBackupTar(w io.Writer, b backup) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	add := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: b.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+
+	err := add("backup.json", struct {
+		Version    int       `json:"version"`
+		CreatedAt  time.Time `json:"created_at"`
+		NextUserID int       `json:"next_user_id"`
+	}{b.Version, b.CreatedAt, b.NextUserID})
+	if err == nil {
+		err = add("users.json", b.Users)
+	}
+	for i, tb := range b.Tenants {
+		dir := fmt.Sprintf("tenants/%d/", i)
+		if err == nil {
+			err = add(dir+"tenant.json", struct {
+				Tenant string `json:"tenant"`
+				NextID int    `json:"next_id"`
+			}{tb.Tenant, tb.NextID})
+		}
+		if err == nil {
+			err = add(dir+"posts.json", tb.Posts)
+		}
+		if err == nil {
+			err = add(dir+"comments.json", tb.Comments)
+		}
+		if err == nil {
+			err = add(dir+"revisions.json", tb.Revisions)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+//--------------RESTORE================
+
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		writeError(w, r, http.StatusBadRequest, "mode must be merge or replace")
+		return
+	}
+
+	b, err := readBackup(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error reading backup: "+err.Error())
+		return
+	}
+	if err := b.validate(); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, "Invalid backup: "+err.Error())
+		return
+	}
+
+	postsMu.Lock()
+	defer postsMu.Unlock()
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	result := restoreResult{Mode: mode}
+	if mode == "replace" {
+		for _, s := range tenants {
+			if err := s.empty(); err != nil {
+				writeError(w, r, http.StatusInternalServerError, "Error deleting posts: "+err.Error())
+				return
+			}
+		}
+	}
+	for _, tb := range b.Tenants {
+		s, err := tenantPostSet(tb.Tenant)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "Error restoring posts: "+err.Error())
+			return
+		}
+		restored, skipped, err := s.restore(tb, mode == "merge")
+		result.Posts += restored
+		result.Skipped += skipped
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "Error restoring posts: "+err.Error())
+			return
+		}
+	}
+
+	result.Users = restoreUsers(b, mode == "merge")
+	if err := saveUsers(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Error saving users: "+err.Error())
+		return
+	}
+	respond(w, r, http.StatusOK, result)
+}
+
+// readBackup reads a backup in either format.
+func readBackup(body io.Reader) (backup, error) {
+	br := bufio.NewReader(body)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		var b backup
+		err := json.NewDecoder(limitRestore(br)).Decode(&b)
+		return b, err
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return backup{}, err
+	}
+	var b backup
+	dirs := map[string]*tenantBackup{}
+	tr := tar.NewReader(limitRestore(zr))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return backup{}, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		var v interface{}
+		switch dir, file := path.Split(name); {
+		case name == "backup.json":
+			v = &b
+		case name == "users.json":
+			v = &b.Users
+		case strings.HasPrefix(dir, "tenants/") && strings.Count(dir, "/") == 2:
+			tb, ok := dirs[dir]
+			if !ok {
+				tb = &tenantBackup{}
+				dirs[dir] = tb
+			}
+			switch file {
+			case "tenant.json":
+				v = tb
+			case "posts.json":
+				v = &tb.Posts
+			case "comments.json":
+				v = &tb.Comments
+			case "revisions.json":
+				v = &tb.Revisions
+			}
+		}
+		if v == nil {
+			continue
+		}
+		if err := json.NewDecoder(tr).Decode(v); err != nil {
+			return backup{}, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	for _, dir := range names {
+		b.Tenants = append(b.Tenants, *dirs[dir])
+	}
+	return b, nil
+}
+
+var errBackupTooLarge = fmt.Errorf("backup is larger than %d bytes", maxRestoreBytes)
+
+// limitRestore fails reads past maxRestoreBytes.
+func limitRestore(r io.Reader) io.Reader {
+	return &limitedReader{r: r}
+}
+
+type limitedReader struct {
+	r    io.Reader
+	read int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.read += int64(n)
+	if lr.read > maxRestoreBytes {
+		return n, errBackupTooLarge
+	}
+	return n, err
+}
+
+// validate checks that a backup hangs together before any of it is
+// restored. The posts themselves aren't validated again: they were
+// valid when backed up, and only admins can restore them.
+func (b *backup) validate() error {
+	if b.Version != backupVersion {
+		return fmt.Errorf("version %d is not supported (want %d)", b.Version, backupVersion)
+	}
+
+	userIDs, userNames := map[int]bool{}, map[string]bool{}
+	for _, u := range b.Users {
+		if u.ID <= 0 || userIDs[u.ID] {
+			return fmt.Errorf("user ID %d is invalid or repeated", u.ID)
+		}
+		if !validUserName.MatchString(u.Name) || userNames[u.Name] {
+			return fmt.Errorf("user name %q is invalid or repeated", u.Name)
+		}
+		userIDs[u.ID], userNames[u.Name] = true, true
+	}
+
+	seen := map[string]bool{}
+	for _, tb := range b.Tenants {
+		if tb.Tenant != "" && !validTenant.MatchString(tb.Tenant) {
+			return fmt.Errorf("tenant %q is invalid", tb.Tenant)
+		}
+		if tb.Tenant != "" && !*multiTenant {
+			return fmt.Errorf("tenant %q can't be restored without -multi-tenant", tb.Tenant)
+		}
+		if seen[tb.Tenant] {
+			return fmt.Errorf("tenant %q is repeated", tb.Tenant)
+		}
+		seen[tb.Tenant] = true
+
+		ids := map[PostID]bool{}
+		for _, p := range tb.Posts {
+			if p.ID == "" || ids[p.ID] {
+				return fmt.Errorf("post ID %q is missing or repeated", p.ID)
+			}
+			ids[p.ID] = true
+		}
+		for _, c := range tb.Comments {
+			if !ids[c.PostID] {
+				return fmt.Errorf("comment %d is on post %s, which isn't in the backup", c.ID, c.PostID)
+			}
+		}
+		for _, rev := range tb.Revisions {
+			if !ids[rev.PostID] {
+				return fmt.Errorf("revision %d is of post %s, which isn't in the backup", rev.N, rev.PostID)
+			}
+		}
+	}
+	return nil
+}
+
+// empty deletes every post, trashed ones included. Callers must hold
+// postsMu.
+func (s *postSet) empty() error {
+	for _, p := range s.store.List() {
+		if err := s.store.Delete(p.ID); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.store.ListTrashed() {
+		if err := s.store.Purge(p.ID); err != nil {
+			return err
+		}
+	}
+	s.tombstones = make(map[PostID]time.Time)
+	s.views = viewCounts{}
+	s.version++
+	s.rebuildDerived()
+	return nil
+}
+
+// restore adds the posts of tb, with their comments and revisions,
+// returning how many it added and how many it skipped as their ID is
+// in use. When merging, comments get new IDs, as the backup's may be
+// taken by others, and replies are pointed at their parents' new IDs.
+// Callers must hold postsMu.
+func (s *postSet) restore(tb tenantBackup, merge bool) (restored, skipped int, err error) {
+	// Whatever happens, the posts restored so far need indexing.
+	defer func() {
+		s.version++
+		s.rebuildDerived()
+	}()
+
+	comments := map[PostID][]Comment{}
+	for _, c := range tb.Comments {
+		comments[c.PostID] = append(comments[c.PostID], c)
+	}
+	revisions := map[PostID][]Revision{}
+	for _, rev := range tb.Revisions {
+		revisions[rev.PostID] = append(revisions[rev.PostID], rev)
+	}
+
+	nextID := tb.NextID
+	for _, p := range tb.Posts {
+		if n, ok := p.ID.asInt(); ok && n >= nextID {
+			nextID = n + 1
+		}
+		_, live := s.store.Get(p.ID)
+		_, trashed := s.store.GetTrashed(p.ID)
+		if live || trashed {
+			skipped++
+			continue
+		}
+
+		deletedAt := p.DeletedAt
+		p.DeletedAt = nil
+		if err := s.store.Create(p); err != nil {
+			return restored, skipped, err
+		}
+		// Comments can only be added to posts out of the trash.
+		if err := s.restoreComments(comments[p.ID], merge); err != nil {
+			return restored, skipped, err
+		}
+		for _, rev := range revisions[p.ID] {
+			if _, err := s.store.AddRevision(rev); err != nil {
+				return restored, skipped, err
+			}
+		}
+		if deletedAt != nil {
+			if _, err := s.store.Trash(p.ID, *deletedAt); err != nil {
+				return restored, skipped, err
+			}
+		}
+		delete(s.tombstones, p.ID)
+		restored++
+	}
+	if nextID > s.nextID {
+		s.nextID = nextID
+	}
+	return restored, skipped, nil
+}
+
+// restoreComments adds the comments of one restored post. When
+// merging, each gets a new ID, and a reply's parent_id and depth follow
+// its parent's; a reply whose parent isn't in the backup, as it was
+// deleted, keeps its depth but no parent, since the old ID may now be
+// another comment's. Callers must hold postsMu.
+func (s *postSet) restoreComments(cs []Comment, merge bool) error {
+	// Parents before their replies.
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ID < cs[j].ID })
+	restored := make(map[int]Comment)
+	for _, c := range cs {
+		oldID := c.ID
+		if merge {
+			c.ID = 0
+			if c.ParentID != 0 {
+				if parent, ok := restored[c.ParentID]; ok {
+					c.ParentID = parent.ID
+					c.Depth = max(parent.Depth, 1) + 1
+				} else {
+					c.ParentID = 0
+				}
+			}
+		}
+		c, err := s.store.AddComment(c)
+		if err != nil {
+			return err
+		}
+		restored[oldID] = c
+	}
+	return nil
+}
+
+// restoreUsers adds the backup's users, returning how many. Callers
+// must hold usersMu.
+func restoreUsers(b backup, merge bool) int {
+	if !merge {
+		users = make(map[int]User)
+	}
+	restored := 0
+	for _, u := range b.Users {
+		if _, taken := users[u.ID]; taken {
+			continue
+		}
+		if _, taken := userByName(u.Name); taken {
+			continue
+		}
+		users[u.ID] = u
+		restored++
+		if u.ID >= nextUserID {
+			nextUserID = u.ID + 1
+		}
+	}
+	if b.NextUserID > nextUserID {
+		nextUserID = b.NextUserID
+	}
+	return restored
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// shortWriter takes n bytes of a response and then fails, like a
+// client gone halfway through a download.
+type shortWriter struct {
+	*httptest.ResponseRecorder
+	n int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		written, _ := w.ResponseRecorder.Write(b[:w.n])
+		w.n = 0
+		return written, errors.New("connection reset")
+	}
+	w.n -= len(b)
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestBackupWriteError(t *testing.T) {
+	ts := newTestServer(t)
+	for i := 0; i < 20; i++ {
+		ts.createPost(`{"body":"a post long enough to fill more than a few bytes of backup"}`)
+	}
+
+	for _, format := range []string{"json", "tar.gz"} {
+		t.Run(format, func(t *testing.T) {
+			defer func() {
+				if p := recover(); p != http.ErrAbortHandler {
+					t.Errorf("recovered %v, want http.ErrAbortHandler", p)
+				}
+			}()
+			w := &shortWriter{ResponseRecorder: httptest.NewRecorder(), n: 100}
+			handleBackup(w, httptest.NewRequest("GET", "/admin/backup?format="+format, nil))
+			t.Error("a short backup finished as if it were whole")
+		})
+	}
+}
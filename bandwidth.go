@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//--------------DAILY BANDWIDTH CAP================
+
+// statusBandwidthLimitExceeded is the non-standard 509 status, which
+// net/http has no constant for.
+const statusBandwidthLimitExceeded = 509
+
+var dailyBandwidth = flag.Int64("daily-bandwidth", 0, "bytes of response bodies to serve per UTC day before answering 509 (0 means unlimited)")
+
+// bytesServed counts response body bytes written since the last reset.
+var bytesServed atomic.Int64
+
+// withBandwidthCap counts the bytes written by every response and,
+// once the daily allowance is used up, refuses requests with 509
+// until resetBandwidthDaily zeroes the counter. A response that starts
+// under the cap is allowed to finish, so the cap can be overshot by
+// the size of the responses in flight.
+func withBandwidthCap(limit int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if bytesServed.Load() >= limit {
+				writeError(w, r, statusBandwidthLimitExceeded, "Bandwidth limit exceeded")
+				return
+			}
+			next.ServeHTTP(&countingWriter{ResponseWriter: w}, r)
+		})
+	}
+}
+
+// resetBandwidthDaily zeroes bytesServed at every UTC midnight.
+func resetBandwidthDaily() {
+	for {
+		now := time.Now().UTC()
+		midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		time.Sleep(midnight.Sub(now))
+		bytesServed.Store(0)
+	}
+}
+
+// countingWriter adds every body byte it writes to bytesServed.
+type countingWriter struct {
+	http.ResponseWriter
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	bytesServed.Add(int64(n))
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the real writer.
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
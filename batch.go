@@ -0,0 +1,323 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+//--------------BATCH OPERATIONS================
+
+// batchOp is a single operation in a POST /batch request, e.g.
+// {"op":"update","id":3,"post":{"body":"..."}}.
+type batchOp struct {
+	Op   string `json:"op"`
+	ID   PostID `json:"id,omitempty"`
+	Post *Post  `json:"post,omitempty"`
+}
+
+// batchResult reports the outcome of one batchOp, using the status
+// code the equivalent single request would have returned.
+type batchResult struct {
+	Op     string `json:"op"`
+	ID     PostID `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Post   *Post  `json:"post,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchRequest struct {
+	Atomic     bool      `json:"atomic"`
+	Operations []batchOp `json:"operations"`
+}
+
+type batchResponse struct {
+	Results    []batchResult `json:"results"`
+	RolledBack bool          `json:"rolled_back,omitempty"`
+}
+
+// handleBatch runs a list of operations in order under a single hold
+// of postsMu, so no other request can observe or interleave with the
+// batch while it runs: a "get" sees the effect of every earlier
+// operation in the same batch and nothing else.
+//
+// Without "atomic", each operation stands alone and a failure doesn't
+// affect the others. With "atomic", the batch stops at the first
+// failing operation and the posts are restored to how they were
+// before the batch started, including nextID, so it's all or nothing.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := decodeJSON(r, r.Body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+		return
+	}
+
+	resp := runBatch(r, req.Operations, req.Atomic, nil)
+
+	code := http.StatusOK
+	if resp.RolledBack {
+		code = http.StatusConflict
+	}
+	respond(w, r, code, resp)
+}
+
+// handleBatchCreate serves POST /posts/batch, which creates a list of
+// posts, all or none. It validates every post before creating any, so
+// a client sees all the invalid ones in one go: if any is invalid the
+// answer is 422, with each invalid post's errors and 424 Failed
+// Dependency for the rest. Otherwise the posts are created as an
+// atomic batch, which can still fail on something only known while
+// creating, such as a duplicate body, in which case nothing is kept
+// and the answer is 409 as for /batch.
+func handleBatchCreate(w http.ResponseWriter, r *http.Request) {
+	var posts []Post
+	if err := decodeJSON(r, r.Body, &posts); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if len(posts) == 0 {
+		writeError(w, r, http.StatusBadRequest, "At least one post is required")
+		return
+	}
+
+	results := make([]batchResult, len(posts))
+	invalid := false
+	for i, p := range posts {
+		p.Body = normalizeBody(p.Body)
+		if err := validatePost(p, ""); err != nil {
+			results[i] = failErr(batchResult{Op: "create"}, err)
+			invalid = true
+		}
+	}
+	if invalid {
+		for i := range results {
+			if results[i].Status == 0 {
+				results[i] = fail(batchResult{Op: "create"}, http.StatusFailedDependency, "Not created, as other posts in the batch are invalid")
+			}
+		}
+		respond(w, r, http.StatusUnprocessableEntity, batchResponse{Results: results})
+		return
+	}
+
+	ops := make([]batchOp, len(posts))
+	for i := range posts {
+		ops[i] = batchOp{Op: "create", Post: &posts[i]}
+	}
+	resp := runBatch(r, ops, true, nil)
+
+	code := http.StatusCreated
+	if resp.RolledBack {
+		code = http.StatusConflict
+	}
+	respond(w, r, code, resp)
+}
+
+// runBatch applies ops in order to the request's posts while holding
+// postsMu. If onResult isn't nil it's called with each result as soon
+// as the operation is done.
+func runBatch(r *http.Request, ops []batchOp, atomic bool, onResult func(batchResult)) batchResponse {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	resp := batchResponse{Results: make([]batchResult, 0, len(ops))}
+	s, err := postSetFor(r)
+	if err != nil {
+		// Nothing can run, so every operation fails as it would alone.
+		for _, op := range ops {
+			res := failErr(batchResult{Op: op.Op, ID: op.ID}, err)
+			resp.Results = append(resp.Results, res)
+			if onResult != nil {
+				onResult(res)
+			}
+		}
+		return resp
+	}
+
+	var (
+		undo       batchUndo
+		snapshotID int
+		held       []postEvent
+	)
+	if atomic {
+		undo = make(batchUndo)
+		snapshotID = s.nextID
+
+		// Events wait until we know the batch won't be rolled back.
+		heldEvents = &held
+		defer func() { heldEvents = nil }()
+	}
+
+	for _, op := range ops {
+		// Once the request's deadline has passed, the rest of the
+		// batch fails instead of running for nobody.
+		var res batchResult
+		if r.Context().Err() != nil {
+			res = fail(batchResult{Op: op.Op}, http.StatusRequestTimeout, "Request deadline exceeded")
+		} else {
+			if atomic && op.ID != "" {
+				undo.remember(s, op.ID)
+			}
+			res = s.applyBatchOp(r, op)
+			if atomic && op.Op == "create" && res.Post != nil {
+				undo[res.Post.ID] = nil
+			}
+		}
+		resp.Results = append(resp.Results, res)
+		if onResult != nil {
+			onResult(res)
+		}
+
+		if atomic && res.Status >= 400 {
+			if err := s.undo(undo); err != nil {
+				slog.Error("rolling back batch", "err", err, "request_id", requestIDOf(r))
+			}
+			s.nextID = snapshotID
+			s.version++
+			s.rebuildDerived()
+			resp.RolledBack = true
+			break
+		}
+	}
+
+	if atomic && !resp.RolledBack {
+		for _, e := range held {
+			writeEvent(e)
+		}
+	}
+	return resp
+}
+
+// batchUndo remembers how each post an atomic batch touches looked
+// before the batch, along with its comments, or nil for one that
+// didn't exist, so a rollback only has to put those back.
+type batchUndo map[PostID]*undoPost
+
+type undoPost struct {
+	post      Post
+	comments  []Comment
+	revisions []Revision
+}
+
+func (u batchUndo) remember(s *postSet, id PostID) {
+	if _, ok := u[id]; ok {
+		return
+	}
+	if p, ok := s.store.Get(id); ok {
+		u[id] = &undoPost{post: p, comments: s.store.Comments(id), revisions: s.store.Revisions(id)}
+	} else {
+		u[id] = nil
+	}
+}
+
+// undo puts back the posts remembered in u. The caller holds postsMu.
+func (s *postSet) undo(u batchUndo) error {
+	for id, orig := range u {
+		_, exists := s.store.Get(id)
+		_, trashed := s.store.GetTrashed(id)
+		var err error
+		switch {
+		case orig == nil && exists:
+			err = s.store.Delete(id)
+		case orig == nil && trashed:
+			err = s.store.Purge(id)
+		case orig != nil && exists:
+			err = s.store.Update(orig.post)
+		case orig != nil && trashed:
+			// Deleting it moved it to the trash.
+			if _, err = s.store.Restore(id); err == nil {
+				err = s.store.Update(orig.post)
+			}
+		case orig != nil:
+			// Deleting the post took its comments with it.
+			err = s.store.Create(orig.post)
+			for _, c := range orig.comments {
+				if err == nil {
+					_, err = s.store.AddComment(c)
+				}
+			}
+			for _, rev := range orig.revisions {
+				if err == nil {
+					_, err = s.store.AddRevision(rev)
+				}
+			}
+		}
+		if err == nil && orig != nil && (exists || trashed) {
+			// Forget the revisions the batch's updates recorded.
+			// Old ones dropped by -max-revisions stay dropped.
+			last := 0
+			if n := len(orig.revisions); n > 0 {
+				last = orig.revisions[n-1].N
+			}
+			err = s.store.DropRevisions(id, last)
+		}
+		if err != nil {
+			return err
+		}
+		if orig != nil {
+			// A delete in the batch left a tombstone for a post
+			// that's back now.
+			delete(s.tombstones, id)
+		}
+	}
+	return nil
+}
+
+// applyBatchOp performs one operation for r. The caller holds postsMu.
+func (s *postSet) applyBatchOp(r *http.Request, op batchOp) batchResult {
+	res := batchResult{Op: op.Op, ID: op.ID}
+	if op.Op == "update" || op.Op == "delete" {
+		if err := s.checkOwner(r, op.ID); err != nil {
+			return failErr(res, err)
+		}
+	}
+
+	switch op.Op {
+	case "create":
+		if op.Post == nil {
+			return fail(res, http.StatusBadRequest, "Post is required")
+		}
+		p := *op.Post
+		var err error
+		if p.AuthorID, err = authorIDFor(r, p.AuthorID); err != nil {
+			return failErr(res, err)
+		}
+		p, err = s.createPost(p)
+		if err != nil {
+			return failErr(res, err)
+		}
+		res.ID, res.Status, res.Post = p.ID, http.StatusCreated, &p
+	case "get":
+		p, err := s.getPost(op.ID)
+		if err != nil {
+			return failErr(res, err)
+		}
+		res.Status, res.Post = http.StatusOK, &p
+	case "update":
+		if op.Post == nil {
+			return fail(res, http.StatusBadRequest, "Post is required")
+		}
+		p, err := s.updatePost(op.ID, *op.Post)
+		if err != nil {
+			return failErr(res, err)
+		}
+		res.Status, res.Post = http.StatusOK, &p
+	case "delete":
+		if err := s.deletePost(op.ID); err != nil {
+			return failErr(res, err)
+		}
+		res.Status = http.StatusOK
+	default:
+		return fail(res, http.StatusBadRequest, "Unknown op: "+op.Op)
+	}
+	return res
+}
+
+func fail(res batchResult, code int, msg string) batchResult {
+	res.Status = code
+	res.Error = msg
+	return res
+}
+
+func failErr(res batchResult, err error) batchResult {
+	code, msg := postErrorStatus(err)
+	return fail(res, code, msg)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+//--------------BULK OPERATIONS================
+
+// POST /posts/bulk runs a list of operations like /batch, and
+// DELETE /posts?ids=1,2,3 deletes several posts. Both answer with
+// one result per post, so the caller can see which ones failed and
+// why.
+
+// handleBulkPosts is the /posts/bulk flavour of handleBatch for sync
+// clients: the body is the bare list of operations and ?atomic=true
+// asks for all-or-nothing. Results and guarantees are the same.
+//
+// A client sending Accept: application/x-ndjson gets each result as
+// its own line as soon as the operation is done, for progress on long
+// imports, followed by a bulkSummary line. The status is then always
+// 200, as it's sent before the outcome is known; with ?atomic=true
+// only the summary says whether the results stuck. Other clients get
+// the buffered response.
+func handleBulkPosts(w http.ResponseWriter, r *http.Request) {
+	var ops []batchOp
+	if err := decodeJSON(r, r.Body, &ops); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+		return
+	}
+
+	atomic := false
+	if v := r.URL.Query().Get("atomic"); v != "" {
+		var err error
+		if atomic, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid atomic flag")
+			return
+		}
+	}
+
+	if wantsNDJSON(r) {
+		streamBulk(w, r, ops, atomic)
+		return
+	}
+
+	resp := runBatch(r, ops, atomic, nil)
+
+	code := http.StatusOK
+	if resp.RolledBack {
+		code = http.StatusConflict
+	}
+	respond(w, r, code, resp)
+}
+
+// bulkSummary is the last line of a streamed /posts/bulk response.
+type bulkSummary struct {
+	Done       bool `json:"done"`
+	Operations int  `json:"operations"`
+	Failed     int  `json:"failed"`
+	RolledBack bool `json:"rolled_back"`
+}
+
+func wantsNDJSON(r *http.Request) bool {
+	for _, mediaRange := range acceptRanges(r.Header.Get("Accept")) {
+		if mediaRange == "application/x-ndjson" {
+			return true
+		}
+	}
+	return false
+}
+
+// streamBulk runs a bulk request, writing and flushing each result as
+// a line of NDJSON as soon as it's known.
+func streamBulk(w http.ResponseWriter, r *http.Request, ops []batchOp, atomic bool) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	summary := bulkSummary{Done: true}
+	resp := runBatch(r, ops, atomic, func(res batchResult) {
+		summary.Operations++
+		if res.Status >= 400 {
+			summary.Failed++
+		}
+		enc.Encode(res)
+		rc.Flush()
+	})
+
+	summary.RolledBack = resp.RolledBack
+	enc.Encode(summary)
+}
+
+// handleDeletePosts deletes each post in ?ids= on its own: one that
+// can't be deleted doesn't stop the others. There's no deleting every
+// post by leaving out ?ids=.
+func handleDeletePosts(w http.ResponseWriter, r *http.Request) {
+	ids, err := parseIDs(r.URL.Query().Get("ids"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(ids) == 0 {
+		writeError(w, r, http.StatusBadRequest, "ids is required")
+		return
+	}
+
+	ops := make([]batchOp, len(ids))
+	for i, id := range ids {
+		ops[i] = batchOp{Op: "delete", ID: id}
+	}
+	respond(w, r, http.StatusOK, runBatch(r, ops, false, nil))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//--------------CACHE-CONTROL================
+
+var defaultCacheControl = flag.String("cache-control", "", "Cache-Control header for GET /posts/{id}, e.g. \"public, max-age=3600\" (empty sends none)")
+
+// routeCacheControl holds -route-cache-control overrides, keyed by
+// the route names in cacheableRoutes.
+var routeCacheControl = make(map[string]string)
+
+// cacheableRoutes are the read routes that send a Cache-Control
+// header when one is configured.
+var cacheableRoutes = []string{"/posts", "/posts/{id}", "/posts/feed.xml"}
+
+func init() {
+	flag.Func("route-cache-control", "per-route Cache-Control override as route=value, e.g. \"/posts=no-cache\" (repeatable; routes: "+strings.Join(cacheableRoutes, ", ")+")", func(s string) error {
+		route, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("want route=value")
+		}
+		for _, known := range cacheableRoutes {
+			if route == known {
+				routeCacheControl[route] = value
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown route %q", route)
+	})
+}
+
+// setCacheControl adds the configured Cache-Control for route, if
+// any. A -route-cache-control override wins, even when it's empty;
+// otherwise only GET /posts/{id} gets the -cache-control default.
+func setCacheControl(w http.ResponseWriter, route string) {
+	value, ok := routeCacheControl[route]
+	if !ok && route == "/posts/{id}" {
+		value = *defaultCacheControl
+	}
+	if value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+}
+
+// postETag is the ETag of GET /posts/{id}. It changes on every update
+// and on locking or unlocking, so a client or CDN holding a long-lived
+// copy can revalidate cheaply and never keeps serving a changed post.
+// Views don't count as a change, just like for collectionETag.
+func postETag(p Post) string {
+	locked := "u"
+	if p.Locked {
+		locked = "l"
+	}
+	return `"` + bootID + "-" + string(p.ID) + "-" + strconv.FormatInt(p.UpdatedAt.UnixNano(), 36) + locked + `"`
+}
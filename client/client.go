@@ -0,0 +1,171 @@
+// Package client talks to the WebServer posts API, so Go programs
+// don't have to build the HTTP requests themselves.
+//
+//	c := client.New("http://localhost:8081")
+//	p, err := c.CreatePost(ctx, client.Post{Body: "hello"})
+//	if errors.Is(err, client.ErrValidation) {
+//		...
+//	}
+//
+// Requests that fail for reasons likely to pass, such as a dropped
+// connection or a 503 while the server restarts, are retried with
+// exponential backoff; see Client.MaxRetries.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client sends requests to one server. Set its fields before the
+// first request and leave them alone afterwards; a Client is then
+// safe to use from several goroutines.
+type Client struct {
+	// BaseURL is the server's address, like http://localhost:8081.
+	BaseURL string
+	// Token, if set, is sent as a bearer token, for servers with
+	// AUTH_SECRET set.
+	Token string
+	// Tenant, if set, is sent as X-Tenant-ID, for servers run with
+	// -multi-tenant.
+	Tenant string
+	// HTTPClient sends the requests; http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// MaxRetries is how many times a failed request is tried again.
+	// New sets it to 3.
+	MaxRetries int
+	// RetryWait is the wait before the first retry, doubled for
+	// each one after, up to MaxRetryWait. A Retry-After from the
+	// server takes precedence. New sets them to 200ms and 5s.
+	RetryWait    time.Duration
+	MaxRetryWait time.Duration
+}
+
+// New returns a Client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimRight(baseURL, "/"),
+		MaxRetries:   3,
+		RetryWait:    200 * time.Millisecond,
+		MaxRetryWait: 5 * time.Second,
+	}
+}
+
+// do sends a request with in as its JSON body, if not nil, and decodes
+// the response into out, if not nil, retrying as the Client allows.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, body)
+		if err == nil && resp.StatusCode < 400 {
+			defer resp.Body.Close()
+			if out == nil {
+				return nil
+			}
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+
+		var wait time.Duration
+		if err == nil {
+			err = responseError(resp)
+			resp.Body.Close()
+			wait = retryAfter(resp)
+		}
+		// A Retry-After longer than we'd wait anyway is left for
+		// the caller to deal with.
+		if attempt >= c.MaxRetries || !retryable(method, resp) || ctx.Err() != nil || wait > c.MaxRetryWait {
+			return err
+		}
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.Tenant)
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return hc.Do(req)
+}
+
+// retryable reports whether a request may be tried again after it
+// failed with resp, which is nil for a connection error. Only a GET is
+// retried after a connection error, since anything else may have been
+// done already; every method is retried after 429, or 503 while the
+// server is down for maintenance, as those were refused before being
+// looked at.
+func retryable(method string, resp *http.Response) bool {
+	if resp == nil {
+		return method == "GET"
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return method == "GET"
+	}
+	return false
+}
+
+// backoff is the wait before retry number attempt+1, with jitter so
+// that many clients don't all come back at once.
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.RetryWait << attempt
+	if wait <= 0 || wait > c.MaxRetryWait {
+		wait = c.MaxRetryWait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryAfter reads a Retry-After in seconds, 0 if there isn't one.
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Errors for the status codes a caller is likely to handle. An *Error
+// matches the one for its status code with errors.Is:
+//
+//	if errors.Is(err, client.ErrNotFound) { ... }
+var (
+	ErrBadRequest   = errors.New("bad request")         // 400
+	ErrUnauthorized = errors.New("unauthorized")        // 401
+	ErrForbidden    = errors.New("forbidden")           // 403
+	ErrNotFound     = errors.New("not found")           // 404, and 410 for a deleted post
+	ErrConflict     = errors.New("conflict")            // 409
+	ErrPrecondition = errors.New("precondition failed") // 412
+	ErrValidation   = errors.New("validation failed")   // 422
+	ErrLocked       = errors.New("locked")              // 423
+	ErrRateLimited  = errors.New("rate limited")        // 429
+	ErrServer       = errors.New("server error")        // 5xx
+	ErrUnavailable  = errors.New("service unavailable") // 503, also matches ErrServer
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:          ErrBadRequest,
+	http.StatusUnauthorized:        ErrUnauthorized,
+	http.StatusForbidden:           ErrForbidden,
+	http.StatusNotFound:            ErrNotFound,
+	http.StatusGone:                ErrNotFound,
+	http.StatusConflict:            ErrConflict,
+	http.StatusPreconditionFailed:  ErrPrecondition,
+	http.StatusUnprocessableEntity: ErrValidation,
+	http.StatusLocked:              ErrLocked,
+	http.StatusTooManyRequests:     ErrRateLimited,
+	http.StatusServiceUnavailable:  ErrUnavailable,
+}
+
+// Error is a response with an error status.
+type Error struct {
+	StatusCode int
+	// Message is the server's explanation, if it sent one.
+	Message string
+	// Fields lists what's wrong with each field of a post, for
+	// ErrValidation.
+	Fields []FieldError
+	// RequestID is the X-Request-ID of the request, to look up in
+	// the server's log.
+	RequestID string
+}
+
+// FieldError is one problem with a field of a post.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	for _, f := range e.Fields {
+		msg += fmt.Sprintf("; %s: %s", f.Field, f.Message)
+	}
+	if e.RequestID != "" {
+		return fmt.Sprintf("%d %s (request ID %s)", e.StatusCode, msg, e.RequestID)
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, msg)
+}
+
+// Is matches e to the error for its status code.
+func (e *Error) Is(target error) bool {
+	if target == ErrServer {
+		return e.StatusCode >= 500
+	}
+	return statusErrors[e.StatusCode] == target
+}
+
+// responseError reads the server's error, which is always a JSON
+// object. Something in between, like a proxy, may answer in plain text.
+func responseError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	// Both the plain errors and problem details (RFC 7807).
+	var body struct {
+		Error  string       `json:"error"`
+		Detail string       `json:"detail"`
+		Title  string       `json:"title"`
+		Fields []FieldError `json:"fields"`
+	}
+	if json.Unmarshal(b, &body) == nil {
+		e.Message = body.Error
+		if e.Message == "" {
+			e.Message = body.Detail
+		}
+		if e.Message == "" {
+			e.Message = body.Title
+		}
+		e.Fields = body.Fields
+		return e
+	}
+
+	// Older servers ended plain text errors with the request ID, which
+	// is already in e.RequestID.
+	msg := strings.TrimSpace(string(b))
+	if i := strings.LastIndex(msg, " (request ID "); i >= 0 {
+		msg = msg[:i]
+	}
+	e.Message = msg
+	return e
+}
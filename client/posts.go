@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// PostID identifies a post. Servers run with -id-strategy=int, the
+// default, number their posts, and others give them UUIDs or ULIDs,
+// so IDs are kept as text: "42", or "01J9ZQ3V1XK4M7Y0T2W8BQ5F6N".
+type PostID string
+
+// MarshalJSON writes a numbered ID as a number, as the server does.
+func (id PostID) MarshalJSON() ([]byte, error) {
+	if _, err := strconv.Atoi(string(id)); err == nil {
+		return []byte(id), nil
+	}
+	return json.Marshal(string(id))
+}
+
+// UnmarshalJSON takes an ID as a number or a string.
+func (id *PostID) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, (*string)(id))
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = PostID(n)
+	return nil
+}
+
+// Post is a post as the server sends it.
+type Post struct {
+	ID        PostID     `json:"id,omitempty"`
+	Body      string     `json:"body"`
+	Author    string     `json:"author,omitempty"`
+	AuthorID  int        `json:"author_id,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	CreatedAt time.Time  `json:"created_at,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at,omitempty"`
+	Locked    bool       `json:"locked,omitempty"`
+	Views     int        `json:"views,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// ListOptions pick which posts ListPosts returns. The zero value asks
+// for the first page of every post.
+type ListOptions struct {
+	// Limit is the page size, at most 100; 0 leaves it to the
+	// server.
+	Limit int
+	// Offset is how many posts to skip.
+	Offset int
+	// Author, if set, keeps only that author's posts.
+	Author string
+	// Tags, if set, keeps only posts with all of them.
+	Tags []string
+	// Sort orders the posts by id (the default), created_at or
+	// views.
+	Sort string
+}
+
+// PostPage is one page of posts.
+type PostPage struct {
+	Posts []Post `json:"data"`
+	// Total is how many posts there are across all pages.
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// More reports whether there are posts after this page.
+func (p *PostPage) More() bool {
+	return p.Offset+len(p.Posts) < p.Total
+}
+
+// NextOptions returns the options for the page after p, given the
+// options p was fetched with.
+func (p *PostPage) NextOptions(opts ListOptions) ListOptions {
+	opts.Offset = p.Offset + len(p.Posts)
+	return opts
+}
+
+// ListPosts returns a page of posts, oldest first unless opts.Sort
+// says otherwise. To go through every post:
+//
+//	opts := client.ListOptions{Limit: 100}
+//	for {
+//		page, err := c.ListPosts(ctx, opts)
+//		...
+//		if !page.More() {
+//			break
+//		}
+//		opts = page.NextOptions(opts)
+//	}
+func (c *Client) ListPosts(ctx context.Context, opts ListOptions) (*PostPage, error) {
+	q := url.Values{}
+	// Asking for an offset makes the server answer with a page.
+	q.Set("offset", strconv.Itoa(opts.Offset))
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Author != "" {
+		q.Set("author", opts.Author)
+	}
+	for _, t := range opts.Tags {
+		q.Add("tag", t)
+	}
+	if opts.Sort != "" {
+		q.Set("sort", opts.Sort)
+	}
+
+	var page PostPage
+	if err := c.do(ctx, "GET", "/posts?"+q.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// GetPost returns the post with the given ID. Reading it counts as a
+// view, like any other GET.
+func (c *Client) GetPost(ctx context.Context, id PostID) (Post, error) {
+	var p Post
+	err := c.do(ctx, "GET", "/posts/"+url.PathEscape(string(id)), nil, &p)
+	return p, err
+}
+
+// CreatePost creates p and returns it as stored, with its ID.
+func (c *Client) CreatePost(ctx context.Context, p Post) (Post, error) {
+	var created Post
+	err := c.do(ctx, "POST", "/posts", newPost{p.Body, p.Author, p.AuthorID, p.Tags}, &created)
+	return created, err
+}
+
+// newPost is what CreatePost sends: just the fields a client sets.
+type newPost struct {
+	Body     string   `json:"body"`
+	Author   string   `json:"author,omitempty"`
+	AuthorID int      `json:"author_id,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// DeletePost deletes the post with the given ID, which moves it to
+// the server's trash.
+func (c *Client) DeletePost(ctx context.Context, id PostID) error {
+	return c.do(ctx, "DELETE", "/posts/"+url.PathEscape(string(id)), nil, nil)
+}
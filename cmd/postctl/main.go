@@ -0,0 +1,195 @@
+// Command postctl works with the posts of a running WebServer from
+// the command line.
+//
+//	postctl [--server URL] [--token TOKEN] [--output table|json] <command> [args]
+//
+//	postctl list [--author NAME] [--tag TAG] [--limit N]
+//	postctl get 3
+//	postctl create --body "hello" [--author NAME] [--tags a,b]
+//	postctl delete 3
+//
+// --server and --token default to $POSTCTL_SERVER and $POSTCTL_TOKEN.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mikevidotto/WebServer/client"
+)
+
+func main() {
+	flag.Usage = usage
+	server := flag.String("server", envOr("POSTCTL_SERVER", "http://localhost:8081"), "address of the server")
+	token := flag.String("token", os.Getenv("POSTCTL_TOKEN"), "bearer token, for servers with auth on")
+	tenant := flag.String("tenant", "", "X-Tenant-ID to send, for servers run with -multi-tenant")
+	output := flag.String("output", "table", "output format: table or json")
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		fatalf("unknown --output %q (want table or json)", *output)
+	}
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	c := client.New(*server)
+	c.Token = *token
+	c.Tenant = *tenant
+
+	ctx := context.Background()
+	args := flag.Args()[1:]
+	switch cmd := flag.Arg(0); cmd {
+	case "list":
+		ps, err := listPosts(ctx, c, args)
+		check(err)
+		printPosts(*output, ps...)
+	case "get":
+		p, err := c.GetPost(ctx, idArg(cmd, args))
+		check(err)
+		printPosts(*output, p)
+	case "create":
+		p, err := c.CreatePost(ctx, postFlags(args))
+		check(err)
+		printPosts(*output, p)
+	case "delete":
+		id := idArg(cmd, args)
+		check(c.DeletePost(ctx, id))
+		if *output == "json" {
+			printJSON(map[string]client.PostID{"deleted": id})
+		} else {
+			fmt.Printf("deleted post %s\n", id)
+		}
+	default:
+		fatalf("unknown command %q", cmd)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: postctl [flags] list | get ID | create --body TEXT | delete ID\n\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// listPosts parses the flags of list and fetches the posts, page by
+// page unless --limit asks for just some.
+func listPosts(ctx context.Context, c *client.Client, args []string) ([]client.Post, error) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	author := fs.String("author", "", "only posts by this author")
+	tag := fs.String("tag", "", "only posts with this tag")
+	limit := fs.Int("limit", 0, "at most this many posts (0 lists them all)")
+	fs.Parse(args)
+	if fs.NArg() > 0 || *limit < 0 {
+		fatalf("usage: postctl list [--author NAME] [--tag TAG] [--limit N]")
+	}
+
+	opts := client.ListOptions{Limit: 100, Author: *author}
+	if *tag != "" {
+		opts.Tags = []string{*tag}
+	}
+	var ps []client.Post
+	for {
+		if *limit > 0 && *limit-len(ps) < opts.Limit {
+			opts.Limit = *limit - len(ps)
+		}
+		page, err := c.ListPosts(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, page.Posts...)
+		if !page.More() || len(page.Posts) == 0 || *limit > 0 && len(ps) >= *limit {
+			return ps, nil
+		}
+		opts = page.NextOptions(opts)
+	}
+}
+
+// idArg parses the single post ID a command takes.
+func idArg(cmd string, args []string) client.PostID {
+	if len(args) != 1 {
+		fatalf("usage: postctl %s ID", cmd)
+	}
+	if args[0] == "" || strings.ContainsAny(args[0], "/?# ") {
+		fatalf("invalid post ID %q", args[0])
+	}
+	return client.PostID(args[0])
+}
+
+// postFlags parses the flags of create into a post.
+func postFlags(args []string) client.Post {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	body := fs.String("body", "", "text of the post (required)")
+	author := fs.String("author", "", "author of the post")
+	tags := fs.String("tags", "", "comma separated tags")
+	fs.Parse(args)
+	if *body == "" || fs.NArg() > 0 {
+		fatalf("usage: postctl create --body TEXT [--author NAME] [--tags a,b]")
+	}
+
+	p := client.Post{Body: *body, Author: *author}
+	if *tags != "" {
+		p.Tags = strings.Split(*tags, ",")
+	}
+	return p
+}
+
+func printPosts(output string, ps ...client.Post) {
+	if output == "json" {
+		if len(ps) == 1 {
+			printJSON(ps[0])
+		} else {
+			printJSON(ps)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tAUTHOR\tTAGS\tVIEWS\tUPDATED\tBODY")
+	for _, p := range ps {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", p.ID, p.Author, strings.Join(p.Tags, ","),
+			p.Views, p.UpdatedAt.Local().Format("2006-01-02 15:04"), firstLine(p.Body, 50))
+	}
+	tw.Flush()
+}
+
+// firstLine shortens body to its first line, at most max characters,
+// to keep table rows on one line.
+func firstLine(body string, max int) string {
+	line, _, cut := strings.Cut(body, "\n")
+	if r := []rune(line); len(r) > max {
+		line, cut = string(r[:max]), true
+	}
+	if cut {
+		line += "…"
+	}
+	return line
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	check(enc.Encode(v))
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func check(err error) {
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "postctl: "+format+"\n", args...)
+	os.Exit(1)
+}
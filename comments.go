@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--------------COMMENTS================
+
+// Comments hang off a post at /posts/{id}/comments. They're kept by
+// the post's Store, so they persist with it, and go when it's deleted.
+// Commenting isn't a change to the post itself, so it leaves the
+// post's UpdatedAt and ETags alone, and works on locked posts too.
+//
+// A comment with a parent_id is a reply to that comment of the same
+// post. Its depth is one more than its parent's, a comment on the post
+// itself being 1 deep, and a reply to a comment already -max-thread-depth
+// deep is refused with 422, so threads can't nest without end.
+// Deleting a comment leaves its replies, still naming it as parent.
+
+var maxThreadDepth = flag.Int("max-thread-depth", 10, "how many comments deep a reply thread may go, a comment on the post itself being 1 deep (0 for no limit)")
+
+type Comment struct {
+	ID        int       `json:"id"`
+	PostID    PostID    `json:"post_id"`
+	ParentID  int       `json:"parent_id,omitempty"`
+	Depth     int       `json:"depth"`
+	Body      string    `json:"body"`
+	Author    string    `json:"author,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	errCommentNotFound = errors.New("comment not found")
+	errEmptyComment    = errors.New("comment body is required")
+	errNoParent        = errors.New("parent comment not found")
+	errThreadTooDeep   = errors.New("reply thread too deep")
+)
+
+func handleGetComments(w http.ResponseWriter, r *http.Request, id PostID) {
+	s := readPostSet(r)
+	defer postsMu.RUnlock()
+
+	if _, err := s.getPost(id); err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusOK, s.store.Comments(id))
+}
+
+func handlePostComment(w http.ResponseWriter, r *http.Request, id PostID) {
+	var c Comment
+	if err := decodeJSON(r, r.Body, &c); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+		return
+	}
+
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err == nil {
+		c, err = s.addComment(id, c)
+	}
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusCreated, c)
+}
+
+func handleDeleteComment(w http.ResponseWriter, r *http.Request, id PostID, cid int) {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err == nil {
+		err = s.deleteComment(id, cid)
+	}
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addComment adds c to the post with the given ID, for /posts/{id}/comments
+// and /graphql. Callers must hold postsMu.
+func (s *postSet) addComment(id PostID, c Comment) (Comment, error) {
+	if strings.TrimSpace(c.Body) == "" {
+		return Comment{}, errEmptyComment
+	}
+	if _, err := s.getPost(id); err != nil {
+		return Comment{}, err
+	}
+	c.Depth = 1
+	if c.ParentID != 0 {
+		parent, ok := s.comment(id, c.ParentID)
+		if !ok {
+			return Comment{}, errNoParent
+		}
+		// Comments from before replies have no depth, and are on the
+		// post itself.
+		c.Depth = max(parent.Depth, 1) + 1
+		if *maxThreadDepth > 0 && c.Depth > *maxThreadDepth {
+			return Comment{}, errThreadTooDeep
+		}
+	}
+	if c.Author == "" {
+		c.Author = defaultAuthor
+	}
+	c.ID = 0
+	c.PostID = id
+	c.CreatedAt = time.Now().UTC()
+	return s.store.AddComment(c)
+}
+
+// comment returns the comment with the given ID on the post with the
+// given ID. Callers must hold postsMu.
+func (s *postSet) comment(id PostID, cid int) (Comment, bool) {
+	for _, c := range s.store.Comments(id) {
+		if c.ID == cid {
+			return c, true
+		}
+	}
+	return Comment{}, false
+}
+
+// deleteComment deletes a comment of the post with the given ID.
+// Callers must hold postsMu.
+func (s *postSet) deleteComment(id PostID, cid int) error {
+	if _, err := s.getPost(id); err != nil {
+		return err
+	}
+	return s.store.DeleteComment(id, cid)
+}
+
+// withCommentID is withID for /posts/{id}/comments/{cid}.
+func withCommentID(h func(w http.ResponseWriter, r *http.Request, id PostID, cid int)) http.HandlerFunc {
+	return withID(func(w http.ResponseWriter, r *http.Request, id PostID) {
+		segment := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		cid, err := strconv.Atoi(segment)
+		if err != nil || !allDigits(segment) {
+			writeError(w, r, http.StatusBadRequest, "Invalid comment ID")
+			return
+		}
+		h(w, r, id, cid)
+	})
+}
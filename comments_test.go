@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// replyChain comments on post 1 and then replies to each comment in
+// turn, n comments in all, and returns the last one.
+func (ts *testServer) replyChain(n int) Comment {
+	ts.t.Helper()
+	var c Comment
+	for i := 0; i < n; i++ {
+		rec := ts.do("POST", "/posts/1/comments", fmt.Sprintf(`{"body":"reply %d","parent_id":%d}`, i, c.ID))
+		wantStatus(ts.t, rec, http.StatusCreated)
+		c = decodeResponse[Comment](ts.t, rec)
+	}
+	return c
+}
+
+func TestThreadDepth(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDepth string
+		// The reply goes to the end of a chain this many comments long.
+		chain int
+		want  int
+	}{
+		{"on the post", "3", 0, http.StatusCreated},
+		{"below the limit", "3", 1, http.StatusCreated},
+		{"at the limit", "3", 2, http.StatusCreated},
+		{"beyond the limit", "3", 3, http.StatusUnprocessableEntity},
+		{"replies only to the post", "1", 1, http.StatusUnprocessableEntity},
+		{"no limit", "0", 50, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, "-max-thread-depth="+tt.maxDepth)
+			ts.createPost(`{"body":"hello"}`)
+			parent := ts.replyChain(tt.chain)
+			if parent.Depth != tt.chain {
+				t.Fatalf("end of the chain is %d deep, want %d", parent.Depth, tt.chain)
+			}
+
+			rec := ts.do("POST", "/posts/1/comments", fmt.Sprintf(`{"body":"last","parent_id":%d}`, parent.ID))
+			wantStatus(t, rec, tt.want)
+			if tt.want != http.StatusCreated {
+				if n := len(decodeResponse[[]Comment](t, ts.do("GET", "/posts/1/comments", ""))); n != tt.chain {
+					t.Errorf("%d comments, want the %d of the chain", n, tt.chain)
+				}
+				return
+			}
+			if c := decodeResponse[Comment](t, rec); c.Depth != tt.chain+1 || c.ParentID != parent.ID {
+				t.Errorf("reply %+v, want %d deep under %d", c, tt.chain+1, parent.ID)
+			}
+		})
+	}
+}
+
+func TestReplyParent(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"one"}`)
+	ts.createPost(`{"body":"two"}`)
+	ts.do("POST", "/posts/2/comments", `{"body":"on two"}`)
+	top := ts.replyChain(1)
+
+	for _, tt := range []struct {
+		name, body string
+		want       int
+	}{
+		{"no such comment", `{"body":"hi","parent_id":99}`, http.StatusUnprocessableEntity},
+		{"on another post", `{"body":"hi","parent_id":1}`, http.StatusUnprocessableEntity},
+		{"depth is the server's", fmt.Sprintf(`{"body":"hi","parent_id":%d,"depth":7}`, top.ID), http.StatusCreated},
+	} {
+		rec := ts.do("POST", "/posts/1/comments", tt.body)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		} else if tt.want == http.StatusCreated {
+			if c := decodeResponse[Comment](t, rec); c.Depth != 2 {
+				t.Errorf("%s: depth %d, want 2", tt.name, c.Depth)
+			}
+		}
+	}
+
+	// Deleting the parent leaves the reply.
+	wantStatus(t, ts.do("DELETE", fmt.Sprintf("/posts/1/comments/%d", top.ID), ""), http.StatusNoContent)
+	if cs := decodeResponse[[]Comment](t, ts.do("GET", "/posts/1/comments", "")); len(cs) != 1 || cs[0].ParentID != top.ID {
+		t.Errorf("comments after deleting the parent: %+v", cs)
+	}
+}
+
+func TestMergeRestoreKeepsThreads(t *testing.T) {
+	withTestAuth(t, []string{"root"}, "root")
+	ts := newTestServer(t)
+	wantStatus(t, ts.as("root", "POST", "/posts", `{"body":"threaded"}`), http.StatusCreated)
+	comment := func(body string, parent int) Comment {
+		t.Helper()
+		rec := ts.as("root", "POST", "/posts/1/comments", fmt.Sprintf(`{"body":%q,"parent_id":%d}`, body, parent))
+		wantStatus(t, rec, http.StatusCreated)
+		return decodeResponse[Comment](t, rec)
+	}
+	top := comment("top", 0)
+	reply := comment("reply", top.ID)
+	comment("reply to reply", reply.ID)
+	orphaned := comment("orphaned parent", 0)
+	comment("orphan", orphaned.ID)
+	wantStatus(t, ts.as("root", "DELETE", fmt.Sprintf("/posts/1/comments/%d", orphaned.ID), ""), http.StatusNoContent)
+
+	rec := ts.as("root", "GET", "/admin/backup", "")
+	wantStatus(t, rec, http.StatusOK)
+	backup := rec.Body.String()
+
+	// Take the old comment IDs with comments on another post, then
+	// bring post 1 back from the backup.
+	wantStatus(t, ts.as("root", "DELETE", "/posts/1", ""), http.StatusOK)
+	wantStatus(t, ts.as("root", "DELETE", "/posts/trash/1", ""), http.StatusOK)
+	wantStatus(t, ts.as("root", "POST", "/posts", `{"body":"other"}`), http.StatusCreated)
+	for i := 0; i < 5; i++ {
+		wantStatus(t, ts.as("root", "POST", "/posts/2/comments", `{"body":"filler"}`), http.StatusCreated)
+	}
+	wantStatus(t, ts.as("root", "POST", "/admin/restore?mode=merge", backup), http.StatusOK)
+
+	byBody := make(map[string]Comment)
+	byID := make(map[int]Comment)
+	for _, c := range decodeResponse[[]Comment](t, ts.do("GET", "/posts/1/comments", "")) {
+		byBody[c.Body], byID[c.ID] = c, c
+	}
+	for _, tt := range []struct {
+		body, parent string
+		depth        int
+	}{
+		{"top", "", 1},
+		{"reply", "top", 2},
+		{"reply to reply", "reply", 3},
+		// Its parent's gone, and its old ID is another comment's.
+		{"orphan", "", 2},
+	} {
+		c, ok := byBody[tt.body]
+		if !ok {
+			t.Errorf("%q wasn't restored", tt.body)
+			continue
+		}
+		parent := byID[c.ParentID].Body
+		if parent != tt.parent || (tt.parent == "" && c.ParentID != 0) || c.Depth != tt.depth {
+			t.Errorf("%q: under %q (%d), %d deep; want under %q, %d deep", tt.body, parent, c.ParentID, c.Depth, tt.parent, tt.depth)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io"
+	"log/slog"
+)
+
+//--------------COMPRESSING STORED BODIES================
+
+var compressBodiesOver = flag.Int("compress-bodies-over", 0, "keep post bodies longer than this many bytes gzip-compressed in memory (0 disables)")
+
+// memoryStore packs posts as it stores them and unpacks them as it
+// hands them out, so everything outside the store only ever sees plain
+// bodies while the map may hold compressed ones.
+
+// pack moves a long body into packed as gzip, unless compressing
+// doesn't make it any smaller.
+func pack(p Post) Post {
+	if *compressBodiesOver <= 0 || len(p.Body) <= *compressBodiesOver {
+		return p
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, p.Body)
+	if err := zw.Close(); err != nil || buf.Len() >= len(p.Body) {
+		return p
+	}
+
+	p.packed = buf.Bytes()
+	p.compressed = true
+	p.Body = ""
+	return p
+}
+
+// unpack restores the plain body of a packed post.
+func unpack(p Post) Post {
+	if !p.compressed {
+		return p
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(p.packed))
+	if err == nil {
+		var body []byte
+		if body, err = io.ReadAll(zr); err == nil {
+			p.Body = string(body)
+		}
+	}
+	if err != nil {
+		// We compressed it ourselves, so this can only be a bug.
+		slog.Error("decompressing body", "post", p.ID, "err", err)
+	}
+
+	p.packed = nil
+	p.compressed = false
+	return p
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// proseBody returns n bytes or so of made-up text, about as
+// compressible as real posts.
+func proseBody(rng *rand.Rand, n int) string {
+	var words []string
+	for i := 0; i < 300; i++ {
+		w := make([]byte, 2+rng.Intn(8))
+		for j := range w {
+			w[j] = byte('a' + rng.Intn(26))
+		}
+		words = append(words, string(w))
+	}
+	var sb strings.Builder
+	for sb.Len() < n {
+		sb.WriteString(words[rng.Intn(len(words))])
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
+
+// BenchmarkCompressBodies fills a store with long posts, with and
+// without -compress-bodies-over, and reports the heap they take as
+// heap-B/post; each op is then a Get, which has to unpack the body.
+func BenchmarkCompressBodies(b *testing.B) {
+	const posts, size = 2000, 4096
+	rng := rand.New(rand.NewSource(1))
+	bodies := make([]string, posts)
+	for i := range bodies {
+		bodies[i] = proseBody(rng, size)
+	}
+
+	for _, tt := range []struct{ name, over string }{
+		{"plain", "0"},
+		{"compressed", "1024"},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			setFlag(b, "compress-bodies-over", tt.over)
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			m := newMemoryStore()
+			for i, body := range bodies {
+				// A copy, so the store doesn't share the bodies above.
+				p := Post{ID: PostID(fmt.Sprint(i + 1)), Body: strings.Clone(body)}
+				if err := m.Create(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := m.Get(PostID(fmt.Sprint(i%posts + 1))); !ok {
+					b.Fatal("post missing")
+				}
+			}
+			// After the loop, as ResetTimer drops reported metrics.
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/posts, "heap-B/post")
+			runtime.KeepAlive(m)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+//--------------CONFIGURATION================
+
+// Every flag can also be set from the environment or a config file.
+// The most specific source wins:
+//
+//  1. the command line, e.g. -data-dir=/var/lib/posts
+//  2. an environment variable named after the flag with WEBSERVER_ in
+//     front, upper case and with _ for -, e.g. WEBSERVER_DATA_DIR
+//  3. the JSON config file named by -config (or WEBSERVER_CONFIG),
+//     an object keyed by flag name, e.g. {"data-dir": "/var/lib/posts"}
+//  4. the flag's default
+//
+// In the config file, durations are strings like "30s" and flags that
+// can be repeated take an array. YAML isn't supported, as the standard
+// library has no YAML parser.
+
+var configFile = flag.String("config", "", "JSON file of flag values, keyed by flag name")
+
+// Kept by loadConfig for reloadConfig (see reload.go): the values the
+// config file gave, and the flags given on the command line or in the
+// environment, which the file can't change.
+var (
+	fileConfig  map[string][]string
+	pinnedFlags = make(map[string]bool)
+)
+
+// loadConfig fills in the flags not given on the command line from the
+// environment and the config file. Call it right after flag.Parse.
+func loadConfig() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	fromEnv := func(name string) (string, bool) {
+		return os.LookupEnv("WEBSERVER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+	}
+	if !set["config"] {
+		if v, ok := fromEnv("config"); ok {
+			*configFile = v
+		}
+	}
+
+	file, err := readConfigFile(*configFile)
+	if err != nil {
+		return err
+	}
+
+	fileConfig = file
+
+	var errs []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || f.Name == "config" {
+			pinnedFlags[f.Name] = true
+			return
+		}
+		if v, ok := fromEnv(f.Name); ok {
+			pinnedFlags[f.Name] = true
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Sprintf("environment value for -%s: %v", f.Name, err))
+			}
+			return
+		}
+		for _, v := range file[f.Name] {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: value for %q: %v", *configFile, f.Name, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("bad configuration:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// readConfigFile returns the values in the config file at path, as
+// the strings that would be given on the command line. Keys that
+// aren't flags are an error, so typos don't go unnoticed.
+func readConfigFile(path string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	if path == "" {
+		return values, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for name, msg := range raw {
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		var list []json.RawMessage
+		if json.Unmarshal(msg, &list) != nil {
+			list = []json.RawMessage{msg}
+		}
+		for _, item := range list {
+			v, err := configString(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: setting %q: %v", path, name, err)
+			}
+			values[name] = append(values[name], v)
+		}
+	}
+	return values, nil
+}
+
+// configString turns a JSON string, number or boolean into the text a
+// flag would be set to.
+func configString(msg json.RawMessage) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("want a string, number or boolean")
+	}
+}
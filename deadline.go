@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//--------------REQUEST DEADLINES================
+
+// A client that knows its own latency budget can send
+// X-Request-Deadline, either as an RFC 3339 time or as a duration from
+// now like "250ms". The request's context gets that deadline, so
+// anything that watches the context gives up in time, and if the
+// handler hasn't finished by then the client gets 408 instead of a
+// late answer.
+//
+// As with http.TimeoutHandler, the response is buffered until the
+// handler returns, so it can be thrown away if the deadline passes
+// first. That means a streamed response isn't sent until it's
+// complete, and work that doesn't watch the context (like a single
+// create) may still take effect after the client got its 408. Streams
+// that never complete on their own, WebSockets and event streams,
+// can't be held back like that, so the header is ignored on them.
+
+var honorDeadlines = flag.Bool("honor-request-deadline", true, "honor the X-Request-Deadline header, answering 408 when it passes")
+
+func parseDeadline(v string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(d), nil
+}
+
+func withRequestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get("X-Request-Deadline")
+		if v == "" || !*honorDeadlines || isStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		deadline, err := parseDeadline(v, now)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "X-Request-Deadline must be an RFC 3339 time or a duration")
+			return
+		}
+		if !deadline.After(now) {
+			writeError(w, r, http.StatusRequestTimeout, "Request deadline exceeded")
+			return
+		}
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		dw := &deadlineWriter{header: w.Header().Clone()}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(dw, r)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			dw.mu.Lock()
+			defer dw.mu.Unlock()
+			dst := w.Header()
+			for k := range dst {
+				delete(dst, k)
+			}
+			for k, vv := range dw.header {
+				dst[k] = vv
+			}
+			if dw.code == 0 {
+				dw.code = http.StatusOK
+			}
+			w.WriteHeader(dw.code)
+			w.Write(dw.buf.Bytes())
+		case <-ctx.Done():
+			dw.mu.Lock()
+			defer dw.mu.Unlock()
+			dw.timedOut = true
+			writeError(w, r, http.StatusRequestTimeout, "Request deadline exceeded")
+		}
+	})
+}
+
+// isStream reports whether r is for a WebSocket, /events or a GraphQL
+// subscription, whose responses go on until the client leaves.
+func isStream(r *http.Request) bool {
+	return r.URL.Path == "/events" || acceptsEventStream(r) || headerHasToken(r.Header, "Connection", "upgrade") || isGRPC(r)
+}
+
+// deadlineWriter holds a response until the handler is done. Writes
+// after the deadline are dropped.
+type deadlineWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (dw *deadlineWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw *deadlineWriter) WriteHeader(code int) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.code == 0 && !dw.timedOut {
+		dw.code = code
+	}
+}
+
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if dw.code == 0 {
+		dw.code = http.StatusOK
+	}
+	return dw.buf.Write(b)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+//--------------DECODING REQUEST BODIES================
+
+var strictFields = flag.Bool("strict-fields", true, "reject JSON request bodies with unknown fields (a request can override this with X-Strict-Fields)")
+
+// decodeJSON decodes a JSON request body into v. Unknown fields are
+// rejected, as they're most likely a typo the client would rather
+// hear about, unless -strict-fields=false lets them through for
+// forward compatibility. A request's X-Strict-Fields: true|false
+// header takes precedence over the flag.
+func decodeJSON(r *http.Request, body io.Reader, v interface{}) error {
+	dec := json.NewDecoder(body)
+	if wantStrictFields(r) {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+func wantStrictFields(r *http.Request) bool {
+	if v := r.Header.Get("X-Strict-Fields"); v != "" {
+		if strict, err := strconv.ParseBool(v); err == nil {
+			return strict
+		}
+	}
+	return *strictFields
+}
+
+// decodeBody decodes a post from a request body in the format its
+// Content-Type names: XML or YAML, shaped like the responses in those
+// formats, or otherwise JSON. YAML goes through decodeJSON, so
+// -strict-fields applies to it; XML ignores unknown elements.
+func decodeBody(r *http.Request, body []byte, v interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/xml", "text/xml":
+		return xml.Unmarshal(body, v)
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		tree, err := parseYAML(body)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(tree)
+		if err != nil {
+			return err
+		}
+		return decodeJSON(r, bytes.NewReader(b), v)
+	}
+	return decodeJSON(r, bytes.NewReader(body), v)
+}
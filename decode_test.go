@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStrictFields(t *testing.T) {
+	tests := []struct {
+		name, flag, header string
+		strict             bool
+	}{
+		{"strict by default", "true", "", true},
+		{"lenient by flag", "false", "", false},
+		{"header loosens", "true", "false", false},
+		{"header tightens", "false", "true", true},
+		{"bad header goes by the flag", "false", "maybe", false},
+	}
+	// Each request has a stray "color", and the answer it gets when
+	// that's rejected.
+	requests := []struct {
+		method, path, body string
+		rejected           int
+	}{
+		{"POST", "/posts", `{"body":"new","color":"red"}`, http.StatusUnprocessableEntity},
+		{"PUT", "/posts/1", `{"body":"put","color":"red"}`, http.StatusUnprocessableEntity},
+		{"PATCH", "/posts/1", `{"body":"patched","color":"red"}`, http.StatusUnprocessableEntity},
+		{"POST", "/posts/1/comments", `{"body":"hi","color":"red"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, "-strict-fields="+tt.flag)
+			ts.createPost(`{"body":"hello"}`)
+			var header []string
+			if tt.header != "" {
+				header = []string{"X-Strict-Fields", tt.header}
+			}
+			for _, req := range requests {
+				want := req.rejected
+				if !tt.strict {
+					want = http.StatusOK
+					if req.method == "POST" {
+						want = http.StatusCreated
+					}
+				}
+				if rec := ts.do(req.method, req.path, req.body, header...); rec.Code != want {
+					t.Errorf("%s %s: status %d, want %d: %s", req.method, req.path, rec.Code, want, rec.Body)
+				}
+			}
+			// Whatever gets through is stored without the stray field.
+			if p := decodeResponse[map[string]interface{}](t, ts.do("GET", "/posts/1", "")); p["color"] != nil {
+				t.Errorf("stored %v", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//--------------DIFFING POSTS================
+
+// diffContext is how many unchanged lines surround each hunk of a
+// unified diff.
+const diffContext = 3
+
+// maxDiffCells bounds the line-by-line comparison table, so two huge
+// posts can't tie up the server.
+const maxDiffCells = 1 << 22
+
+// diffLine is one line of a line diff: kept ("equal"), only in the
+// first post ("delete") or only in the second ("insert").
+type diffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// handleDiffPosts compares the bodies of posts ?a= and ?b= line by
+// line. ?format=unified answers with a unified diff as text; the
+// default, ?format=json, lists every line with its op.
+func handleDiffPosts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	a, okA := parsePostID(q.Get("a"))
+	b, okB := parsePostID(q.Get("b"))
+	if !okA || !okB {
+		writeError(w, r, http.StatusBadRequest, "a and b must be post IDs")
+		return
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "unified" {
+		writeError(w, r, http.StatusBadRequest, "format must be json or unified")
+		return
+	}
+
+	s := readPostSet(r)
+	pa, errA := s.getPost(a)
+	pb, errB := s.getPost(b)
+	postsMu.RUnlock()
+
+	if errA != nil {
+		writePostError(w, r, errA)
+		return
+	}
+	if errB != nil {
+		writePostError(w, r, errB)
+		return
+	}
+
+	linesA := strings.Split(pa.Body, "\n")
+	linesB := strings.Split(pb.Body, "\n")
+	if (len(linesA)+1)*(len(linesB)+1) > maxDiffCells {
+		writeError(w, r, http.StatusUnprocessableEntity, "Posts are too long to diff")
+		return
+	}
+	lines := diffLines(linesA, linesB)
+
+	if format == "unified" {
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		writeUnified(w, fmt.Sprintf("posts/%s", a), fmt.Sprintf("posts/%s", b), lines)
+		return
+	}
+	respond(w, r, http.StatusOK, lines)
+}
+
+// diffLines computes a line diff of a and b from their longest common
+// subsequence.
+func diffLines(a, b []string) []diffLine {
+	// lcs[i][j] is the LCS length of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, diffLine{"equal", a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, diffLine{"delete", a[i]})
+			i++
+		default:
+			out = append(out, diffLine{"insert", b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, diffLine{"delete", a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, diffLine{"insert", b[j]})
+	}
+	return out
+}
+
+// writeUnified writes lines as a unified diff, grouping changes into
+// hunks with diffContext lines of context.
+func writeUnified(w io.Writer, nameA, nameB string, lines []diffLine) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+
+	// lineA and lineB are the 1-based line numbers in each post at
+	// the start of lines[k].
+	lineA := make([]int, len(lines)+1)
+	lineB := make([]int, len(lines)+1)
+	lineA[0], lineB[0] = 1, 1
+	for k, l := range lines {
+		lineA[k+1], lineB[k+1] = lineA[k], lineB[k]
+		if l.Op != "insert" {
+			lineA[k+1]++
+		}
+		if l.Op != "delete" {
+			lineB[k+1]++
+		}
+	}
+
+	for k := 0; k < len(lines); {
+		if lines[k].Op == "equal" {
+			k++
+			continue
+		}
+
+		// Grow the hunk until a run of more than twice the context
+		// separates it from the next change.
+		start := max(k-diffContext, 0)
+		end := k
+		for end < len(lines) {
+			if lines[end].Op != "equal" {
+				end++
+				continue
+			}
+			run := end
+			for run < len(lines) && lines[run].Op == "equal" {
+				run++
+			}
+			if run == len(lines) || run-end > 2*diffContext {
+				end = min(end+diffContext, len(lines))
+				break
+			}
+			end = run
+		}
+
+		fmt.Fprintf(w, "@@ -%s +%s @@\n",
+			hunkRange(lineA[start], lineA[end]-lineA[start]),
+			hunkRange(lineB[start], lineB[end]-lineB[start]))
+		for _, l := range lines[start:end] {
+			prefix := " "
+			switch l.Op {
+			case "delete":
+				prefix = "-"
+			case "insert":
+				prefix = "+"
+			}
+			fmt.Fprintf(w, "%s%s\n", prefix, l.Text)
+		}
+		k = end
+	}
+}
+
+// hunkRange formats a hunk header range. An empty range names the
+// line before it, as diff(1) does.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
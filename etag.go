@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--------------ETAGS================
+
+// bootID tells ETags from different runs of the server apart, since
+// a postSet's version starts again from zero after a restart.
+var bootID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// collectionETag is the ETag of GET /posts at the current version.
+// The version is bumped by every change to the posts map, so the ETag
+// changes whenever the list could. Every tenant's versions count from
+// zero, so with -multi-tenant the tenant is in it too. Callers must
+// hold postsMu.
+func (s *postSet) collectionETag() string {
+	if s.tenant != "" {
+		return `"` + bootID + "-" + s.tenant + "-" + strconv.FormatUint(s.version, 10) + `"`
+	}
+	return `"` + bootID + "-" + strconv.FormatUint(s.version, 10) + `"`
+}
+
+// encodedETag is the ETag of a response sent compressed with encoding,
+// gzip or deflate: "abc" becomes "abc-gzip". The compressed bytes
+// aren't the plain ones, so a cache mustn't take one for the other,
+// as it would with the same strong ETag on both.
+func encodedETag(etag, encoding string) string {
+	if !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// identityETag undoes encodedETag. A client that has the compressed
+// form of a post has that post all the same, so the conditional
+// request checks below take either.
+func identityETag(etag string) string {
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if rest, ok := strings.CutSuffix(etag, "-"+encoding+`"`); ok {
+			return rest + `"`
+		}
+	}
+	return etag
+}
+
+// etagMatches reports whether an If-None-Match style header lists
+// etag, in any encoding. Weak and strong forms compare equal, as
+// If-None-Match uses weak comparison.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = identityETag(strings.TrimPrefix(strings.TrimSpace(candidate), "W/"))
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch reports whether an If-Match header allows a change to the
+// resource whose current ETag is etag. No header allows anything.
+// Unlike etagMatches this is the strong comparison RFC 9110 asks for,
+// so a weak ETag never matches. The ETag of a compressed response
+// does, as it stands for the same version of the post.
+func ifMatch(header, etag string) bool {
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if identityETag(strings.TrimSpace(candidate)) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch answers 412 and returns false if r was made against a
+// different version of p than the current one, so that two clients
+// editing the same post can't silently overwrite each other. Callers
+// must hold postsMu.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, p Post) bool {
+	etag := postETag(p)
+	if ifMatch(r.Header.Get("If-Match"), etag) {
+		return true
+	}
+	w.Header().Set("ETag", etag)
+	writeError(w, r, http.StatusPreconditionFailed, "Post has changed since the ETag in If-Match")
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIfMatch(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"hello"}`)
+	etag := ts.do("GET", "/posts/1", "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET /posts/1 has no ETag")
+	}
+
+	tests := []struct {
+		name, method, body, ifMatch string
+		want                        int
+	}{
+		{"PUT stale", "PUT", `{"body":"a"}`, `"stale"`, http.StatusPreconditionFailed},
+		{"PATCH stale", "PATCH", `{"body":"a"}`, `"stale"`, http.StatusPreconditionFailed},
+		{"DELETE stale", "DELETE", "", `"stale"`, http.StatusPreconditionFailed},
+		{"PUT weak", "PUT", `{"body":"a"}`, "W/" + etag, http.StatusPreconditionFailed},
+		{"PUT current", "PUT", `{"body":"a"}`, etag, http.StatusOK},
+		// The PUT changed the post, so its old ETag is stale now.
+		{"PATCH after PUT", "PATCH", `{"body":"b"}`, etag, http.StatusPreconditionFailed},
+		{"PATCH star", "PATCH", `{"body":"b"}`, "*", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := ts.do(tt.method, "/posts/1", tt.body, "If-Match", tt.ifMatch)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+		if rec.Code == http.StatusPreconditionFailed && rec.Header().Get("ETag") == "" {
+			t.Errorf("%s: 412 without the current ETag", tt.name)
+		}
+	}
+
+	if got := decodeResponse[Post](t, ts.do("GET", "/posts/1", "")); got.Body != "b" {
+		t.Errorf("body %q, want b", got.Body)
+	}
+}
+
+func TestIfMatchRoundTrip(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"hello"}`)
+
+	rec := ts.do("PUT", "/posts/1", `{"body":"one"}`)
+	wantStatus(t, rec, http.StatusOK)
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("PUT has no ETag")
+	}
+	// The ETag a write answers with is good for the next write.
+	wantStatus(t, ts.do("PUT", "/posts/1", `{"body":"two"}`, "If-Match", etag), http.StatusOK)
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"hello"}`)
+
+	for _, path := range []string{"/posts/1", "/posts"} {
+		rec := ts.do("GET", path, "")
+		wantStatus(t, rec, http.StatusOK)
+		etag := rec.Header().Get("ETag")
+
+		rec = ts.do("GET", path, "", "If-None-Match", etag)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("GET %s with its ETag: status %d, %d bytes, want an empty 304", path, rec.Code, rec.Body.Len())
+		}
+		wantStatus(t, ts.do("GET", path, "", "If-None-Match", `"other"`), http.StatusOK)
+	}
+
+	// A change to the post changes both ETags.
+	postETag := ts.do("GET", "/posts/1", "").Header().Get("ETag")
+	listETag := ts.do("GET", "/posts", "").Header().Get("ETag")
+	wantStatus(t, ts.do("PATCH", "/posts/1", `{"body":"changed"}`), http.StatusOK)
+	wantStatus(t, ts.do("GET", "/posts/1", "", "If-None-Match", postETag), http.StatusOK)
+	wantStatus(t, ts.do("GET", "/posts", "", "If-None-Match", listETag), http.StatusOK)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+)
+
+//--------------MUTATION EVENTS================
+
+var emitEvents = flag.Bool("emit-events", false, "write a JSON line to stdout for every change to a post")
+
+// postEvent is one line of the event stream. Log collectors parse
+// these, so the field set is stable: only add fields, never rename or
+// remove them.
+//
+//	event   post.created, post.updated, post.deleted, post.locked,
+//	        post.unlocked, post.reserved, post.restored or
+//	        post.purged
+//	id      ID of the post
+//	author  author of the post, omitted if it has none
+//	tenant  tenant owning the post, omitted without -multi-tenant
+//	time    when the change happened, RFC 3339 with nanoseconds, UTC
+type postEvent struct {
+	Event  string `json:"event"`
+	ID     PostID `json:"id"`
+	Author string `json:"author,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	Time   string `json:"time"`
+}
+
+// eventLog is kept apart from the default logger, which goes to
+// stderr, so events can be collected without other log output mixed
+// in.
+var eventLog = log.New(os.Stdout, "", 0)
+
+// heldEvents collects events instead of writing them while an atomic
+// batch runs, since the batch may yet be rolled back. Guarded by
+// postsMu.
+var heldEvents *[]postEvent
+
+// emitEvent records a change to p. Callers must hold postsMu.
+func (s *postSet) emitEvent(event string, p Post) {
+	if !*emitEvents && !broker.active() {
+		return
+	}
+
+	e := postEvent{
+		Event:  event,
+		ID:     p.ID,
+		Author: p.Author,
+		Tenant: s.tenant,
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if heldEvents != nil {
+		*heldEvents = append(*heldEvents, e)
+		return
+	}
+	writeEvent(e)
+}
+
+// writeEvent logs e with -emit-events and passes it to the clients
+// of GET /events.
+func writeEvent(e postEvent) {
+	broker.publish(e)
+	if !*emitEvents {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	eventLog.Println(string(b))
+}
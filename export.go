@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--------------EXPORT AND IMPORT================
+
+// GET /posts/export writes out every post of the tenant as CSV or
+// NDJSON (one JSON post per line), and POST /posts/import creates
+// posts from the same, for moving content between this server and
+// other systems.
+//
+// CSV has a header row naming the columns. Export writes id, body,
+// author, author_id, tags (separated by spaces), created_at,
+// updated_at, locked and views. Import needs a body column and reads
+// author, author_id and tags; the other columns are what the server
+// sets itself, so they're ignored, and an exported file can be
+// imported again as it is. NDJSON lines are posts as the rest of the
+// API takes them.
+//
+// Every row is created as a new post on its own, like POST /posts
+// would, so one invalid row doesn't stop the others. The answer lists
+// the rows that failed by line number, with the status and error
+// POST /posts would have given them.
+
+// exportChunk is how many posts are copied at a time while exporting,
+// so the lock isn't held while a slow client reads them.
+const exportChunk = 100
+
+// exportColumns are the CSV columns written, in order.
+var exportColumns = []string{"id", "body", "author", "author_id", "tags", "created_at", "updated_at", "locked", "views"}
+
+type importResult struct {
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []importError `json:"errors"`
+}
+
+type importError struct {
+	Line   int    `json:"line"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// transferFormat picks csv or ndjson from ?format=, or failing that
+// from the Content-Type of an import.
+func transferFormat(r *http.Request) (string, bool) {
+	format := r.URL.Query().Get("format")
+	if format == "" && r.Method == "POST" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = "csv"
+		case "application/x-ndjson", "application/jsonl":
+			format = "ndjson"
+		}
+	}
+	if format == "" && r.Method == "GET" {
+		format = "ndjson"
+	}
+	return format, format == "csv" || format == "ndjson"
+}
+
+//--------------EXPORT================
+
+func handleExportPosts(w http.ResponseWriter, r *http.Request) {
+	format, ok := transferFormat(r)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "format must be csv or ndjson")
+		return
+	}
+
+	s := readPostSet(r)
+	ids := s.store.IDs()
+	postsMu.RUnlock()
+
+	name := "posts-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	var write func(Post) error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		defer cw.Flush()
+		cw.Write(exportColumns)
+		write = func(p Post) error { return cw.Write(postRecord(p)) }
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(p Post) error { return enc.Encode(p) }
+	}
+
+	// Posts deleted since the IDs were taken are skipped, and ones
+	// created since are left for the next export.
+	chunk := make([]Post, 0, exportChunk)
+	for start := 0; start < len(ids); start += exportChunk {
+		end := start + exportChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk = chunk[:0]
+		postsMu.RLock()
+		for _, id := range ids[start:end] {
+			if p, ok := s.store.Get(id); ok {
+				chunk = append(chunk, p)
+			}
+		}
+		postsMu.RUnlock()
+
+		for _, p := range listable(chunk) {
+			if err := write(p); err != nil {
+				// The client has gone away.
+				return
+			}
+		}
+	}
+}
+
+// postRecord is p as a CSV row in exportColumns order.
+func postRecord(p Post) []string {
+	authorID := ""
+	if p.AuthorID != 0 {
+		authorID = strconv.Itoa(p.AuthorID)
+	}
+	return []string{
+		string(p.ID),
+		p.Body,
+		p.Author,
+		authorID,
+		strings.Join(p.Tags, " "),
+		p.CreatedAt.Format(time.RFC3339Nano),
+		p.UpdatedAt.Format(time.RFC3339Nano),
+		strconv.FormatBool(p.Locked),
+		strconv.Itoa(p.Views),
+	}
+}
+
+//--------------IMPORT================
+
+// handleImportPosts imports in the background with Prefer:
+// respond-async (see jobs.go), since a large file can take longer than
+// the client will wait. The job's result is the importResult, or its
+// error why the file couldn't be read at all.
+func handleImportPosts(w http.ResponseWriter, r *http.Request) {
+	format, ok := transferFormat(r)
+	if !ok {
+		writeError(w, r, http.StatusUnsupportedMediaType, "Send text/csv or application/x-ndjson, or say which with ?format=csv or ?format=ndjson")
+		return
+	}
+
+	if prefersAsync(r) {
+		// Read the whole file now, while the request is still
+		// open.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Error reading import: "+err.Error())
+			return
+		}
+		startJob(w, r, "import", func(r *http.Request) (interface{}, error) {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			return importPosts(r, format)
+		})
+		return
+	}
+
+	result, err := importPosts(r, format)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error reading import: "+err.Error())
+		return
+	}
+	respond(w, r, http.StatusOK, result)
+}
+
+// importPosts creates a post from each row of r's body, in format.
+func importPosts(r *http.Request, format string) (importResult, error) {
+	result := importResult{Errors: []importError{}}
+	importRow := func(line int, p Post, err error) {
+		var res batchResult
+		if err != nil {
+			res = failErr(res, unknownFieldError(err))
+			if res.Status == http.StatusInternalServerError {
+				// Not one of the post errors, so the row itself
+				// couldn't be read.
+				res = fail(res, http.StatusBadRequest, "Error parsing row: "+err.Error())
+			}
+		} else {
+			postsMu.Lock()
+			if s, err := postSetFor(r); err != nil {
+				res = failErr(res, err)
+			} else {
+				res = s.applyBatchOp(r, batchOp{Op: "create", Post: &p})
+			}
+			postsMu.Unlock()
+			if res.Status == http.StatusCreated {
+				result.Imported++
+				return
+			}
+		}
+		result.Failed++
+		result.Errors = append(result.Errors, importError{Line: line, Status: res.Status, Error: res.Error})
+	}
+
+	var err error
+	if format == "csv" {
+		err = importCSV(r.Body, importRow)
+	} else {
+		err = importNDJSON(r, importRow)
+	}
+	return result, err
+}
+
+// importCSV calls row with each post read from body. It only fails if
+// there's no header row with a body column to go on; errors in other
+// rows are passed on to row.
+func importCSV(body io.Reader, row func(line int, p Post, err error)) error {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return errors.New("the header row is missing")
+	}
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["body"]; !ok {
+		return errors.New("the header row has no body column")
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			row(perr.Line, Post{}, perr.Err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		p, err := postFromRecord(record, columns)
+		row(line, p, err)
+	}
+}
+
+// postFromRecord reads the columns of a CSV row a post is created
+// from.
+func postFromRecord(record []string, columns map[string]int) (Post, error) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	p := Post{Body: field("body"), Author: field("author")}
+	if v := strings.TrimSpace(field("author_id")); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return Post{}, errors.New("author_id must be a number")
+		}
+		p.AuthorID = id
+	}
+	p.Tags = strings.FieldsFunc(field("tags"), func(r rune) bool { return r == ' ' || r == ',' })
+	return p, nil
+}
+
+// importNDJSON calls row with each post read from r's body, skipping
+// blank lines.
+func importNDJSON(r *http.Request, row func(line int, p Post, err error)) error {
+	br := bufio.NewReader(r.Body)
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			var p Post
+			row(line, p, decodeJSON(r, bytes.NewReader(data), &p))
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
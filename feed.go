@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//--------------RSS FEED================
+
+var (
+	feedSize  = flag.Int("feed-size", 20, "number of recent posts in /posts/feed.xml")
+	feedTitle = flag.String("feed-title", "Posts", "title of the RSS feed")
+)
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	Description string `xml:"description"`
+	Author      string `xml:"author,omitempty"`
+	PubDate     string `xml:"pubDate"`
+}
+
+// handleFeed serves the latest -feed-size posts, newest first, as an
+// RSS 2.0 feed.
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	ps := listable(readPostSet(r).store.List())
+	postsMu.RUnlock()
+
+	setCacheControl(w, "/posts/feed.xml")
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID > ps[j].ID })
+	if n := *feedSize; n >= 0 && len(ps) > n {
+		ps = ps[:n]
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + r.Host
+
+	feed := rss{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         *feedTitle,
+			Link:          base + "/posts",
+			Description:   "The most recent posts",
+			LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, p := range ps {
+		link := fmt.Sprintf("%s/posts/%s", base, p.ID)
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       feedItemTitle(p),
+			Link:        link,
+			GUID:        link,
+			Description: p.Body,
+			Author:      p.Author,
+			PubDate:     p.CreatedAt.Format(time.RFC1123Z),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(feed)
+}
+
+// feedItemTitle uses the start of the body as the title, since posts
+// don't have one of their own.
+func feedItemTitle(p Post) string {
+	const max = 60
+	runes := []rune(p.Body)
+	if len(runes) <= max {
+		return p.Body
+	}
+	return string(runes[:max]) + "…"
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//--------------XML AND YAML================
+
+// Both formats are written from the value's JSON encoding, so they
+// carry the same field names, omissions and time formats as JSON, in
+// the same order. Requests can use them too: POST /posts and PUT
+// /posts/{id} decode bodies by Content-Type, see decodeBody.
+
+// ordered is a JSON object with its fields in their original order,
+// which a map would lose.
+type ordered []orderedField
+
+type orderedField struct {
+	key   string
+	value interface{}
+}
+
+// MarshalJSON writes the fields in order; /graphql relies on this to
+// answer in the order fields were asked for.
+func (o ordered) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// toOrdered re-reads v's JSON encoding as ordered objects, []interface{}
+// arrays and json.Number, string, bool or nil scalars.
+func toOrdered(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return readOrdered(dec)
+}
+
+func readOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := ordered{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, orderedField{key.(string), value})
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			value, err := readOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err := dec.Token()
+		return arr, err
+	}
+	return tok, nil
+}
+
+// scalarText is how XML writes a scalar.
+func scalarText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+//--------------XML================
+
+// XML puts the value in a <response> element. Object fields become
+// elements named after them, array elements become <item>s, and null
+// becomes an empty element:
+//
+//	<response><id>1</id><tags><item>go</item></tags></response>
+//
+// A key that isn't a valid element name, like a map key with spaces,
+// becomes <entry key="...">.
+type xmlFormatter struct{}
+
+func (xmlFormatter) ContentType() string { return "application/xml" }
+
+func (xmlFormatter) Encode(w io.Writer, v interface{}) error {
+	tree, err := toOrdered(v)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString(xml.Header)
+	writeXMLElement(bw, "response", tree)
+	bw.WriteString("\n")
+	return bw.Flush()
+}
+
+var xmlName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+func writeXMLElement(w *bufio.Writer, name string, v interface{}) {
+	open, end := "<"+name+">", "</"+name+">"
+	if !xmlName.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "xml") {
+		var key bytes.Buffer
+		xml.EscapeText(&key, []byte(name))
+		open, end = `<entry key="`+key.String()+`">`, "</entry>"
+	}
+
+	switch v := v.(type) {
+	case nil:
+		w.WriteString(strings.TrimSuffix(open, ">") + "/>")
+		return
+	case ordered:
+		w.WriteString(open)
+		for _, f := range v {
+			writeXMLElement(w, f.key, f.value)
+		}
+	case []interface{}:
+		w.WriteString(open)
+		for _, item := range v {
+			writeXMLElement(w, "item", item)
+		}
+	default:
+		w.WriteString(open)
+		xml.EscapeText(w, []byte(scalarText(v)))
+	}
+	w.WriteString(end)
+}
+
+//--------------YAML================
+
+// YAML is written in block style, quoting strings whenever a plain
+// scalar could be read back as something else.
+type yamlFormatter struct{}
+
+func (yamlFormatter) ContentType() string { return "application/yaml" }
+
+func (yamlFormatter) Encode(w io.Writer, v interface{}) error {
+	tree, err := toOrdered(v)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	switch tree.(type) {
+	case ordered, []interface{}:
+		writeYAML(&buf, tree, 0)
+	default:
+		buf.WriteString(yamlScalar(tree) + "\n")
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func writeYAML(buf *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := v.(type) {
+	case ordered:
+		if len(v) == 0 {
+			buf.WriteString(pad + "{}\n")
+		}
+		for _, f := range v {
+			buf.WriteString(pad + yamlScalar(f.key) + ":")
+			writeYAMLValue(buf, f.value, indent+2)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString(pad + "[]\n")
+		}
+		for _, item := range v {
+			if _, ok := item.(ordered); ok && len(item.(ordered)) > 0 {
+				// The first field goes on the dash's line.
+				var inner bytes.Buffer
+				writeYAML(&inner, item, indent+2)
+				buf.WriteString(pad + "- " + strings.TrimPrefix(inner.String(), pad+"  "))
+				continue
+			}
+			buf.WriteString(pad + "-")
+			writeYAMLValue(buf, item, indent+2)
+		}
+	}
+}
+
+// writeYAMLValue finishes a line ending in a key's colon or an item's
+// dash.
+func writeYAMLValue(buf *bytes.Buffer, v interface{}, indent int) {
+	switch v := v.(type) {
+	case ordered:
+		if len(v) == 0 {
+			buf.WriteString(" {}\n")
+			return
+		}
+		buf.WriteString("\n")
+		writeYAML(buf, v, indent)
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString(" []\n")
+			return
+		}
+		buf.WriteString("\n")
+		writeYAML(buf, v, indent)
+	default:
+		buf.WriteString(" " + yamlScalar(v) + "\n")
+	}
+}
+
+// yamlPlain matches strings that are safe to leave unquoted.
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_./-]*$`)
+
+// yamlReserved are plain scalars YAML 1.1 readers take for booleans
+// or null.
+var yamlReserved = map[string]bool{
+	"true": true, "false": true, "yes": true, "no": true, "on": true,
+	"off": true, "y": true, "n": true, "null": true,
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		if yamlPlain.MatchString(v) && !yamlReserved[strings.ToLower(v)] {
+			return v
+		}
+		// A JSON string is also a valid double-quoted YAML scalar.
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		enc.Encode(v)
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+	return scalarText(v)
+}
+
+// parseYAML reads the part of YAML that request bodies need: block
+// mappings and sequences, plain, quoted and flow scalars, and literal
+// block scalars (|) for multi-line bodies. JSON, being valid YAML, is
+// read as JSON. Anchors, tags, folded scalars and multiple documents
+// are refused rather than misread.
+func parseYAML(data []byte) (interface{}, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	p := &yamlParser{}
+	for i, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		p.lines = append(p.lines, yamlLine{i + 1, line})
+	}
+	p.skipBlank()
+	if p.i < len(p.lines) && strings.TrimSpace(p.lines[p.i].text) == "---" {
+		p.i++
+		p.skipBlank()
+	}
+	if p.i == len(p.lines) {
+		return nil, nil
+	}
+	v, err := p.block(p.indent())
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if p.i < len(p.lines) {
+		return nil, p.errorf("unexpected content")
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	number int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	line := len(p.lines)
+	if p.i < len(p.lines) {
+		line = p.lines[p.i].number
+	}
+	return fmt.Errorf("YAML line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// skipBlank moves past empty and comment-only lines.
+func (p *yamlParser) skipBlank() {
+	for p.i < len(p.lines) {
+		t := strings.TrimSpace(p.lines[p.i].text)
+		if t != "" && !strings.HasPrefix(t, "#") {
+			return
+		}
+		p.i++
+	}
+}
+
+func (p *yamlParser) indent() int {
+	text := p.lines[p.i].text
+	return len(text) - len(strings.TrimLeft(text, " "))
+}
+
+func (p *yamlParser) content() string {
+	return strings.TrimSpace(p.lines[p.i].text)
+}
+
+func isSequenceItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+// block reads the mapping or sequence starting at the current line,
+// whose entries are indented by indent.
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if strings.HasPrefix(p.lines[p.i].text, strings.Repeat(" ", indent)+"\t") {
+		return nil, p.errorf("tabs can't indent YAML")
+	}
+	if isSequenceItem(p.content()) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+	for p.skipBlank(); p.i < len(p.lines) && p.indent() == indent && isSequenceItem(p.content()); p.skipBlank() {
+		rest := strings.TrimSpace(strings.TrimPrefix(p.content(), "-"))
+		if rest == "" {
+			p.i++
+			item, err := p.nested(indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, item)
+			continue
+		}
+		if _, _, isMapping := splitYAMLKey(rest); isMapping || isSequenceItem(rest) {
+			// "- key: value" starts a mapping indented past the
+			// dash, so read the line again as if it were that.
+			p.lines[p.i].text = strings.Repeat(" ", indent+2) + rest
+			item, err := p.block(indent + 2)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, item)
+			continue
+		}
+		item, err := p.scalar(rest)
+		if err != nil {
+			return nil, err
+		}
+		p.i++
+		seq = append(seq, item)
+	}
+	if p.i < len(p.lines) && p.indent() > indent {
+		return nil, p.errorf("bad indentation")
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.skipBlank(); p.i < len(p.lines) && p.indent() == indent && !isSequenceItem(p.content()); p.skipBlank() {
+		key, rest, ok := splitYAMLKey(p.content())
+		if !ok {
+			return nil, p.errorf("expected key: value")
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+
+		var (
+			value interface{}
+			err   error
+		)
+		switch {
+		case rest == "":
+			p.i++
+			value, err = p.nested(indent)
+		case rest == "|" || rest == "|-":
+			value = p.literal(indent, rest == "|")
+		default:
+			value, err = p.scalar(rest)
+			p.i++
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	if p.i < len(p.lines) && p.indent() > indent {
+		return nil, p.errorf("bad indentation")
+	}
+	return m, nil
+}
+
+// nested reads the value of a key or dash left empty on its own line:
+// a block indented further, a sequence at the key's own indent, or
+// else null.
+func (p *yamlParser) nested(parent int) (interface{}, error) {
+	p.skipBlank()
+	if p.i == len(p.lines) {
+		return nil, nil
+	}
+	if n := p.indent(); n > parent || (n == parent && isSequenceItem(p.content())) {
+		if n == parent {
+			return p.sequence(n)
+		}
+		return p.block(n)
+	}
+	return nil, nil
+}
+
+// literal reads a | block scalar: the following lines indented past
+// the key, kept as they are.
+func (p *yamlParser) literal(parent int, keepNewline bool) string {
+	p.i++
+	var lines []string
+	indent := -1
+	for ; p.i < len(p.lines); p.i++ {
+		text := p.lines[p.i].text
+		if strings.TrimSpace(text) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		n := len(text) - len(strings.TrimLeft(text, " "))
+		if n <= parent {
+			break
+		}
+		if indent < 0 {
+			indent = n
+		}
+		if n < indent {
+			break
+		}
+		lines = append(lines, text[indent:])
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	s := strings.Join(lines, "\n")
+	if keepNewline && s != "" {
+		s += "\n"
+	}
+	return s
+}
+
+// splitYAMLKey splits "key: value" or "key:". Keys may be quoted.
+func splitYAMLKey(s string) (key, rest string, ok bool) {
+	if strings.HasPrefix(s, `"`) {
+		end := strings.Index(s[1:], `"`)
+		if end < 0 {
+			return "", "", false
+		}
+		if err := json.Unmarshal([]byte(s[:end+2]), &key); err != nil {
+			return "", "", false
+		}
+		s = s[end+2:]
+		if !strings.HasPrefix(s, ":") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(s[1:]), true
+	}
+	if strings.HasSuffix(s, ":") && !strings.Contains(s, ": ") {
+		return s[:len(s)-1], "", s != ":"
+	}
+	key, rest, ok = strings.Cut(s, ": ")
+	if !ok || key == "" || strings.ContainsAny(key[:1], "'[{#&*!|>%@`") {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(rest), true
+}
+
+func (p *yamlParser) scalar(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		var v string
+		end := strings.LastIndex(s, `"`)
+		if end == 0 || !yamlTrailerOK(s[end+1:]) {
+			return nil, p.errorf("unterminated string")
+		}
+		// Close enough: YAML's double-quoted escapes are a superset
+		// of JSON's, and the common ones are shared.
+		if err := json.Unmarshal([]byte(s[:end+1]), &v); err != nil {
+			return nil, p.errorf("invalid string: %v", err)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		end := strings.LastIndex(s, "'")
+		if end == 0 || !yamlTrailerOK(s[end+1:]) {
+			return nil, p.errorf("unterminated string")
+		}
+		return strings.ReplaceAll(s[1:end], "''", "'"), nil
+	case strings.HasPrefix(s, "["), strings.HasPrefix(s, "{"):
+		var v interface{}
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err == nil {
+			return v, nil
+		}
+		if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+			// A flow sequence of plain scalars, like [go, web].
+			seq := []interface{}{}
+			if inner := strings.TrimSpace(s[1 : len(s)-1]); inner != "" {
+				for _, item := range strings.Split(inner, ",") {
+					v, err := p.scalar(strings.TrimSpace(item))
+					if err != nil {
+						return nil, err
+					}
+					seq = append(seq, v)
+				}
+			}
+			return seq, nil
+		}
+		return nil, p.errorf("unsupported flow collection")
+	case strings.ContainsAny(s[:1], "&*!>%@`"):
+		return nil, p.errorf("unsupported YAML: %s", s)
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return json.Number(s), nil
+	}
+	return s, nil
+}
+
+// yamlTrailerOK reports whether what follows a quoted scalar is only
+// a comment.
+func yamlTrailerOK(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
@@ -2,4 +2,9 @@ module github.com/mikevidotto/WebServer
 
 go 1.22.4
 
-require github.com/mikevidotto/greeting v0.0.0-20240625221535-f21e90feb3cf
+require (
+	github.com/mikevidotto/greeting v0.0.0-20240625221535-f21e90feb3cf
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	golang.org/x/text v0.21.0
+)
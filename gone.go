@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+//--------------410 GONE FOR DELETED POSTS================
+
+var goneRetention = flag.Duration("gone-retention", 0, "answer 410 Gone for posts deleted within this long (0 keeps answering 404)")
+
+// A postSet's tombstones record when each post was deleted, so a GET
+// can tell a deleted post (410) from one that never existed (404).
+
+// recordTombstone notes that the post with the given ID was deleted.
+func (s *postSet) recordTombstone(id PostID) {
+	if *goneRetention > 0 {
+		s.tombstones[id] = time.Now()
+	}
+}
+
+// deletedRecently reports whether the post was deleted within the
+// retention window.
+func (s *postSet) deletedRecently(id PostID) bool {
+	deletedAt, ok := s.tombstones[id]
+	return ok && time.Since(deletedAt) < *goneRetention
+}
+
+// pruneTombstones drops tombstones older than the retention window,
+// once per interval, so they don't pile up forever.
+func pruneTombstones(interval time.Duration) {
+	for range time.Tick(interval) {
+		postsMu.Lock()
+		for _, s := range tenants {
+			for id, deletedAt := range s.tombstones {
+				if time.Since(deletedAt) >= *goneRetention {
+					delete(s.tombstones, id)
+				}
+			}
+		}
+		postsMu.Unlock()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGoneRetention(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention string
+		// setup runs on posts 1 and 2; the test then asks for post 1,
+		// or with no setup for post 3, which never existed.
+		setup func(ts *testServer)
+		want  int
+	}{
+		{"never existed", "1h", nil, http.StatusNotFound},
+		{"deleted", "1h", func(ts *testServer) {
+			wantStatus(ts.t, ts.do("DELETE", "/posts/1", ""), http.StatusOK)
+		}, http.StatusGone},
+		{"deleted without retention", "0s", func(ts *testServer) {
+			wantStatus(ts.t, ts.do("DELETE", "/posts/1", ""), http.StatusOK)
+		}, http.StatusNotFound},
+		{"purged", "1h", func(ts *testServer) {
+			wantStatus(ts.t, ts.do("DELETE", "/posts/1", ""), http.StatusOK)
+			wantStatus(ts.t, ts.do("DELETE", "/posts/trash/1", ""), http.StatusOK)
+		}, http.StatusGone},
+		{"deleted before the window", "1h", func(ts *testServer) {
+			wantStatus(ts.t, ts.do("DELETE", "/posts/1", ""), http.StatusOK)
+			s := lookupPostSet("")
+			postsMu.Lock()
+			s.tombstones["1"] = time.Now().Add(-2 * time.Hour)
+			postsMu.Unlock()
+		}, http.StatusNotFound},
+		{"restored", "1h", func(ts *testServer) {
+			wantStatus(ts.t, ts.do("DELETE", "/posts/1", ""), http.StatusOK)
+			wantStatus(ts.t, ts.do("POST", "/posts/1/restore", ""), http.StatusOK)
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, "-gone-retention="+tt.retention)
+			ts.createPost(`{"body":"one"}`)
+			ts.createPost(`{"body":"two"}`)
+			path := "/posts/3"
+			if tt.setup != nil {
+				tt.setup(ts)
+				path = "/posts/1"
+			}
+
+			wantStatus(t, ts.do("GET", path, ""), tt.want)
+			if tt.want == http.StatusOK {
+				return
+			}
+			// Commenting on it answers the same.
+			wantStatus(t, ts.do("POST", path+"/comments", `{"body":"hi"}`), tt.want)
+			// And a post that never was is still just not found.
+			wantStatus(t, ts.do("GET", "/posts/99", ""), http.StatusNotFound)
+		})
+	}
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//--------------GRAPHQL PARSER================
+
+// parseGraphQL reads the executable part of the GraphQL language that
+// /graphql needs: operations with variables, fields with aliases and
+// arguments, named and inline fragments, and the @skip and @include
+// directives. Type system definitions are refused.
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind       string // query, mutation or subscription
+	name       string
+	vars       []gqlVarDef
+	selections []*gqlSelection
+}
+
+type gqlVarDef struct {
+	name    string
+	typ     string // as written, like [String!]!
+	nonNull bool
+	def     interface{}
+	hasDef  bool
+	line    int
+	column  int
+}
+
+type gqlFragment struct {
+	name       string
+	typeCond   string
+	selections []*gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (fragment set) or an
+// inline fragment (inline set).
+type gqlSelection struct {
+	alias, name string
+	args        []gqlArg
+	directives  []gqlDirective
+	selections  []*gqlSelection
+
+	fragment string
+	inline   bool
+	typeCond string
+
+	line, column int
+}
+
+// key is the field's name in the response.
+func (f *gqlSelection) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type gqlArg struct {
+	name  string
+	value interface{}
+}
+
+type gqlDirective struct {
+	name string
+	args []gqlArg
+}
+
+// Values are parsed into int, float64, string, bool, nil, gqlEnum,
+// []interface{} and map[string]interface{}, with gqlVar standing in
+// for variables until the request's variables are known.
+type (
+	gqlVar  string
+	gqlEnum string
+)
+
+// maxGraphQLNesting bounds how deeply selections and values may nest,
+// so a query can't run the parser out of stack.
+const maxGraphQLNesting = 32
+
+// gqlSyntaxError is a parse error, at a 1-based line and column.
+type gqlSyntaxError struct {
+	msg          string
+	line, column int
+}
+
+func (e *gqlSyntaxError) Error() string {
+	return fmt.Sprintf("Syntax error at %d:%d: %s", e.line, e.column, e.msg)
+}
+
+type gqlToken struct {
+	kind  byte // the punctuator ('.' for ...), n(ame), i(nt), f(loat), s(tring), or 0 at the end
+	text  string
+	start int
+}
+
+type gqlParser struct {
+	src   string
+	pos   int
+	tok   gqlToken
+	depth int
+}
+
+func parseGraphQL(src string) (doc *gqlDocument, err error) {
+	p := &gqlParser{src: src}
+	// Errors are panicked as *gqlSyntaxError and recovered here,
+	// rather than checked after every token.
+	defer func() {
+		if e := recover(); e != nil {
+			serr, ok := e.(*gqlSyntaxError)
+			if !ok {
+				panic(e)
+			}
+			doc, err = nil, serr
+		}
+	}()
+
+	p.next()
+	doc = &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.tok.kind != 0 {
+		switch {
+		case p.tok.kind == '{':
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: p.selectionSet()})
+		case p.tok.kind == 'n' && (p.tok.text == "query" || p.tok.text == "mutation" || p.tok.text == "subscription"):
+			doc.operations = append(doc.operations, p.operation())
+		case p.tok.kind == 'n' && p.tok.text == "fragment":
+			f := p.fragment()
+			if _, dup := doc.fragments[f.name]; dup {
+				p.failf("fragment %q is defined twice", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			p.failf("expected an operation or fragment, found %s", p.describe())
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, &gqlSyntaxError{"no operation", 1, 1}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) operation() *gqlOperation {
+	op := &gqlOperation{kind: p.tok.text}
+	p.next()
+	if p.tok.kind == 'n' {
+		op.name = p.name()
+	}
+	if p.skip('(') {
+		for !p.skip(')') {
+			line, column := p.position(p.tok.start)
+			p.expect('$')
+			v := gqlVarDef{name: p.name(), line: line, column: column}
+			p.expect(':')
+			v.typ, v.nonNull = p.typeRef()
+			if p.skip('=') {
+				v.def, v.hasDef = p.value(true), true
+			}
+			op.vars = append(op.vars, v)
+		}
+	}
+	p.directives()
+	op.selections = p.selectionSet()
+	return op
+}
+
+func (p *gqlParser) fragment() *gqlFragment {
+	p.next()
+	f := &gqlFragment{name: p.name()}
+	if f.name == "on" {
+		p.failf("a fragment can't be named on")
+	}
+	if p.tok.kind != 'n' || p.tok.text != "on" {
+		p.failf("expected on, found %s", p.describe())
+	}
+	p.next()
+	f.typeCond = p.name()
+	p.directives()
+	f.selections = p.selectionSet()
+	return f
+}
+
+// typeRef reads a type like String, [Int!] or ID!, returning it as
+// written.
+func (p *gqlParser) typeRef() (string, bool) {
+	var typ string
+	if p.skip('[') {
+		inner, _ := p.typeRef()
+		p.expect(']')
+		typ = "[" + inner + "]"
+	} else {
+		typ = p.name()
+	}
+	if p.skip('!') {
+		return typ + "!", true
+	}
+	return typ, false
+}
+
+func (p *gqlParser) selectionSet() []*gqlSelection {
+	p.expect('{')
+	p.nest()
+	defer p.unnest()
+
+	var sels []*gqlSelection
+	for !p.skip('}') {
+		line, column := p.position(p.tok.start)
+		if p.skip('.') {
+			sel := &gqlSelection{line: line, column: column}
+			if p.tok.kind == 'n' && p.tok.text != "on" {
+				sel.fragment = p.name()
+				sel.directives = p.directives()
+			} else {
+				sel.inline = true
+				if p.tok.kind == 'n' {
+					p.next()
+					sel.typeCond = p.name()
+				}
+				sel.directives = p.directives()
+				sel.selections = p.selectionSet()
+			}
+			sels = append(sels, sel)
+			continue
+		}
+
+		f := &gqlSelection{name: p.name(), line: line, column: column}
+		if p.skip(':') {
+			f.alias, f.name = f.name, p.name()
+		}
+		f.args = p.arguments(false)
+		f.directives = p.directives()
+		if p.tok.kind == '{' {
+			f.selections = p.selectionSet()
+		}
+		sels = append(sels, f)
+	}
+	if len(sels) == 0 {
+		p.failf("a selection set can't be empty")
+	}
+	return sels
+}
+
+func (p *gqlParser) arguments(constant bool) []gqlArg {
+	if !p.skip('(') {
+		return nil
+	}
+	var args []gqlArg
+	for !p.skip(')') {
+		a := gqlArg{name: p.name()}
+		p.expect(':')
+		a.value = p.value(constant)
+		args = append(args, a)
+	}
+	return args
+}
+
+func (p *gqlParser) directives() []gqlDirective {
+	var ds []gqlDirective
+	for p.skip('@') {
+		ds = append(ds, gqlDirective{name: p.name(), args: p.arguments(false)})
+	}
+	return ds
+}
+
+// value reads a value; constant ones, like variable defaults, can't
+// refer to variables.
+func (p *gqlParser) value(constant bool) interface{} {
+	tok := p.tok
+	switch tok.kind {
+	case '$':
+		if constant {
+			p.failf("variables aren't allowed here")
+		}
+		p.next()
+		return gqlVar(p.name())
+	case 'i':
+		p.next()
+		n, err := strconv.Atoi(tok.text)
+		if err != nil {
+			p.failAt(tok.start, "integer %s out of range", tok.text)
+		}
+		return n
+	case 'f':
+		p.next()
+		f, _ := strconv.ParseFloat(tok.text, 64)
+		return f
+	case 's':
+		p.next()
+		return tok.text
+	case 'n':
+		p.next()
+		switch tok.text {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return gqlEnum(tok.text)
+	case '[':
+		p.next()
+		p.nest()
+		defer p.unnest()
+		list := []interface{}{}
+		for !p.skip(']') {
+			list = append(list, p.value(constant))
+		}
+		return list
+	case '{':
+		p.next()
+		p.nest()
+		defer p.unnest()
+		obj := map[string]interface{}{}
+		for !p.skip('}') {
+			name := p.name()
+			p.expect(':')
+			obj[name] = p.value(constant)
+		}
+		return obj
+	}
+	p.failf("expected a value, found %s", p.describe())
+	return nil
+}
+
+func (p *gqlParser) nest() {
+	p.depth++
+	if p.depth > maxGraphQLNesting {
+		p.failf("nested more than %d deep", maxGraphQLNesting)
+	}
+}
+
+func (p *gqlParser) unnest() { p.depth-- }
+
+func (p *gqlParser) name() string {
+	if p.tok.kind != 'n' {
+		p.failf("expected a name, found %s", p.describe())
+	}
+	name := p.tok.text
+	p.next()
+	return name
+}
+
+func (p *gqlParser) expect(kind byte) {
+	if !p.skip(kind) {
+		p.failf("expected %q, found %s", string(kind), p.describe())
+	}
+}
+
+// skip moves past the current token if it's the punctuator kind.
+func (p *gqlParser) skip(kind byte) bool {
+	if p.tok.kind != kind {
+		return false
+	}
+	p.next()
+	return true
+}
+
+func (p *gqlParser) describe() string {
+	switch p.tok.kind {
+	case 0:
+		return "the end of the query"
+	case 's':
+		return "a string"
+	}
+	return strconv.Quote(p.tok.text)
+}
+
+func (p *gqlParser) failf(format string, args ...interface{}) {
+	p.failAt(p.tok.start, format, args...)
+}
+
+func (p *gqlParser) failAt(pos int, format string, args ...interface{}) {
+	line, column := p.position(pos)
+	panic(&gqlSyntaxError{fmt.Sprintf(format, args...), line, column})
+}
+
+// position turns a byte offset into a line and a column in runes.
+func (p *gqlParser) position(pos int) (line, column int) {
+	before := p.src[:pos]
+	line = strings.Count(before, "\n") + 1
+	column = utf8.RuneCountInString(before[strings.LastIndexByte(before, '\n')+1:]) + 1
+	return line, column
+}
+
+//--------------GRAPHQL LEXER================
+
+// next reads the next token into p.tok, skipping whitespace, commas
+// and comments, which GraphQL ignores.
+func (p *gqlParser) next() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if strings.HasPrefix(p.src[p.pos:], "\ufeff") {
+			p.pos += len("\ufeff")
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+
+	start := p.pos
+	if p.pos == len(p.src) {
+		p.tok = gqlToken{start: start}
+		return
+	}
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{kind: '.', text: "...", start: start}
+	case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+		p.pos++
+		p.tok = gqlToken{kind: c, text: string(c), start: start}
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: 'n', text: p.src[start:p.pos], start: start}
+	case c == '-' || isDigit(c):
+		p.tok = p.number()
+	case c == '"':
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			p.tok = gqlToken{kind: 's', text: p.blockString(), start: start}
+		} else {
+			p.tok = gqlToken{kind: 's', text: p.quotedString(), start: start}
+		}
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.failAt(start, "unexpected character %q", r)
+	}
+}
+
+func (p *gqlParser) number() gqlToken {
+	start := p.pos
+	kind := byte('i')
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	intStart := p.pos
+	if digits() == 0 {
+		p.failAt(start, "invalid number")
+	}
+	if p.src[intStart] == '0' && p.pos-intStart > 1 {
+		p.failAt(start, "numbers can't start with 0")
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		kind = 'f'
+		p.pos++
+		if digits() == 0 {
+			p.failAt(start, "invalid number")
+		}
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		kind = 'f'
+		p.pos++
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		if digits() == 0 {
+			p.failAt(start, "invalid number")
+		}
+	}
+	// 12abc is an error, not 12 followed by a name.
+	if p.pos < len(p.src) && (p.src[p.pos] == '_' || p.src[p.pos] == '.' || isLetter(p.src[p.pos])) {
+		p.failAt(start, "invalid number")
+	}
+	return gqlToken{kind: kind, text: p.src[start:p.pos], start: start}
+}
+
+func (p *gqlParser) quotedString() string {
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' || p.src[p.pos] == '\r' {
+			p.failAt(start, "unterminated string")
+		}
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return b.String()
+		case c == '\\':
+			if p.pos+1 >= len(p.src) {
+				p.failAt(start, "unterminated string")
+			}
+			esc := p.src[p.pos+1]
+			p.pos += 2
+			switch esc {
+			case '"', '\\', '/':
+				b.WriteByte(esc)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					p.failAt(p.pos-2, "invalid escape")
+				}
+				n, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					p.failAt(p.pos-2, "invalid escape")
+				}
+				b.WriteRune(rune(n))
+				p.pos += 4
+			default:
+				p.failAt(p.pos-2, "invalid escape \\%c", esc)
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// blockString reads a """block string""", removing the indentation
+// its lines share and the blank lines around it.
+func (p *gqlParser) blockString() string {
+	start := p.pos
+	p.pos += 3
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) {
+			p.failAt(start, "unterminated string")
+		}
+		if strings.HasPrefix(p.src[p.pos:], `\"""`) {
+			b.WriteString(`"""`)
+			p.pos += 4
+			continue
+		}
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			p.pos += 3
+			break
+		}
+		b.WriteByte(p.src[p.pos])
+		p.pos++
+	}
+
+	lines := strings.Split(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		} else {
+			lines[i] = ""
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
@@ -0,0 +1,1010 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--------------GRAPHQL================
+
+// /graphql answers GraphQL over the same posts, comments and users as
+// the REST API, under the same lock, so both always show the same
+// thing. It takes the usual {"query","variables","operationName"}
+// JSON body, or a bare query with Content-Type: application/graphql,
+// and GET /graphql?query=... for queries. GET /graphql without a query
+// returns the schema:
+//
+//	{ post(id: 3) { body comments { body author } user { name } } }
+//
+// Mutations do what the REST request would, with the same checks, and
+// a field that fails is null with an error whose extensions.status is
+// the REST status code. Reading a post here doesn't count as a view.
+//
+// Subscriptions are sent as Server-Sent Events, one "next" event per
+// change with the subscription's result as data, so they need Accept:
+// text/event-stream. That includes GET, for EventSource.
+//
+// Only what's in the schema below can be asked for; there's no
+// introspection beyond __typename. An operation asking for anything
+// else is answered 400 before any of it runs, so a mutation with a
+// mistake in it changes nothing. With auth on, mutations need a
+// bearer token but queries don't, so withAuth lets POST /graphql
+// through and mutations are checked here. A POST still counts against
+// the write rate limit, so use GET for queries under tight limits.
+
+const graphqlSchema = `type Query {
+  post(id: ID!): Post
+  posts(limit: Int = 20, offset: Int = 0, author: String, tag: String): [Post!]!
+  user(id: Int!): User
+  users: [User!]!
+}
+
+type Mutation {
+  createPost(body: String!, author: String, authorId: Int, tags: [String!]): Post
+  updatePost(id: ID!, body: String!, author: String, tags: [String!]): Post
+  deletePost(id: ID!): Boolean
+  addComment(postId: ID!, body: String!, author: String, parentId: Int): Comment
+  deleteComment(postId: ID!, id: Int!): Boolean
+}
+
+type Subscription {
+  "Every change to a post, or to the one with the given ID."
+  postChanged(id: ID): PostEvent!
+}
+
+type Post {
+  id: ID!
+  body: String!
+  "The body rendered from Markdown, as by GET /posts/{id}/html."
+  html: String!
+  author: String
+  authorId: Int
+  user: User
+  tags: [String!]!
+  createdAt: String!
+  updatedAt: String!
+  locked: Boolean!
+  views: Int!
+  comments: [Comment!]!
+}
+
+type Comment {
+  id: Int!
+  postId: ID!
+  post: Post
+  "The comment this replies to, if any."
+  parentId: Int
+  "1 for a comment on the post, one more for each reply down a thread."
+  depth: Int!
+  body: String!
+  author: String
+  createdAt: String!
+}
+
+type User {
+  id: Int!
+  name: String!
+  createdAt: String!
+  posts(limit: Int = 20, offset: Int = 0): [Post!]!
+}
+
+type PostEvent {
+  "post.created, post.updated, post.deleted and so on; see GET /events."
+  event: String!
+  id: ID!
+  author: String
+  time: String!
+  "The post as it is now, null once it's deleted."
+  post: Post
+}
+`
+
+// gqlFields lists the fields of each type in graphqlSchema with the
+// types of their arguments, to check a query against before running
+// it.
+var gqlFields = map[string]map[string]map[string]string{
+	"Query": {
+		"post":  {"id": "ID!"},
+		"posts": {"limit": "Int", "offset": "Int", "author": "String", "tag": "String"},
+		"user":  {"id": "Int!"},
+		"users": nil,
+	},
+	"Mutation": {
+		"createPost":    {"body": "String!", "author": "String", "authorId": "Int", "tags": "[String!]"},
+		"updatePost":    {"id": "ID!", "body": "String!", "author": "String", "tags": "[String!]"},
+		"deletePost":    {"id": "ID!"},
+		"addComment":    {"postId": "ID!", "body": "String!", "author": "String", "parentId": "Int"},
+		"deleteComment": {"postId": "ID!", "id": "Int!"},
+	},
+	"Subscription": {
+		"postChanged": {"id": "ID"},
+	},
+	"Post": {
+		"id": nil, "body": nil, "html": nil, "author": nil, "authorId": nil, "user": nil, "tags": nil,
+		"createdAt": nil, "updatedAt": nil, "locked": nil, "views": nil, "comments": nil,
+	},
+	"Comment": {
+		"id": nil, "postId": nil, "post": nil, "parentId": nil, "depth": nil, "body": nil, "author": nil, "createdAt": nil,
+	},
+	"User": {
+		"id": nil, "name": nil, "createdAt": nil,
+		"posts": {"limit": "Int", "offset": "Int"},
+	},
+	"PostEvent": {
+		"event": nil, "id": nil, "author": nil, "time": nil, "post": nil,
+	},
+}
+
+// gqlObjectFields gives the object type of each field in graphqlSchema
+// whose value is an object or a list of them; the rest are scalars.
+var gqlObjectFields = map[string]map[string]string{
+	"Query":        {"post": "Post", "posts": "Post", "user": "User", "users": "User"},
+	"Mutation":     {"createPost": "Post", "updatePost": "Post", "addComment": "Comment"},
+	"Subscription": {"postChanged": "PostEvent"},
+	"Post":         {"user": "User", "comments": "Comment"},
+	"Comment":      {"post": "Post"},
+	"User":         {"posts": "Post"},
+	"PostEvent":    {"post": "Post"},
+}
+
+// gqlRootTypes maps each kind of operation to its type in
+// graphqlSchema.
+var gqlRootTypes = map[string]string{
+	"query":        "Query",
+	"mutation":     "Mutation",
+	"subscription": "Subscription",
+}
+
+// maxGraphQLDepth bounds how many objects deep a query may go, since
+// fragments can nest further than the query text itself does.
+const maxGraphQLDepth = 10
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type graphqlResponse struct {
+	Data   interface{}    `json:"data,omitempty"`
+	Errors []graphqlError `json:"errors,omitempty"`
+}
+
+type graphqlError struct {
+	Message    string                 `json:"message"`
+	Locations  []graphqlLocation      `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type graphqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// gqlStatusError is a failed field with the status code the REST
+// request would have answered.
+type gqlStatusError struct {
+	status int
+	msg    string
+}
+
+func (e *gqlStatusError) Error() string { return e.msg }
+
+func handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	switch {
+	case r.Method == "GET":
+		q := r.URL.Query()
+		if !q.Has("query") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, graphqlSchema)
+			return
+		}
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "Invalid variables: "+err.Error())
+				return
+			}
+		}
+	case strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql"):
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeGraphQLError(w, http.StatusBadRequest, "Error reading request body: "+err.Error())
+			return
+		}
+		req.Query = string(b)
+	default:
+		if err := decodeJSON(r, r.Body, &req); err != nil {
+			writeGraphQLError(w, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+			return
+		}
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		var serr *gqlSyntaxError
+		errors.As(err, &serr)
+		writeGraphQL(w, http.StatusBadRequest, graphqlResponse{Errors: []graphqlError{{
+			Message:   err.Error(),
+			Locations: []graphqlLocation{{serr.line, serr.column}},
+		}}})
+		return
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	vars, err := op.variables(req.Variables)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	e := &gqlExec{r: r, doc: doc, vars: vars}
+
+	// The whole operation is checked before any of it runs, so a
+	// mutation asking for something that isn't there changes nothing.
+	if e.validate(gqlRootTypes[op.kind], op.selections, nil, 0); len(e.errors) > 0 {
+		writeGraphQL(w, http.StatusBadRequest, graphqlResponse{Errors: e.errors})
+		return
+	}
+
+	switch op.kind {
+	case "subscription":
+		e.subscribe(w, op)
+		return
+	case "mutation":
+		if r.Method == "GET" {
+			w.Header().Set("Allow", "POST")
+			writeGraphQLError(w, http.StatusMethodNotAllowed, "Mutations must be sent with POST")
+			return
+		}
+		if _, err := authenticate(r); !mayWrite(err) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="posts"`)
+			writeGraphQLError(w, http.StatusUnauthorized, "Authentication required: "+err.Error())
+			return
+		}
+		// Mutation fields run one after another, under one hold of
+		// the lock, like /batch.
+		postsMu.Lock()
+		s, err := postSetFor(r)
+		if err != nil {
+			postsMu.Unlock()
+			writeGraphQLError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		e.s = s
+		data := e.selectionSet(gqlMutation{}, op.selections, nil, 0)
+		postsMu.Unlock()
+		writeGraphQL(w, http.StatusOK, graphqlResponse{data, e.errors})
+	default:
+		e.s = readPostSet(r)
+		data := e.selectionSet(gqlQuery{}, op.selections, nil, 0)
+		postsMu.RUnlock()
+		writeGraphQL(w, http.StatusOK, graphqlResponse{data, e.errors})
+	}
+}
+
+func writeGraphQL(w http.ResponseWriter, code int, resp graphqlResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeGraphQLError answers with a request error, one that stopped
+// the query from running at all.
+func writeGraphQLError(w http.ResponseWriter, code int, msg string) {
+	writeGraphQL(w, code, graphqlResponse{Errors: []graphqlError{{Message: msg}}})
+}
+
+// operation picks the operation to run: the one named, or the only
+// one.
+func (doc *gqlDocument) operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, errors.New("operationName is required when there are several operations")
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("No operation named %q", name)
+}
+
+// variables fills in the defaults of variables the request didn't
+// send, and checks the required ones are there.
+func (op *gqlOperation) variables(sent map[string]interface{}) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	for _, def := range op.vars {
+		v, ok := sent[def.name]
+		switch {
+		case ok:
+			vars[def.name] = v
+		case def.hasDef:
+			vars[def.name] = def.def
+		}
+		if vars[def.name] == nil && def.nonNull {
+			return nil, fmt.Errorf("Variable $%s of type %s is required", def.name, def.typ)
+		}
+	}
+	return vars, nil
+}
+
+//--------------GRAPHQL EXECUTION================
+
+// gqlExec runs one operation against a tenant's posts, whose lock the
+// caller holds.
+type gqlExec struct {
+	r      *http.Request
+	s      *postSet
+	doc    *gqlDocument
+	vars   map[string]interface{}
+	errors []graphqlError
+}
+
+// gqlObject is a value of one of the object types in graphqlSchema.
+// resolve returns a field's value: a scalar, a gqlObject, a
+// []gqlObject, or nil for null. Its arguments have been checked
+// against gqlFields.
+type gqlObject interface {
+	typeName() string
+	resolve(e *gqlExec, field string, args map[string]interface{}) (interface{}, error)
+}
+
+// validate checks the fields sels asks of an object of the given type,
+// and those under them, against graphqlSchema, recording what's wrong
+// in e.errors.
+func (e *gqlExec) validate(typeName string, sels []*gqlSelection, path []interface{}, depth int) {
+	for _, group := range e.collectFields(typeName, sels, make(map[string]bool)) {
+		f := group[0]
+		fieldPath := append(path[:len(path):len(path)], f.key())
+		var subs []*gqlSelection
+		for _, same := range group {
+			subs = append(subs, same.selections...)
+		}
+
+		objType := gqlObjectFields[typeName][f.name]
+		if argTypes, ok := gqlFields[typeName][f.name]; !ok && f.name != "__typename" {
+			e.fail(f, fieldPath, http.StatusBadRequest, fmt.Sprintf("Cannot query field %q on type %q", f.name, typeName))
+			continue
+		} else if _, err := e.arguments(f.args, argTypes); err != nil {
+			e.fail(f, fieldPath, http.StatusBadRequest, err.Error())
+			continue
+		}
+		switch {
+		case objType == "" && len(subs) > 0:
+			e.fail(f, fieldPath, http.StatusBadRequest, fmt.Sprintf("Field %q has no subfields", f.name))
+		case objType != "" && len(subs) == 0:
+			e.fail(f, fieldPath, http.StatusBadRequest, fmt.Sprintf("Field %q of type %q must have a selection of subfields", f.name, objType))
+		case objType != "" && depth >= maxGraphQLDepth:
+			e.fail(f, fieldPath, http.StatusBadRequest, fmt.Sprintf("Query is nested more than %d objects deep", maxGraphQLDepth))
+		case objType != "":
+			e.validate(objType, subs, fieldPath, depth+1)
+		}
+	}
+}
+
+// selectionSet resolves the fields sels asks of obj, in order.
+func (e *gqlExec) selectionSet(obj gqlObject, sels []*gqlSelection, path []interface{}, depth int) ordered {
+	out := ordered{}
+	for _, group := range e.collectFields(obj.typeName(), sels, make(map[string]bool)) {
+		f := group[0]
+		key := f.key()
+		fieldPath := append(path[:len(path):len(path)], key)
+		if f.name == "__typename" {
+			out = append(out, orderedField{key, obj.typeName()})
+			continue
+		}
+
+		var subs []*gqlSelection
+		for _, same := range group {
+			subs = append(subs, same.selections...)
+		}
+		out = append(out, orderedField{key, e.field(obj, f, subs, fieldPath, depth)})
+	}
+	return out
+}
+
+// field resolves one field of obj, which group may ask for several
+// times with their selections merged into subs. validate has already
+// checked it against the schema.
+func (e *gqlExec) field(obj gqlObject, f *gqlSelection, subs []*gqlSelection, path []interface{}, depth int) interface{} {
+	args, err := e.arguments(f.args, gqlFields[obj.typeName()][f.name])
+	if err != nil {
+		e.fail(f, path, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	v, err := obj.resolve(e, f.name, args)
+	if err != nil {
+		e.failErr(f, path, err)
+		return nil
+	}
+	return e.complete(v, f, subs, path, depth)
+}
+
+// complete turns a resolved value into its part of the response.
+func (e *gqlExec) complete(v interface{}, f *gqlSelection, subs []*gqlSelection, path []interface{}, depth int) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case gqlObject:
+		return e.selectionSet(v, subs, path, depth+1)
+	case []gqlObject:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.complete(item, f, subs, append(path[:len(path):len(path)], i), depth)
+		}
+		return list
+	}
+	return v
+}
+
+// collectFields flattens sels for an object of the given type, going
+// into the fragments that apply to it and leaving out fields skipped
+// by directives. Fields asked for more than once under the same name
+// are grouped together.
+func (e *gqlExec) collectFields(typeName string, sels []*gqlSelection, visited map[string]bool) [][]*gqlSelection {
+	var groups [][]*gqlSelection
+	index := make(map[string]int)
+	add := func(more [][]*gqlSelection) {
+		for _, group := range more {
+			key := group[0].key()
+			if i, ok := index[key]; ok {
+				groups[i] = append(groups[i], group...)
+			} else {
+				index[key] = len(groups)
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	for _, sel := range sels {
+		if !e.included(sel) {
+			continue
+		}
+		switch {
+		case sel.fragment != "":
+			frag, ok := e.doc.fragments[sel.fragment]
+			if !ok {
+				e.fail(sel, nil, http.StatusBadRequest, fmt.Sprintf("Unknown fragment %q", sel.fragment))
+				continue
+			}
+			if visited[sel.fragment] || frag.typeCond != typeName {
+				continue
+			}
+			visited[sel.fragment] = true
+			add(e.collectFields(typeName, frag.selections, visited))
+		case sel.inline:
+			if sel.typeCond == "" || sel.typeCond == typeName {
+				add(e.collectFields(typeName, sel.selections, visited))
+			}
+		default:
+			add([][]*gqlSelection{{sel}})
+		}
+	}
+	return groups
+}
+
+// included applies @skip(if:) and @include(if:).
+func (e *gqlExec) included(sel *gqlSelection) bool {
+	for _, d := range sel.directives {
+		args, err := e.arguments(d.args, map[string]string{"if": "Boolean!"})
+		if err == nil && d.name != "skip" && d.name != "include" {
+			err = fmt.Errorf("Unknown directive @%s", d.name)
+		}
+		if err != nil {
+			e.fail(sel, nil, http.StatusBadRequest, err.Error())
+			return false
+		}
+		if args["if"].(bool) == (d.name == "skip") {
+			return false
+		}
+	}
+	return true
+}
+
+// arguments fills in variables and checks the arguments against their
+// types, which come from gqlFields.
+func (e *gqlExec) arguments(args []gqlArg, types map[string]string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, a := range args {
+		typ, ok := types[a.name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown argument %q", a.name)
+		}
+		v, err := coerceGraphQL(e.substitute(a.value), typ)
+		if err != nil {
+			return nil, fmt.Errorf("Argument %q: %v", a.name, err)
+		}
+		values[a.name] = v
+	}
+	for name, typ := range types {
+		if _, ok := values[name]; !ok && strings.HasSuffix(typ, "!") {
+			return nil, fmt.Errorf("Argument %q of type %s is required", name, typ)
+		}
+	}
+	return values, nil
+}
+
+// substitute replaces the variables in v with their values.
+func (e *gqlExec) substitute(v interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlVar:
+		return e.vars[string(v)]
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.substitute(item)
+		}
+		return list
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			obj[k] = e.substitute(item)
+		}
+		return obj
+	}
+	return v
+}
+
+// coerceGraphQL checks that v is of type typ, one of the argument
+// types gqlFields uses. Numbers from JSON variables arrive as
+// float64, and whole ones are accepted as Int.
+func coerceGraphQL(v interface{}, typ string) (interface{}, error) {
+	if inner, ok := strings.CutSuffix(typ, "!"); ok {
+		if v == nil {
+			return nil, fmt.Errorf("expected %s, not null", typ)
+		}
+		return coerceGraphQL(v, inner)
+	}
+	if v == nil {
+		return nil, nil
+	}
+	if inner, ok := strings.CutPrefix(typ, "["); ok {
+		inner = strings.TrimSuffix(inner, "]")
+		items, ok := v.([]interface{})
+		if !ok {
+			// A single value stands for a list of one.
+			items = []interface{}{v}
+		}
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			var err error
+			if list[i], err = coerceGraphQL(item, inner); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+
+	switch typ {
+	case "Int":
+		switch n := v.(type) {
+		case int:
+			return n, nil
+		case float64:
+			if n == math.Trunc(n) && math.Abs(n) <= math.MaxInt32 {
+				return int(n), nil
+			}
+		}
+	case "String":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "ID":
+		// Post IDs, which are numbers or strings; see ids.go.
+		s, ok := v.(string)
+		switch n := v.(type) {
+		case int:
+			s, ok = strconv.Itoa(n), true
+		case float64:
+			s, ok = strconv.FormatFloat(n, 'f', -1, 64), n == math.Trunc(n)
+		}
+		if id, valid := parsePostID(s); ok && valid {
+			return id, nil
+		}
+	case "Boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s", typ)
+}
+
+func (e *gqlExec) fail(sel *gqlSelection, path []interface{}, status int, msg string) {
+	e.errors = append(e.errors, graphqlError{
+		Message:    msg,
+		Locations:  []graphqlLocation{{sel.line, sel.column}},
+		Path:       path,
+		Extensions: map[string]interface{}{"status": status},
+	})
+}
+
+// failErr records a resolver's error with the status REST would give
+// it.
+func (e *gqlExec) failErr(sel *gqlSelection, path []interface{}, err error) {
+	var serr *gqlStatusError
+	if errors.As(err, &serr) {
+		e.fail(sel, path, serr.status, serr.msg)
+		return
+	}
+	code, msg := postErrorStatus(err)
+	if code == http.StatusInternalServerError {
+		slog.Error("resolving GraphQL field", "field", sel.name, "err", err, "request_id", requestIDOf(e.r))
+	}
+	e.fail(sel, path, code, msg)
+}
+
+// batchError turns a failed batchResult into an error.
+func batchError(res batchResult) error {
+	if res.Status >= 400 {
+		return &gqlStatusError{res.Status, res.Error}
+	}
+	return nil
+}
+
+//--------------GRAPHQL TYPES================
+
+type (
+	gqlQuery     struct{}
+	gqlMutation  struct{}
+	gqlPost      Post
+	gqlComment   Comment
+	gqlUser      User
+	gqlPostEvent postEvent
+)
+
+func (gqlQuery) typeName() string { return "Query" }
+
+func (gqlQuery) resolve(e *gqlExec, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "post":
+		p, err := e.s.getPost(args["id"].(PostID))
+		if err == errNotFound || err == errGone {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return gqlPost(p), nil
+	case "posts":
+		ps := listable(e.s.store.List())
+		var f postFilter
+		if author, ok := args["author"].(string); ok {
+			f.author, f.hasAuthor = author, true
+		}
+		if tag, ok := args["tag"].(string); ok {
+			f.tags = []string{tag}
+		}
+		return pagePosts(f.apply(ps), args)
+	case "user":
+		usersMu.Lock()
+		u, ok := users[args["id"].(int)]
+		usersMu.Unlock()
+		if !ok {
+			return nil, nil
+		}
+		return gqlUser(u), nil
+	case "users":
+		usersMu.Lock()
+		list := make([]User, 0, len(users))
+		for _, u := range users {
+			list = append(list, u)
+		}
+		usersMu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		objs := make([]gqlObject, len(list))
+		for i, u := range list {
+			objs[i] = gqlUser(u)
+		}
+		return objs, nil
+	}
+	return nil, nil
+}
+
+// pagePosts sorts ps by ID and returns the page asked for by the limit
+// and offset arguments.
+func pagePosts(ps []Post, args map[string]interface{}) ([]gqlObject, error) {
+	limit, offset := 20, 0
+	if v, ok := args["limit"].(int); ok {
+		limit = v
+	}
+	if v, ok := args["offset"].(int); ok {
+		offset = v
+	}
+	if limit < 1 || limit > maxLimit {
+		return nil, &gqlStatusError{http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLimit)}
+	}
+	if offset < 0 {
+		return nil, &gqlStatusError{http.StatusBadRequest, "offset must be a non-negative integer"}
+	}
+
+	sortByID(ps)
+	ps = ps[min(offset, len(ps)):]
+	ps = ps[:min(limit, len(ps))]
+	objs := make([]gqlObject, len(ps))
+	for i, p := range ps {
+		objs[i] = gqlPost(p)
+	}
+	return objs, nil
+}
+
+func (gqlMutation) typeName() string { return "Mutation" }
+
+func (gqlMutation) resolve(e *gqlExec, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "createPost", "updatePost":
+		p := Post{Body: args["body"].(string)}
+		p.Author, _ = args["author"].(string)
+		p.AuthorID, _ = args["authorId"].(int)
+		if tags, ok := args["tags"].([]interface{}); ok {
+			p.Tags = make([]string, len(tags))
+			for i, t := range tags {
+				p.Tags[i] = t.(string)
+			}
+		}
+		op := batchOp{Op: "create", Post: &p}
+		if field == "updatePost" {
+			op = batchOp{Op: "update", ID: args["id"].(PostID), Post: &p}
+		}
+		res := e.s.applyBatchOp(e.r, op)
+		if err := batchError(res); err != nil {
+			return nil, err
+		}
+		return gqlPost(*res.Post), nil
+	case "deletePost":
+		if err := batchError(e.s.applyBatchOp(e.r, batchOp{Op: "delete", ID: args["id"].(PostID)})); err != nil {
+			return nil, err
+		}
+		return true, nil
+	case "addComment":
+		c := Comment{Body: args["body"].(string)}
+		c.Author, _ = args["author"].(string)
+		c.ParentID, _ = args["parentId"].(int)
+		c, err := e.s.addComment(args["postId"].(PostID), c)
+		if err != nil {
+			return nil, err
+		}
+		return gqlComment(c), nil
+	case "deleteComment":
+		if err := e.s.deleteComment(args["postId"].(PostID), args["id"].(int)); err != nil {
+			return nil, err
+		}
+		return true, nil
+	}
+	return nil, nil
+}
+
+func (gqlPost) typeName() string { return "Post" }
+
+func (p gqlPost) resolve(e *gqlExec, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "id":
+		return p.ID, nil
+	case "body":
+		return p.Body, nil
+	case "html":
+		return renderMarkdown(p.Body), nil
+	case "author":
+		return optionalString(p.Author), nil
+	case "authorId":
+		if p.AuthorID == 0 {
+			return nil, nil
+		}
+		return p.AuthorID, nil
+	case "user":
+		usersMu.Lock()
+		u, ok := users[p.AuthorID]
+		usersMu.Unlock()
+		if !ok {
+			return nil, nil
+		}
+		return gqlUser(u), nil
+	case "tags":
+		if p.Tags == nil {
+			return []string{}, nil
+		}
+		return p.Tags, nil
+	case "createdAt":
+		return p.CreatedAt.Format(time.RFC3339Nano), nil
+	case "updatedAt":
+		return p.UpdatedAt.Format(time.RFC3339Nano), nil
+	case "locked":
+		return p.Locked, nil
+	case "views":
+		return p.Views, nil
+	case "comments":
+		cs := e.s.store.Comments(p.ID)
+		objs := make([]gqlObject, len(cs))
+		for i, c := range cs {
+			objs[i] = gqlComment(c)
+		}
+		return objs, nil
+	}
+	return nil, nil
+}
+
+func (gqlComment) typeName() string { return "Comment" }
+
+func (c gqlComment) resolve(e *gqlExec, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "id":
+		return c.ID, nil
+	case "postId":
+		return c.PostID, nil
+	case "post":
+		if p, ok := e.s.store.Get(c.PostID); ok {
+			return gqlPost(p), nil
+		}
+		return nil, nil
+	case "parentId":
+		if c.ParentID == 0 {
+			return nil, nil
+		}
+		return c.ParentID, nil
+	case "depth":
+		return c.Depth, nil
+	case "body":
+		return c.Body, nil
+	case "author":
+		return optionalString(c.Author), nil
+	case "createdAt":
+		return c.CreatedAt.Format(time.RFC3339Nano), nil
+	}
+	return nil, nil
+}
+
+func (gqlUser) typeName() string { return "User" }
+
+func (u gqlUser) resolve(e *gqlExec, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "id":
+		return u.ID, nil
+	case "name":
+		return u.Name, nil
+	case "createdAt":
+		return u.CreatedAt.Format(time.RFC3339Nano), nil
+	case "posts":
+		all := listable(e.s.store.List())
+		ps := all[:0]
+		for _, p := range all {
+			if p.AuthorID == u.ID {
+				ps = append(ps, p)
+			}
+		}
+		return pagePosts(ps, args)
+	}
+	return nil, nil
+}
+
+func (gqlPostEvent) typeName() string { return "PostEvent" }
+
+func (ev gqlPostEvent) resolve(e *gqlExec, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "event":
+		return ev.Event, nil
+	case "id":
+		return ev.ID, nil
+	case "author":
+		return optionalString(ev.Author), nil
+	case "time":
+		return ev.Time, nil
+	case "post":
+		if p, ok := e.s.store.Get(ev.ID); ok {
+			return gqlPost(p), nil
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// optionalString is s, or null if it's empty.
+func optionalString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+//--------------GRAPHQL SUBSCRIPTIONS================
+
+// gqlSubscription is the root of a subscription's result for one
+// event.
+type gqlSubscription struct{ event postEvent }
+
+func (gqlSubscription) typeName() string { return "Subscription" }
+
+func (sub gqlSubscription) resolve(e *gqlExec, field string, args map[string]interface{}) (interface{}, error) {
+	return gqlPostEvent(sub.event), nil
+}
+
+// subscribe streams op's result for every change to the tenant's
+// posts, as handleEvents does.
+func (e *gqlExec) subscribe(w http.ResponseWriter, op *gqlOperation) {
+	r := e.r
+	if !acceptsEventStream(r) {
+		writeGraphQLError(w, http.StatusNotAcceptable, "Subscriptions are sent as Server-Sent Events; send Accept: text/event-stream")
+		return
+	}
+	roots := e.collectFields("Subscription", op.selections, make(map[string]bool))
+	if len(roots) != 1 {
+		writeGraphQLError(w, http.StatusBadRequest, "A subscription must select exactly one field")
+		return
+	}
+	root := roots[0][0]
+	args, _ := e.arguments(root.args, gqlFields["Subscription"][root.name])
+	onlyID, _ := args["id"].(PostID)
+
+	if !broker.join() {
+		w.Header().Set("Retry-After", subscribersRetryAfter)
+		writeGraphQLError(w, http.StatusServiceUnavailable, "Too many event streams open; try again later")
+		return
+	}
+	defer broker.leave()
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ch := broker.subscribe(tenantOf(r))
+	defer broker.unsubscribe(ch)
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				fmt.Fprint(w, "event: complete\ndata:\n\n")
+				rc.Flush()
+				return
+			}
+			if onlyID != "" && ev.ID != onlyID {
+				continue
+			}
+			e.errors = nil
+			e.s = readPostSet(r)
+			data := e.selectionSet(gqlSubscription{ev.postEvent}, op.selections, nil, 0)
+			postsMu.RUnlock()
+			b, _ := json.Marshal(graphqlResponse{data, e.errors})
+			fmt.Fprintf(w, "id: %d\nevent: next\ndata: %s\n\n", ev.id, b)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	for _, mediaRange := range acceptRanges(r.Header.Get("Accept")) {
+		if mediaRange == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
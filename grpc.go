@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+//--------------gRPC================
+
+// The PostService of proto/posts.proto is served on the same port as
+// the REST API, at /webserver.posts.v1.PostService/{method}, for
+// internal services that would rather skip JSON. It works on the same
+// posts, with the same rules: validation, -unique-per-author, locks,
+// If-Match (if_match), the trash, events, and per tenant with
+// -multi-tenant, from the x-tenant-id metadata.
+//
+// gRPC needs HTTP/2. With TLS the server negotiates it like any
+// browser would; without it, clients connect with plaintext HTTP/2
+// ("h2c", like grpc.WithTransportCredentials(insecure.NewCredentials())
+// in grpc-go). Plaintext HTTP/2 connections are taken over from the
+// http.Server, so a shutdown doesn't wait for their calls to finish.
+//
+// As with /graphql, reading needs no login even with auth on, while
+// CreatePost, UpdatePost and DeletePost need an authorization: Bearer
+// metadata entry and answer UNAUTHENTICATED without one. Every call is
+// a POST, so -rate-writes limits all of them. Messages are taken up to
+// 4 MiB and uncompressed only, and a grpc-timeout is honored.
+
+const grpcServicePath = "/webserver.posts.v1.PostService/"
+
+// maxGRPCMessage is the largest request message taken, the same as
+// gRPC's own default.
+const maxGRPCMessage = 4 << 20
+
+// gRPC status codes, from google.golang.org/grpc/codes.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is an error with the status a gRPC client should see.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// grpcStatus maps an error from a method to a gRPC status. Errors from
+// the postSet helpers get the status nearest their HTTP one.
+func grpcStatus(ctx context.Context, err error) (int, string) {
+	var gerr *grpcError
+	if errors.As(err, &gerr) {
+		return gerr.code, gerr.msg
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return grpcDeadlineExceeded, "deadline exceeded"
+	}
+	code, msg := postErrorStatus(err)
+	switch code {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return grpcInvalidArgument, msg
+	case http.StatusForbidden:
+		return grpcPermissionDenied, msg
+	case http.StatusNotFound, http.StatusGone:
+		return grpcNotFound, msg
+	case http.StatusConflict:
+		return grpcAlreadyExists, msg
+	case http.StatusLocked:
+		return grpcFailedPrecondition, msg
+	}
+	return grpcInternal, msg
+}
+
+// A grpcMethod handles one call. It gets the request message and
+// sends its response messages on stream, one for a unary call.
+type grpcMethod func(r *http.Request, req []byte, stream *grpcStream) error
+
+// grpcStream sends the response messages of a call.
+type grpcStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// send writes msg the way readGRPCMessage reads one.
+func (s *grpcStream) send(msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := s.w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// sendHeader sends the response headers before any message, so a
+// client knows a stream is open.
+func (s *grpcStream) sendHeader() error {
+	s.w.WriteHeader(http.StatusOK)
+	return s.rc.Flush()
+}
+
+var grpcMethods = map[string]grpcMethod{
+	"CreatePost": grpcCreatePost,
+	"GetPost":    grpcGetPost,
+	"ListPosts":  grpcListPosts,
+	"UpdatePost": grpcUpdatePost,
+	"DeletePost": grpcDeletePost,
+	"Watch":      grpcWatch,
+}
+
+// isGRPC reports whether r is a gRPC call.
+func isGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
+}
+
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		writeError(w, r, http.StatusHTTPVersionNotSupported, "gRPC needs HTTP/2")
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && ct != "application/grpc+proto" {
+		writeError(w, r, http.StatusUnsupportedMediaType, "Content-Type must be application/grpc or application/grpc+proto")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Accept-Encoding", "identity")
+	// The status goes in the trailers, after any messages.
+	status := func(code int, msg string) {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+		if msg != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(msg))
+		}
+	}
+
+	method, ok := grpcMethods[strings.TrimPrefix(r.URL.Path, grpcServicePath)]
+	if !ok {
+		status(grpcUnimplemented, "unknown method "+r.URL.Path)
+		return
+	}
+	if v := r.Header.Get("Grpc-Timeout"); v != "" {
+		timeout, err := parseGRPCTimeout(v)
+		if err != nil {
+			status(grpcInvalidArgument, err.Error())
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		code, msg := grpcStatus(r.Context(), err)
+		status(code, msg)
+		return
+	}
+	stream := &grpcStream{w: w, rc: http.NewResponseController(w)}
+	if err := method(r, req, stream); err != nil {
+		code, msg := grpcStatus(r.Context(), err)
+		status(code, msg)
+		return
+	}
+	status(grpcOK, "")
+}
+
+// readGRPCMessage reads the one request message of a call: a byte
+// saying whether it's compressed, its length as four bytes, big
+// endian, and the message.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request message: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages aren't supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "request message larger than %d bytes", maxGRPCMessage)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request message: %v", err)
+	}
+	return msg, nil
+}
+
+// parseGRPCTimeout parses a grpc-timeout header: at most 8 digits and
+// a unit, H, M, S, m (milliseconds), u or n.
+func parseGRPCTimeout(v string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	if len(v) < 2 || len(v) > 9 {
+		return 0, fmt.Errorf("bad grpc-timeout %q", v)
+	}
+	unit, ok := units[v[len(v)-1]]
+	n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("bad grpc-timeout %q", v)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// grpcPercentEncode encodes a grpc-message: bytes outside printable
+// ASCII, and %, as %XX.
+func grpcPercentEncode(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// withH2C lets clients speak HTTP/2 without TLS, for gRPC. Everything
+// else on such a connection is served as usual.
+func withH2C(h http.Handler) http.Handler {
+	return h2c.NewHandler(h, &http2.Server{IdleTimeout: *idleTimeout})
+}
+
+// grpcMayWrite returns UNAUTHENTICATED unless r may change posts.
+func grpcMayWrite(r *http.Request) error {
+	if _, err := authenticate(r); !mayWrite(err) {
+		return grpcErrorf(grpcUnauthenticated, "authentication required: %v", err)
+	}
+	return nil
+}
+
+// grpcPostID parses the id of a request.
+func grpcPostID(id string) (PostID, error) {
+	pid, ok := parsePostID(id)
+	if !ok {
+		return "", grpcErrorf(grpcInvalidArgument, "invalid post ID %q", id)
+	}
+	return pid, nil
+}
+
+func encodePost(p Post) []byte {
+	var w pbWriter
+	w.string(1, string(p.ID))
+	w.string(2, p.Body)
+	w.string(3, p.Author)
+	w.varint(4, int64(p.AuthorID))
+	w.strings(5, p.Tags)
+	w.timestamp(6, p.CreatedAt)
+	w.timestamp(7, p.UpdatedAt)
+	w.bool(8, p.Locked)
+	w.varint(9, int64(p.Views))
+	if p.DeletedAt != nil {
+		w.timestamp(10, *p.DeletedAt)
+	}
+	return w.buf
+}
+
+func grpcCreatePost(r *http.Request, req []byte, stream *grpcStream) error {
+	if err := grpcMayWrite(r); err != nil {
+		return err
+	}
+	var p Post
+	err := readProtobuf(req, func(f pbField) error {
+		switch f.num {
+		case 1:
+			p.Body = f.string()
+		case 2:
+			p.Author = f.string()
+		case 3:
+			p.AuthorID = int(f.int64())
+		case 4:
+			p.Tags = append(p.Tags, f.string())
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	if p.AuthorID, err = authorIDFor(r, p.AuthorID); err != nil {
+		return err
+	}
+	s, err := postSetFor(r)
+	if err != nil {
+		return err
+	}
+	if p, err = s.createPost(p); err != nil {
+		return err
+	}
+	return stream.send(encodePost(p))
+}
+
+func grpcGetPost(r *http.Request, req []byte, stream *grpcStream) error {
+	var id string
+	var noCount bool
+	err := readProtobuf(req, func(f pbField) error {
+		switch f.num {
+		case 1:
+			id = f.string()
+		case 2:
+			noCount = f.bool()
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	pid, err := grpcPostID(id)
+	if err != nil {
+		return err
+	}
+
+	s := readPostSet(r)
+	p, err := s.getPost(pid)
+	if err == nil {
+		// Counted as for GET /posts/{id}; see views.go.
+		if noCount {
+			p.Views += s.views.pending(pid)
+		} else {
+			p.Views += s.views.add(pid)
+		}
+	}
+	postsMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return stream.send(encodePost(p))
+}
+
+func grpcListPosts(r *http.Request, req []byte, stream *grpcStream) error {
+	var limit, offset int32
+	var filter postFilter
+	var order string
+	err := readProtobuf(req, func(f pbField) error {
+		switch f.num {
+		case 1:
+			limit = f.int32()
+		case 2:
+			offset = f.int32()
+		case 3:
+			filter.author, filter.hasAuthor = f.string(), true
+		case 4:
+			filter.tags = append(filter.tags, strings.ToLower(strings.TrimSpace(f.string())))
+		case 5:
+			order = f.string()
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	switch {
+	case limit == 0:
+		limit = 20
+	case limit < 0 || limit > maxLimit:
+		return grpcErrorf(grpcInvalidArgument, "limit must be between 1 and %d", maxLimit)
+	}
+	if offset < 0 {
+		return grpcErrorf(grpcInvalidArgument, "offset must not be negative")
+	}
+
+	s := readPostSet(r)
+	var ps []Post
+	if len(filter.tags) > 0 {
+		ps = s.taggedPosts(filter.tags[0])
+	} else {
+		ps = s.store.List()
+	}
+	postsMu.RUnlock()
+
+	ps = filter.apply(listable(ps))
+	switch order {
+	case "", "id":
+		sortByID(ps)
+	case "created_at":
+		sortByCreated(ps)
+	case "views":
+		sortByViews(ps)
+	default:
+		return grpcErrorf(grpcInvalidArgument, "sort must be id, created_at or views")
+	}
+
+	var w pbWriter
+	for _, p := range paginate(ps, int(limit), int(offset)) {
+		w.message(1, encodePost(p))
+	}
+	w.varint(2, int64(len(ps)))
+	return stream.send(w.buf)
+}
+
+func grpcUpdatePost(r *http.Request, req []byte, stream *grpcStream) error {
+	if err := grpcMayWrite(r); err != nil {
+		return err
+	}
+	var id, etag string
+	var p Post
+	err := readProtobuf(req, func(f pbField) error {
+		switch f.num {
+		case 1:
+			id = f.string()
+		case 2:
+			p.Body = f.string()
+		case 3:
+			p.Author = f.string()
+		case 4:
+			p.Tags = append(p.Tags, f.string())
+		case 5:
+			etag = f.string()
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	pid, err := grpcPostID(id)
+	if err != nil {
+		return err
+	}
+
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err != nil {
+		return err
+	}
+	old, err := s.getPost(pid)
+	if err == nil {
+		err = s.checkOwner(r, pid)
+	}
+	if err != nil {
+		return err
+	}
+	if !ifMatch(etag, postETag(old)) {
+		return grpcErrorf(grpcFailedPrecondition, "post has changed since the ETag in if_match")
+	}
+	if p, err = s.updatePost(pid, p); err != nil {
+		return err
+	}
+	return stream.send(encodePost(p))
+}
+
+func grpcDeletePost(r *http.Request, req []byte, stream *grpcStream) error {
+	if err := grpcMayWrite(r); err != nil {
+		return err
+	}
+	var id, etag string
+	err := readProtobuf(req, func(f pbField) error {
+		switch f.num {
+		case 1:
+			id = f.string()
+		case 2:
+			etag = f.string()
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	pid, err := grpcPostID(id)
+	if err != nil {
+		return err
+	}
+
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err != nil {
+		return err
+	}
+	old, err := s.getPost(pid)
+	if err == nil {
+		err = s.checkOwner(r, pid)
+	}
+	if err != nil {
+		return err
+	}
+	if !ifMatch(etag, postETag(old)) {
+		return grpcErrorf(grpcFailedPrecondition, "post has changed since the ETag in if_match")
+	}
+	if err := s.deletePost(pid); err != nil {
+		return err
+	}
+	return stream.send(nil)
+}
+
+// grpcWatch streams the events of GET /events as PostEvent messages
+// until the client goes. It takes a place under -max-subscribers like
+// any other stream.
+func grpcWatch(r *http.Request, req []byte, stream *grpcStream) error {
+	if !broker.join() {
+		return grpcErrorf(grpcUnavailable, "too many open streams, retry in %ss", subscribersRetryAfter)
+	}
+	defer broker.leave()
+
+	ch := broker.subscribe(tenantOf(r))
+	defer broker.unsubscribe(ch)
+
+	// A stream lasts as long as the client wants, whatever
+	// -write-timeout says.
+	stream.rc.SetWriteDeadline(time.Time{})
+	if err := stream.sendHeader(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return grpcErrorf(grpcUnavailable, "server shutting down")
+			}
+			var w pbWriter
+			w.varint(1, e.id)
+			w.string(2, e.Event)
+			w.string(3, string(e.ID))
+			w.string(4, e.Author)
+			w.string(5, e.Tenant)
+			if t, err := time.Parse(time.RFC3339Nano, e.Time); err == nil {
+				w.timestamp(6, t)
+			}
+			if err := stream.send(w.buf); err != nil {
+				return err
+			}
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
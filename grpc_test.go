@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcServer serves ts over TLS with HTTP/2, as gRPC needs, and
+// returns a client for it.
+func grpcServer(t *testing.T, ts *testServer) (*httptest.Server, *http.Client) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(ts.h)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, srv.Client()
+}
+
+// grpcResult is what a call got back.
+type grpcResult struct {
+	msgs    [][]byte
+	status  int
+	message string
+}
+
+// startGRPC makes a call of method with msg and returns the response
+// once its headers are in.
+func startGRPC(t *testing.T, client *http.Client, url, method string, msg []byte, header ...string) *http.Response {
+	t.Helper()
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	req, _ := http.NewRequest("POST", url+grpcServicePath+method, bytes.NewReader(append(frame, msg...)))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readGRPCFrame reads one response message, or returns false at the
+// end of the response.
+func readGRPCFrame(t *testing.T, body io.Reader) ([]byte, bool) {
+	t.Helper()
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err == io.EOF {
+		return nil, false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(body, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg, true
+}
+
+// callGRPC makes a call and reads the whole response.
+func callGRPC(t *testing.T, client *http.Client, url, method string, msg []byte, header ...string) grpcResult {
+	t.Helper()
+	resp := startGRPC(t, client, url, method, msg, header...)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: HTTP status %d", method, resp.StatusCode)
+	}
+	var res grpcResult
+	for {
+		msg, ok := readGRPCFrame(t, resp.Body)
+		if !ok {
+			break
+		}
+		res.msgs = append(res.msgs, msg)
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		t.Fatalf("%s: no grpc-status trailer", method)
+	}
+	res.status, _ = strconv.Atoi(status)
+	res.message = resp.Trailer.Get("Grpc-Message")
+	return res
+}
+
+// decodePostMessage reads the fields of a Post message that the tests
+// look at.
+func decodePostMessage(t *testing.T, b []byte) Post {
+	t.Helper()
+	var p Post
+	err := readProtobuf(b, func(f pbField) error {
+		switch f.num {
+		case 1:
+			p.ID = PostID(f.string())
+		case 2:
+			p.Body = f.string()
+		case 3:
+			p.Author = f.string()
+		case 5:
+			p.Tags = append(p.Tags, f.string())
+		case 7:
+			var sec, nsec int64
+			readProtobuf(f.b, func(f pbField) error {
+				if f.num == 1 {
+					sec = f.int64()
+				} else {
+					nsec = f.int64()
+				}
+				return nil
+			})
+			p.UpdatedAt = time.Unix(sec, nsec).UTC()
+		case 9:
+			p.Views = int(f.int64())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestGRPCPostService(t *testing.T) {
+	ts := newTestServer(t)
+	srv, client := grpcServer(t, ts)
+
+	var create pbWriter
+	create.string(1, "hello over gRPC")
+	create.string(2, "ann")
+	create.strings(4, []string{"Go", "rpc"})
+	res := callGRPC(t, client, srv.URL, "CreatePost", create.buf)
+	if res.status != grpcOK || len(res.msgs) != 1 {
+		t.Fatalf("CreatePost: status %d %q, %d messages", res.status, res.message, len(res.msgs))
+	}
+	created := decodePostMessage(t, res.msgs[0])
+	if created.ID != "1" || created.Body != "hello over gRPC" || created.Author != "ann" || len(created.Tags) != 2 || created.Tags[0] != "go" {
+		t.Fatalf("created %+v", created)
+	}
+	// The same post as over REST.
+	if p := decodeResponse[Post](t, ts.do("GET", "/posts/1?no_count=true", "")); p.Body != created.Body {
+		t.Errorf("GET /posts/1 = %+v", p)
+	}
+	ts.createPost(`{"body":"second","author":"bob"}`)
+
+	var get pbWriter
+	get.string(1, "1")
+	res = callGRPC(t, client, srv.URL, "GetPost", get.buf)
+	if res.status != grpcOK || decodePostMessage(t, res.msgs[0]).Views != 1 {
+		t.Errorf("GetPost: status %d %q", res.status, res.message)
+	}
+
+	var list pbWriter
+	list.string(3, "bob")
+	res = callGRPC(t, client, srv.URL, "ListPosts", list.buf)
+	var posts []Post
+	var total int64
+	readProtobuf(res.msgs[0], func(f pbField) error {
+		if f.num == 1 {
+			posts = append(posts, decodePostMessage(t, f.b))
+		} else if f.num == 2 {
+			total = f.int64()
+		}
+		return nil
+	})
+	if res.status != grpcOK || total != 1 || len(posts) != 1 || posts[0].Body != "second" {
+		t.Errorf("ListPosts by bob: status %d, total %d, %+v", res.status, total, posts)
+	}
+
+	var stale pbWriter
+	stale.string(1, "1")
+	stale.string(2, "changed")
+	stale.string(5, `"stale"`)
+	if res = callGRPC(t, client, srv.URL, "UpdatePost", stale.buf); res.status != grpcFailedPrecondition {
+		t.Errorf("UpdatePost with a stale if_match: status %d %q", res.status, res.message)
+	}
+	var update pbWriter
+	update.string(1, "1")
+	update.string(2, "changed")
+	update.string(5, postETag(created))
+	if res = callGRPC(t, client, srv.URL, "UpdatePost", update.buf); res.status != grpcOK || decodePostMessage(t, res.msgs[0]).Body != "changed" {
+		t.Errorf("UpdatePost: status %d %q", res.status, res.message)
+	}
+
+	var del pbWriter
+	del.string(1, "1")
+	if res = callGRPC(t, client, srv.URL, "DeletePost", del.buf); res.status != grpcOK || len(res.msgs) != 1 {
+		t.Errorf("DeletePost: status %d %q", res.status, res.message)
+	}
+	wantStatus(t, ts.do("GET", "/posts/1", ""), http.StatusNotFound)
+
+	var bad pbWriter
+	bad.string(1, "x")
+	var empty pbWriter
+	empty.string(1, " ")
+	for _, tt := range []struct {
+		method string
+		msg    []byte
+		want   int
+	}{
+		{"GetPost", get.buf, grpcNotFound},
+		{"GetPost", bad.buf, grpcInvalidArgument},
+		{"CreatePost", empty.buf, grpcInvalidArgument},
+		{"ListPosts", []byte{0xff}, grpcInvalidArgument},
+		{"Nothing", nil, grpcUnimplemented},
+	} {
+		if res := callGRPC(t, client, srv.URL, tt.method, tt.msg); res.status != tt.want || res.message == "" {
+			t.Errorf("%s %x: status %d %q, want %d", tt.method, tt.msg, res.status, res.message, tt.want)
+		}
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	ts := newTestServer(t)
+	srv, client := grpcServer(t, ts)
+
+	resp := startGRPC(t, client, srv.URL, "Watch", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Watch: HTTP status %d", resp.StatusCode)
+	}
+	waitForStreams(t, 1)
+
+	ts.createPost(`{"body":"watched","author":"ann"}`)
+	msg, ok := readGRPCFrame(t, resp.Body)
+	if !ok {
+		t.Fatalf("Watch ended: status %s", resp.Trailer.Get("Grpc-Status"))
+	}
+	got := make(map[int]string)
+	readProtobuf(msg, func(f pbField) error {
+		got[f.num] = f.string()
+		return nil
+	})
+	if got[2] != "post.created" || got[3] != "1" || got[4] != "ann" {
+		t.Errorf("event %q", got)
+	}
+
+	resp.Body.Close()
+	waitForStreams(t, 0)
+}
+
+func TestGRPCNeedsLoginToWrite(t *testing.T) {
+	withTestAuth(t, []string{"ann"})
+	ts := newTestServer(t)
+	srv, client := grpcServer(t, ts)
+
+	var create pbWriter
+	create.string(1, "hello")
+	if res := callGRPC(t, client, srv.URL, "CreatePost", create.buf); res.status != grpcUnauthenticated {
+		t.Errorf("CreatePost without a login: status %d %q", res.status, res.message)
+	}
+	res := callGRPC(t, client, srv.URL, "CreatePost", create.buf, "Authorization", "Bearer "+token("ann"))
+	if res.status != grpcOK {
+		t.Fatalf("CreatePost as ann: status %d %q", res.status, res.message)
+	}
+	// Reading needs no login.
+	if res := callGRPC(t, client, srv.URL, "ListPosts", nil); res.status != grpcOK {
+		t.Errorf("ListPosts without a login: status %d %q", res.status, res.message)
+	}
+}
+
+func TestGRPCOverPlaintext(t *testing.T) {
+	ts := newTestServer(t)
+	srv := httptest.NewServer(withH2C(ts.h))
+	t.Cleanup(srv.Close)
+
+	// HTTP/1.1 can't carry gRPC.
+	resp := startGRPC(t, srv.Client(), srv.URL, "ListPosts", nil)
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Errorf("over HTTP/1.1: HTTP status %d", resp.StatusCode)
+	}
+
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	ts.createPost(`{"body":"plain"}`)
+	if res := callGRPC(t, h2c, srv.URL, "ListPosts", nil); res.status != grpcOK || len(res.msgs) != 1 {
+		t.Errorf("ListPosts over h2c: status %d %q", res.status, res.message)
+	}
+	// Everything else still works on the same port.
+	wantStatus(t, ts.do("GET", "/posts", ""), http.StatusOK)
+}
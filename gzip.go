@@ -0,0 +1,304 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//--------------COMPRESSING RESPONSES================
+
+var (
+	compressResponsesOver = flag.Int("compress-responses-over", 1024, "gzip or deflate responses longer than this many bytes for clients that accept it (0 disables)")
+	gzipLevel             = flag.String("gzip-level", "DefaultCompression", "gzip level for compressed responses: 0 (none) to 9, BestSpeed (1), BestCompression (9) or DefaultCompression")
+)
+
+// withCompression compresses responses for clients that send
+// Accept-Encoding with gzip or deflate, preferring gzip. A response is
+// held back until it reaches -compress-responses-over bytes, and sent
+// as it is if it never does, since compressing a short body costs more
+// than it saves.
+//
+// Responses that wouldn't shrink are left alone: already compressed
+// types like images and archives, partial content, and anything a
+// handler encoded itself. So are event streams, where every event must
+// reach the client as soon as it's flushed. A compressed response's
+// ETag gets the encoding added, as in "abc-gzip", since its bytes
+// differ from the plain response's; see encodedETag.
+//
+// -gzip-level trades CPU for size: BestSpeed suits a server short of
+// CPU, BestCompression one short of bandwidth. It only applies to gzip;
+// deflate always uses its default level.
+func withCompression(next http.Handler) http.Handler {
+	// Checked at startup by checkGzipLevel.
+	level, _ := parseGzipLevel(*gzipLevel)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		// gRPC frames its messages itself; see grpc.go.
+		if encoding == "" || r.Method == "HEAD" || isGRPC(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, level: level, ifNoneMatch: r.Header.Get("If-None-Match")}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding
+// header, or "" if it allows neither.
+func acceptedEncoding(header string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+	if star, ok := q["*"]; ok {
+		for _, e := range []string{"gzip", "deflate"} {
+			if _, named := q[e]; !named {
+				q[e] = star
+			}
+		}
+	}
+
+	switch {
+	case q["gzip"] > 0 && q["gzip"] >= q["deflate"]:
+		return "gzip"
+	case q["deflate"] > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+// gzipLevels are the names -gzip-level takes besides 0 to 9.
+var gzipLevels = map[string]int{
+	"bestspeed":          gzip.BestSpeed,
+	"bestcompression":    gzip.BestCompression,
+	"defaultcompression": gzip.DefaultCompression,
+}
+
+// parseGzipLevel turns a -gzip-level value into a gzip level.
+func parseGzipLevel(s string) (int, error) {
+	if level, ok := gzipLevels[strings.ToLower(s)]; ok {
+		return level, nil
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil || level < gzip.NoCompression || level > gzip.BestCompression {
+		return 0, fmt.Errorf("-gzip-level %q isn't allowed (want 0 to 9, BestSpeed, BestCompression or DefaultCompression)", s)
+	}
+	return level, nil
+}
+
+func checkGzipLevel() error {
+	_, err := parseGzipLevel(*gzipLevel)
+	return err
+}
+
+// gzipWriters holds a pool of gzip writers for every level, since a
+// writer can't change level once made. It's filled in by init and
+// only read after, so needs no lock.
+var (
+	gzipWriters = make(map[int]*sync.Pool)
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(io.Discard) }}
+)
+
+func init() {
+	for level := gzip.DefaultCompression; level <= gzip.BestCompression; level++ {
+		gzipWriters[level] = &sync.Pool{New: func() interface{} {
+			zw, _ := gzip.NewWriterLevel(io.Discard, level)
+			return zw
+		}}
+	}
+}
+
+// compressor is what gzip.Writer and zlib.Writer have in common.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressWriter buffers the start of a response until it knows
+// whether to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	level    int // for gzip
+
+	code    int
+	buf     []byte
+	decided bool
+	zw      compressor // set once decided to compress
+	// ifNoneMatch is the request's, to tell which ETag a 304 is for.
+	ifNoneMatch string
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if code < 200 {
+		// Informational responses, like 103 Early Hints, go out
+		// as they come.
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.code == 0 {
+		cw.code = code
+	}
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.code == 0 {
+		cw.code = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) >= *compressResponsesOver {
+			if err := cw.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends what's been written so far, deciding whether to
+// compress if that's still open.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the real writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide sends the header, compressing the body if it may and
+// compressible is set, followed by whatever was buffered.
+func (cw *compressWriter) decide(compressible bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		// net/http would sniff the compressed bytes otherwise.
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if compressible && cw.compressible() {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.zw = gzipWriters[cw.level].Get().(*gzip.Writer)
+		} else {
+			cw.zw = zlibWriters.Get().(*zlib.Writer)
+		}
+		cw.zw.Reset(cw.ResponseWriter)
+	}
+	if etag := h.Get("ETag"); etag != "" {
+		// A 304 confirms the copy the client has, which is the
+		// compressed one if it sent that one's ETag.
+		if encoded := encodedETag(etag, cw.encoding); cw.zw != nil || (cw.code == http.StatusNotModified && listsETag(cw.ifNoneMatch, encoded)) {
+			h.Set("ETag", encoded)
+		}
+	}
+
+	if cw.code != 0 {
+		cw.ResponseWriter.WriteHeader(cw.code)
+	}
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	var err error
+	if cw.zw != nil {
+		_, err = cw.zw.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// listsETag reports whether an If-None-Match header lists exactly
+// etag, weak or strong.
+func listsETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether the response is worth compressing.
+func (cw *compressWriter) compressible() bool {
+	h := cw.Header()
+	if cw.code == http.StatusPartialContent || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(strings.ToLower(h.Get("Content-Type")), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	switch mediaType {
+	case "image/svg+xml":
+		return true
+	case "text/event-stream":
+		return false
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/", "font/woff"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/zip", "application/zstd",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed", "application/pdf":
+		return false
+	}
+	return true
+}
+
+// close finishes the response once the handler returns.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.code == 0 && len(cw.buf) == 0 {
+			// Nothing written, or the connection was hijacked.
+			return
+		}
+		// Never reached the threshold, so not worth it.
+		cw.decide(false)
+	}
+	if cw.zw == nil {
+		return
+	}
+	cw.zw.Close()
+	cw.zw.Reset(io.Discard)
+	if cw.encoding == "gzip" {
+		gzipWriters[cw.level].Put(cw.zw)
+	} else {
+		zlibWriters.Put(cw.zw)
+	}
+	cw.zw = nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseGzipLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		ok   bool
+	}{
+		{"DefaultCompression", gzip.DefaultCompression, true},
+		{"bestspeed", gzip.BestSpeed, true},
+		{"BestCompression", gzip.BestCompression, true},
+		{"0", gzip.NoCompression, true},
+		{"6", 6, true},
+		{"9", 9, true},
+		{"10", 0, false},
+		{"-1", 0, false},
+		{"fast", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseGzipLevel(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseGzipLevel(%q) = %d, %v; want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	body := `{"body":"` + strings.Repeat("all work and no play makes jack a dull boy ", 100) + `"}`
+
+	// gzipped returns the size of GET /posts/1 gzipped at level, and
+	// checks it unzips to the post.
+	gzipped := func(level string) int {
+		ts := newTestServer(t, "-gzip-level="+level)
+		ts.createPost(body)
+		rec := ts.do("GET", "/posts/1?no_count=1", "", "Accept-Encoding", "gzip")
+		wantStatus(t, rec, http.StatusOK)
+		if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("level %s: Content-Encoding %q", level, got)
+		}
+		size := rec.Body.Len()
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("level %s: %v", level, err)
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil || !strings.Contains(string(b), "dull boy") {
+			t.Fatalf("level %s: unzipped %d bytes, %v", level, len(b), err)
+		}
+		return size
+	}
+
+	stored := gzipped("0")
+	best := gzipped("BestCompression")
+	if stored < len(body) {
+		t.Errorf("level 0 gave %d bytes for a %d byte post, so it compressed", stored, len(body))
+	}
+	if best >= stored/10 {
+		t.Errorf("BestCompression gave %d bytes, level 0 %d", best, stored)
+	}
+}
+
+func TestEncodedETags(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"` + strings.Repeat("all work and no play makes jack a dull boy ", 100) + `"}`)
+
+	plain := ts.do("GET", "/posts/1?no_count=1", "").Header().Get("ETag")
+	for _, encoding := range []string{"gzip", "deflate"} {
+		for _, path := range []string{"/posts/1?no_count=1", "/posts"} {
+			identity := ts.do("GET", path, "").Header().Get("ETag")
+			rec := ts.do("GET", path, "", "Accept-Encoding", encoding)
+			etag := rec.Header().Get("ETag")
+			if rec.Header().Get("Content-Encoding") != encoding || etag != strings.TrimSuffix(identity, `"`)+"-"+encoding+`"` {
+				t.Errorf("%s %s: ETag %s, plain %s", encoding, path, etag, identity)
+			}
+
+			// Either ETag gets a 304 naming the copy the client has.
+			for _, have := range []string{etag, identity} {
+				rec := ts.do("GET", path, "", "Accept-Encoding", encoding, "If-None-Match", have)
+				if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != have {
+					t.Errorf("%s %s If-None-Match %s: %d with ETag %s", encoding, path, have, rec.Code, rec.Header().Get("ETag"))
+				}
+			}
+		}
+	}
+
+	// The compressed post's ETag is as good for a write as the plain one.
+	gzipped := ts.do("GET", "/posts/1?no_count=1", "", "Accept-Encoding", "gzip").Header().Get("ETag")
+	if gzipped == plain {
+		t.Fatalf("gzipped ETag %s is the plain one", gzipped)
+	}
+	wantStatus(t, ts.do("PATCH", "/posts/1", `{"body":"short"}`, "If-Match", gzipped), http.StatusOK)
+	wantStatus(t, ts.do("PATCH", "/posts/1", `{"body":"again"}`, "If-Match", gzipped), http.StatusPreconditionFailed)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+//--------------HEALTH CHECKS================
+
+// GET /healthz says whether the server is alive, for a liveness probe:
+// it fails only if requests can't get at the posts, which a restart
+// would fix. GET /readyz says whether it can do its job, for a
+// readiness probe or load balancer: it also checks every store and
+// search index, with -store=file that new journals can be created in
+// -data-dir, and with -warmup-paths that the warmup is done (see
+// warmup.go).
+//
+// Both answer 200 if every check passes and 503 otherwise, listing
+// each check:
+//
+//	{"status":"ok","checks":{"posts_lock":{"status":"ok"},...}}
+
+// lockCheckTimeout is how long the posts lock may stay taken before
+// the server counts as stuck.
+const lockCheckTimeout = 2 * time.Second
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Checks: map[string]healthCheck{}}
+	report.add("posts_lock", checkPostsLock())
+	report.write(w, r)
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Checks: map[string]healthCheck{}}
+	lockErr := checkPostsLock()
+	report.add("posts_lock", lockErr)
+	if lockErr == nil {
+		for name, err := range checkStores() {
+			report.add(name, err)
+		}
+		for name, err := range checkSearchIndexes() {
+			report.add(name, err)
+		}
+	}
+	if *storeKind == "file" {
+		report.add("data_dir", checkDataDir())
+	}
+	if *warmupPaths != "" {
+		report.add("warmup", checkWarmup())
+	}
+	report.write(w, r)
+}
+
+func (h *healthReport) add(name string, err error) {
+	if err != nil {
+		h.Checks[name] = healthCheck{Status: "fail", Error: err.Error()}
+		return
+	}
+	h.Checks[name] = healthCheck{Status: "ok"}
+}
+
+func (h *healthReport) write(w http.ResponseWriter, r *http.Request) {
+	h.Status = "ok"
+	code := http.StatusOK
+	for _, c := range h.Checks {
+		if c.Status != "ok" {
+			h.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	// Probes poll, and a cached answer is no answer.
+	w.Header().Set("Cache-Control", "no-store")
+	respond(w, r, code, h)
+}
+
+// checkPostsLock fails if postsMu can't be had within
+// lockCheckTimeout, such as after a deadlock.
+func checkPostsLock() error {
+	locked := make(chan struct{})
+	go func() {
+		postsMu.Lock()
+		close(locked)
+		postsMu.Unlock()
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-time.After(lockCheckTimeout):
+		return fmt.Errorf("posts lock not acquired within %s", lockCheckTimeout)
+	}
+}
+
+// checkStores checks every tenant's store, naming each check store
+// or store:<tenant>.
+func checkStores() map[string]error {
+	postsMu.RLock()
+	defer postsMu.RUnlock()
+
+	results := make(map[string]error)
+	for tenant, s := range tenants {
+		name := "store"
+		if tenant != "" {
+			name += ":" + tenant
+		}
+		results[name] = s.store.Check()
+	}
+	if len(results) == 0 {
+		results["store"] = nil
+	}
+	return results
+}
+
+// checkSearchIndexes fails for every tenant whose search index is
+// being rebuilt (see search.go), naming each check search_index or
+// search_index:<tenant>.
+func checkSearchIndexes() map[string]error {
+	postsMu.RLock()
+	defer postsMu.RUnlock()
+
+	results := make(map[string]error)
+	for tenant, s := range tenants {
+		name := "search_index"
+		if tenant != "" {
+			name += ":" + tenant
+		}
+		results[name] = nil
+		if !s.textIndex.ready() {
+			results[name] = errors.New("rebuilding: " + s.textIndex.progress())
+		}
+	}
+	return results
+}
+
+// checkDataDir makes sure a file can be created in -data-dir, as the
+// first post of a new tenant needs.
+func checkDataDir() error {
+	if err := os.MkdirAll(*dataDir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(*dataDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
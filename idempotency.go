@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//--------------IDEMPOTENCY KEYS================
+
+var idempotencyTTL = flag.Duration("idempotency-ttl", 24*time.Hour, "how long the response to a POST /posts with an Idempotency-Key is kept to replay (0 ignores the header)")
+
+// A client that may retry a POST /posts, not knowing whether the first
+// try got through, sends the same Idempotency-Key header with each
+// try. The first one creates the post and its response is kept for
+// -idempotency-ttl; the others get that response again, marked with
+// X-Idempotent-Replayed: true, instead of creating another post.
+//
+// Keys are the client's to choose, such as a UUID, and are only
+// compared with others from the same tenant and user. Reusing a key
+// for a different request is a 422, and retrying while the first try
+// is still running a 409. Responses that say to try again later (408,
+// 429 and 5xx) aren't kept, so a retry after one of those runs anew.
+
+// maxIdempotencyKey is the longest key accepted.
+const maxIdempotencyKey = 255
+
+// replayedHeaders are the response headers kept with a response.
+// Others, like X-Request-ID, belong to the request that made them.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+type idempotencyKey struct {
+	tenant, user, key string
+}
+
+// idempotentResponse is the response to the first request with a key,
+// once done is set.
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+
+	done   bool
+	code   int
+	header http.Header
+	body   []byte
+}
+
+var (
+	idempotentResponses = make(map[idempotencyKey]*idempotentResponse)
+	idempotencyMu       sync.Mutex
+)
+
+// withIdempotencyKey makes h safe to retry with an Idempotency-Key.
+func withIdempotencyKey(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || *idempotencyTTL <= 0 {
+			h(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeError(w, r, http.StatusBadRequest, "Idempotency-Key must be at most 255 printable ASCII characters")
+			return
+		}
+
+		// The body has to be read here, to tell a retry from a
+		// different request, and is handed on to h as it was.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "Error reading request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256([]byte(r.Method + " " + r.URL.RequestURI() + "\n" + r.Header.Get("Content-Type") + "\n" + string(body)))
+
+		k := idempotencyKey{tenantOf(r), userOf(r), key}
+		now := time.Now()
+		idempotencyMu.Lock()
+		if prev, ok := idempotentResponses[k]; ok && now.Before(prev.expires) {
+			samePayload, done, code, header, body := prev.fingerprint == fingerprint, prev.done, prev.code, prev.header, prev.body
+			idempotencyMu.Unlock()
+			switch {
+			case !samePayload:
+				writeError(w, r, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+			case !done:
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+			default:
+				for name, values := range header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("X-Idempotent-Replayed", "true")
+				w.WriteHeader(code)
+				w.Write(body)
+			}
+			return
+		}
+		entry := &idempotentResponse{fingerprint: fingerprint, expires: now.Add(*idempotencyTTL)}
+		idempotentResponses[k] = entry
+		idempotencyMu.Unlock()
+
+		rec := &recordingWriter{ResponseWriter: w}
+		finished := false
+		defer func() {
+			// A panic in h is a 500 too, so forget the key rather
+			// than answer 409 to every retry.
+			if !finished {
+				idempotencyMu.Lock()
+				delete(idempotentResponses, k)
+				idempotencyMu.Unlock()
+			}
+		}()
+		h(rec, r)
+		finished = true
+
+		idempotencyMu.Lock()
+		defer idempotencyMu.Unlock()
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		if rec.code == http.StatusRequestTimeout || rec.code == http.StatusTooManyRequests || rec.code >= 500 {
+			delete(idempotentResponses, k)
+			return
+		}
+		entry.done, entry.code, entry.body = true, rec.code, rec.body.Bytes()
+		entry.header = make(http.Header)
+		for _, name := range replayedHeaders {
+			if v := rec.Header().Values(name); len(v) > 0 {
+				entry.header[name] = v
+			}
+		}
+	}
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKey {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// recordingWriter keeps a copy of the response it passes on.
+type recordingWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	if rw.code == 0 && code >= 200 {
+		rw.code = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.code == 0 {
+		rw.code = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the real writer.
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// forgetIdempotencyKeys drops expired responses, checking once per
+// interval.
+func forgetIdempotencyKeys(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		idempotencyMu.Lock()
+		for k, resp := range idempotentResponses {
+			if !now.Before(resp.expires) {
+				delete(idempotentResponses, k)
+			}
+		}
+		idempotencyMu.Unlock()
+	}
+}
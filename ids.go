@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--------------POST IDS================
+
+var idStrategy = flag.String("id-strategy", "int", "how new posts are identified: int for 1, 2, 3..., uuid for random UUIDv4s or ulid for ULIDs, which sort by creation time")
+
+// Sequential IDs tell anyone who can see two posts how many were made
+// in between, and two servers hand out the same ones, so their posts
+// can't be merged. With -id-strategy=uuid or ulid new posts get
+// random string IDs instead, and are served as such in URLs and JSON:
+//
+//	{"id": "01J9ZQ3V1XK4M7Y0T2W8BQ5F6N", ...}
+//
+// Integer IDs are still kept as strings inside, like the others, but
+// appear as numbers in JSON, so nothing changes for clients of a
+// server left at -id-strategy=int. Posts keep the ID they were given,
+// so a server switched to another strategy goes on serving its old
+// posts under their old IDs.
+//
+// Ordering by ID compares integer IDs as numbers, with any of them
+// before any string ID, and string IDs as text. ULIDs start with the
+// time they were made, so they sort like integer IDs do, oldest
+// first; UUIDs sort in no useful order, so ?order=created_at is the
+// way to page through those in order. -reuse-ids only applies to
+// integer IDs.
+
+// PostID identifies a post: the decimal digits of an integer ID, a
+// lower-case UUID or an upper-case ULID. The zero value is no post.
+type PostID string
+
+// intID makes the PostID of an integer ID, or "" of 0.
+func intID(n int) PostID {
+	if n == 0 {
+		return ""
+	}
+	return PostID(strconv.Itoa(n))
+}
+
+// asInt returns an integer ID as a number.
+func (id PostID) asInt() (int, bool) {
+	if !isIntID(string(id)) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(id))
+	return n, err == nil
+}
+
+// less orders post IDs as described above, with no ID before any.
+func (id PostID) less(other PostID) bool {
+	a, b := isIntID(string(id)), isIntID(string(other))
+	switch {
+	case id == "" || other == "":
+		return other != ""
+	case a && b && len(id) != len(other):
+		return len(id) < len(other)
+	case a != b:
+		return a
+	}
+	return id < other
+}
+
+func (id PostID) MarshalJSON() ([]byte, error) {
+	if isIntID(string(id)) {
+		return []byte(id), nil
+	}
+	return json.Marshal(string(id))
+}
+
+// UnmarshalJSON takes an integer ID as a number or a string, so
+// clients written for either kind work with both.
+func (id *PostID) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	var s string
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	} else {
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		s = n.String()
+	}
+	if s == "" || s == "0" {
+		*id = ""
+		return nil
+	}
+	parsed, ok := parsePostID(s)
+	if !ok {
+		return fmt.Errorf("%q is not a post ID", s)
+	}
+	*id = parsed
+	return nil
+}
+
+// parsePostID reads a post ID from a URL or request body, whatever
+// the -id-strategy, as old posts keep the IDs of an earlier one.
+func parsePostID(s string) (PostID, bool) {
+	switch {
+	case allDigits(s):
+		// Leading zeros are allowed, as they always have been.
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return "", false
+		}
+		return intID(n), true
+	case isUUID(s):
+		return PostID(strings.ToLower(s)), true
+	case isULID(s):
+		return PostID(strings.ToUpper(s)), true
+	}
+	return "", false
+}
+
+// isIntID reports whether s is a positive integer without leading
+// zeros, short enough to be an int.
+func isIntID(s string) bool {
+	if s == "" || len(s) > 18 || s[0] == '0' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if s[i] != '-' {
+				return false
+			}
+		case !isHexDigit(s[i]):
+			return false
+		}
+	}
+	return true
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// crockford is the base32 alphabet of ULIDs, without I, L, O and U.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func isULID(s string) bool {
+	if len(s) != 26 || s[0] > '7' {
+		// The first character only holds 3 of the 128 bits.
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !strings.ContainsRune(crockford, rune(s[i]&^0x20)) && !(s[i] >= '0' && s[i] <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func checkIDStrategy() error {
+	switch *idStrategy {
+	case "int", "uuid", "ulid":
+	default:
+		return fmt.Errorf("unknown -id-strategy %q (want int, uuid or ulid)", *idStrategy)
+	}
+	if *reuseIDs && *idStrategy != "int" {
+		return errors.New("-reuse-ids needs -id-strategy=int")
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() PostID {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return PostID(h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:])
+}
+
+// lastULID is the ULID made last, so that another made in the same
+// millisecond can follow it. Guarded by postsMu, which every caller
+// of newULID holds.
+var lastULID [16]byte
+
+// newULID returns a ULID: the time in milliseconds in the first 48
+// bits and random bits after. Within one millisecond the random part
+// counts up instead, so IDs made one after another still sort in
+// order.
+func newULID(now time.Time) PostID {
+	var b [16]byte
+	ms := uint64(now.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	if bytes.Equal(b[:6], lastULID[:6]) {
+		copy(b[6:], lastULID[6:])
+		for i := 15; i >= 6; i-- {
+			b[i]++
+			if b[i] != 0 {
+				break
+			}
+		}
+	} else {
+		rand.Read(b[6:])
+	}
+	lastULID = b
+
+	// 128 bits in 26 characters of 5 bits, the first holding 3.
+	var out [26]byte
+	var acc uint64
+	bits := 0
+	j := 0
+	for i := 0; i < 26; i++ {
+		need := 5
+		if i == 0 {
+			need = 3
+		}
+		for bits < need {
+			acc = acc<<8 | uint64(b[j])
+			j++
+			bits += 8
+		}
+		bits -= need
+		out[i] = crockford[(acc>>uint(bits))&(1<<uint(need)-1)]
+	}
+	return PostID(out[:])
+}
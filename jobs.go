@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------ASYNC JOBS================
+
+var jobTTL = flag.Duration("job-ttl", time.Hour, "how long GET /jobs/{id} keeps the result of a finished job (0 keeps them until restart)")
+
+// A request that could take longer than a client or proxy will wait,
+// like POST /posts/import with a large file, may send
+//
+//	Prefer: respond-async
+//
+// to have it run in the background instead. The request is read in
+// full, then answered with 202 Accepted, a Location of /jobs/{id} and
+// the job so far:
+//
+//	{"id":"4f1c...","op":"import","status":"running","created_at":"..."}
+//
+// GET /jobs/{id} then answers the same, until the status is done and
+// result holds what the request would have returned, or failed with
+// error saying why. Finished jobs are kept for -job-ttl. Jobs live in
+// memory only, so a restart loses them, and can only be seen from the
+// tenant, and with auth on by the user, that started them.
+//
+// Without the header, or for requests that don't support it, the
+// request runs as usual.
+
+// Job statuses.
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+type job struct {
+	ID         string      `json:"id"`
+	Op         string      `json:"op"`
+	Status     string      `json:"status"`
+	CreatedAt  time.Time   `json:"created_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+
+	tenant, user string
+}
+
+var (
+	jobs   = make(map[string]*job)
+	jobsMu sync.Mutex
+)
+
+// prefersAsync reports whether r asks to be answered before it's run.
+func prefersAsync(r *http.Request) bool {
+	return headerHasToken(r.Header, "Prefer", "respond-async")
+}
+
+// startJob runs fn in the background as the op of a new job, and
+// answers r with 202 and the job. fn gets a copy of r that outlives
+// the request, so its body must have been read already. It returns
+// the job's result, or an error to fail it with.
+func startJob(w http.ResponseWriter, r *http.Request, op string, fn func(r *http.Request) (interface{}, error)) {
+	j := &job{
+		ID:        newRequestID(),
+		Op:        op,
+		Status:    jobRunning,
+		CreatedAt: time.Now().UTC(),
+		tenant:    tenantOf(r),
+		user:      userOf(r),
+	}
+	jobsMu.Lock()
+	jobs[j.ID] = j
+	snapshot := *j
+	jobsMu.Unlock()
+
+	bg := r.WithContext(context.WithoutCancel(r.Context()))
+	go func() {
+		result, err := fn(bg)
+
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+		now := time.Now().UTC()
+		j.FinishedAt = &now
+		if err != nil {
+			j.Status, j.Error = jobFailed, err.Error()
+			return
+		}
+		j.Status, j.Result = jobDone, result
+	}()
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	w.Header().Set("Preference-Applied", "respond-async")
+	respond(w, r, http.StatusAccepted, snapshot)
+}
+
+// handleGetJob is GET /jobs/{id}.
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+
+	jobsMu.Lock()
+	j, ok := jobs[id]
+	var snapshot job
+	if ok {
+		snapshot = *j
+	}
+	jobsMu.Unlock()
+
+	// Someone else's job is as good as no job.
+	if !ok || j.tenant != tenantOf(r) || (authEnabled() && j.user != userOf(r)) {
+		writeError(w, r, http.StatusNotFound, "Job not found")
+		return
+	}
+	respond(w, r, http.StatusOK, snapshot)
+}
+
+// expireJobs calls dropExpiredJobs once per interval.
+func expireJobs(interval time.Duration) {
+	for range time.Tick(interval) {
+		dropExpiredJobs(time.Now())
+	}
+}
+
+// dropExpiredJobs drops the jobs that had finished -job-ttl before now.
+func dropExpiredJobs(now time.Time) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for id, j := range jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) >= *jobTTL {
+			delete(jobs, id)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitForJob polls GET /jobs/{id} until the job has finished.
+func (ts *testServer) waitForJob(id string, header ...string) job {
+	ts.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		rec := ts.do("GET", "/jobs/"+id, "", header...)
+		wantStatus(ts.t, rec, http.StatusOK)
+		if j := decodeResponse[job](ts.t, rec); j.Status != jobRunning {
+			return j
+		}
+	}
+	ts.t.Fatalf("job %s still running", id)
+	return job{}
+}
+
+func TestAsyncImport(t *testing.T) {
+	ts := newTestServer(t)
+	csv := "body,author\nhello,ann\n,bob\nworld,cy\n"
+
+	rec := ts.do("POST", "/posts/import", csv, "Content-Type", "text/csv", "Prefer", "respond-async")
+	wantStatus(t, rec, http.StatusAccepted)
+	j := decodeResponse[job](t, rec)
+	if rec.Header().Get("Location") != "/jobs/"+j.ID || j.Op != "import" {
+		t.Fatalf("Location %q, job %+v", rec.Header().Get("Location"), j)
+	}
+
+	j = ts.waitForJob(j.ID)
+	result, _ := j.Result.(map[string]interface{})
+	if j.Status != jobDone || result["imported"] != 2.0 || result["failed"] != 1.0 || j.FinishedAt == nil {
+		t.Errorf("finished job %+v", j)
+	}
+	if list := decodeResponse[[]Post](t, ts.do("GET", "/posts", "")); len(list) != 2 {
+		t.Errorf("%d posts imported, want 2", len(list))
+	}
+
+	// A file that can't be read at all fails the job.
+	rec = ts.do("POST", "/posts/import", "author\nann\n", "Content-Type", "text/csv", "Prefer", "respond-async")
+	wantStatus(t, rec, http.StatusAccepted)
+	if j := ts.waitForJob(decodeResponse[job](t, rec).ID); j.Status != jobFailed || j.Error == "" {
+		t.Errorf("job for a file without a body column %+v", j)
+	}
+
+	// Without the header the import runs there and then.
+	rec = ts.do("POST", "/posts/import", csv, "Content-Type", "text/csv")
+	wantStatus(t, rec, http.StatusOK)
+}
+
+func TestJobsAreTheirStarters(t *testing.T) {
+	withTestAuth(t, []string{"ann", "bob"})
+	ts := newTestServer(t, "-multi-tenant=true")
+	rec := ts.as("ann", "POST", "/posts/import", `{"body":"hi"}`, "Content-Type", "application/x-ndjson", "Prefer", "respond-async", "X-Tenant-ID", "a")
+	wantStatus(t, rec, http.StatusAccepted)
+	id := decodeResponse[job](t, rec).ID
+
+	ts.waitForJob(id, "Authorization", "Bearer "+token("ann"), "X-Tenant-ID", "a")
+	wantStatus(t, ts.as("ann", "GET", "/jobs/"+id, "", "X-Tenant-ID", "b"), http.StatusNotFound)
+	wantStatus(t, ts.as("bob", "GET", "/jobs/"+id, "", "X-Tenant-ID", "a"), http.StatusNotFound)
+	wantStatus(t, ts.as("ann", "GET", "/jobs/nope", "", "X-Tenant-ID", "a"), http.StatusNotFound)
+}
+
+func TestFinishedJobsExpire(t *testing.T) {
+	ts := newTestServer(t, "-job-ttl=1h")
+	rec := ts.do("POST", "/posts/import", `{"body":"hi"}`, "Content-Type", "application/x-ndjson", "Prefer", "respond-async")
+	id := decodeResponse[job](t, rec).ID
+	finished := *ts.waitForJob(id).FinishedAt
+
+	dropExpiredJobs(finished.Add(59 * time.Minute))
+	wantStatus(t, ts.do("GET", "/jobs/"+id, ""), http.StatusOK)
+	dropExpiredJobs(finished.Add(time.Hour))
+	wantStatus(t, ts.do("GET", "/jobs/"+id, ""), http.StatusNotFound)
+}
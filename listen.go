@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//--------------LISTENING================
+
+// Socket tuning for bursts of new connections and for handing the
+// port over to a new process without downtime. These are only
+// supported on Linux (see sockopt_linux.go); elsewhere the server
+// refuses to start if they're changed from their defaults.
+//
+// Caveats:
+//   - The kernel silently caps -listen-backlog at net.core.somaxconn,
+//     so raise that too for big backlogs.
+//   - Go already turns SO_REUSEADDR on for listeners, so -reuse-addr
+//     is only useful to turn it off.
+//   - With -reuse-port, every process listening on the port gets a
+//     share of new connections, including old ones that haven't
+//     exited yet. All of them must be run by the same user.
+//   - The reuse options apply to TCP only; the backlog applies to the
+//     Unix socket too.
+var (
+	listenBacklog = flag.Int("listen-backlog", 0, "length of the queue of pending connections (0 uses the system default; Linux only)")
+	reuseAddr     = flag.Bool("reuse-addr", true, "set SO_REUSEADDR on the TCP listener (Linux only)")
+	reusePort     = flag.Bool("reuse-port", false, "set SO_REUSEPORT on the TCP listener, so several servers can share the port (Linux only)")
+)
+
+// listen opens the server's listener: the Unix socket at SOCKET_PATH
+// when that's set, otherwise TCP on addr.
+func listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: controlSocket}
+
+	if socketPath == "" {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := setBacklog(ln); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		scheme := "http"
+		if tlsEnabled() {
+			scheme = "https"
+		}
+		slog.Info("server is running", "url", scheme+"://localhost"+addr)
+		return ln, nil
+	}
+
+	// A socket file left behind by a server that didn't shut down
+	// cleanly would make Listen fail, so remove it first. Anything
+	// that isn't a socket is left alone.
+	if fi, err := os.Lstat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(socketPath + " exists and is not a socket")
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := lc.Listen(context.Background(), "unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := setBacklog(ln); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	slog.Info("server is running", "socket", socketPath)
+	return ln, nil
+}
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for requests in flight to finish when shutting down")
+
+// shutdownOnSignal shuts the servers down on SIGINT or SIGTERM: they
+// stop accepting connections, then wait up to -shutdown-timeout for
+// the requests in flight before cutting off whatever is left. A second
+// signal cuts them off straight away. Closing a Unix listener removes
+// its socket file. Nil servers are skipped.
+func shutdownOnSignal(srvs ...*http.Server) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	slog.Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for _, srv := range srvs {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("closing remaining connections", "err", err)
+			srv.Close()
+		}
+	}
+}
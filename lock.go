@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+)
+
+//--------------LOCKING POSTS================
+
+// A locked post can still be read, but updating or deleting it fails
+// with 423 Locked until it's unlocked again.
+
+func handleLockPost(w http.ResponseWriter, r *http.Request, id PostID) {
+	setLocked(w, r, id, true)
+}
+
+func handleUnlockPost(w http.ResponseWriter, r *http.Request, id PostID) {
+	setLocked(w, r, id, false)
+}
+
+func setLocked(w http.ResponseWriter, r *http.Request, id PostID, locked bool) {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	p, err := s.getPost(id)
+	if err == nil {
+		err = s.checkOwner(r, id)
+	}
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+
+	p.Locked = locked
+	if err := s.store.Update(p); err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	s.version++
+	if locked {
+		s.emitEvent("post.locked", p)
+	} else {
+		s.emitEvent("post.unlocked", p)
+	}
+
+	respond(w, r, http.StatusOK, p)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+//--------------LOGGING================
+
+// Everything the server logs goes through slog to stderr, as text or
+// as one JSON object per line with -log-format=json. Messages below
+// -log-level are dropped. Events from -emit-events stay on stdout,
+// apart from the logs.
+//
+// With -log-requests, which is on by default, every request is logged
+// once it's served:
+//
+//	level=INFO msg=request method=GET path=/posts/1 status=200 duration=1.2ms bytes=154 remote_ip=10.0.0.7 request_id=4f1c...
+//
+// Server errors are logged at ERROR, the rest at INFO. The remote IP is
+// the client's, found as for the rate limits.
+
+var (
+	logFormat   = flag.String("log-format", "text", "text or json")
+	logRequests = flag.Bool("log-requests", true, "log every request served")
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// currentLogLevel is the level of the default logger, which a reload (see
+// reload.go) can change while it's in use.
+var currentLogLevel slog.LevelVar
+
+// parseLogLevel turns a -log-level value into a slog level.
+func parseLogLevel(s string) (slog.Level, error) {
+	level, ok := logLevels[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown -log-level %q (want debug, info, warn or error)", s)
+	}
+	return level, nil
+}
+
+// setupLogging makes the logger -log-format and -log-level ask for
+// the default, which also sends whatever goes through the log package
+// to it.
+func setupLogging() error {
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	currentLogLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: &currentLogLevel}
+
+	var h slog.Handler
+	switch *logFormat {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown -log-format %q (want text or json)", *logFormat)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// serverErrorLog is for http.Server.ErrorLog, so errors net/http logs
+// itself, like failed TLS handshakes, are structured too.
+func serverErrorLog() *log.Logger {
+	return slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+}
+
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		level := slog.LevelInfo
+		if sw.status() >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status(),
+			"duration", time.Since(start),
+			"bytes", sw.bytes,
+			"remote_ip", clientIP(r),
+			"request_id", requestIDOf(r),
+		)
+	})
+}
@@ -1,116 +1,699 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 //--------------INITIAL SETUP================
 
 // 1. add Post struct
+//
+// The xml tags are only for reading request bodies; see formats.go.
 type Post struct {
-	ID   int    `json:"id"`
-	Body string `json:"body"`
+	ID        PostID    `json:"id" xml:"id"`
+	Body      string    `json:"body" xml:"body"`
+	Author    string    `json:"author,omitempty" xml:"author"`
+	AuthorID  int       `json:"author_id,omitempty" xml:"author_id"`
+	Tags      []string  `json:"tags,omitempty" xml:"tags>item"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+	Locked    bool      `json:"locked" xml:"locked"`
+	Reserved  bool      `json:"reserved,omitempty" xml:"reserved"`
+	Views     int       `json:"views" xml:"views"`
+
+	// DeletedAt is set on posts in the trash; see trash.go.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at"`
+
+	// packed holds the gzip-compressed body of a stored post when
+	// compressed is set, in which case Body is empty. See compress.go.
+	packed     []byte
+	compressed bool
 }
 
 // 2. add global variables
 var (
-	posts   = make(map[int]Post)
-	nextID  = 1
-	postsMu sync.Mutex
+	// postsMu guards every tenant's posts; see tenant.go for where
+	// the posts themselves live. Handlers that only read take the
+	// read lock, through readPostSet, so they don't wait on each
+	// other, only on writes.
+	postsMu sync.RWMutex
+
+	// defaultAuthor is applied to new posts that don't name an
+	// author. Precedence: an author sent in the request body always
+	// wins, then DEFAULT_AUTHOR, otherwise the post has no author.
+	defaultAuthor = os.Getenv("DEFAULT_AUTHOR")
+
+	// socketPath, when set, makes the server listen on a Unix socket
+	// instead of TCP, for sidecars on the same host.
+	socketPath = os.Getenv("SOCKET_PATH")
+)
+
+// command line flags
+var (
+	addr              = flag.String("addr", ":8081", "TCP address to listen on, when SOCKET_PATH isn't set")
+	readTimeout       = flag.Duration("read-timeout", 0, "how long reading a whole request may take (0 means no limit)")
+	writeTimeout      = flag.Duration("write-timeout", 0, "how long writing a response may take (0 means no limit)")
+	idleTimeout       = flag.Duration("idle-timeout", 0, "how long an idle keep-alive connection is kept open (0 uses -read-timeout)")
+	logLevel          = flag.String("log-level", "info", "debug, info, warn or error; debug also logs every list served")
+	disableKeepAlives = flag.Bool("disable-keepalives", false, "close the connection after every response")
+	shortListLock     = flag.Bool("short-list-lock", false, "only hold the posts lock while GET /posts copies the posts, not while it filters and encodes them")
 )
 
 //--------------IMPLEMENTING SERVER================
 
-// 3. add HandleFuncs and start server listening at localhost.
+// 3. add Handles and start server listening at localhost.
 func main() {
+	flag.Parse()
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkTLSFlags(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkGzipLevel(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkIDStrategy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkIndexFlags(); err != nil {
+		log.Fatal(err)
+	}
+
+	// With -store=file this loads the posts saved by earlier runs.
+	if err := loadStores(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadUsers(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadUI(); err != nil {
+		log.Fatal(err)
+	}
 
-	http.HandleFunc("/posts", postsHandler)
-	http.HandleFunc("/posts/", postHandler)
+	handler := newHandler()
+	if !tlsEnabled() {
+		handler = withH2C(handler)
+	}
+	go reloadOnSignal()
+	if *warmupPaths != "" {
+		warmupDone.Store(false)
+		go warmUp(routes())
+	}
 
-	fmt.Println("Server is running at the http://localhost:8081")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	if *goneRetention > 0 {
+		go pruneTombstones(time.Minute)
+	}
+	if *viewsFlushInterval > 0 {
+		go flushViewsEvery(*viewsFlushInterval)
+	}
+	go expireReservations(time.Minute)
+	if *trashRetention > 0 {
+		go purgeExpiredTrash(time.Minute)
+	}
+	if *idempotencyTTL > 0 {
+		go forgetIdempotencyKeys(time.Minute)
+	}
+	if *jobTTL > 0 {
+		go expireJobs(time.Minute)
+	}
+	go forgetIdleBuckets(10 * time.Minute)
+	if *dailyBandwidth > 0 {
+		go resetBandwidthDaily()
+	}
+
+	srv := &http.Server{
+		Addr:         *addr,
+		Handler:      handler,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+		ErrorLog:     serverErrorLog(),
+	}
+	var certs *autocert.Manager
+	if tlsEnabled() {
+		// checkTLSFlags has made sure this works.
+		srv.TLSConfig, _ = tlsConfig()
+		if acmeEnabled() {
+			certs = newCertManager(srv.TLSConfig)
+		}
+	}
+
+	// Event streams never finish on their own, so end them when
+	// shutting down instead of waiting out -shutdown-timeout.
+	srv.RegisterOnShutdown(broker.closeAll)
+
+	// Keep-alives are on by default. Turning them off is occasionally
+	// needed for load testing or to work around buggy proxies.
+	srv.SetKeepAlivesEnabled(!*disableKeepAlives)
+
+	ln, err := listen(srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	redirect := startRedirectServer(certs)
+	stopped := make(chan struct{})
+	go func() {
+		shutdownOnSignal(srv, redirect)
+		close(stopped)
+	}()
+
+	if err := serve(srv, ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	// Serve returns as soon as shutdown starts, so wait for the
+	// requests in flight before saving the last of the posts.
+	<-stopped
+	if err := closeStores(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newHandler builds the server's handler: the routes below, behind the
+// middleware every request goes through.
+func newHandler() http.Handler {
+	// Every request goes through these, top to bottom, before it
+	// reaches the routes.
+	return chain(routes(),
+		withRequestID,
+		withMetrics,
+		when(*logRequests, withRequestLog),
+		when(*dailyBandwidth > 0, withBandwidthCap(*dailyBandwidth)),
+		when(*compressResponsesOver > 0, withCompression),
+		withServiceStatus,
+		withRateLimit,
+		withPathGuard,
+		withRequestDeadline,
+		withAuth,
+		when(*noIndex, withNoIndex),
+	)
 }
 
-//--------------HANDLING REQUESTS================
+// routes maps every path the server answers to its handlers.
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/posts", tenanted(methods{
+		"GET":    negotiated(withResponseCache("/posts", handleGetPosts)),
+		"POST":   withIdempotencyKey(handlePostPosts),
+		"DELETE": handleDeletePosts,
+	}))
+	mux.Handle("/events", tenanted(methods{
+		"GET": handleEvents,
+	}))
+	mux.Handle("/ws", tenanted(methods{
+		"GET": handleWS,
+	}))
+	mux.Handle("/tags", tenanted(methods{
+		"GET": negotiated(handleGetTags),
+	}))
+	mux.Handle("/posts/search", tenanted(methods{
+		"GET": negotiated(handleSearchPosts),
+	}))
+	mux.Handle("/posts/feed.xml", tenanted(methods{
+		"GET": handleFeed,
+	}))
+	mux.Handle("/posts/stats/size", tenanted(methods{
+		"GET": handleSizeStats,
+	}))
+	mux.Handle("/posts/wordcount", tenanted(methods{
+		"GET": handleWordCount,
+	}))
+	mux.Handle("/posts/diff", tenanted(methods{
+		"GET": handleDiffPosts,
+	}))
+	mux.Handle("/posts/reserve", tenanted(methods{
+		"POST": handleReservePost,
+	}))
+	mux.Handle("/posts/batch", tenanted(methods{
+		"POST": memoryGuarded(handleBatchCreate),
+	}))
+	mux.Handle("/posts/export", tenanted(methods{
+		"GET": handleExportPosts,
+	}))
+	mux.Handle("/posts/import", tenanted(methods{
+		"POST": memoryGuarded(handleImportPosts),
+	}))
+	mux.Handle("/posts/bulk", tenanted(methods{
+		"POST": memoryGuarded(handleBulkPosts),
+	}))
+	mux.Handle("/posts/trash", tenanted(methods{
+		"GET":    negotiated(handleGetTrash),
+		"DELETE": handleEmptyTrash,
+	}))
+	mux.Handle("/posts/trash/", tenanted(methods{
+		"DELETE": withTrashID(handlePurgePost),
+	}))
+	mux.Handle("/posts/", tenanted(subroutes{
+		"": methods{
+			"GET":    negotiated(withResponseCache("/posts/{id}", withID(handleGetPost))),
+			"PUT":    withID(handlePutPost),
+			"PATCH":  withID(handlePatchPost),
+			"DELETE": withID(handleDeletePost),
+		},
+		"lock": methods{
+			"POST": withID(handleLockPost),
+		},
+		"unlock": methods{
+			"POST": withID(handleUnlockPost),
+		},
+		"restore": methods{
+			"POST": withID(handleRestorePost),
+		},
+		"html": methods{
+			"GET": withID(handleGetPostHTML),
+		},
+		"revisions": methods{
+			"GET": negotiated(withID(handleGetRevisions)),
+		},
+		"revisions/*/revert": methods{
+			"POST": withRevision(handleRevertPost),
+		},
+		"comments": methods{
+			"GET":  negotiated(withID(handleGetComments)),
+			"POST": withID(handlePostComment),
+		},
+		"comments/*": methods{
+			"DELETE": withCommentID(handleDeleteComment),
+		},
+	}))
+	mux.Handle("/graphql", tenanted(methods{
+		"GET":  handleGraphQL,
+		"POST": handleGraphQL,
+	}))
+	mux.Handle("/batch", tenanted(methods{
+		"POST": memoryGuarded(handleBatch),
+	}))
+	mux.Handle("/jobs/", tenanted(methods{
+		"GET": negotiated(handleGetJob),
+	}))
+	mux.Handle(grpcServicePath, tenanted(methods{
+		"POST": handleGRPC,
+	}))
+	mux.Handle("/users", methods{
+		"GET":  negotiated(handleGetUsers),
+		"POST": handlePostUsers,
+	})
+	mux.Handle("/users/", userRoutes{
+		user: methods{
+			"GET":    negotiated(withUserID(handleGetUser)),
+			"PUT":    withUserID(selfOrAdmin(handlePutUser)),
+			"DELETE": withUserID(selfOrAdmin(handleDeleteUser)),
+		},
+		posts: tenanted(methods{
+			"GET": negotiated(withUserID(handleGetUserPosts)),
+		}),
+	})
+	mux.Handle("/healthz", methods{
+		"GET": handleHealthz,
+	})
+	mux.Handle("/readyz", methods{
+		"GET": handleReadyz,
+	})
+	mux.Handle("/metrics", methods{
+		"GET": handleMetrics,
+	})
+	mux.Handle("/openapi.json", methods{
+		"GET": handleOpenAPI,
+	})
+	mux.Handle("/docs", methods{
+		"GET": handleDocs,
+	})
+	// / is the web UI, and answers 404 for paths no other route
+	// takes.
+	mux.HandleFunc("/", handleRoot)
+	mux.Handle("/ui/", methods{
+		"GET": handleUIAsset,
+	})
+	mux.Handle("/capabilities", methods{
+		"GET": handleCapabilities,
+	})
+	if authEnabled() {
+		mux.Handle("/auth/login", methods{
+			"POST": handleLogin,
+		})
+	}
+	mux.Handle("/admin/status", methods{
+		"GET":    handleGetStatus,
+		"PUT":    withAdmin(handlePutStatus),
+		"DELETE": withAdmin(handleDeleteStatus),
+	})
+	mux.Handle("/admin/backup", methods{
+		"GET": withAdmin(handleBackup),
+	})
+	mux.Handle("/admin/restore", methods{
+		"POST": withAdmin(memoryGuarded(handleRestore)),
+	})
 
-// 4. postsHandler function
-func postsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		handleGetPosts(w, r)
-	case "POST":
-		handlePostPosts(w, r)
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if *noIndex {
+		mux.Handle("/robots.txt", methods{
+			"GET": handleRobots,
+		})
 	}
+	return mux
 }
 
-// 5. postHandler function
-func postHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.URL.Path[len("/posts/"):])
+//--------------CRUD OPERATIONS================
+
+func handleGetPosts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	ids, err := parseIDs(q.Get("ids"))
 	if err != nil {
-		http.Error(w, "Invalid post ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := parseFields(q.Get("fields"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter, err := parsePostFilter(q)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	switch r.Method {
-	case "GET":
-		handleGetPost(w, r, id)
-	case "DELETE":
-		handleDeletePost(w, r, id)
+	// ?report_missing=true adds the requested ?ids= that don't exist
+	// to the response, so they aren't confused with ones filtered out.
+	reportMissing := false
+	if v := q.Get("report_missing"); v != "" {
+		if reportMissing, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid report_missing flag")
+			return
+		}
+		if reportMissing && ids == nil {
+			writeError(w, r, http.StatusBadRequest, "report_missing requires ids")
+			return
+		}
+	}
+
+	// ?as=map returns an object keyed by post ID instead of an array.
+	as := q.Get("as")
+	if as != "" && as != "array" && as != "map" {
+		writeError(w, r, http.StatusBadRequest, "as must be array or map")
+		return
+	}
+
+	// ?order=id sorts by ID, which is also the default when asking for
+	// specific ids, searching or paginating. ?order=as-requested keeps
+	// the order of ?ids=, ?order=created_at puts the oldest first and
+	// ?order=views puts the most viewed first. ?sort= is another name
+	// for ?order=.
+	order := q.Get("order")
+	if q.Has("sort") {
+		if q.Has("order") {
+			writeError(w, r, http.StatusBadRequest, "Use sort or order, not both")
+			return
+		}
+		order = q.Get("sort")
+	}
+	switch {
+	case order == "" || order == "id" || order == "created_at" || order == "views":
+	case order == "as-requested" && ids != nil:
+	case order == "as-requested":
+		writeError(w, r, http.StatusBadRequest, "order=as-requested requires ids")
+		return
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusBadRequest, "Invalid order: "+order)
+		return
 	}
-}
 
-//--------------CRUD OPERATIONS================
+	// ?q= searches post bodies and switches the response to a page
+	// of results with the total match count. So does ?limit= or
+	// ?offset= on their own, to page through the whole list.
+	search, searching := q["q"]
+	_, paging := q["before"]
+	_, cursoring := q["cursor"]
+	paginating := searching || (!paging && !cursoring && (q.Has("limit") || q.Has("offset")))
+	var limit, offset int
+	if paginating {
+		if limit, offset, err = parseLimitOffset(q, 20); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// ?before=<id> pages backwards: the posts with lower IDs, newest
+	// first, plus a prev_cursor to pass as the next ?before=.
+	var before PostID
+	if paging {
+		var ok bool
+		if before, ok = parsePostID(q.Get("before")); !ok {
+			writeError(w, r, http.StatusBadRequest, "before must be a post ID")
+			return
+		}
+		if searching || order != "" || q.Has("offset") {
+			writeError(w, r, http.StatusBadRequest, "before can't be combined with q, order or offset")
+			return
+		}
+		if limit, _, err = parseLimitOffset(q, 20); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// ?cursor= pages forwards in a stable order, by ID or with
+	// ?order=created_at oldest first. An empty ?cursor= starts at the
+	// beginning, and each page's next_cursor is the ?cursor= for the
+	// one after it.
+	var cursor pageCursor
+	if cursoring {
+		if searching || paging || ids != nil || q.Has("offset") {
+			writeError(w, r, http.StatusBadRequest, "cursor can't be combined with q, before, ids or offset")
+			return
+		}
+		if cursor, err = parseCursor(q.Get("cursor"), order); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		order = cursor.Order
+		if limit, _, err = parseLimitOffset(q, 20); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
-func handleGetPosts(w http.ResponseWriter, r *http.Request) {
 	// this essentially locks the server so that we can
-	// manipulate the posts map without worrying about
-	// another request trying to do the same thing at
-	// the same time.
-	postsMu.Lock()
+	// read the posts map without another request changing it
+	// at the same time. Other readers don't have to wait,
+	// as it's only a read lock.
+	s := readPostSet(r)
 
 	// defers unlocking until the function has finished executing,
 	// but define it up the top with our lock. Nice and neat.
 	// Caution: deferred statements are first-in-last-out,
 	// which is not all that intuitive to begin with.
-	defer postsMu.Unlock()
+	// With -short-list-lock we let go early, see below, so only
+	// unlock here if we still hold it.
+	locked := true
+	defer func() {
+		if locked {
+			postsMu.RUnlock()
+		}
+	}()
+
+	// Taken under the lock, so every change up to this instant is in
+	// this response. Delta sync clients send it back as their next
+	// ?modified_since=.
+	w.Header().Set("X-Server-Time", time.Now().UTC().Format(time.RFC3339Nano))
+
+	// Nothing has changed since the client's copy, so don't send the
+	// whole list again.
+	etag := s.collectionETag()
+	w.Header().Set("ETag", etag)
+	setCacheControl(w, "/posts")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	n := s.store.Len()
+	if ids != nil {
+		n = len(ids)
+	}
+	if (paginating || paging || cursoring) && limit < n {
+		n = limit
+	}
+	if !withinMemoryBudget(w, r, s.estimateListBytes(n)) {
+		return
+	}
 
 	// Copying the posts to a new slice of type []Post
-	ps := make([]Post, 0, len(posts))
-	for _, p := range posts {
-		ps = append(ps, p)
+	var ps []Post
+	missing := []PostID{}
+	if ids != nil {
+		// Only the requested posts; IDs that don't exist are skipped.
+		ps = make([]Post, 0, len(ids))
+		for _, id := range ids {
+			if p, ok := s.store.Get(id); ok {
+				ps = append(ps, p)
+			} else {
+				missing = append(missing, id)
+			}
+		}
+	} else if len(filter.tags) > 0 {
+		ps = s.taggedPosts(filter.tags[0])
+	} else if cursoring && order == "id" {
+		// One more than the page, to tell whether there's another.
+		ps = s.postsAfter(cursor.ID, limit+1, filter)
+	} else {
+		ps = s.store.List()
 	}
 
-	fmt.Println(ps)
+	// A delta sync client has to hear about the posts deleted since
+	// its last sync too, or it keeps showing them. They're added after
+	// the other filters, which a stub has nothing to match against; a
+	// client just skips the IDs it doesn't have. Searching and the
+	// ?before= and ?cursor= pages leave them out.
+	var deleted []Post
+	if !filter.since.IsZero() && ids == nil && !searching && !paging && !cursoring {
+		deleted = s.deletedSince(filter.since)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ps)
+	// ps is a copy of the posts as of now; Post values share their
+	// strings rather than duplicating them, so the copy is cheap. With
+	// -short-list-lock, filtering, sorting and encoding work on that
+	// consistent snapshot without holding up writers.
+	if *shortListLock {
+		postsMu.RUnlock()
+		locked = false
+	}
+
+	ps = append(filter.apply(listable(ps)), deleted...)
+
+	// Filtering by the search is the last filter, so what's left is
+	// the total for every filter applied.
+	if searching {
+		ps = matchingSearch(ps, search[0])
+	}
+	total := len(ps)
+
+	switch {
+	case order == "views":
+		sortByViews(ps)
+	case order == "created_at":
+		sortByCreated(ps)
+	case order == "id" || (order == "" && (ids != nil || paginating)):
+		sortByID(ps)
+	}
+
+	if paginating {
+		ps = paginate(ps, limit, offset)
+	}
+	var prevCursor *PostID
+	if paging {
+		ps, prevCursor = pageBefore(ps, before, limit)
+	}
+	var nextCursor *string
+	if cursoring {
+		ps, nextCursor = pageAfter(ps, cursor, limit)
+	}
+
+	if slog.Default().Enabled(r.Context(), slog.LevelDebug) {
+		slog.Debug("listing posts", "posts", redacted(ps))
+	}
+
+	// ?render=html adds each body rendered from Markdown; see
+	// markdown.go.
+	render := wantsHTML(r)
+	items := make([]interface{}, len(ps))
+	for i, p := range ps {
+		switch {
+		case p.DeletedAt != nil:
+			items[i] = deletedPost{ID: p.ID, Deleted: true, DeletedAt: *p.DeletedAt}
+		case fields != nil:
+			m := project(p, fields)
+			if render {
+				m["html"] = renderMarkdown(p.Body)
+			}
+			items[i] = m
+		case render:
+			items[i] = renderedPost{p, renderMarkdown(p.Body)}
+		default:
+			items[i] = p
+		}
+	}
+
+	var data interface{} = items
+	if as == "map" {
+		byID := make(map[string]interface{}, len(ps))
+		for i, p := range ps {
+			byID[string(p.ID)] = items[i]
+		}
+		data = byID
+	}
+	switch {
+	case paginating:
+		page := listPage{Data: data, Total: total, Limit: limit, Offset: offset}
+		if offset+len(ps) < total {
+			page.Next = nextPageURL(r, limit, offset+len(ps))
+		}
+		if reportMissing {
+			page.Missing = missing
+		}
+		data = page
+	case paging:
+		page := keysetPage{Data: data, PrevCursor: prevCursor}
+		if reportMissing {
+			page.Missing = missing
+		}
+		data = page
+	case cursoring:
+		data = cursorPage{Data: data, NextCursor: nextCursor}
+	case reportMissing:
+		data = missingPage{Data: data, Missing: missing}
+	}
+
+	respond(w, r, http.StatusOK, data)
 }
 
 func handlePostPosts(w http.ResponseWriter, r *http.Request) {
 	var p Post
 
+	// The server always gives handlers a non-nil body, but a
+	// handler called directly (say from a test) might not.
+	if r.Body == nil {
+		writeError(w, r, http.StatusBadRequest, "Request body is required")
+		return
+	}
+
 	// This will read the entire body into a byte slice
 	// i.e. ([]byte)
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, "Error reading request body")
+		return
+	}
+
+	// Without this check an empty body fails in the JSON decoder
+	// with an unhelpful "EOF".
+	if len(bytes.TrimSpace(body)) == 0 {
+		writeError(w, r, http.StatusBadRequest, "Request body is required")
 		return
 	}
 
 	// Now we'll try to parse the body. This is similar
 	// to JSON.parse in JavaScript.
-	if err := json.Unmarshal(body, &p); err != nil {
-		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+	if err := decodeBody(r, body, &p); err != nil {
+		writeBodyError(w, r, err)
 		return
 	}
 
@@ -119,42 +702,289 @@ func handlePostPosts(w http.ResponseWriter, r *http.Request) {
 	postsMu.Lock()
 	defer postsMu.Unlock()
 
-	p.ID = nextID
-	nextID++
-	posts[p.ID] = p
+	if p.AuthorID, err = authorIDFor(r, p.AuthorID); err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	p, err = s.createPost(p)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(p)
+	respond(w, r, http.StatusCreated, p)
 }
 
-func handleGetPost(w http.ResponseWriter, r *http.Request, id int) {
-	postsMu.Lock()
-	defer postsMu.Unlock()
+func handleGetPost(w http.ResponseWriter, r *http.Request, id PostID) {
+	// ?no_count=true reads the post without counting it as a view.
+	count := true
+	if v := r.URL.Query().Get("no_count"); v != "" {
+		noCount, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid no_count flag")
+			return
+		}
+		count = !noCount
+	}
 
-	p, ok := posts[id]
-	if !ok {
-		http.Error(w, "Post not found", http.StatusNotFound)
+	// Views are counted apart from the post (see views.go), so even
+	// counting one only needs the read lock.
+	s := readPostSet(r)
+	defer postsMu.RUnlock()
+	p, err := s.getPost(id)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+
+	// A revalidation that finds the post unchanged isn't a view.
+	etag := postETag(p)
+	w.Header().Set("ETag", etag)
+	setCacheControl(w, "/posts/{id}")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(p)
+	// A view isn't a change to the post, so it leaves UpdatedAt and
+	// the collection version alone. That means a cached list can show
+	// slightly old view counts.
+	if count {
+		p.Views += s.views.add(id)
+	} else {
+		p.Views += s.views.pending(id)
+	}
+
+	if wantsHTML(r) {
+		respond(w, r, http.StatusOK, renderedPost{p, renderMarkdown(p.Body)})
+		return
+	}
+	respond(w, r, http.StatusOK, p)
 }
 
-func handleDeletePost(w http.ResponseWriter, r *http.Request, id int) {
+func handleDeletePost(w http.ResponseWriter, r *http.Request, id PostID) {
 	postsMu.Lock()
 	defer postsMu.Unlock()
 
-	// If you use a two-value assignment for accessing a
-	// value on a map, you get the value first then an
-	// "exists" variable.
-	_, ok := posts[id]
-	if !ok {
-		http.Error(w, "Post not found", http.StatusNotFound)
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	old, err := s.getPost(id)
+	if err == nil {
+		err = s.checkOwner(r, id)
+	}
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	if !checkIfMatch(w, r, old) {
+		return
+	}
+	if err := s.deletePost(id); err != nil {
+		writePostError(w, r, err)
 		return
 	}
 
-	delete(posts, id)
 	w.WriteHeader(http.StatusOK)
 }
+
+//--------------MUTATING THE POSTS MAP================
+
+// These helpers are shared by the single-post handlers and /batch.
+// Callers must hold postsMu.
+
+var (
+	errNotFound  = errors.New("post not found")
+	errGone      = errors.New("post deleted")
+	errDuplicate = errors.New("duplicate post body for author")
+	errLocked    = errors.New("post locked")
+)
+
+// getPost looks up the post with the given ID.
+func (s *postSet) getPost(id PostID) (Post, error) {
+	p, ok := s.store.Get(id)
+	if !ok {
+		if s.deletedRecently(id) {
+			return Post{}, errGone
+		}
+		return Post{}, errNotFound
+	}
+	return p, nil
+}
+
+// createPost assigns p the next ID, fills in defaults and stores it.
+func (s *postSet) createPost(p Post) (Post, error) {
+	if p.Author == "" {
+		p.Author = defaultAuthor
+	}
+	p.Body = normalizeBody(p.Body)
+	if err := validatePost(p, ""); err != nil {
+		return Post{}, err
+	}
+	if err := s.checkUniqueBody(p); err != nil {
+		return Post{}, err
+	}
+	tags, err := normalizeTags(p.Tags)
+	if err != nil {
+		return Post{}, err
+	}
+	p.Tags = tags
+
+	p.Locked = false
+	p.Reserved = false
+	p.Views = 0
+	p.DeletedAt = nil
+	p.ID = s.allocateID()
+	s.views.forget(p.ID)
+	p.CreatedAt = time.Now().UTC()
+	p.UpdatedAt = p.CreatedAt
+	if err := s.store.Create(p); err != nil {
+		return Post{}, err
+	}
+	s.version++
+	s.bodyBytes += int64(len(p.Body))
+	delete(s.tombstones, p.ID)
+	s.indexBody(p)
+	s.indexTags(p)
+	s.textIndex.add(p)
+	s.recordRevision(p)
+	s.emitEvent("post.created", p)
+	return p, nil
+}
+
+// updatePost replaces the stored post with the given ID.
+func (s *postSet) updatePost(id PostID, p Post) (Post, error) {
+	old, ok := s.store.Get(id)
+	if !ok {
+		return Post{}, errNotFound
+	}
+	if old.Locked {
+		return Post{}, errLocked
+	}
+
+	p.Body = normalizeBody(p.Body)
+	if err := validatePost(p, id); err != nil {
+		return Post{}, err
+	}
+
+	// Updating a reserved post is what finalizes it.
+	p.ID = id
+	p.Locked = false
+	p.Reserved = false
+	if err := s.checkUniqueBody(p); err != nil {
+		return Post{}, err
+	}
+	tags, err := normalizeTags(p.Tags)
+	if err != nil {
+		return Post{}, err
+	}
+	p.Tags = tags
+
+	p.AuthorID = old.AuthorID
+	p.CreatedAt = old.CreatedAt
+	p.UpdatedAt = time.Now().UTC()
+	p.Views = old.Views
+	p.DeletedAt = nil
+	if err := s.store.Update(p); err != nil {
+		return Post{}, err
+	}
+	s.unindexBody(old)
+	s.unindexTags(old)
+	s.textIndex.remove(old)
+	s.version++
+	s.bodyBytes += int64(len(p.Body) - len(old.Body))
+	s.indexBody(p)
+	s.indexTags(p)
+	s.textIndex.add(p)
+	s.recordRevision(p)
+	s.emitEvent("post.updated", p)
+	return p, nil
+}
+
+// deletePost moves the post with the given ID to the trash.
+func (s *postSet) deletePost(id PostID) error {
+	p, ok := s.store.Get(id)
+	if !ok {
+		return errNotFound
+	}
+	if p.Locked {
+		return errLocked
+	}
+
+	p, err := s.store.Trash(id, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	s.version++
+	s.bodyBytes -= int64(len(p.Body))
+	s.unindexBody(p)
+	s.unindexTags(p)
+	s.textIndex.remove(p)
+	s.recordTombstone(id)
+	s.emitEvent("post.deleted", p)
+	return nil
+}
+
+// rebuildDerived recomputes everything kept alongside posts after they
+// have been loaded or restored wholesale.
+func (s *postSet) rebuildDerived() {
+	s.rebuildBodyIndex()
+	s.rebuildTagIndex()
+	s.rebuildTextIndex()
+	s.recountBodyBytes()
+	s.rebuildFreeIDs()
+}
+
+// postErrorStatus maps an error from the helpers above to the status
+// code and message a client should see.
+func postErrorStatus(err error) (int, string) {
+	var verr *validationError
+	if errors.As(err, &verr) {
+		return http.StatusUnprocessableEntity, verr.Error()
+	}
+	switch err {
+	case errNotFound:
+		return http.StatusNotFound, "Post not found"
+	case errGone:
+		return http.StatusGone, "Post has been deleted"
+	case errDuplicate:
+		return http.StatusConflict, "Author already has a post with this body"
+	case errLocked:
+		return http.StatusLocked, "Post is locked"
+	case errInvalidTags:
+		return http.StatusBadRequest, fmt.Sprintf("At most %d tags, each up to %d letters, digits, - or _", maxTags, maxTagLen)
+	case errUnknownUser:
+		return http.StatusBadRequest, "Unknown author_id"
+	case errForbidden:
+		return http.StatusForbidden, "Only the post's author can change it"
+	case errCommentNotFound:
+		return http.StatusNotFound, "Comment not found"
+	case errEmptyComment:
+		return http.StatusBadRequest, "Comment body is required"
+	case errNoParent:
+		return http.StatusUnprocessableEntity, "parent_id must be a comment on the same post"
+	case errThreadTooDeep:
+		return http.StatusUnprocessableEntity, fmt.Sprintf("Reply threads are at most %d comments deep", *maxThreadDepth)
+	case errRevisionNotFound:
+		return http.StatusNotFound, "Revision not found"
+	default:
+		return http.StatusInternalServerError, "Internal server error"
+	}
+}
+
+func writePostError(w http.ResponseWriter, r *http.Request, err error) {
+	var verr *validationError
+	if errors.As(err, &verr) {
+		writeValidationError(w, r, verr)
+		return
+	}
+	code, msg := postErrorStatus(err)
+	writeError(w, r, code, msg)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//--------------TEST SERVER================
+
+// The server keeps its posts, users and settings in package variables,
+// so tests run one at a time against a fresh copy of them: each starts
+// with newTestServer, which empties them and builds the same handler
+// main serves.
+
+func TestMain(m *testing.M) {
+	// A line per request would bury the test output.
+	flag.Set("log-requests", "false")
+	os.Exit(m.Run())
+}
+
+type testServer struct {
+	t testing.TB
+	h http.Handler
+}
+
+// newTestServer resets the server's state and sets the given flags,
+// each like "-store=file", until the test ends.
+func newTestServer(t testing.TB, flags ...string) *testServer {
+	t.Helper()
+	for _, f := range flags {
+		name, value, _ := strings.Cut(strings.TrimPrefix(f, "-"), "=")
+		setFlag(t, name, value)
+	}
+	resetState(t)
+	return &testServer{t: t, h: newHandler()}
+}
+
+// setFlag sets a flag until the test ends.
+func setFlag(t testing.TB, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("no flag -%s", name)
+	}
+	old := f.Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("-%s=%s: %v", name, value, err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+// resetState empties everything the server keeps, as after a restart
+// with -store=memory.
+func resetState(t testing.TB) {
+	postsMu.Lock()
+	tenants = make(map[string]*postSet)
+	postsMu.Unlock()
+
+	usersMu.Lock()
+	users = make(map[int]User)
+	nextUserID = 1
+	usersMu.Unlock()
+
+	statusMu.Lock()
+	status = serviceStatus{}
+	statusMu.Unlock()
+
+	bucketsMu.Lock()
+	buckets = make(map[bucketKey]*bucket)
+	bucketsMu.Unlock()
+
+	jobsMu.Lock()
+	jobs = make(map[string]*job)
+	jobsMu.Unlock()
+
+	respCache = &responseCache{entries: make(map[responseCacheKey]*list.Element), order: list.New()}
+}
+
+// withTestAuth turns authentication on until the test ends, with the
+// given logins, all with the password "pw", and admins. Call it before
+// newTestServer, which only serves /auth/login with it on.
+func withTestAuth(t *testing.T, logins []string, admins ...string) {
+	oldSecret, oldUsers, oldAdmins := authSecret, authUsers, adminUsers
+	t.Cleanup(func() { authSecret, authUsers, adminUsers = oldSecret, oldUsers, oldAdmins })
+
+	authSecret = []byte("test secret")
+	authUsers = make(map[string]string)
+	for _, name := range logins {
+		authUsers[name] = "pw"
+	}
+	adminUsers = make(map[string]bool)
+	for _, name := range admins {
+		adminUsers[name] = true
+	}
+}
+
+// token returns a bearer token for the login.
+func token(login string) string {
+	now := time.Now()
+	return signToken(tokenClaims{Subject: login, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+}
+
+// do sends a request with the given body, if it isn't empty, and
+// headers, given as name and value one after the other.
+func (ts *testServer) do(method, path, body string, header ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var r *http.Request
+	if body != "" {
+		r = httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+	} else {
+		r = httptest.NewRequest(method, path, nil)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	ts.h.ServeHTTP(rec, r)
+	return rec
+}
+
+// as sends a request like do, logged in as login.
+func (ts *testServer) as(login, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	return ts.do(method, path, body, append(header, "Authorization", "Bearer "+token(login))...)
+}
+
+// createPost creates a post from a JSON body and returns it.
+func (ts *testServer) createPost(body string, header ...string) Post {
+	ts.t.Helper()
+	rec := ts.do("POST", "/posts", body, header...)
+	if rec.Code != http.StatusCreated {
+		ts.t.Fatalf("POST /posts %s: %d %s", body, rec.Code, rec.Body)
+	}
+	return decodeResponse[Post](ts.t, rec)
+}
+
+// decodeResponse decodes a JSON response body.
+func decodeResponse[T any](t testing.TB, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return v
+}
+
+// wantStatus fails the test unless rec has the given status.
+func wantStatus(t testing.TB, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status %d, want %d: %s", rec.Code, want, rec.Body)
+	}
+}
+
+//--------------CRUD================
+
+func TestPostCRUD(t *testing.T) {
+	ts := newTestServer(t)
+
+	p := ts.createPost(`{"body":"hello","author":"ann","tags":["Go"]}`)
+	if p.ID != "1" || p.Body != "hello" || p.Author != "ann" || len(p.Tags) != 1 || p.Tags[0] != "go" {
+		t.Fatalf("created %+v", p)
+	}
+	if p.CreatedAt.IsZero() || !p.UpdatedAt.Equal(p.CreatedAt) {
+		t.Errorf("timestamps %v, %v", p.CreatedAt, p.UpdatedAt)
+	}
+
+	rec := ts.do("GET", "/posts/1", "")
+	wantStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[Post](t, rec); got.Body != "hello" || got.Views != 1 {
+		t.Errorf("GET /posts/1 = %+v", got)
+	}
+
+	ts.createPost(`{"body":"second"}`)
+	rec = ts.do("GET", "/posts", "")
+	wantStatus(t, rec, http.StatusOK)
+	if list := decodeResponse[[]Post](t, rec); len(list) != 2 {
+		t.Errorf("GET /posts has %d posts, want 2", len(list))
+	}
+
+	rec = ts.do("PUT", "/posts/1", `{"body":"changed","author":"ann"}`)
+	wantStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[Post](t, rec); got.Body != "changed" || !got.CreatedAt.Equal(p.CreatedAt) {
+		t.Errorf("PUT /posts/1 = %+v", got)
+	}
+
+	rec = ts.do("PATCH", "/posts/1", `{"author":null}`)
+	wantStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[Post](t, rec); got.Body != "changed" || got.Author != "" {
+		t.Errorf("PATCH /posts/1 = %+v", got)
+	}
+
+	wantStatus(t, ts.do("DELETE", "/posts/1", ""), http.StatusOK)
+	wantStatus(t, ts.do("GET", "/posts/1", ""), http.StatusNotFound)
+	wantStatus(t, ts.do("DELETE", "/posts/1", ""), http.StatusNotFound)
+	if list := decodeResponse[[]Post](t, ts.do("GET", "/posts", "")); len(list) != 1 || list[0].ID != "2" {
+		t.Errorf("GET /posts after delete = %+v", list)
+	}
+}
+
+func TestErrorPaths(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"hello"}`)
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"GET", "/posts/abc", "", http.StatusBadRequest},
+		{"GET", "/posts/0", "", http.StatusBadRequest},
+		{"GET", "/posts/99", "", http.StatusNotFound},
+		{"PUT", "/posts/99", `{"body":"x"}`, http.StatusNotFound},
+		{"PATCH", "/posts/99", `{"body":"x"}`, http.StatusNotFound},
+		{"DELETE", "/posts/99", "", http.StatusNotFound},
+		{"PATCH", "/posts", "", http.StatusMethodNotAllowed},
+		{"POST", "/posts/1", "", http.StatusMethodNotAllowed},
+		{"GET", "/posts?order=sideways", "", http.StatusBadRequest},
+		{"GET", "/posts?limit=1000", "", http.StatusBadRequest},
+		{"GET", "/posts?cursor=nonsense", "", http.StatusBadRequest},
+		{"GET", "/posts/1/comments/x", "", http.StatusMethodNotAllowed},
+		{"DELETE", "/posts/1/comments/9", "", http.StatusNotFound},
+		{"GET", "/users/1", "", http.StatusNotFound},
+		{"GET", "/users/x", "", http.StatusBadRequest},
+		{"GET", "/nowhere", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := ts.do(tt.method, tt.path, tt.body); rec.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d: %s", tt.method, tt.path, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+func TestDefaultAuthor(t *testing.T) {
+	old := defaultAuthor
+	defaultAuthor = "house"
+	t.Cleanup(func() { defaultAuthor = old })
+
+	tests := []struct {
+		name, body, want string
+	}{
+		{"absent", `{"body":"hi"}`, "house"},
+		{"null", `{"body":"hi","author":null}`, "house"},
+		{"empty", `{"body":"hi","author":""}`, "house"},
+		{"given", `{"body":"hi","author":"ann"}`, "ann"},
+		{"given as the default", `{"body":"hi","author":"house"}`, "house"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			if p := ts.createPost(tt.body); p.Author != tt.want {
+				t.Errorf("post author %q, want %q", p.Author, tt.want)
+			}
+			rec := ts.do("POST", "/posts/1/comments", strings.Replace(tt.body, "hi", "a comment", 1))
+			wantStatus(t, rec, http.StatusCreated)
+			if c := decodeResponse[Comment](t, rec); c.Author != tt.want {
+				t.Errorf("comment author %q, want %q", c.Author, tt.want)
+			}
+		})
+	}
+
+	// Only new posts get it: taking the author off one leaves it
+	// without.
+	ts := newTestServer(t)
+	for i, tt := range []struct{ method, body string }{
+		{"PUT", `{"body":"changed"}`},
+		{"PATCH", `{"author":null}`},
+	} {
+		ts.createPost(fmt.Sprintf(`{"body":"post %d","author":"ann"}`, i))
+		rec := ts.do(tt.method, fmt.Sprintf("/posts/%d", i+1), tt.body)
+		wantStatus(t, rec, http.StatusOK)
+		if p := decodeResponse[Post](t, rec); p.Author != "" {
+			t.Errorf("%s %s: author %q, want none", tt.method, tt.body, p.Author)
+		}
+	}
+}
+
+//--------------VALIDATION================
+
+func TestCreateValidation(t *testing.T) {
+	tests := []struct {
+		name, body string
+		want       int
+		field      string
+	}{
+		{"ok", `{"body":"hi"}`, http.StatusCreated, ""},
+		{"missing body", `{"author":"ann"}`, http.StatusUnprocessableEntity, "body"},
+		{"blank body", `{"body":"  \n"}`, http.StatusUnprocessableEntity, "body"},
+		{"too long", `{"body":"` + strings.Repeat("x", 10001) + `"}`, http.StatusUnprocessableEntity, "body"},
+		{"long author", `{"body":"hi","author":"` + strings.Repeat("a", 101) + `"}`, http.StatusUnprocessableEntity, "author"},
+		{"id set", `{"id":5,"body":"hi"}`, http.StatusUnprocessableEntity, "id"},
+		{"bad tag", `{"body":"hi","tags":["no spaces"]}`, http.StatusUnprocessableEntity, "tags"},
+		{"unknown field", `{"body":"hi","color":"red"}`, http.StatusUnprocessableEntity, "color"},
+		{"not JSON", `{"body":`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			rec := ts.do("POST", "/posts", tt.body)
+			wantStatus(t, rec, tt.want)
+			if tt.field == "" {
+				return
+			}
+			resp := decodeResponse[struct{ Fields []fieldError }](t, rec)
+			if len(resp.Fields) != 1 || resp.Fields[0].Field != tt.field {
+				t.Errorf("fields %+v, want just %s", resp.Fields, tt.field)
+			}
+		})
+	}
+}
+
+func TestValidationListsEveryField(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.do("POST", "/posts", `{"id":3,"body":"","author":"`+strings.Repeat("a", 101)+`"}`)
+	wantStatus(t, rec, http.StatusUnprocessableEntity)
+	resp := decodeResponse[struct{ Fields []fieldError }](t, rec)
+	if len(resp.Fields) != 3 {
+		t.Errorf("fields %+v, want id, body and author", resp.Fields)
+	}
+}
+
+//--------------BENCHMARKS================
+
+// fillPosts creates n posts with bodies of about size bytes, straight
+// into the store rather than through the handlers.
+func fillPosts(tb testing.TB, n, size int) {
+	tb.Helper()
+	rng := rand.New(rand.NewSource(1))
+	postsMu.Lock()
+	defer postsMu.Unlock()
+	s, err := tenantPostSet("")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := s.createPost(Post{Body: proseBody(rng, size), Author: fmt.Sprint("author", i%50)}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkListLock lists many posts, with and without
+// -short-list-lock, while a writer keeps taking the posts lock, and
+// reports how long the writer waited for it, which is how long the
+// list held it.
+func BenchmarkListLock(b *testing.B) {
+	for _, tt := range []struct{ name, short string }{
+		{"whole-request", "false"},
+		{"short", "true"},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			ts := newTestServer(b, "-short-list-lock="+tt.short)
+			fillPosts(b, 5000, 512)
+
+			var waits []time.Duration
+			stop, stopped := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(stopped)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					start := time.Now()
+					postsMu.Lock()
+					waits = append(waits, time.Since(start))
+					postsMu.Unlock()
+					time.Sleep(50 * time.Microsecond)
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				wantStatus(b, ts.do("GET", "/posts?order=created_at", ""), http.StatusOK)
+			}
+			b.StopTimer()
+			close(stop)
+			<-stopped
+
+			var total, longest time.Duration
+			for _, w := range waits {
+				total += w
+				longest = max(longest, w)
+			}
+			b.ReportMetric(float64(total.Microseconds())/float64(len(waits)), "writer-wait-µs")
+			b.ReportMetric(float64(longest.Microseconds()), "max-writer-wait-µs")
+		})
+	}
+}
+
+// BenchmarkReadWriteContention reads single posts from many goroutines
+// with a share of the requests writing instead. Reads only take the
+// read lock, so with -cpu=1,4,8 reads alone should scale with the CPUs
+// and writes should cost them in proportion.
+func BenchmarkReadWriteContention(b *testing.B) {
+	for _, writePercent := range []int{0, 1, 10} {
+		b.Run(fmt.Sprintf("writes=%d%%", writePercent), func(b *testing.B) {
+			ts := newTestServer(b)
+			const posts = 1000
+			fillPosts(b, posts, 512)
+
+			var n atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := n.Add(1)
+					path := fmt.Sprintf("/posts/%d", i%posts+1)
+					method, body, want := "GET", "", http.StatusOK
+					if i%100 < int64(writePercent) {
+						method, body = "PATCH", fmt.Sprintf(`{"body":"edit %d"}`, i)
+					} else {
+						// Counting a view is a write of its own.
+						path += "?no_count=true"
+					}
+					if rec := ts.do(method, path, body); rec.Code != want {
+						b.Errorf("%s %s: status %d", method, path, rec.Code)
+					}
+				}
+			})
+		})
+	}
+}
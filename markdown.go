@@ -0,0 +1,339 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+//--------------MARKDOWN================
+
+// Post bodies are Markdown. GET /posts/{id}/html renders one as an
+// HTML fragment, and ?render=html on GET /posts and GET /posts/{id}
+// adds the same HTML to each post as "html".
+//
+// renderMarkdown handles the common subset: paragraphs, # headings,
+// > quotes, - and 1. lists, ``` and indented code, ---, **strong**,
+// *emphasis*, `code`, [links](url) and <autolinks>. It's safe by
+// construction rather than by cleaning up afterwards: every bit of
+// the body is escaped, raw HTML included, so the only tags in the
+// output are the ones it writes itself, and links only go to http,
+// https, mailto or relative URLs.
+
+// renderedPost is a post with its body rendered, for ?render=html.
+type renderedPost struct {
+	Post
+	HTML string `json:"html" xml:"html"`
+}
+
+// wantsHTML reports whether r asked for ?render=html.
+func wantsHTML(r *http.Request) bool {
+	return r.URL.Query().Get("render") == "html"
+}
+
+func handleGetPostHTML(w http.ResponseWriter, r *http.Request, id PostID) {
+	s := readPostSet(r)
+	p, err := s.getPost(id)
+	postsMu.RUnlock()
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("ETag", postETag(p))
+	// Even if a browser opens the fragment directly, nothing in it
+	// may run.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if etagMatches(r.Header.Get("If-None-Match"), postETag(p)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write([]byte(renderMarkdown(p.Body)))
+}
+
+var (
+	mdHeading     = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+	mdRule        = regexp.MustCompile(`^ {0,3}([-*_])[ \t]*(?:[-*_][ \t]*){2,}$`)
+	mdBullet      = regexp.MustCompile(`^ {0,3}[-*+][ \t]+`)
+	mdOrdered     = regexp.MustCompile(`^ {0,3}\d{1,9}[.)][ \t]+`)
+	mdFence       = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([A-Za-z0-9_+-]*)")
+	mdIndented    = regexp.MustCompile(`^(    |\t)`)
+	mdQuote       = regexp.MustCompile(`^ {0,3}> ?`)
+	mdLanguageTag = regexp.MustCompile(`^[A-Za-z0-9_+-]+$`)
+)
+
+// renderMarkdown renders a Markdown body as an HTML fragment.
+func renderMarkdown(body string) string {
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n"))
+	return b.String()
+}
+
+// renderBlocks writes lines as a sequence of blocks.
+func renderBlocks(b *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			fence := m[1]
+			i++
+			var code []string
+			for i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // the closing fence, if there is one
+			writeCode(b, code, m[2])
+
+		case mdIndented.MatchString(line):
+			var code []string
+			for i < len(lines) && (mdIndented.MatchString(lines[i]) || strings.TrimSpace(lines[i]) == "") {
+				code = append(code, mdIndented.ReplaceAllString(lines[i], ""))
+				i++
+			}
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			writeCode(b, code, "")
+
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			tag := "h" + string(rune('0'+len(m[1])))
+			b.WriteString("<" + tag + ">" + renderInline(m[2]) + "</" + tag + ">\n")
+			i++
+
+		case mdRule.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case mdQuote.MatchString(line):
+			var quoted []string
+			for i < len(lines) && mdQuote.MatchString(lines[i]) {
+				quoted = append(quoted, mdQuote.ReplaceAllString(lines[i], ""))
+				i++
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+
+		case mdBullet.MatchString(line), mdOrdered.MatchString(line):
+			marker, tag := mdBullet, "ul"
+			if !mdBullet.MatchString(line) {
+				marker, tag = mdOrdered, "ol"
+			}
+			b.WriteString("<" + tag + ">\n")
+			for i < len(lines) && marker.MatchString(lines[i]) {
+				item := marker.ReplaceAllString(lines[i], "")
+				i++
+				// Indented lines continue the item.
+				for i < len(lines) && strings.TrimSpace(lines[i]) != "" && startsIndented(lines[i]) && !marker.MatchString(lines[i]) {
+					item += "\n" + strings.TrimSpace(lines[i])
+					i++
+				}
+				b.WriteString("<li>" + renderInline(item) + "</li>\n")
+			}
+			b.WriteString("</" + tag + ">\n")
+
+		default:
+			var para []string
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "" && (len(para) == 0 || !startsBlock(lines[i])) {
+				para = append(para, lines[i])
+				i++
+			}
+			b.WriteString("<p>" + renderInline(strings.Join(para, "\n")) + "</p>\n")
+		}
+	}
+}
+
+// startsBlock reports whether line starts a block other than a
+// paragraph, which ends the paragraph before it.
+func startsBlock(line string) bool {
+	return mdFence.MatchString(line) || mdHeading.MatchString(line) || mdRule.MatchString(line) ||
+		mdQuote.MatchString(line) || mdBullet.MatchString(line) || mdOrdered.MatchString(line)
+}
+
+func startsIndented(line string) bool {
+	return strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t")
+}
+
+func writeCode(b *strings.Builder, code []string, lang string) {
+	b.WriteString("<pre><code")
+	if lang != "" && mdLanguageTag.MatchString(lang) {
+		b.WriteString(` class="language-` + lang + `"`)
+	}
+	b.WriteString(">")
+	b.WriteString(html.EscapeString(strings.Join(code, "\n")))
+	if len(code) > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString("</code></pre>\n")
+}
+
+// renderInline renders the spans in a block's text.
+func renderInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()<>#+-.!", s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			ticks := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			if end := strings.Index(s[i+ticks:], s[i:i+ticks]); end >= 0 {
+				code := strings.TrimSpace(s[i+ticks : i+ticks+end])
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += 2*ticks + end
+				continue
+			}
+
+		case c == '*' || c == '_':
+			delim := s[i : i+1]
+			if strings.HasPrefix(s[i:], delim+delim) {
+				delim += delim
+			}
+			// An _ inside a word, as in snake_case, is just an _.
+			leftFlanking := i+len(delim) < len(s) && s[i+len(delim)] != ' '
+			if c == '_' && i > 0 && isWordByte(s[i-1]) {
+				leftFlanking = false
+			}
+			if end := strings.Index(s[i+len(delim):], delim); leftFlanking && end > 0 && s[i+len(delim)+end-1] != ' ' {
+				tag := "em"
+				if len(delim) == 2 {
+					tag = "strong"
+				}
+				inner := s[i+len(delim) : i+len(delim)+end]
+				b.WriteString("<" + tag + ">" + renderInline(inner) + "</" + tag + ">")
+				i += 2*len(delim) + end
+				continue
+			}
+
+		case c == '[':
+			if text, dest, n, ok := parseLink(s[i:]); ok {
+				if href, safe := safeURL(dest); safe {
+					b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener">` + renderInline(text) + "</a>")
+				} else {
+					b.WriteString(renderInline(text))
+				}
+				i += n
+				continue
+			}
+
+		case c == '<':
+			if end := strings.IndexByte(s[i:], '>'); end > 0 {
+				dest := s[i+1 : i+end]
+				if u, err := url.Parse(dest); err == nil && u.Scheme != "" && !strings.ContainsAny(dest, " \t\n") {
+					if href, safe := safeURL(dest); safe {
+						b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener">` + html.EscapeString(dest) + "</a>")
+						i += end + 1
+						continue
+					}
+				}
+			}
+
+		case c == '\n':
+			// Two trailing spaces make a hard line break.
+			if strings.HasSuffix(b.String(), "  ") {
+				trimmed := strings.TrimRight(b.String(), " ")
+				b.Reset()
+				b.WriteString(trimmed + "<br>")
+			}
+		}
+
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// parseLink parses [text](dest) at the start of s, returning the text,
+// the destination and the length of the whole link.
+func parseLink(s string) (text, dest string, n int, ok bool) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			if i+1 >= len(s) || s[i+1] != '(' {
+				return "", "", 0, false
+			}
+			end := closingParen(s[i+2:])
+			if end < 0 {
+				return "", "", 0, false
+			}
+			dest = strings.TrimSpace(s[i+2 : i+2+end])
+			// Drop a "title", which we don't use; anything else
+			// after a space means it isn't a link after all.
+			if sp := strings.IndexAny(dest, " \t"); sp >= 0 {
+				title := strings.TrimSpace(dest[sp:])
+				if !strings.HasPrefix(title, `"`) && !strings.HasPrefix(title, "'") {
+					return "", "", 0, false
+				}
+				dest = dest[:sp]
+			}
+			return s[1:i], strings.Trim(dest, "<>"), i + 3 + end, true
+		}
+	}
+	return "", "", 0, false
+}
+
+// closingParen finds the ) ending a link destination, skipping over
+// balanced pairs like those in a Wikipedia URL. It returns -1 if there
+// isn't one.
+func closingParen(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case '\n':
+			return -1
+		}
+	}
+	return -1
+}
+
+// safeURL reports whether a link to dest may be rendered: http, https
+// and mailto URLs, and relative ones. Whitespace and control
+// characters are refused outright, since browsers strip some of them
+// and would read "java\tscript:" as "javascript:".
+func safeURL(dest string) (string, bool) {
+	for _, c := range dest {
+		if c <= ' ' || c == 0x7f {
+			return "", false
+		}
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return u.String(), dest != ""
+	}
+	return "", false
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
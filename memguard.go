@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+//--------------PER-REQUEST MEMORY GUARD================
+
+var requestMemoryBudget = flag.Int64("request-memory-budget", 0, "reject requests estimated to need more than this many bytes (0 disables the guard)")
+
+const (
+	// postOverhead approximates what a post costs beyond its body:
+	// the struct, the other fields and their JSON encoding.
+	postOverhead = 256
+
+	// bodyExpansion approximates how many times its own size a bulk
+	// request body costs once decoded and answered with per-operation
+	// results.
+	bodyExpansion = 3
+)
+
+// A postSet's bodyBytes is the total length of its post bodies. It
+// gives the average post size used by the list estimate.
+
+// recountBodyBytes recomputes bodyBytes from posts. Callers must hold
+// postsMu.
+func (s *postSet) recountBodyBytes() {
+	s.bodyBytes = 0
+	for _, p := range s.store.List() {
+		s.bodyBytes += int64(len(p.Body))
+	}
+}
+
+// estimateListBytes estimates the memory needed to return n posts:
+// n times the average post, where the average post is the average
+// body length plus postOverhead. Callers must hold postsMu.
+func (s *postSet) estimateListBytes(n int) int64 {
+	avg := int64(postOverhead)
+	if s.store.Len() > 0 {
+		avg += s.bodyBytes / int64(s.store.Len())
+	}
+	return int64(n) * avg
+}
+
+// withinMemoryBudget answers 400 and returns false if estimate is over
+// -request-memory-budget.
+func withinMemoryBudget(w http.ResponseWriter, r *http.Request, estimate int64) bool {
+	if *requestMemoryBudget <= 0 || estimate <= *requestMemoryBudget {
+		return true
+	}
+	writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Request would need about %d bytes, over the per-request budget of %d", estimate, *requestMemoryBudget))
+	return false
+}
+
+// memoryGuarded protects a bulk endpoint by estimating its cost as
+// bodyExpansion times the request body. Bodies of unknown length are
+// cut off once they reach the size the budget allows.
+func memoryGuarded(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *requestMemoryBudget > 0 {
+			if r.ContentLength > 0 && !withinMemoryBudget(w, r, r.ContentLength*bodyExpansion) {
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, *requestMemoryBudget/bodyExpansion)
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//--------------METRICS================
+
+// GET /metrics serves Prometheus metrics in the text exposition
+// format. withMetrics is the outermost middleware, so every request is
+// counted, including those refused by the rate limit or bandwidth cap.
+//
+//	http_requests_total{method,route,code}            counter
+//	http_request_duration_seconds{method,route}       histogram
+//	http_requests_in_flight                           gauge
+//	response_cache_hits_total                         counter, -response-cache-size only
+//	response_cache_misses_total                       counter, -response-cache-size only
+//	posts{tenant}                                     gauge
+//	posts_body_bytes{tenant}                          gauge
+//	search_index_pending_posts{tenant}                gauge
+//	store_file_bytes{tenant}                          gauge, -store=file only
+//
+// The route label is the documented path from apiRoutes, such as
+// /posts/{id}, or "other" for anything else, so that request paths
+// can't blow up the number of series. Streams like /events and /ws
+// are timed for as long as they stay open.
+
+// latencyBuckets are the upper bounds of the duration histogram, in
+// seconds; Prometheus' defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method, route string
+	code          int
+}
+
+type routeKey struct {
+	method, route string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+var (
+	metricsMu        sync.Mutex
+	requestCounts    = make(map[requestKey]uint64)
+	requestLatency   = make(map[routeKey]*histogram)
+	requestsInFlight atomic.Int64
+)
+
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsInFlight.Add(1)
+		defer requestsInFlight.Add(-1)
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		elapsed := time.Since(start).Seconds()
+
+		method := r.Method
+		if !knownMethods[method] {
+			method = "other"
+		}
+		route := routeLabel(r.URL.Path)
+
+		metricsMu.Lock()
+		defer metricsMu.Unlock()
+		requestCounts[requestKey{method, route, sw.status()}]++
+		h := requestLatency[routeKey{method, route}]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+			requestLatency[routeKey{method, route}] = h
+		}
+		for i, le := range latencyBuckets {
+			if elapsed <= le {
+				h.counts[i]++
+				break
+			}
+		}
+		h.count++
+		h.sum += elapsed
+	})
+}
+
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true,
+	"PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+// statusWriter remembers the status code of the response and how
+// many body bytes were written.
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.code == 0 {
+		sw.code = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the real writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// status is the code sent, which is 200 if the handler never wrote
+// anything.
+func (sw *statusWriter) status() int {
+	if sw.code == 0 {
+		return http.StatusOK
+	}
+	return sw.code
+}
+
+// routeLabel finds the apiRoutes path matching path, where a {param}
+// segment matches any number, or a post's UUID or ULID.
+func routeLabel(path string) string {
+	segments := strings.Split(path, "/")
+	for _, route := range apiRoutes {
+		if routeMatches(strings.Split(route.path, "/"), segments) {
+			return route.path
+		}
+	}
+	return "other"
+}
+
+func routeMatches(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") {
+			if _, ok := parsePostID(segments[i]); !ok && !allDigits(segments[i]) {
+				return false
+			}
+		} else if t != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	metricsMu.Lock()
+	requests := make([]requestKey, 0, len(requestCounts))
+	for k := range requestCounts {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	fmt.Fprintln(bw, "# HELP http_requests_total Requests served, by method, route and status code.")
+	fmt.Fprintln(bw, "# TYPE http_requests_total counter")
+	for _, k := range requests {
+		fmt.Fprintf(bw, "http_requests_total{method=%q,route=%q,code=\"%d\"} %d\n", k.method, k.route, k.code, requestCounts[k])
+	}
+
+	routes := make([]routeKey, 0, len(requestLatency))
+	for k := range requestLatency {
+		routes = append(routes, k)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	fmt.Fprintln(bw, "# HELP http_request_duration_seconds Time to serve requests, by method and route.")
+	fmt.Fprintln(bw, "# TYPE http_request_duration_seconds histogram")
+	for _, k := range routes {
+		h := requestLatency[k]
+		labels := fmt.Sprintf("method=%q,route=%q", k.method, k.route)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(bw, "http_request_duration_seconds_bucket{%s,le=%q} %d\n", labels, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(bw, "http_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(bw, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+	metricsMu.Unlock()
+
+	fmt.Fprintln(bw, "# HELP http_requests_in_flight Requests being served right now.")
+	fmt.Fprintln(bw, "# TYPE http_requests_in_flight gauge")
+	fmt.Fprintf(bw, "http_requests_in_flight %d\n", requestsInFlight.Load())
+
+	if *responseCacheSize > 0 {
+		fmt.Fprintln(bw, "# HELP response_cache_hits_total Reads answered from -response-cache-size.")
+		fmt.Fprintln(bw, "# TYPE response_cache_hits_total counter")
+		fmt.Fprintf(bw, "response_cache_hits_total %d\n", responseCacheHits.Load())
+		fmt.Fprintln(bw, "# HELP response_cache_misses_total Cacheable reads that had to be served by the handler.")
+		fmt.Fprintln(bw, "# TYPE response_cache_misses_total counter")
+		fmt.Fprintf(bw, "response_cache_misses_total %d\n", responseCacheMisses.Load())
+	}
+
+	writeStoreMetrics(bw)
+}
+
+// writeStoreMetrics reports every tenant's posts, whichever tenant
+// asks.
+func writeStoreMetrics(bw *bufio.Writer) {
+	type storeStats struct {
+		tenant    string
+		posts     int
+		bodyBytes int64
+		fileBytes int64 // -1 when the store has no file
+		unindexed int
+	}
+
+	postsMu.RLock()
+	stats := make([]storeStats, 0, len(tenants))
+	for tenant, s := range tenants {
+		st := storeStats{tenant, s.store.Len(), s.bodyBytes, -1, len(s.textIndex.pending)}
+		if fs, ok := s.store.(*fileStore); ok {
+			if info, err := os.Stat(fs.path); err == nil {
+				st.fileBytes = info.Size()
+			}
+		}
+		stats = append(stats, st)
+	}
+	postsMu.RUnlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].tenant < stats[j].tenant })
+
+	fmt.Fprintln(bw, "# HELP posts Posts stored, by tenant.")
+	fmt.Fprintln(bw, "# TYPE posts gauge")
+	for _, st := range stats {
+		fmt.Fprintf(bw, "posts{tenant=%q} %d\n", st.tenant, st.posts)
+	}
+	fmt.Fprintln(bw, "# HELP posts_body_bytes Total length of the post bodies, by tenant.")
+	fmt.Fprintln(bw, "# TYPE posts_body_bytes gauge")
+	for _, st := range stats {
+		fmt.Fprintf(bw, "posts_body_bytes{tenant=%q} %d\n", st.tenant, st.bodyBytes)
+	}
+	fmt.Fprintln(bw, "# HELP search_index_pending_posts Posts the search index rebuild has yet to index, by tenant.")
+	fmt.Fprintln(bw, "# TYPE search_index_pending_posts gauge")
+	for _, st := range stats {
+		fmt.Fprintf(bw, "search_index_pending_posts{tenant=%q} %d\n", st.tenant, st.unindexed)
+	}
+	if *storeKind != "file" {
+		return
+	}
+	fmt.Fprintln(bw, "# HELP store_file_bytes Size of the journal file, by tenant.")
+	fmt.Fprintln(bw, "# TYPE store_file_bytes gauge")
+	for _, st := range stats {
+		if st.fileBytes >= 0 {
+			fmt.Fprintf(bw, "store_file_bytes{tenant=%q} %d\n", st.tenant, st.fileBytes)
+		}
+	}
+}
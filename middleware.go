@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+)
+
+//--------------MIDDLEWARE================
+
+// A middleware wraps a handler with behaviour that cuts across routes,
+// like auth or logging, without the handlers knowing about it. The
+// with* functions around the package are middlewares.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in mws. The first middleware is the outermost, so a
+// request passes through them in the order they're listed.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// when is mw if cond is true, and otherwise a middleware that leaves
+// the handler as it is. It's for layers turned on by a flag.
+func when(cond bool, mw middleware) middleware {
+	if !cond {
+		return func(h http.Handler) http.Handler { return h }
+	}
+	return mw
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//--------------CONTENT NEGOTIATION================
+
+var strictAccept = flag.Bool("strict-accept", false, "answer 406 when the Accept header rules out every supported media type")
+
+// A Formatter serializes response values as one media type. Handlers
+// don't encode responses themselves; they call respond, which picks
+// the Formatter matching the request's Accept header.
+type Formatter interface {
+	ContentType() string
+	Encode(w io.Writer, v interface{}) error
+}
+
+// defaultMediaType is used when Accept is missing or, without
+// -strict-accept, can't be satisfied.
+const defaultMediaType = "application/json"
+
+// formatters is the registry of response formats keyed by media type.
+// Adding a format is a matter of adding it here.
+var formatters = map[string]Formatter{
+	"application/json": jsonFormatter{},
+	"application/xml":  xmlFormatter{},
+	"application/yaml": yamlFormatter{},
+}
+
+type jsonFormatter struct{}
+
+func (jsonFormatter) ContentType() string { return "application/json" }
+
+func (jsonFormatter) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// supportedTypes lists the registered media types, sorted.
+func supportedTypes() []string {
+	types := make([]string, 0, len(formatters))
+	for t := range formatters {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// respond writes v with the given status code using the Formatter the
+// request's Accept header asks for.
+func respond(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	f, _ := formatterFor(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", f.ContentType())
+	w.WriteHeader(code)
+	f.Encode(w, v)
+}
+
+// negotiated wraps a read handler so that, with -strict-accept, a
+// request whose Accept header can't be satisfied gets a 406 listing
+// the supported types. Otherwise the handler falls back to JSON.
+func negotiated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := formatterFor(r.Header.Get("Accept")); !ok && *strictAccept {
+			if wantsProblem(r) {
+				writeProblem(w, r, http.StatusNotAcceptable, "Not acceptable", map[string]interface{}{"supported": supportedTypes()})
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotAcceptable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":      "Not acceptable",
+				"supported":  supportedTypes(),
+				"request_id": requestIDOf(r),
+			})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// formatterFor picks the registered Formatter the Accept header
+// prefers most. If nothing registered is acceptable it returns the
+// default formatter and false.
+func formatterFor(accept string) (Formatter, bool) {
+	if accept == "" {
+		return formatters[defaultMediaType], true
+	}
+
+	for _, mediaRange := range acceptRanges(accept) {
+		if f, ok := formatters[mediaRange]; ok {
+			return f, true
+		}
+		// For wildcards, prefer the default before the others.
+		if mediaMatches(mediaRange, defaultMediaType) {
+			return formatters[defaultMediaType], true
+		}
+		for _, t := range supportedTypes() {
+			if mediaMatches(mediaRange, t) {
+				return formatters[t], true
+			}
+		}
+	}
+	return formatters[defaultMediaType], false
+}
+
+// acceptRanges returns the media ranges of an Accept header, most
+// preferred first. Ranges with q=0 are refusals and are dropped.
+func acceptRanges(header string) []string {
+	type weighted struct {
+		mediaRange string
+		q          float64
+	}
+
+	var ranges []weighted
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, weighted{mediaType, q})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	out := make([]string, len(ranges))
+	for i, wr := range ranges {
+		out[i] = wr.mediaRange
+	}
+	return out
+}
+
+// mediaMatches reports whether a media range such as "application/*"
+// covers the media type t.
+func mediaMatches(mediaRange, t string) bool {
+	if mediaRange == "*/*" || mediaRange == t {
+		return true
+	}
+	if strings.HasSuffix(mediaRange, "/*") {
+		return strings.HasPrefix(t, strings.TrimSuffix(mediaRange, "*"))
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+//--------------NORMALIZING BODIES================
+
+// Clients don't agree on whitespace and line endings, so the same text
+// can arrive in several forms. These flags tidy bodies up on create
+// and update, before the uniqueness check, so stored content and
+// duplicate detection don't depend on which client sent it.
+//
+// -normalize-unicode puts bodies in Unicode NFC, so an "é" typed as
+// one code point and one pasted as "e" plus a combining accent are
+// stored, searched and compared as the same text.
+var (
+	trimBodies        = flag.Bool("trim-bodies", false, "trim leading and trailing whitespace from post bodies")
+	normalizeNewlines = flag.Bool("normalize-newlines", false, "convert CRLF line endings in post bodies to LF")
+	normalizeUnicode  = flag.Bool("normalize-unicode", false, "convert post bodies to Unicode normalization form C (NFC)")
+)
+
+func normalizeBody(body string) string {
+	if *normalizeUnicode {
+		body = norm.NFC.String(body)
+	}
+	if *normalizeNewlines {
+		body = strings.ReplaceAll(body, "\r\n", "\n")
+	}
+	if *trimBodies {
+		body = strings.TrimSpace(body)
+	}
+	return body
+}
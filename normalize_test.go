@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNormalizeBodies(t *testing.T) {
+	// The "é" is an "e" and a combining acute accent.
+	const body = `{"body":"  Café\r\nnoir  "}`
+	tests := []struct {
+		name  string
+		flags []string
+		want  string
+	}{
+		{"off", nil, "  Café\r\nnoir  "},
+		{"trim", []string{"-trim-bodies=true"}, "Café\r\nnoir"},
+		{"newlines", []string{"-normalize-newlines=true"}, "  Café\nnoir  "},
+		{"unicode", []string{"-normalize-unicode=true"}, "  Café\r\nnoir  "},
+		{"all", []string{"-trim-bodies=true", "-normalize-newlines=true", "-normalize-unicode=true"}, "Café\nnoir"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, tt.flags...)
+			if p := ts.createPost(body); p.Body != tt.want {
+				t.Errorf("created %q, want %q", p.Body, tt.want)
+			}
+			for _, method := range []string{"PUT", "PATCH"} {
+				rec := ts.do(method, "/posts/1", body)
+				wantStatus(t, rec, http.StatusOK)
+				if p := decodeResponse[Post](t, rec); p.Body != tt.want {
+					t.Errorf("%s: %q, want %q", method, p.Body, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeUnicodeFindsDuplicates(t *testing.T) {
+	ts := newTestServer(t, "-normalize-unicode=true", "-unique-per-author=true")
+	ts.createPost(`{"body":"Café","author":"ann"}`)
+	wantStatus(t, ts.do("POST", "/posts", `{"body":"Café","author":"ann"}`), http.StatusConflict)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------OPENAPI================
+
+// GET /openapi.json describes the API as OpenAPI 3.0, and /docs shows
+// it in Swagger UI. The schemas are built by reflection from the same
+// structs the handlers encode and decode, using their json tags, so a
+// field added to Post shows up in the spec without anyone touching
+// this file. The routes themselves are listed in apiRoutes below,
+// which has to follow the http.Handle calls in main.
+
+// apiRoute documents one method on one path.
+type apiRoute struct {
+	method, path, summary string
+	params                []apiParam
+
+	// request and response are example values whose types give
+	// the schemas; nil means there's no body.
+	request  interface{}
+	response interface{}
+	status   int
+}
+
+type apiParam struct {
+	name, in, typ, description string
+}
+
+func queryParam(name, typ, description string) apiParam {
+	return apiParam{name, "query", typ, description}
+}
+
+var (
+	postIDParam    = apiParam{"id", "path", "string", "post ID: a number, UUID or ULID"}
+	userIDParam    = apiParam{"id", "path", "integer", "user ID"}
+	commentIDParam = apiParam{"cid", "path", "integer", "comment ID"}
+	revisionParam  = apiParam{"n", "path", "integer", "revision number"}
+)
+
+// filterParams are the list filters of parsePostFilter.
+var filterParams = []apiParam{
+	queryParam("author", "string", "posts by exactly this author"),
+	queryParam("modified_since", "string", "posts updated after this RFC 3339 time, plus {id, deleted: true, deleted_at} for those deleted since"),
+	queryParam("created_since", "string", "posts created after this RFC 3339 time"),
+	queryParam("regex", "string", "posts whose body matches this regular expression"),
+	queryParam("locked", "boolean", "posts that are or aren't locked"),
+	queryParam("tag", "string", "posts with this tag; repeat for posts with all of them"),
+}
+
+var pageParams = []apiParam{
+	queryParam("limit", "integer", fmt.Sprintf("page size, at most %d", maxLimit)),
+	queryParam("offset", "integer", "posts to skip"),
+}
+
+func params(groups ...[]apiParam) []apiParam {
+	var all []apiParam
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+var apiRoutes = []apiRoute{
+	{method: "GET", path: "/posts", summary: "List posts", response: []Post{}, status: 200, params: params(filterParams, pageParams, []apiParam{
+		queryParam("q", "string", "only posts whose body contains this, ignoring case; answers with a page"),
+		queryParam("ids", "string", "comma separated post IDs, in the order wanted"),
+		queryParam("fields", "string", "comma separated fields to include"),
+		queryParam("before", "string", "keyset paging: posts with lower IDs, newest first"),
+		queryParam("cursor", "string", "cursor paging in order=id or order=created_at: empty for the first page, then the previous page's next_cursor"),
+		queryParam("sort", "string", "id, created_at, views or as-requested"),
+		queryParam("report_missing", "boolean", "list requested IDs that don't exist"),
+		queryParam("render", "string", "html to add each body rendered from Markdown as html"),
+	})},
+	{method: "POST", path: "/posts", summary: "Create a post", request: Post{}, response: Post{}, status: 201, params: []apiParam{
+		{"Idempotency-Key", "header", "string", "retries with the same key get the first response instead of another post"},
+	}},
+	{method: "DELETE", path: "/posts", summary: "Delete several posts, each on its own", response: batchResponse{}, status: 200, params: []apiParam{
+		queryParam("ids", "string", "comma separated IDs of the posts to delete"),
+	}},
+	{method: "GET", path: "/posts/export", summary: "Download every post as CSV or NDJSON", status: 200, params: []apiParam{
+		queryParam("format", "string", "ndjson (the default) or csv"),
+	}},
+	{method: "POST", path: "/posts/import", summary: "Create a post from each row of CSV or NDJSON (in the background, answering 202, with Prefer: respond-async)", response: importResult{}, status: 200, params: []apiParam{
+		queryParam("format", "string", "csv or ndjson, if the Content-Type doesn't say"),
+	}},
+	{method: "POST", path: "/posts/batch", summary: "Create several posts, all or none", request: []Post{}, response: batchResponse{}, status: 201},
+	{method: "GET", path: "/posts/{id}", summary: "Get a post, counting a view", response: Post{}, status: 200, params: []apiParam{postIDParam,
+		queryParam("no_count", "boolean", "don't count this as a view"),
+		queryParam("render", "string", "html to add the body rendered from Markdown as html"),
+	}},
+	{method: "PUT", path: "/posts/{id}", summary: "Replace a post", request: Post{}, response: Post{}, status: 200, params: []apiParam{postIDParam}},
+	{method: "PATCH", path: "/posts/{id}", summary: "Change part of a post with a JSON Merge Patch", request: Post{}, response: Post{}, status: 200, params: []apiParam{postIDParam}},
+	{method: "DELETE", path: "/posts/{id}", summary: "Move a post and its comments to the trash", status: 200, params: []apiParam{postIDParam}},
+	{method: "POST", path: "/posts/{id}/lock", summary: "Lock a post against changes", response: Post{}, status: 200, params: []apiParam{postIDParam}},
+	{method: "POST", path: "/posts/{id}/unlock", summary: "Unlock a post", response: Post{}, status: 200, params: []apiParam{postIDParam}},
+	{method: "POST", path: "/posts/{id}/restore", summary: "Take a post back out of the trash", response: Post{}, status: 200, params: []apiParam{postIDParam}},
+	{method: "GET", path: "/posts/{id}/html", summary: "A post's body rendered from Markdown as an HTML fragment", status: 200, params: []apiParam{postIDParam}},
+	{method: "GET", path: "/posts/{id}/revisions", summary: "List a post's revisions, oldest first", response: []Revision{}, status: 200, params: []apiParam{postIDParam}},
+	{method: "POST", path: "/posts/{id}/revisions/{n}/revert", summary: "Put a post back the way it was in a revision", response: Post{}, status: 200, params: []apiParam{postIDParam, revisionParam}},
+	{method: "GET", path: "/posts/{id}/comments", summary: "List a post's comments", response: []Comment{}, status: 200, params: []apiParam{postIDParam}},
+	{method: "POST", path: "/posts/{id}/comments", summary: "Comment on a post, or with parent_id reply to one of its comments", request: Comment{}, response: Comment{}, status: 201, params: []apiParam{postIDParam}},
+	{method: "DELETE", path: "/posts/{id}/comments/{cid}", summary: "Delete a comment", status: 204, params: []apiParam{postIDParam, commentIDParam}},
+	{method: "GET", path: "/posts/search", summary: "Search posts, best match first", response: listPage{Data: []searchHit{}}, status: 200, params: params([]apiParam{
+		queryParam("q", "string", "words that must all appear"),
+	}, filterParams, pageParams)},
+	{method: "GET", path: "/posts/feed.xml", summary: "RSS feed of the latest posts", status: 200},
+	{method: "GET", path: "/posts/stats/size", summary: "Body size statistics", response: sizeStats{}, status: 200},
+	{method: "GET", path: "/posts/wordcount", summary: "Count words, overall and by author", response: wordCount{}, status: 200, params: filterParams},
+	{method: "GET", path: "/posts/diff", summary: "Line diff of two posts' bodies", response: []diffLine{}, status: 200, params: []apiParam{
+		queryParam("a", "string", "first post ID"),
+		queryParam("b", "string", "second post ID"),
+		queryParam("format", "string", "json or unified"),
+	}},
+	{method: "POST", path: "/posts/reserve", summary: "Reserve an ID for a post written later", response: Post{}, status: 201},
+	{method: "GET", path: "/posts/trash", summary: "List deleted posts, latest first", response: []Post{}, status: 200},
+	{method: "DELETE", path: "/posts/trash", summary: "Purge every post in the trash you may change", response: map[string]int{}, status: 200},
+	{method: "DELETE", path: "/posts/trash/{id}", summary: "Purge a post from the trash", status: 200, params: []apiParam{postIDParam}},
+	{method: "POST", path: "/posts/bulk", summary: "Run operations, streaming results as NDJSON on request", request: []batchOp{}, response: batchResponse{}, status: 200, params: []apiParam{
+		queryParam("atomic", "boolean", "all or nothing"),
+	}},
+	{method: "GET", path: "/graphql", summary: "Run a GraphQL query, or get the schema without one", status: 200, params: []apiParam{
+		queryParam("query", "string", "GraphQL query or subscription"),
+		queryParam("variables", "string", "JSON object of variables"),
+		queryParam("operationName", "string", "operation to run"),
+	}},
+	{method: "POST", path: "/graphql", summary: "Run a GraphQL query or mutation", request: graphqlRequest{}, response: graphqlResponse{}, status: 200},
+	{method: "POST", path: "/batch", summary: "Run operations in order under one lock", request: batchRequest{}, response: batchResponse{}, status: 200},
+	{method: "GET", path: "/tags", summary: "Tags in use with their post counts", response: []tagCount{}, status: 200},
+	{method: "GET", path: "/events", summary: "Server-Sent Events for changes to posts", status: 200},
+	{method: "GET", path: "/ws", summary: "WebSocket for post operations and change events", status: 101},
+	{method: "GET", path: "/jobs/{id}", summary: "Get a background job started with Prefer: respond-async", response: job{}, status: 200, params: []apiParam{
+		{"id", "path", "string", "job ID"},
+	}},
+	{method: "GET", path: "/users", summary: "List users", response: []User{}, status: 200},
+	{method: "POST", path: "/users", summary: "Create a user", request: User{}, response: User{}, status: 201},
+	{method: "GET", path: "/users/{id}", summary: "Get a user", response: User{}, status: 200, params: []apiParam{userIDParam}},
+	{method: "PUT", path: "/users/{id}", summary: "Rename a user (the user themselves or ADMIN_USERS only)", request: User{}, response: User{}, status: 200, params: []apiParam{userIDParam}},
+	{method: "DELETE", path: "/users/{id}", summary: "Delete a user (the user themselves or ADMIN_USERS only)", status: 204, params: []apiParam{userIDParam}},
+	{method: "GET", path: "/users/{id}/posts", summary: "List a user's posts", response: []Post{}, status: 200, params: []apiParam{userIDParam}},
+	{method: "GET", path: "/capabilities", summary: "What the client may do", response: capabilities{}, status: 200},
+	{method: "POST", path: "/auth/login", summary: "Get a bearer token (only with AUTH_SECRET set)", request: loginRequest{}, response: loginResponse{}, status: 200},
+	{method: "GET", path: "/admin/status", summary: "Get the service status banner", response: serviceStatus{}, status: 200},
+	{method: "PUT", path: "/admin/status", summary: "Set the service status banner (ADMIN_USERS only)", request: serviceStatus{}, response: serviceStatus{}, status: 200},
+	{method: "DELETE", path: "/admin/status", summary: "Clear the service status banner (ADMIN_USERS only)", status: 204},
+	{method: "GET", path: "/admin/backup", summary: "Download a snapshot of every tenant's posts and the users (ADMIN_USERS only)", response: backup{}, status: 200, params: []apiParam{
+		queryParam("format", "string", "json (the default) or tar.gz"),
+	}},
+	{method: "POST", path: "/admin/restore", summary: "Load a snapshot from GET /admin/backup (ADMIN_USERS only)", request: backup{}, response: restoreResult{}, status: 200, params: []apiParam{
+		queryParam("mode", "string", "merge (the default) to add to what's there, or replace to start over from the snapshot"),
+	}},
+	{method: "GET", path: "/healthz", summary: "Liveness check", response: healthReport{}, status: 200},
+	{method: "GET", path: "/readyz", summary: "Readiness check of every store", response: healthReport{}, status: 200},
+	{method: "GET", path: "/metrics", summary: "Prometheus metrics", status: 200},
+	{method: "GET", path: "/openapi.json", summary: "This OpenAPI document", status: 200},
+	{method: "GET", path: "/docs", summary: "Swagger UI for this document", status: 200},
+	{method: "GET", path: "/", summary: "Admin web UI", status: 200},
+}
+
+// responseTypes are what respond can encode.
+var responseTypes = []string{"application/json", "application/xml", "application/yaml"}
+
+var (
+	openAPISpec     map[string]interface{}
+	openAPISpecOnce sync.Once
+)
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPISpecOnce.Do(func() { openAPISpec = buildOpenAPI() })
+	w.Header().Set("Content-Type", "application/json")
+	jsonFormatter{}.Encode(w, openAPISpec)
+}
+
+func buildOpenAPI() map[string]interface{} {
+	s := &schemaSet{components: make(map[string]interface{})}
+	errorSchema := s.schemaOf(reflect.TypeOf(struct {
+		Error string `json:"error"`
+	}{}))
+	problemSchema := s.schemaOf(reflect.TypeOf(problem{}))
+
+	paths := make(map[string]interface{})
+	for _, route := range apiRoutes {
+		if route.path == "/auth/login" && !authEnabled() {
+			continue
+		}
+		op := map[string]interface{}{
+			"summary": route.summary,
+			"responses": map[string]interface{}{
+				fmt.Sprint(route.status): s.response(route, route.response),
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": errorSchema},
+						problemMediaType:   map[string]interface{}{"schema": problemSchema},
+					},
+				},
+			},
+		}
+		if len(route.params) > 0 {
+			var ps []interface{}
+			for _, p := range route.params {
+				ps = append(ps, map[string]interface{}{
+					"name":        p.name,
+					"in":          p.in,
+					"required":    p.in == "path",
+					"description": p.description,
+					"schema":      map[string]interface{}{"type": p.typ},
+				})
+			}
+			op["parameters"] = ps
+		}
+		if route.request != nil {
+			content := map[string]interface{}{}
+			for _, t := range []string{"application/json", "application/xml", "application/yaml"} {
+				content[t] = map[string]interface{}{"schema": s.schemaOf(reflect.TypeOf(route.request))}
+			}
+			op["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		}
+
+		item, _ := paths[route.path].(map[string]interface{})
+		if item == nil {
+			item = make(map[string]interface{})
+			paths[route.path] = item
+		}
+		item[strings.ToLower(route.method)] = op
+	}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "WebServer posts API",
+			"version": "1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": s.components},
+	}
+	if authEnabled() {
+		spec["components"].(map[string]interface{})["securitySchemes"] = map[string]interface{}{
+			"bearer": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+		}
+		spec["security"] = []interface{}{map[string]interface{}{"bearer": []string{}}}
+	}
+	return spec
+}
+
+func (s *schemaSet) response(route apiRoute, v interface{}) map[string]interface{} {
+	resp := map[string]interface{}{"description": http.StatusText(route.status)}
+	if v == nil {
+		return resp
+	}
+	content := map[string]interface{}{}
+	for _, t := range responseTypes {
+		content[t] = map[string]interface{}{"schema": s.schemaOf(reflect.TypeOf(v))}
+	}
+	resp["content"] = content
+	return resp
+}
+
+// schemaSet collects the named struct schemas that others refer to.
+type schemaSet struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType   = reflect.TypeOf(time.Time{})
+	postIDType = reflect.TypeOf(PostID(""))
+)
+
+// schemaOf returns the schema of t. Named structs go into components
+// and are referred to by $ref, so each is described once.
+func (s *schemaSet) schemaOf(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == postIDType:
+		// A number, or a UUID or ULID string; see ids.go.
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "integer"},
+			map[string]interface{}{"type": "string"},
+		}}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := s.components[name]; !ok {
+			s.components[name] = nil // stops recursion through itself
+			s.components[name] = s.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return s.structSchema(t)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	}
+	// interface{}, such as listPage's data: anything.
+	return map[string]interface{}{}
+}
+
+// structSchema follows encoding/json: unexported fields and "-" are
+// skipped, embedded structs are flattened, and omitempty fields aren't
+// required.
+func (s *schemaSet) structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	s.addFields(t, props, &required)
+	schema := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s *schemaSet) addFields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			s.addFields(f.Type, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.schemaOf(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+//--------------SWAGGER UI================
+
+// docsPage loads Swagger UI from a CDN rather than shipping its
+// assets, so /docs needs the browser to have internet access; the spec
+// itself is always served locally.
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>WebServer API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, docsPage)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+)
+
+//--------------PROBLEM DETAILS================
+
+// With -problem-details, or for a request that accepts
+// application/problem+json, errors are sent as RFC 7807 problem
+// details instead of the usual {"error":...} body:
+//
+//	{"type":"about:blank","title":"Not Found","status":404,
+//	 "detail":"Post not found","instance":"/posts/7"}
+//
+// We don't define problem types of our own, so type is always
+// about:blank and title is the standard text for the status code.
+
+const problemMediaType = "application/problem+json"
+
+var problemDetails = flag.Bool("problem-details", false, "send all errors as RFC 7807 application/problem+json")
+
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// wantsProblem reports whether r's errors should be problem details.
+// Only an explicit application/problem+json in Accept counts, not a
+// wildcard, so clients that don't know the format aren't surprised.
+func wantsProblem(r *http.Request) bool {
+	if *problemDetails {
+		return true
+	}
+	for _, mediaRange := range acceptRanges(r.Header.Get("Accept")) {
+		if mediaRange == problemMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeProblem sends a problem details body. Any extra members, like
+// the supported types of a 406, go in alongside the standard ones, as
+// does the request ID.
+func writeProblem(w http.ResponseWriter, r *http.Request, code int, detail string, extra map[string]interface{}) {
+	if id := requestIDOf(r); id != "" {
+		withID := map[string]interface{}{"request_id": id}
+		for k, v := range extra {
+			withID[k] = v
+		}
+		extra = withID
+	}
+
+	title := http.StatusText(code)
+	if code == statusBandwidthLimitExceeded {
+		title = "Bandwidth Limit Exceeded"
+	}
+	p := problem{
+		Type:     "about:blank",
+		Title:    title,
+		Status:   code,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", problemMediaType)
+	w.WriteHeader(code)
+	if len(extra) == 0 {
+		json.NewEncoder(w).Encode(p)
+		return
+	}
+	body := map[string]interface{}{
+		"type":     p.Type,
+		"title":    p.Title,
+		"status":   p.Status,
+		"detail":   p.Detail,
+		"instance": p.Instance,
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError sends msg as a JSON error body, e.g.
+// {"error":"...","request_id":"..."}, or as problem details if r wants
+// them. Every error goes out through here, so clients can read any
+// failure the same way.
+func writeError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	if wantsProblem(r) {
+		writeProblem(w, r, code, msg, nil)
+		return
+	}
+	body := map[string]string{"error": msg}
+	if id := requestIDOf(r); id != "" {
+		body["request_id"] = id
+	}
+	// Whatever a handler said about its body before failing is void.
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+//--------------PROTOBUF WIRE FORMAT================
+
+// Just enough of the protobuf wire format for the messages in
+// proto/posts.proto, written out by hand so the server doesn't need
+// the protobuf module and generated code. Only the wire types those
+// messages use are written: varints for integers and bools, and
+// length-delimited for strings and nested messages. Reading skips
+// fields it doesn't know, of any wire type, as protobuf readers must.
+//
+// As in proto3, zero values aren't written, and a missing field reads
+// as zero.
+
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+var errBadProtobuf = errors.New("malformed protobuf message")
+
+// pbWriter builds a message field by field.
+type pbWriter struct {
+	buf []byte
+}
+
+func (w *pbWriter) tag(field, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wireType))
+}
+
+// varint writes an int32, int64, uint or enum field. Negative numbers
+// take ten bytes, as protobuf has them.
+func (w *pbWriter) varint(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, pbVarint)
+	w.buf = binary.AppendUvarint(w.buf, uint64(v))
+}
+
+func (w *pbWriter) bool(field int, v bool) {
+	if v {
+		w.varint(field, 1)
+	}
+}
+
+func (w *pbWriter) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	w.tag(field, pbBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// strings writes a repeated string field, one entry per string.
+func (w *pbWriter) strings(field int, ss []string) {
+	for _, s := range ss {
+		w.tag(field, pbBytes)
+		w.buf = binary.AppendUvarint(w.buf, uint64(len(s)))
+		w.buf = append(w.buf, s...)
+	}
+}
+
+// message writes a nested message, even an empty one, as that's how
+// protobuf tells it from a missing one.
+func (w *pbWriter) message(field int, m []byte) {
+	w.tag(field, pbBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(m)))
+	w.buf = append(w.buf, m...)
+}
+
+// timestamp writes a google.protobuf.Timestamp, unless t is zero.
+func (w *pbWriter) timestamp(field int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	var ts pbWriter
+	ts.varint(1, t.Unix())
+	ts.varint(2, int64(t.Nanosecond()))
+	w.message(field, ts.buf)
+}
+
+// pbField is one field read from a message. For varints n holds the
+// value; for length-delimited fields b holds the bytes.
+type pbField struct {
+	num      int
+	wireType int
+	n        uint64
+	b        []byte
+}
+
+func (f pbField) string() string { return string(f.b) }
+
+// int32 reads an int32 varint, which protobuf sign-extends to 64 bits.
+func (f pbField) int32() int32 { return int32(f.n) }
+
+func (f pbField) int64() int64 { return int64(f.n) }
+
+func (f pbField) bool() bool { return f.n != 0 }
+
+// readProtobuf calls fn with each field of the message in b, in order.
+func readProtobuf(b []byte, fn func(f pbField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key>>3 == 0 || key>>3 > math.MaxInt32 {
+			return errBadProtobuf
+		}
+		b = b[n:]
+		f := pbField{num: int(key >> 3), wireType: int(key & 7)}
+		switch f.wireType {
+		case pbVarint:
+			if f.n, n = binary.Uvarint(b); n <= 0 {
+				return errBadProtobuf
+			}
+			b = b[n:]
+		case pbFixed64:
+			if len(b) < 8 {
+				return errBadProtobuf
+			}
+			f.n, b = binary.LittleEndian.Uint64(b), b[8:]
+		case pbBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errBadProtobuf
+			}
+			f.b, b = b[n:n+int(size)], b[n+int(size):]
+		case pbFixed32:
+			if len(b) < 4 {
+				return errBadProtobuf
+			}
+			f.n, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			// Groups, long deprecated, and nonsense.
+			return errBadProtobuf
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
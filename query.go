@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--------------LIST QUERY PARAMETERS================
+
+// postFields are the JSON field names a client can ask for with
+// ?fields=.
+var postFields = map[string]bool{
+	"id":         true,
+	"body":       true,
+	"author":     true,
+	"author_id":  true,
+	"created_at": true,
+	"updated_at": true,
+	"locked":     true,
+	"views":      true,
+	"tags":       true,
+}
+
+// parseIDs parses a comma separated ?ids= value. An empty value means
+// no ID filter and returns nil. Repeated IDs are only kept once, at
+// their first position.
+func parseIDs(s string) ([]PostID, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var ids []PostID
+	seen := make(map[PostID]bool)
+	for _, part := range strings.Split(s, ",") {
+		id, ok := parsePostID(strings.TrimSpace(part))
+		if !ok {
+			return nil, errors.New("Invalid post ID in ids: " + part)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseFields parses a comma separated ?fields= value, rejecting
+// names that aren't fields of a Post.
+func parseFields(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var fields []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if !postFields[f] {
+			return nil, errors.New("Unknown field in fields: " + f)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// project returns only the requested fields of p, keyed by their JSON
+// names.
+func project(p Post, fields []string) map[string]interface{} {
+	m := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		switch f {
+		case "id":
+			m["id"] = p.ID
+		case "body":
+			m["body"] = p.Body
+		case "author":
+			m["author"] = p.Author
+		case "author_id":
+			m["author_id"] = p.AuthorID
+		case "created_at":
+			m["created_at"] = p.CreatedAt
+		case "updated_at":
+			m["updated_at"] = p.UpdatedAt
+		case "locked":
+			m["locked"] = p.Locked
+		case "views":
+			m["views"] = p.Views
+		case "tags":
+			m["tags"] = p.Tags
+		}
+	}
+	return m
+}
+
+// postFilter holds the filters shared by GET /posts and the endpoints
+// that summarize the same subsets of posts:
+//
+//	?author=         posts by exactly this author
+//	?modified_since= posts updated after this RFC3339 time (GET /posts
+//	                 also lists the ones deleted since, as stubs)
+//	?regex=          posts whose body matches this regular expression
+//	?created_since=  posts created after this RFC3339 time
+//	?locked=         posts that are (true) or aren't (false) locked
+//	?tag=            posts with this tag; repeat it for posts with all
+type postFilter struct {
+	author       string
+	hasAuthor    bool
+	since        time.Time
+	regex        *regexp.Regexp
+	createdSince time.Time
+	locked       *bool
+	tags         []string
+}
+
+// maxRegexLen bounds ?regex= patterns. Go's regexp runs in time
+// linear in the input, so there is no catastrophic backtracking to
+// guard against, but compiling and matching still grow with the size
+// of the pattern.
+const maxRegexLen = 256
+
+func parsePostFilter(q url.Values) (postFilter, error) {
+	var f postFilter
+	if v, ok := q["author"]; ok {
+		f.author, f.hasAuthor = v[0], true
+	}
+	if v := q.Get("modified_since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, errors.New("Invalid modified_since, expected RFC3339")
+		}
+		f.since = t
+	}
+	if v, ok := q["regex"]; ok {
+		if len(v[0]) > maxRegexLen {
+			return f, fmt.Errorf("regex must be at most %d bytes", maxRegexLen)
+		}
+		re, err := regexp.Compile(v[0])
+		if err != nil {
+			return f, errors.New("Invalid regex: " + err.Error())
+		}
+		f.regex = re
+	}
+	if v := q.Get("created_since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, errors.New("Invalid created_since, expected RFC3339")
+		}
+		f.createdSince = t
+	}
+	if v := q.Get("locked"); v != "" {
+		locked, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, errors.New("Invalid locked flag")
+		}
+		f.locked = &locked
+	}
+	for _, t := range q["tag"] {
+		f.tags = append(f.tags, strings.ToLower(strings.TrimSpace(t)))
+	}
+	return f, nil
+}
+
+// apply keeps the posts matching every filter, filtering in place.
+func (f postFilter) apply(ps []Post) []Post {
+	kept := ps[:0]
+	for _, p := range ps {
+		if f.hasAuthor && p.Author != f.author {
+			continue
+		}
+		if !f.since.IsZero() && !p.UpdatedAt.After(f.since) {
+			continue
+		}
+		if f.regex != nil && !f.regex.MatchString(p.Body) {
+			continue
+		}
+		if !f.createdSince.IsZero() && !p.CreatedAt.After(f.createdSince) {
+			continue
+		}
+		if f.locked != nil && p.Locked != *f.locked {
+			continue
+		}
+		if !hasAllTags(p, f.tags) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// matchingSearch keeps the posts whose body contains term, ignoring
+// case, filtering in place.
+func matchingSearch(ps []Post, term string) []Post {
+	term = strings.ToLower(term)
+	kept := ps[:0]
+	for _, p := range ps {
+		if strings.Contains(strings.ToLower(p.Body), term) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// listPage is the response to a ?q= search or to paging with
+// ?limit= and ?offset=: one page of results plus the number of posts
+// matching before pagination, and a link to the next page if there's
+// more.
+type listPage struct {
+	Data   interface{} `json:"data"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	Next   string      `json:"next,omitempty"`
+
+	// Missing is only set with ?report_missing=true.
+	Missing []PostID `json:"missing,omitempty"`
+}
+
+// missingPage is the response to ?ids=...&report_missing=true: the
+// posts found, plus the requested IDs that don't exist. IDs of posts
+// that exist but were filtered out are in neither.
+type missingPage struct {
+	Data    interface{} `json:"data"`
+	Missing []PostID    `json:"missing"`
+}
+
+// keysetPage is the response to ?before=. PrevCursor is the ?before=
+// for the next page back, or null when there are no older posts.
+type keysetPage struct {
+	Data       interface{} `json:"data"`
+	PrevCursor *PostID     `json:"prev_cursor"`
+
+	// Missing is only set with ?report_missing=true.
+	Missing []PostID `json:"missing,omitempty"`
+}
+
+// pageBefore returns up to limit of the posts with IDs below before,
+// highest first, and the cursor for the page after that if there is
+// one. Keying on the ID rather than an offset means posts created or
+// deleted while paging don't shift what the next page holds.
+func pageBefore(ps []Post, before PostID, limit int) ([]Post, *PostID) {
+	older := ps[:0]
+	for _, p := range ps {
+		if p.ID.less(before) {
+			older = append(older, p)
+		}
+	}
+	sort.Slice(older, func(i, j int) bool { return older[j].ID.less(older[i].ID) })
+
+	if len(older) <= limit {
+		return older, nil
+	}
+	older = older[:limit]
+	cursor := older[limit-1].ID
+	return older, &cursor
+}
+
+// cursorPage is the response to ?cursor=. NextCursor is the ?cursor=
+// for the next page, or null on the last one.
+type cursorPage struct {
+	Data       interface{} `json:"data"`
+	NextCursor *string     `json:"next_cursor"`
+}
+
+// pageCursor is where a page of ?cursor= ends: the order it's in and
+// the last post on it. Clients get it as opaque base64 of its JSON.
+type pageCursor struct {
+	Order     string     `json:"order"`
+	ID        PostID     `json:"id"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// parseCursor reads a ?cursor=, which an empty one starts in order. A
+// cursor keeps its order, so ?order= needn't be sent again but can't
+// change along the way.
+func parseCursor(v, order string) (pageCursor, error) {
+	if order != "" && order != "id" && order != "created_at" {
+		return pageCursor{}, errors.New("cursor pages in order=id or order=created_at")
+	}
+	if v == "" {
+		if order == "" {
+			order = "id"
+		}
+		return pageCursor{Order: order}, nil
+	}
+
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || (c.Order != "id" && c.Order != "created_at") || c.ID == "" || (c.Order == "created_at") != (c.CreatedAt != nil) {
+		return pageCursor{}, errors.New("cursor is invalid")
+	}
+	if order != "" && order != c.Order {
+		return pageCursor{}, errors.New("cursor is for order=" + c.Order)
+	}
+	return c, nil
+}
+
+func (c pageCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// after reports whether p comes after the cursor in its order.
+func (c pageCursor) after(p Post) bool {
+	if c.CreatedAt != nil && !p.CreatedAt.Equal(*c.CreatedAt) {
+		return p.CreatedAt.After(*c.CreatedAt)
+	}
+	return c.ID.less(p.ID)
+}
+
+// pageAfter returns up to limit of ps, which are sorted in c's order,
+// that come after c, and the cursor for the page after that if there
+// is one. Like pageBefore, it's keyed on the last post seen, so posts
+// created or deleted while paging don't shift the pages.
+func pageAfter(ps []Post, c pageCursor, limit int) ([]Post, *string) {
+	i := sort.Search(len(ps), func(i int) bool { return c.after(ps[i]) })
+	ps = ps[i:]
+	if len(ps) <= limit {
+		return ps, nil
+	}
+	ps = ps[:limit]
+	last := ps[limit-1]
+	next := pageCursor{Order: c.Order, ID: last.ID}
+	if c.Order == "created_at" {
+		next.CreatedAt = &last.CreatedAt
+	}
+	cursor := next.String()
+	return ps, &cursor
+}
+
+// postsAfter returns up to n of the listable posts matching f with IDs
+// above afterID, lowest first. It reads them from the store a chunk at
+// a time, so a page near the start doesn't copy every post.
+func (s *postSet) postsAfter(afterID PostID, n int, f postFilter) []Post {
+	var ps []Post
+	for len(ps) < n {
+		chunk := s.store.ListAfter(afterID, maxLimit)
+		if len(chunk) == 0 {
+			break
+		}
+		afterID = chunk[len(chunk)-1].ID
+		ps = append(ps, f.apply(listable(chunk))...)
+	}
+	if len(ps) > n {
+		ps = ps[:n]
+	}
+	return ps
+}
+
+// maxLimit caps ?limit= so a single page can't be the whole map.
+const maxLimit = 100
+
+// parseLimitOffset reads ?limit= and ?offset=, using defaultLimit
+// when no limit is given.
+func parseLimitOffset(q url.Values, defaultLimit int) (limit, offset int, err error) {
+	limit = defaultLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// nextPageURL is the request's URL with limit and offset set for the
+// following page, keeping every other parameter.
+func nextPageURL(r *http.Request, limit, offset int) string {
+	q := r.URL.Query()
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("offset", strconv.Itoa(offset))
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// paginate returns the page of ps starting at offset.
+func paginate(ps []Post, limit, offset int) []Post {
+	if offset >= len(ps) {
+		return ps[:0]
+	}
+	ps = ps[offset:]
+	if len(ps) > limit {
+		ps = ps[:limit]
+	}
+	return ps
+}
+
+// sortByID orders posts by ascending ID; see ids.go.
+func sortByID(ps []Post) {
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID.less(ps[j].ID) })
+}
+
+// sortByCreated orders posts oldest first, then by ascending ID.
+func sortByCreated(ps []Post) {
+	sort.Slice(ps, func(i, j int) bool {
+		if !ps[i].CreatedAt.Equal(ps[j].CreatedAt) {
+			return ps[i].CreatedAt.Before(ps[j].CreatedAt)
+		}
+		return ps[i].ID.less(ps[j].ID)
+	})
+}
+
+// sortByViews orders posts most viewed first, then by ascending ID.
+func sortByViews(ps []Post) {
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].Views != ps[j].Views {
+			return ps[i].Views > ps[j].Views
+		}
+		return ps[i].ID.less(ps[j].ID)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// syncedIDs lists GET /posts?modified_since=since plus query, and
+// returns the IDs of the posts in it, or in its data if it's a page,
+// with a "-" before those sent as deleted stubs, sorted.
+func (ts *testServer) syncedIDs(since, query string) []string {
+	ts.t.Helper()
+	rec := ts.do("GET", "/posts?modified_since="+url.QueryEscape(since)+query, "")
+	wantStatus(ts.t, rec, http.StatusOK)
+	var items []map[string]interface{}
+	if strings.HasPrefix(rec.Body.String(), "{") {
+		items = decodeResponse[struct{ Data []map[string]interface{} }](ts.t, rec).Data
+	} else {
+		items = decodeResponse[[]map[string]interface{}](ts.t, rec)
+	}
+	var ids []string
+	for _, item := range items {
+		id := fmt.Sprint(item["id"])
+		if item["deleted"] == true {
+			if _, ok := item["deleted_at"].(string); !ok || len(item) != 3 {
+				ts.t.Errorf("stub %v, want only id, deleted and deleted_at", item)
+			}
+			id = "-" + id
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestModifiedSince(t *testing.T) {
+	ts := newTestServer(t, "-gone-retention=1h")
+
+	ts.createPost(`{"body":"untouched","author":"ann"}`)                  // 1
+	ts.createPost(`{"body":"updated later","author":"ann"}`)              // 2
+	ts.createPost(`{"body":"deleted later","author":"ann"}`)              // 3
+	ts.createPost(`{"body":"purged later","author":"ann"}`)               // 4
+	ts.createPost(`{"body":"deleted before"}`)                            // 5
+	ts.createPost(`{"body":"deleted and restored later","author":"ann"}`) // 6
+	wantStatus(t, ts.do("DELETE", "/posts/5", ""), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/6", ""), http.StatusOK)
+
+	// The client's last sync.
+	since := ts.do("GET", "/posts", "").Header().Get("X-Server-Time")
+	if since == "" {
+		t.Fatal("no X-Server-Time")
+	}
+
+	ts.createPost(`{"body":"created later","author":"bob"}`) // 7
+	wantStatus(t, ts.do("PATCH", "/posts/2", `{"body":"updated"}`), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/3", ""), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/4", ""), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/trash/4", ""), http.StatusOK)
+	wantStatus(t, ts.do("POST", "/posts/6/restore", ""), http.StatusOK)
+
+	tests := []struct {
+		name, query string
+		want        []string
+	}{
+		{"everything", "", []string{"-3", "-4", "2", "6", "7"}},
+		{"paginated", "&limit=2&offset=0", []string{"-3", "2"}},
+		// Stubs have nothing to filter on, so they're always sent.
+		{"filtered", "&author=bob", []string{"-3", "-4", "7"}},
+		{"searching", "&q=later", []string{"6", "7"}},
+		{"cursor", "&cursor=", []string{"2", "6", "7"}},
+	}
+	for _, tt := range tests {
+		if got := ts.syncedIDs(since, tt.query); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Nothing has changed since now.
+	now := ts.do("GET", "/posts", "").Header().Get("X-Server-Time")
+	if got := ts.syncedIDs(now, ""); len(got) != 0 {
+		t.Errorf("since the last sync: got %v, want nothing", got)
+	}
+}
+
+func TestModifiedSinceMissesUntrackedPurges(t *testing.T) {
+	// Without -gone-retention a purged post leaves no trace.
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"one"}`)
+	ts.createPost(`{"body":"two"}`)
+	since := ts.do("GET", "/posts", "").Header().Get("X-Server-Time")
+
+	wantStatus(t, ts.do("DELETE", "/posts/1", ""), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/2", ""), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/trash/2", ""), http.StatusOK)
+	if got := ts.syncedIDs(since, ""); strings.Join(got, ",") != "-1" {
+		t.Errorf("got %v, want [-1]", got)
+	}
+}
+
+func TestModifiedSinceAfterRollback(t *testing.T) {
+	ts := newTestServer(t, "-gone-retention=1h")
+	ts.createPost(`{"body":"one"}`)
+	ts.createPost(`{"body":"two"}`)
+	since := ts.do("GET", "/posts", "").Header().Get("X-Server-Time")
+
+	// Each deletes a post and then fails, so nothing is deleted.
+	wantStatus(t, ts.do("POST", "/batch", `{"atomic":true,"operations":[{"op":"delete","id":1},{"op":"delete","id":99}]}`), http.StatusConflict)
+	wantStatus(t, ts.do("POST", "/posts/bulk?atomic=true", `[{"op":"delete","id":2},{"op":"update","id":99,"post":{"body":"x"}}]`), http.StatusConflict)
+
+	if got := ts.syncedIDs(since, ""); len(got) != 0 {
+		t.Errorf("got %v, want nothing", got)
+	}
+	for _, path := range []string{"/posts/1", "/posts/2"} {
+		wantStatus(t, ts.do("GET", path, ""), http.StatusOK)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//--------------RATE LIMITING================
+
+// Each client IP gets a token bucket per route group: reads (GET and
+// HEAD) and writes (everything else). A request takes a token; the
+// bucket refills at the group's rate up to its burst size, and a
+// client with an empty bucket gets 429 with a Retry-After saying when
+// the next token arrives. A rate of 0 leaves the group unlimited.
+//
+// Behind a proxy every request comes from the proxy's address, so the
+// client is taken from X-Forwarded-For instead, but only when the
+// request came from one of -trusted-proxies; otherwise anyone could
+// dodge the limit by sending the header themselves.
+var (
+	readRate   = flag.Float64("rate-reads", 0, "reads (GET, HEAD) per second allowed per client IP (0 means unlimited)")
+	readBurst  = flag.Int("burst-reads", 20, "reads a client may make at once before -rate-reads applies")
+	writeRate  = flag.Float64("rate-writes", 0, "writes per second allowed per client IP (0 means unlimited)")
+	writeBurst = flag.Int("burst-writes", 5, "writes a client may make at once before -rate-writes applies")
+)
+
+// trustedProxies are the networks whose X-Forwarded-For is believed.
+var trustedProxies []*net.IPNet
+
+func init() {
+	flag.Func("trusted-proxies", "comma separated CIDRs of proxies whose X-Forwarded-For names the client, e.g. 10.0.0.0/8", func(s string) error {
+		for _, cidr := range strings.Split(s, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return err
+			}
+			trustedProxies = append(trustedProxies, n)
+		}
+		return nil
+	})
+}
+
+// rateLimits are the limits requests are held to. Requests read them
+// from currentRateLimits rather than the flags, so that a SIGHUP (see
+// reload.go) can swap all four at once while requests are served.
+type rateLimits struct {
+	readRate   float64
+	readBurst  int
+	writeRate  float64
+	writeBurst int
+}
+
+var currentRateLimits atomic.Pointer[rateLimits]
+
+func rateLimitsFromFlags() *rateLimits {
+	return &rateLimits{*readRate, *readBurst, *writeRate, *writeBurst}
+}
+
+// limit returns the rate and burst for reads or writes.
+func (l *rateLimits) limit(write bool) (float64, int) {
+	if write {
+		return l.writeRate, l.writeBurst
+	}
+	return l.readRate, l.readBurst
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	write bool
+	ip    string
+}
+
+var (
+	buckets   = make(map[bucketKey]*bucket)
+	bucketsMu sync.Mutex
+)
+
+// withRateLimit is always in the chain, even with both rates 0, since
+// a reload may turn the limits on.
+func withRateLimit(next http.Handler) http.Handler {
+	currentRateLimits.Store(rateLimitsFromFlags())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead
+		rate, burst := currentRateLimits.Load().limit(write)
+		if rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if wait := takeToken(bucketKey{write, clientIP(r)}, rate, burst, time.Now()); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, fmt.Sprintf("Rate limit exceeded, retry in %s", wait.Round(time.Millisecond)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// takeToken takes a token from key's bucket, returning 0, or returns
+// how long until there will be one.
+func takeToken(key bucketKey, rate float64, burst int, now time.Time) time.Duration {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// forgetIdleBuckets drops buckets that haven't been used for an
+// interval, so clients that went away don't use memory forever. Unless
+// the rate is tiny they've refilled by then, so a new bucket is the
+// same as the old one.
+func forgetIdleBuckets(interval time.Duration) {
+	for range time.Tick(interval) {
+		bucketsMu.Lock()
+		for key, b := range buckets {
+			if time.Since(b.last) >= interval {
+				delete(buckets, key)
+			}
+		}
+		bucketsMu.Unlock()
+	}
+}
+
+// clientIP is the address of the client that made r: the peer, or
+// with a trusted proxy in front, the last address in X-Forwarded-For
+// that isn't one of our proxies.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// A Unix socket has no client address.
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
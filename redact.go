@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+//--------------REDACTING LOGGED BODIES================
+
+// Post bodies can hold personal or confidential content, which
+// shouldn't end up in logs. With -redact-bodies, anything that logs a
+// post goes through redacted first, so only the size of the body is
+// shown, e.g. [redacted 128 bytes].
+var redactBodies = flag.Bool("redact-bodies", false, "replace post bodies in logs with their length")
+
+// redacted returns ps ready to be logged: unchanged, or copies with
+// the bodies replaced if -redact-bodies is set.
+func redacted(ps []Post) []Post {
+	if !*redactBodies {
+		return ps
+	}
+	out := make([]Post, len(ps))
+	for i, p := range ps {
+		p.Body = redactedBody(p.Body)
+		p.packed = nil
+		out[i] = p
+	}
+	return out
+}
+
+func redactedBody(body string) string {
+	return fmt.Sprintf("[redacted %d bytes]", len(body))
+}
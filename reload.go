@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//--------------RELOADING================
+
+// On SIGHUP the server reads the -config file again and applies what
+// changed in it, without a restart, to these settings:
+//
+//	log-level
+//	rate-reads, burst-reads, rate-writes, burst-writes
+//
+// Every new value is checked before any is used, so a bad file changes
+// nothing and the server carries on as it was. The rate limits change
+// together, for requests already being served too.
+//
+// Everything else, like -addr or -store, is only read at startup; a
+// change to it is logged as ignored and takes effect on the next
+// restart. So is a change to a setting given on the command line or in
+// the environment, which win over the file as they do at startup.
+// Without -config there's nothing to reload, and a SIGHUP is only
+// logged. (There are no CORS or webhook settings in this server yet;
+// when there are, they belong in reloadConfig too.)
+
+// reloadOnSignal reloads the configuration on every SIGHUP.
+func reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if *configFile == "" {
+			slog.Warn("SIGHUP: no -config file to reload")
+			continue
+		}
+		if err := reloadConfig(); err != nil {
+			slog.Error("reloading configuration, nothing changed", "err", err)
+		}
+	}
+}
+
+// reloadConfig applies the changes to the -config file since it was
+// last read.
+func reloadConfig() error {
+	file, err := readConfigFile(*configFile)
+	if err != nil {
+		return err
+	}
+
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	limits := *rateLimitsFromFlags()
+
+	var errs, changed []string
+	values := make(map[string]string)
+	for _, name := range changedSettings(fileConfig, file) {
+		if pinnedFlags[name] {
+			slog.Warn("config file change ignored: set on the command line or in the environment", "setting", name)
+			continue
+		}
+		v := flag.Lookup(name).DefValue
+		if list := file[name]; len(list) > 0 {
+			v = list[len(list)-1]
+		}
+
+		var err error
+		switch name {
+		case "log-level":
+			level, err = parseLogLevel(v)
+		case "rate-reads":
+			limits.readRate, err = strconv.ParseFloat(v, 64)
+		case "burst-reads":
+			limits.readBurst, err = strconv.Atoi(v)
+		case "rate-writes":
+			limits.writeRate, err = strconv.ParseFloat(v, 64)
+		case "burst-writes":
+			limits.writeBurst, err = strconv.Atoi(v)
+		default:
+			slog.Warn("config file change ignored until restart", "setting", name)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("setting %q: %v", name, err))
+			continue
+		}
+		values[name] = v
+		changed = append(changed, name)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: %s", *configFile, strings.Join(errs, "; "))
+	}
+
+	currentLogLevel.Set(level)
+	currentRateLimits.Store(&limits)
+	// The flags too, so the next reload starts from these.
+	for name, v := range values {
+		flag.Set(name, v)
+	}
+	fileConfig = file
+	slog.Info("reloaded configuration", "file", *configFile, "changed", strings.Join(changed, ","))
+	return nil
+}
+
+// changedSettings returns the names of the settings that differ
+// between two readings of the config file, in order.
+func changedSettings(old, new map[string][]string) []string {
+	var names []string
+	for name, v := range new {
+		if !slices.Equal(old[name], v) {
+			names = append(names, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withConfigFile points -config at a file holding config, as read at
+// startup, until the test ends. It returns a func that rewrites the
+// file.
+func withConfigFile(t *testing.T, config string) func(string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(config)
+	setFlag(t, "config", path)
+
+	oldFile, oldPinned, oldLevel := fileConfig, pinnedFlags, currentLogLevel.Level()
+	t.Cleanup(func() {
+		fileConfig, pinnedFlags = oldFile, oldPinned
+		currentLogLevel.Set(oldLevel)
+	})
+	var err error
+	if fileConfig, err = readConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	pinnedFlags = make(map[string]bool)
+	return write
+}
+
+func TestReloadConfig(t *testing.T) {
+	rewrite := withConfigFile(t, `{"addr": ":8081"}`)
+	// Restored when the test ends, since a reload sets them.
+	setFlag(t, "log-level", "info")
+	setFlag(t, "rate-writes", "0")
+	setFlag(t, "burst-writes", "5")
+	ts := newTestServer(t)
+
+	ts.createPost(`{"body":"one"}`)
+	ts.createPost(`{"body":"two"}`)
+
+	rewrite(`{"addr": ":9090", "log-level": "debug", "rate-writes": 0.001, "burst-writes": 1}`)
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentLogLevel.Level(); got != slog.LevelDebug {
+		t.Errorf("log level %v, want debug", got)
+	}
+	if *addr != ":8081" {
+		t.Errorf("-addr changed to %s", *addr)
+	}
+	// The handler made before the reload goes by the new limits.
+	ts.createPost(`{"body":"three"}`)
+	rec := ts.do("POST", "/posts", `{"body":"four"}`)
+	wantStatus(t, rec, http.StatusTooManyRequests)
+
+	// Dropping a setting from the file puts back its default.
+	rewrite(`{"addr": ":9090", "log-level": "debug"}`)
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if l := currentRateLimits.Load(); l.writeRate != 0 || l.writeBurst != 5 {
+		t.Errorf("limits %+v, want the defaults", *l)
+	}
+	ts.createPost(`{"body":"four"}`)
+}
+
+func TestReloadConfigChangesNothingOnError(t *testing.T) {
+	rewrite := withConfigFile(t, `{}`)
+	setFlag(t, "log-level", "info")
+	setFlag(t, "rate-reads", "0")
+	newTestServer(t)
+
+	for _, config := range []string{
+		`{"log-level": "debug", "rate-reads": "fast"}`,
+		`{"log-level": "loud"}`,
+		`{"log-level": "debug", "no-such-setting": 1}`,
+		`{"log-level": "debug",`,
+	} {
+		rewrite(config)
+		if err := reloadConfig(); err == nil {
+			t.Errorf("%s: no error", config)
+		}
+		if got := currentLogLevel.Level(); got != slog.LevelInfo {
+			t.Errorf("%s: log level %v, want info", config, got)
+		}
+		if l := currentRateLimits.Load(); l.readRate != 0 {
+			t.Errorf("%s: read rate %v", config, l.readRate)
+		}
+	}
+}
+
+func TestReloadConfigKeepsPinnedFlags(t *testing.T) {
+	rewrite := withConfigFile(t, `{}`)
+	setFlag(t, "log-level", "warn")
+	pinnedFlags["log-level"] = true
+
+	rewrite(`{"log-level": "debug"}`)
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if *logLevel != "warn" || currentLogLevel.Level() == slog.LevelDebug {
+		t.Errorf("-log-level %s, level %v; want warn kept", *logLevel, currentLogLevel.Level())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"time"
+)
+
+//--------------RESERVING IDS================
+
+var reservationTTL = flag.Duration("reservation-ttl", time.Hour, "how long a reserved post waits to be finalized before it's dropped")
+
+// handleReservePost allocates an ID for a post whose content comes
+// later. The placeholder is marked reserved and left out of listings
+// until an update finalizes it; otherwise it expires after
+// -reservation-ttl.
+func handleReservePost(w http.ResponseWriter, r *http.Request) {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	authorID, err := authorIDFor(r, 0)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	p := Post{
+		AuthorID:  authorID,
+		ID:        s.allocateID(),
+		Reserved:  true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.store.Create(p); err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	s.version++
+	delete(s.tombstones, p.ID)
+	s.emitEvent("post.reserved", p)
+
+	respond(w, r, http.StatusCreated, p)
+}
+
+// expireReservations deletes reservations older than -reservation-ttl,
+// checking once per interval.
+func expireReservations(interval time.Duration) {
+	for range time.Tick(interval) {
+		postsMu.Lock()
+		for _, s := range tenants {
+			for _, p := range s.store.List() {
+				if p.Reserved && time.Since(p.CreatedAt) >= *reservationTTL {
+					// Not worth keeping in the trash.
+					s.deletePost(p.ID)
+					s.purgePost(p.ID)
+				}
+			}
+		}
+		postsMu.Unlock()
+	}
+}
+
+// listable drops reserved posts, which don't belong in listings until
+// they're finalized. It filters in place.
+func listable(ps []Post) []Post {
+	kept := ps[:0]
+	for _, p := range ps {
+		if !p.Reserved {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
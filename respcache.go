@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//--------------RESPONSE CACHE================
+
+var (
+	responseCacheSize = flag.Int("response-cache-size", 0, "encoded GET /posts and GET /posts/{id} responses kept in memory, least recently used dropped first (0 disables the cache)")
+	responseCacheTTL  = flag.Duration("response-cache-ttl", time.Minute, "how long a response stays in -response-cache-size")
+)
+
+// Read-heavy clients ask for the same posts and pages over and over,
+// and each time the handler holds the read lock while it filters,
+// sorts and encodes them. With -response-cache-size the encoded 200
+// responses are kept and sent again as they are.
+//
+// Entries are keyed by the tenant's version (see etag.go) along with
+// the URL and the response format, so every change to the posts makes
+// the old entries unreachable and they're soon dropped; there's no
+// serving a page from before a write. Views don't change the version,
+// though, so the view counts in a cached response can be up to
+// -response-cache-ttl old.
+//
+// A hit on GET /posts/{id} still counts the view unless ?no_count=true;
+// only the encoding is saved.
+//
+// Hits and misses show up in /metrics as response_cache_hits_total and
+// response_cache_misses_total.
+
+// maxCachedResponse is the largest body kept, so a few huge lists
+// can't push everything else out or use unbounded memory.
+const maxCachedResponse = 1 << 20
+
+type responseCacheKey struct {
+	tenant      string
+	version     uint64
+	url         string
+	contentType string
+}
+
+type cachedResponse struct {
+	key     responseCacheKey
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// responseCache is an LRU list of cachedResponses, most recently used
+// at the front, with an index into it.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[responseCacheKey]*list.Element
+	order   *list.List
+}
+
+var (
+	respCache = &responseCache{entries: make(map[responseCacheKey]*list.Element), order: list.New()}
+
+	responseCacheHits   atomic.Int64
+	responseCacheMisses atomic.Int64
+)
+
+func (c *responseCache) get(key responseCacheKey, now time.Time) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cachedResponse)
+	if !now.Before(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry, true
+}
+
+func (c *responseCache) put(entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[entry.key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > *responseCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// withResponseCache serves h's responses for route from the cache
+// when it can. The caller puts it inside negotiated, so the response
+// format is settled.
+func withResponseCache(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *responseCacheSize <= 0 {
+			h(w, r)
+			return
+		}
+
+		s := readPostSet(r)
+		version := s.version
+		postsMu.RUnlock()
+
+		contentType := "application/json"
+		if f, ok := formatterFor(r.Header.Get("Accept")); ok {
+			contentType = f.ContentType()
+		}
+		key := responseCacheKey{tenantOf(r), version, r.URL.RequestURI(), contentType}
+		now := time.Now()
+		if entry, ok := respCache.get(key, now); ok {
+			responseCacheHits.Add(1)
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			// Revalidations get their 304 as they would from h, and
+			// like there, aren't views.
+			if etag := entry.header.Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if route == "/posts/{id}" && countsView(r) {
+				countView(r)
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(entry.body)
+			return
+		}
+		responseCacheMisses.Add(1)
+
+		// Only the headers h sets are kept; the ones already there,
+		// like X-Request-ID, belong to this request.
+		before := make(map[string]bool, len(w.Header()))
+		for name := range w.Header() {
+			before[name] = true
+		}
+		rec := &recordingWriter{ResponseWriter: w}
+		h(rec, r)
+		if rec.code != http.StatusOK || rec.body.Len() > maxCachedResponse {
+			return
+		}
+		entry := &cachedResponse{key: key, header: make(http.Header), body: rec.body.Bytes(), expires: now.Add(*responseCacheTTL)}
+		for name, values := range w.Header() {
+			if !before[name] {
+				entry.header[name] = values
+			}
+		}
+		respCache.put(entry)
+	}
+}
+
+// countsView reports whether a GET /posts/{id} counts as a view, which
+// it does unless it has a valid ?no_count=true. An invalid one is a 400
+// from handleGetPost, which is never cached.
+func countsView(r *http.Request) bool {
+	v := r.URL.Query().Get("no_count")
+	noCount, err := strconv.ParseBool(v)
+	return v == "" || err != nil || !noCount
+}
+
+// countView adds a view to the post a cached GET /posts/{id} served.
+func countView(r *http.Request) {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/posts/"), "/")
+	id, ok := parsePostID(segment)
+	if !ok {
+		return
+	}
+
+	s := readPostSet(r)
+	defer postsMu.RUnlock()
+	if _, ok := s.store.Get(id); ok {
+		s.views.add(id)
+	}
+}
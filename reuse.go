@@ -0,0 +1,71 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"time"
+)
+
+//--------------REUSING FREED IDS================
+
+var reuseIDs = flag.Bool("reuse-ids", false, "give new posts the smallest ID freed by a delete instead of always a new one")
+
+// A postSet's freeIDs hold the IDs of purged posts, smallest on top,
+// when -reuse-ids is set.
+
+// idHeap is a min-heap of post IDs for container/heap.
+type idHeap []int
+
+func (h idHeap) Len() int            { return len(h) }
+func (h idHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h idHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *idHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+
+func (h *idHeap) Pop() interface{} {
+	old := *h
+	id := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return id
+}
+
+// allocateID returns the ID for a new post: a new UUID or ULID with
+// -id-strategy=uuid or ulid (see ids.go), the smallest freed ID with
+// -reuse-ids, otherwise the next one. Callers must hold postsMu.
+func (s *postSet) allocateID() PostID {
+	switch *idStrategy {
+	case "uuid":
+		return newUUID()
+	case "ulid":
+		return newULID(time.Now())
+	}
+	if *reuseIDs && s.freeIDs.Len() > 0 {
+		return intID(heap.Pop(&s.freeIDs).(int))
+	}
+	id := s.nextID
+	s.nextID++
+	return intID(id)
+}
+
+// releaseID makes a purged post's ID available again.
+func (s *postSet) releaseID(id PostID) {
+	if n, ok := id.asInt(); ok && *reuseIDs {
+		heap.Push(&s.freeIDs, n)
+	}
+}
+
+// rebuildFreeIDs recomputes freeIDs as every ID below nextID that has
+// no post, in the trash or out of it.
+func (s *postSet) rebuildFreeIDs() {
+	s.freeIDs = s.freeIDs[:0]
+	if !*reuseIDs {
+		return
+	}
+	for id := 1; id < s.nextID; id++ {
+		_, live := s.store.Get(intID(id))
+		_, trashed := s.store.GetTrashed(intID(id))
+		if !live && !trashed {
+			s.freeIDs = append(s.freeIDs, id)
+		}
+	}
+	heap.Init(&s.freeIDs)
+}
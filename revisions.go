@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--------------REVISION HISTORY================
+
+var maxRevisions = flag.Int("max-revisions", 50, "revisions kept per post, dropping the oldest (0 keeps them all)")
+
+// Creating a post and every update to it after that records a
+// revision: the body, author and tags the post had from then on,
+// numbered from 1. Reverting to a revision is an update like any
+// other, so it's recorded as a new revision rather than rewinding the
+// history.
+//
+//	GET  /posts/{id}/revisions               oldest first
+//	POST /posts/{id}/revisions/{n}/revert
+
+type Revision struct {
+	N         int       `json:"n"`
+	PostID    PostID    `json:"post_id"`
+	Body      string    `json:"body"`
+	Author    string    `json:"author,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var errRevisionNotFound = errors.New("revision not found")
+
+func handleGetRevisions(w http.ResponseWriter, r *http.Request, id PostID) {
+	s := readPostSet(r)
+	defer postsMu.RUnlock()
+
+	if _, err := s.getPost(id); err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusOK, s.store.Revisions(id))
+}
+
+func handleRevertPost(w http.ResponseWriter, r *http.Request, id PostID, n int) {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	old, err := s.getPost(id)
+	if err == nil {
+		err = s.checkOwner(r, id)
+	}
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	if !checkIfMatch(w, r, old) {
+		return
+	}
+
+	p, err := s.revertPost(id, n)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", postETag(p))
+	respond(w, r, http.StatusOK, p)
+}
+
+// withRevision parses the post ID and revision number from a
+// /posts/{id}/revisions/{n}/revert path.
+func withRevision(h func(w http.ResponseWriter, r *http.Request, id PostID, n int)) http.HandlerFunc {
+	return withID(func(w http.ResponseWriter, r *http.Request, id PostID) {
+		segments := strings.Split(r.URL.Path, "/")
+		segment := segments[len(segments)-2]
+		n, err := strconv.Atoi(segment)
+		if err != nil || !allDigits(segment) {
+			writeError(w, r, http.StatusBadRequest, "Invalid revision number")
+			return
+		}
+		h(w, r, id, n)
+	})
+}
+
+// recordRevision adds p as it is now to its history. The change to p
+// has already been made by then, so failing to record it is only
+// logged. Callers must hold postsMu.
+func (s *postSet) recordRevision(p Post) {
+	rev := Revision{
+		PostID:    p.ID,
+		Body:      p.Body,
+		Author:    p.Author,
+		Tags:      p.Tags,
+		CreatedAt: p.UpdatedAt,
+	}
+	if _, err := s.store.AddRevision(rev); err != nil {
+		slog.Error("recording revision", "post", p.ID, "tenant", s.tenant, "err", err)
+	}
+}
+
+// revertPost updates the post with the given ID to what it was in
+// revision n. Callers must hold postsMu.
+func (s *postSet) revertPost(id PostID, n int) (Post, error) {
+	for _, rev := range s.store.Revisions(id) {
+		if rev.N == n {
+			return s.updatePost(id, Post{Body: rev.Body, Author: rev.Author, Tags: rev.Tags})
+		}
+	}
+	return Post{}, errRevisionNotFound
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+)
+
+//--------------KEEPING OUT OF SEARCH INDEXES================
+
+var (
+	noIndex   = flag.Bool("noindex", true, "serve /robots.txt and send X-Robots-Tag: noindex")
+	robotsTxt = flag.String("robots-txt", "User-agent: *\nDisallow: /\n", "contents of /robots.txt")
+)
+
+// handleRobots serves the configured robots.txt.
+func handleRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, *robotsTxt)
+}
+
+// withNoIndex asks crawlers not to index any response.
+func withNoIndex(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//--------------ROUTING================
+
+// methods maps HTTP methods to the handler serving them on a single
+// route. Every route goes through it so that a method the route
+// doesn't support gets the same 405 response and Allow header
+// everywhere.
+type methods map[string]http.HandlerFunc
+
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, ok := m[r.Method]
+	if !ok && r.Method == "HEAD" {
+		// net/http drops the body for HEAD, so GET can answer it.
+		h, ok = m["GET"]
+	}
+	if !ok {
+		w.Header().Set("Allow", m.allow())
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	h(w, r)
+}
+
+// allow lists the supported methods for the Allow header.
+func (m methods) allow() string {
+	ms := make([]string, 0, len(m)+1)
+	for method := range m {
+		ms = append(ms, method)
+	}
+	if _, ok := m["GET"]; ok {
+		if _, ok := m["HEAD"]; !ok {
+			ms = append(ms, "HEAD")
+		}
+	}
+	sort.Strings(ms)
+	return strings.Join(ms, ", ")
+}
+
+// subroutes dispatches requests under /posts/{id} on what follows the
+// ID: "" for /posts/{id} itself, "lock" for /posts/{id}/lock and so on.
+// A "*" segment in a key matches any one segment, so "comments/*" is
+// /posts/{id}/comments/{cid}.
+type subroutes map[string]http.Handler
+
+func (s subroutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, action, _ := strings.Cut(r.URL.Path[len("/posts/"):], "/")
+	h, ok := s[action]
+	for key, kh := range s {
+		if !ok && strings.Contains(key, "*") && wildcardMatch(key, action) {
+			h, ok = kh, true
+		}
+	}
+	if !ok {
+		// Also catches extra segments, like /posts/1/2/3.
+		writeError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// wildcardMatch reports whether action has the segments of key, a "*"
+// matching any non-empty segment.
+func wildcardMatch(key, action string) bool {
+	keys, segments := strings.Split(key, "/"), strings.Split(action, "/")
+	if len(keys) != len(segments) {
+		return false
+	}
+	for i, k := range keys {
+		if segments[i] == "" || k != "*" && k != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// withID adapts a handler that works on a single post by parsing the
+// post ID from a /posts/{id} path. An integer ID must be all digits,
+// which rules out the signs and spaces strconv.Atoi would otherwise
+// allow; see ids.go for the others.
+func withID(h func(w http.ResponseWriter, r *http.Request, id PostID)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		segment, _, _ := strings.Cut(r.URL.Path[len("/posts/"):], "/")
+		id, ok := parsePostID(segment)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "Invalid post ID")
+			return
+		}
+		h(w, r, id)
+	}
+}
+
+func allDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+var maxPathLength = flag.Int("max-path-length", 1024, "reject request paths longer than this many bytes")
+
+// withPathGuard rejects malformed paths with a 400 before they reach
+// the mux: paths over -max-path-length, and paths with traversal,
+// control characters, backslashes or encoded slashes, none of which
+// any route uses.
+func withPathGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.EscapedPath()
+		if len(raw) > *maxPathLength {
+			writeError(w, r, http.StatusBadRequest, "Path too long")
+			return
+		}
+		if suspiciousPath(r.URL.Path, raw) {
+			writeError(w, r, http.StatusBadRequest, "Invalid path")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func suspiciousPath(path, raw string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." || segment == "." {
+			return true
+		}
+	}
+	for _, c := range path {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return true
+		}
+	}
+	lower := strings.ToLower(raw)
+	return strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMethodNotAllowed(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"hello"}`)
+	ts.do("POST", "/posts/1/comments", `{"body":"hi"}`)
+	ts.do("POST", "/users", `{"name":"ann","email":"ann@example.com"}`)
+
+	tests := []struct {
+		method, path, allow string
+	}{
+		{"PUT", "/posts", "DELETE, GET, HEAD, POST"},
+		{"PATCH", "/posts", "DELETE, GET, HEAD, POST"},
+		{"POST", "/posts/1", "DELETE, GET, HEAD, PATCH, PUT"},
+		{"GET", "/posts/1/lock", "POST"},
+		{"DELETE", "/posts/1/restore", "POST"},
+		{"PUT", "/posts/1/comments", "GET, HEAD, POST"},
+		{"GET", "/posts/1/comments/1", "DELETE"},
+		{"GET", "/posts/1/revisions/1/revert", "POST"},
+		{"POST", "/posts/search", "GET, HEAD"},
+		{"GET", "/posts/import", "POST"},
+		{"POST", "/posts/trash", "DELETE, GET, HEAD"},
+		{"GET", "/posts/trash/1", "DELETE"},
+		{"DELETE", "/graphql", "GET, HEAD, POST"},
+		{"GET", "/batch", "POST"},
+		{"DELETE", "/jobs/x", "GET, HEAD"},
+		{"PATCH", "/users", "GET, HEAD, POST"},
+		{"POST", "/users/1", "DELETE, GET, HEAD, PUT"},
+		{"POST", "/users/1/posts", "GET, HEAD"},
+		{"POST", "/healthz", "GET, HEAD"},
+		{"DELETE", "/metrics", "GET, HEAD"},
+		{"POST", "/admin/status", "DELETE, GET, HEAD, PUT"},
+		{"GET", "/admin/restore", "POST"},
+	}
+	for _, tt := range tests {
+		rec := ts.do(tt.method, tt.path, "")
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: status %d, want 405", tt.method, tt.path, rec.Code)
+			continue
+		}
+		if got := rec.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tt.method, tt.path, got, tt.allow)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", tt.method, tt.path, ct)
+		}
+		if body := decodeResponse[map[string]string](t, rec); body["error"] != "Method not allowed" {
+			t.Errorf("%s %s: body %v", tt.method, tt.path, body)
+		}
+
+		// The same as a problem, for clients that ask for one.
+		rec = ts.do(tt.method, tt.path, "", "Accept", problemMediaType)
+		p := decodeResponse[problem](t, rec)
+		if rec.Code != http.StatusMethodNotAllowed || p.Status != http.StatusMethodNotAllowed || p.Instance != tt.path {
+			t.Errorf("%s %s as a problem: status %d, %+v", tt.method, tt.path, rec.Code, p)
+		}
+		if got := rec.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s as a problem: Allow %q, want %q", tt.method, tt.path, got, tt.allow)
+		}
+	}
+}
+
+func TestHeadFollowsGet(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"hello"}`)
+
+	for _, path := range []string{"/posts", "/posts/1", "/tags", "/healthz"} {
+		if rec := ts.do("HEAD", path, ""); rec.Code != http.StatusOK {
+			t.Errorf("HEAD %s: status %d, want 200", path, rec.Code)
+		}
+	}
+	// A route without GET has no HEAD either.
+	wantStatus(t, ts.do("HEAD", "/posts/1/lock", ""), http.StatusMethodNotAllowed)
+}
+
+func TestErrorsAreJSON(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"hello"}`)
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"GET", "/posts/abc", "", http.StatusBadRequest},
+		{"GET", "/posts/1/2/3", "", http.StatusNotFound},
+		{"GET", "/posts/7", "", http.StatusNotFound},
+		{"GET", "/posts?limit=x", "", http.StatusBadRequest},
+		{"POST", "/posts", `{"body":`, http.StatusBadRequest},
+		{"PUT", "/posts/1", "not json", http.StatusBadRequest},
+		{"DELETE", "/posts/1/comments/9", "", http.StatusNotFound},
+		{"POST", "/admin/restore?mode=all", "{}", http.StatusForbidden},
+		{"PATCH", "/tags", "", http.StatusMethodNotAllowed},
+		{"GET", "/nowhere", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := ts.do(tt.method, tt.path, tt.body)
+		if rec.Code != tt.want || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: %d %s, want %d in JSON", tt.method, tt.path, rec.Code, rec.Header().Get("Content-Type"), tt.want)
+			continue
+		}
+		if e := decodeResponse[map[string]string](t, rec); e["error"] == "" || e["request_id"] == "" {
+			t.Errorf("%s %s: %v", tt.method, tt.path, e)
+		}
+
+		rec = ts.do(tt.method, tt.path, tt.body, "Accept", problemMediaType)
+		if p := decodeResponse[problem](t, rec); p.Status != tt.want || p.Detail == "" {
+			t.Errorf("%s %s as a problem: %+v", tt.method, tt.path, p)
+		}
+	}
+}
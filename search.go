@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//--------------FULL-TEXT SEARCH================
+
+// GET /posts/search?q=go+release finds the posts containing every
+// word of q, best match first. Unlike ?q= on /posts, which looks for
+// the text anywhere in each body, it matches whole words and doesn't
+// look at the posts at all: each postSet keeps an inverted index from
+// every word to the posts using it, updated as posts change.
+//
+// Results are ranked with BM25, which favours posts that use the
+// query's words often, words that are rare across all posts, and
+// shorter posts.
+//
+// The index is rebuilt from scratch when the posts are loaded, restored
+// or rolled back. For a tenant with more than -index-chunk posts that
+// runs in the background, so as not to hold the posts lock for the
+// whole of it: each turn indexes up to -index-chunk posts, stopping
+// early after -index-budget, then lets the lock go. Until it's done
+// search answers 503 with a Retry-After, and /readyz fails with how
+// far it's got; /metrics has search_index_pending_posts too.
+
+var (
+	indexChunk  = flag.Int("index-chunk", 1000, "posts the search index rebuild takes in one turn with the posts lock; tenants with no more posts than this are indexed at once")
+	indexBudget = flag.Duration("index-budget", 10*time.Millisecond, "longest the search index rebuild holds the posts lock in one turn (0 is no limit beyond -index-chunk)")
+)
+
+func checkIndexFlags() error {
+	if *indexChunk < 1 {
+		return errors.New("-index-chunk must be at least 1")
+	}
+	return nil
+}
+
+// BM25's usual tuning: k1 limits how much repeating a word helps, b
+// how much long posts are penalized.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// invertedIndex maps each word to how many times each post uses it.
+type invertedIndex struct {
+	postings   map[string]map[PostID]int
+	lengths    map[PostID]int
+	totalWords int
+
+	// pending holds the posts a background rebuild has yet to
+	// index, out of total. Changes to them are left to the rebuild,
+	// which reads the post as it is by then.
+	pending map[PostID]bool
+	total   int
+}
+
+func newInvertedIndex() invertedIndex {
+	return invertedIndex{
+		postings: make(map[string]map[PostID]int),
+		lengths:  make(map[PostID]int),
+	}
+}
+
+// words splits text into lower-cased words, at anything that isn't a
+// letter or digit.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// ready reports whether every post is in the index.
+func (ix *invertedIndex) ready() bool {
+	return len(ix.pending) == 0
+}
+
+// progress says how far a rebuild has got.
+func (ix *invertedIndex) progress() string {
+	return fmt.Sprintf("%d of %d posts indexed", ix.total-len(ix.pending), ix.total)
+}
+
+func (ix *invertedIndex) add(p Post) {
+	if ix.pending[p.ID] {
+		return
+	}
+	ws := words(p.Body)
+	if len(ws) == 0 {
+		return
+	}
+	for _, w := range ws {
+		counts, ok := ix.postings[w]
+		if !ok {
+			counts = make(map[PostID]int)
+			ix.postings[w] = counts
+		}
+		counts[p.ID]++
+	}
+	ix.lengths[p.ID] = len(ws)
+	ix.totalWords += len(ws)
+}
+
+func (ix *invertedIndex) remove(p Post) {
+	if ix.pending[p.ID] {
+		return
+	}
+	for _, w := range words(p.Body) {
+		delete(ix.postings[w], p.ID)
+		if len(ix.postings[w]) == 0 {
+			delete(ix.postings, w)
+		}
+	}
+	ix.totalWords -= ix.lengths[p.ID]
+	delete(ix.lengths, p.ID)
+}
+
+// search returns the IDs of the posts containing every term, with
+// their scores.
+func (ix *invertedIndex) search(terms []string) map[PostID]float64 {
+	if len(terms) == 0 || len(ix.lengths) == 0 {
+		return nil
+	}
+
+	// Start from the rarest term, so there are fewest candidates.
+	sort.Slice(terms, func(i, j int) bool { return len(ix.postings[terms[i]]) < len(ix.postings[terms[j]]) })
+
+	n := float64(len(ix.lengths))
+	avgLen := float64(ix.totalWords) / n
+	scores := make(map[PostID]float64)
+	for id := range ix.postings[terms[0]] {
+		scores[id] = 0
+	}
+	for _, t := range terms {
+		counts := ix.postings[t]
+		df := float64(len(counts))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id := range scores {
+			tf, ok := counts[id]
+			if !ok {
+				delete(scores, id)
+				continue
+			}
+			norm := 1 - bm25B + bm25B*float64(ix.lengths[id])/avgLen
+			scores[id] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*norm)
+		}
+	}
+	return scores
+}
+
+// rebuildTextIndex recomputes textIndex from posts, in the background
+// if there are over -index-chunk of them. Callers must hold postsMu for
+// writing, if the server is running.
+func (s *postSet) rebuildTextIndex() {
+	s.textIndex = newInvertedIndex()
+	s.indexGen++
+	ids := s.store.IDs()
+	if len(ids) <= *indexChunk {
+		for _, id := range ids {
+			if p, ok := s.store.Get(id); ok {
+				s.textIndex.add(p)
+			}
+		}
+		return
+	}
+
+	s.textIndex.pending = make(map[PostID]bool, len(ids))
+	for _, id := range ids {
+		s.textIndex.pending[id] = true
+	}
+	s.textIndex.total = len(ids)
+	go s.indexInTurns(s.indexGen, ids, *indexChunk, *indexBudget)
+}
+
+// indexInTurns indexes the posts with the given IDs, up to chunk of
+// them or for up to budget a turn, unless another rebuild starts
+// first.
+func (s *postSet) indexInTurns(gen int, ids []PostID, chunk int, budget time.Duration) {
+	for len(ids) > 0 {
+		postsMu.Lock()
+		if s.indexGen != gen {
+			postsMu.Unlock()
+			return
+		}
+		start := time.Now()
+		for n := 0; n < chunk && len(ids) > 0; n++ {
+			id := ids[0]
+			ids = ids[1:]
+			delete(s.textIndex.pending, id)
+			if p, ok := s.store.Get(id); ok {
+				s.textIndex.add(p)
+			}
+			if budget > 0 && time.Since(start) >= budget {
+				break
+			}
+		}
+		postsMu.Unlock()
+	}
+}
+
+// searchHit is a post found by /posts/search and how well it matched.
+type searchHit struct {
+	Post
+	Score float64 `json:"score"`
+}
+
+func handleSearchPosts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	terms := words(q.Get("q"))
+	if len(terms) == 0 {
+		writeError(w, r, http.StatusBadRequest, "q must contain at least one word")
+		return
+	}
+	limit, offset, err := parseLimitOffset(q, 20)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parsePostFilter(q)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s := readPostSet(r)
+	if !s.textIndex.ready() {
+		progress := s.textIndex.progress()
+		postsMu.RUnlock()
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, "Search index is being rebuilt ("+progress+")")
+		return
+	}
+	scores := s.textIndex.search(terms)
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		if p, ok := s.store.Get(id); ok {
+			hits = append(hits, searchHit{Post: p, Score: score})
+		}
+	}
+	postsMu.RUnlock()
+
+	kept := hits[:0]
+	for _, h := range hits {
+		if len(filter.apply(listable([]Post{h.Post}))) == 1 {
+			kept = append(kept, h)
+		}
+	}
+	hits = kept
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+
+	total := len(hits)
+	if offset >= len(hits) {
+		hits = hits[:0]
+	} else {
+		hits = hits[offset:]
+	}
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	page := listPage{Data: hits, Total: total, Limit: limit, Offset: offset}
+	if offset+len(hits) < total {
+		page.Next = nextPageURL(r, limit, offset+len(hits))
+	}
+	respond(w, r, http.StatusOK, page)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"go is fun, go go go"}`)
+	ts.createPost(`{"body":"rust is fun"}`)
+	ts.createPost(`{"body":"go and rust"}`)
+
+	tests := []struct {
+		q    string
+		want []PostID
+	}{
+		{"go", []PostID{"1", "3"}},
+		// The shorter post first.
+		{"fun", []PostID{"2", "1"}},
+		{"rust+go", []PostID{"3"}},
+		{"python", nil},
+	}
+	for _, tt := range tests {
+		rec := ts.do("GET", "/posts/search?q="+tt.q, "")
+		wantStatus(t, rec, http.StatusOK)
+		page := decodeResponse[struct{ Data []searchHit }](t, rec)
+		var got []PostID
+		for _, h := range page.Data {
+			got = append(got, h.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("q=%s: %v, want %v", tt.q, got, tt.want)
+		}
+	}
+	wantStatus(t, ts.do("GET", "/posts/search?q=", ""), http.StatusBadRequest)
+}
+
+func TestSearchIndexRebuildsInTurns(t *testing.T) {
+	ts := newTestServer(t, "-index-chunk=10")
+	for i := 0; i < 45; i++ {
+		ts.createPost(fmt.Sprintf(`{"body":"post number%d"}`, i))
+	}
+
+	// Start a rebuild and stop it before it starts, as if it were
+	// slow, to see what clients see meanwhile.
+	postsMu.Lock()
+	s := tenants[""]
+	s.rebuildTextIndex()
+	s.indexGen++
+	if s.textIndex.ready() || s.textIndex.total != 45 {
+		t.Errorf("rebuild of 45 posts with -index-chunk=10 isn't in the background")
+	}
+	postsMu.Unlock()
+
+	rec := ts.do("GET", "/posts/search?q=post", "")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("search while rebuilding: %d %s", rec.Code, rec.Body)
+	}
+	rec = ts.do("GET", "/readyz", "")
+	if c := decodeResponse[healthReport](t, rec).Checks["search_index"]; rec.Code != http.StatusServiceUnavailable || c.Error != "rebuilding: 0 of 45 posts indexed" {
+		t.Errorf("/readyz while rebuilding: %d, search_index %+v", rec.Code, c)
+	}
+	if body := ts.do("GET", "/metrics", "").Body.String(); !strings.Contains(body, `search_index_pending_posts{tenant=""} 45`) {
+		t.Error("/metrics has no search_index_pending_posts 45")
+	}
+
+	// Now for real.
+	postsMu.Lock()
+	s.rebuildTextIndex()
+	postsMu.Unlock()
+
+	// Changes while it runs are kept either way.
+	ts.createPost(`{"body":"post numbernew"}`)
+	wantStatus(t, ts.do("PATCH", "/posts/1", `{"body":"changed number0"}`), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/2", ""), http.StatusOK)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		rec := ts.do("GET", "/posts/search?q=post", "")
+		if rec.Code == http.StatusOK {
+			break
+		}
+		if rec.Code != http.StatusServiceUnavailable || time.Now().After(deadline) {
+			t.Fatalf("search while rebuilding: %d %s", rec.Code, rec.Body)
+		}
+	}
+
+	count := func(q string) int {
+		return decodeResponse[struct{ Total int }](t, ts.do("GET", "/posts/search?q="+q, "")).Total
+	}
+	// 45 posts, less the deleted one and the changed one, plus the
+	// new one.
+	if n := count("post"); n != 44 {
+		t.Errorf("%d posts found with post, want 44", n)
+	}
+	if n := count("changed"); n != 1 {
+		t.Errorf("%d posts found with changed, want 1", n)
+	}
+	if n := count("number1"); n != 0 {
+		t.Errorf("the deleted post was found")
+	}
+	wantStatus(t, ts.do("GET", "/readyz", ""), http.StatusOK)
+}
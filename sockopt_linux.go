@@ -0,0 +1,64 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import (
+	"net"
+	"strings"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package only defines
+// for some Linux architectures. MIPS uses a different number and gets
+// sockopt_other.go instead.
+const soReusePort = 0xf
+
+// controlSocket sets -reuse-addr and -reuse-port on TCP listeners.
+// It runs after Go's own defaults and before bind, so ours win.
+func controlSocket(network, address string, c syscall.RawConn) error {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		addr := 0
+		if *reuseAddr {
+			addr = 1
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, addr)
+		if sockErr == nil && *reusePort {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setBacklog applies -listen-backlog. Go always listens with the
+// system maximum, but calling listen(2) again on a listening socket
+// just changes the length of its queue.
+func setBacklog(ln net.Listener) error {
+	if *listenBacklog <= 0 {
+		return nil
+	}
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	err = rc.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), *listenBacklog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
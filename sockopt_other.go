@@ -0,0 +1,23 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func controlSocket(network, address string, c syscall.RawConn) error {
+	if !*reuseAddr || *reusePort {
+		return errors.New("-reuse-addr and -reuse-port are only supported on Linux")
+	}
+	return nil
+}
+
+func setBacklog(ln net.Listener) error {
+	if *listenBacklog > 0 {
+		return errors.New("-listen-backlog is only supported on Linux")
+	}
+	return nil
+}
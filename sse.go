@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//--------------SERVER-SENT EVENTS================
+
+// GET /events streams the same events as -emit-events to the client as
+// Server-Sent Events, so a page can keep its list of posts up to date
+// (in a browser, with new EventSource("/events")). Each event is named
+// after what happened and carries the postEvent as JSON:
+//
+//	id: 42
+//	event: post.created
+//	data: {"event":"post.created","id":7,"time":"..."}
+//
+// A client only hears about its own tenant's posts. Events aren't
+// kept, so a client that reconnects misses what happened meanwhile
+// and should reload the list.
+//
+// Every stream holds a goroutine and a buffer for as long as it's
+// open, so -max-subscribers caps how many may be open at once, counting
+// /events, /ws connections and GraphQL subscriptions together. Past
+// it, new ones get 503 with a Retry-After until one closes.
+
+var maxSubscribers = flag.Int("max-subscribers", 1000, "most event streams open at once; more get 503 (0 is no limit)")
+
+// subscribersRetryAfter is the Retry-After, in seconds, of a stream
+// turned away by -max-subscribers.
+const subscribersRetryAfter = "10"
+
+// sseHeartbeat is how often an idle stream gets a comment line, so
+// proxies don't time it out.
+const sseHeartbeat = 15 * time.Second
+
+// sseBuffer is how many events a client may fall behind by before
+// it's disconnected, rather than holding up everyone else.
+const sseBuffer = 64
+
+// sseEvent is a postEvent numbered for the SSE id: field. Numbers
+// count up across all tenants, so a client's may have gaps.
+type sseEvent struct {
+	id int64
+	postEvent
+}
+
+// eventBroker fans events out to the subscribed streams.
+type eventBroker struct {
+	mu     sync.Mutex
+	subs   map[chan sseEvent]string // to the tenant it's for
+	nextID int64
+
+	// streams counts the open streams for -max-subscribers. It's
+	// apart from subs since a dropped subscriber's stream stays open
+	// until its handler notices.
+	streams atomic.Int64
+}
+
+var broker = &eventBroker{subs: make(map[chan sseEvent]string)}
+
+// active reports whether anyone is listening, so events needn't be
+// made when nobody is.
+func (b *eventBroker) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+func (b *eventBroker) subscribe(tenant string) chan sseEvent {
+	ch := make(chan sseEvent, sseBuffer)
+	b.mu.Lock()
+	b.subs[ch] = tenant
+	b.mu.Unlock()
+	return ch
+}
+
+// unsubscribe stops sending to ch, if it hasn't been dropped already.
+func (b *eventBroker) unsubscribe(ch chan sseEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// publish hands e to the streams of its tenant without waiting. A
+// stream whose buffer is full is dropped: its channel is closed, which
+// ends the response.
+func (b *eventBroker) publish(e postEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	for ch, tenant := range b.subs {
+		if tenant != e.Tenant {
+			continue
+		}
+		select {
+		case ch <- sseEvent{b.nextID, e}:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// join takes one of the -max-subscribers places for a stream, and
+// reports false if they're all taken. A stream that joins must leave
+// when it closes.
+func (b *eventBroker) join() bool {
+	n := b.streams.Add(1)
+	if *maxSubscribers > 0 && n > int64(*maxSubscribers) {
+		b.streams.Add(-1)
+		return false
+	}
+	return true
+}
+
+// leave gives back the place taken by join.
+func (b *eventBroker) leave() {
+	b.streams.Add(-1)
+}
+
+// joinOrReject joins the broker, or answers 503 and returns false if
+// there's no room.
+func joinOrReject(w http.ResponseWriter, r *http.Request) bool {
+	if broker.join() {
+		return true
+	}
+	w.Header().Set("Retry-After", subscribersRetryAfter)
+	writeError(w, r, http.StatusServiceUnavailable, "Too many event streams open; try again later")
+	return false
+}
+
+// closeAll ends every stream, so they don't hold up a shutdown.
+func (b *eventBroker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !joinOrReject(w, r) {
+		return
+	}
+	defer broker.leave()
+
+	rc := http.NewResponseController(w)
+	// A stream lasts as long as the client wants, whatever
+	// -write-timeout says.
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ch := broker.subscribe(tenantOf(r))
+	defer broker.unsubscribe(ch)
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(e.postEvent)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.Event, data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
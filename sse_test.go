@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openStream starts GET path on srv and waits for it to connect. The
+// stream is closed when the test ends, if it isn't before.
+func openStream(t *testing.T, srv *httptest.Server, path string, header ...string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", srv.URL+path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, ": connected") {
+		t.Fatalf("GET %s: first line %q, %v", path, line, err)
+	}
+	return resp
+}
+
+// waitForStreams waits for the number of open streams to drop to n,
+// as the server only notices a client going once it's gone.
+func waitForStreams(t *testing.T, n int64) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); broker.streams.Load() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams open, want %d", broker.streams.Load(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxSubscribers(t *testing.T) {
+	ts := newTestServer(t, "-max-subscribers=2")
+	srv := httptest.NewServer(ts.h)
+	// Cleanups run last first, so this waits for the streams to close.
+	t.Cleanup(srv.Close)
+
+	first := openStream(t, srv, "/events")
+	openStream(t, srv, "/events")
+
+	resp := openStream(t, srv, "/events")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("third stream: status %d, Retry-After %q; want 503 with one", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	// Being turned away doesn't take a place.
+	waitForStreams(t, 2)
+
+	// Closing a stream frees its place.
+	first.Body.Close()
+	waitForStreams(t, 1)
+	if resp := openStream(t, srv, "/events"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream after one closed: status %d", resp.StatusCode)
+	}
+}
+
+// openWS opens a WebSocket to srv's /ws and returns the status of the
+// handshake. A connection that opens is closed when the test ends.
+func openWS(t *testing.T, srv *httptest.Server) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestMaxSubscribersIsShared(t *testing.T) {
+	ts := newTestServer(t, "-max-subscribers=3")
+	srv := httptest.NewServer(ts.h)
+	t.Cleanup(srv.Close)
+
+	const subscription = "/graphql?query=subscription%7BpostChanged%7Bevent%7D%7D"
+	if resp := openStream(t, srv, "/events"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("/events: status %d", resp.StatusCode)
+	}
+	if code := openWS(t, srv); code != http.StatusSwitchingProtocols {
+		t.Fatalf("/ws: status %d", code)
+	}
+	if resp := openStream(t, srv, subscription, "Accept", "text/event-stream"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("subscription: status %d", resp.StatusCode)
+	}
+	waitForStreams(t, 3)
+
+	// Now there's no room for any of them.
+	if resp := openStream(t, srv, "/events"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/events: status %d, want 503", resp.StatusCode)
+	}
+	if code := openWS(t, srv); code != http.StatusServiceUnavailable {
+		t.Errorf("/ws: status %d, want 503", code)
+	}
+	resp := openStream(t, srv, subscription, "Accept", "text/event-stream")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("subscription: status %d, Retry-After %q; want 503 with one", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	waitForStreams(t, 3)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//--------------BODY SIZE STATISTICS================
+
+var statsTTL = flag.Duration("stats-ttl", 10*time.Second, "how long GET /posts/stats/size reuses its last result")
+
+type sizeStats struct {
+	Posts      int     `json:"posts"`
+	TotalBytes int     `json:"total_bytes"`
+	MinBytes   int     `json:"min_bytes"`
+	MaxBytes   int     `json:"max_bytes"`
+	AvgBytes   float64 `json:"avg_bytes"`
+	LargestID  PostID  `json:"largest_id,omitempty"`
+	ComputedAt string  `json:"computed_at"`
+	at         time.Time
+}
+
+// cachedSizeStats holds the last result per tenant.
+var (
+	cachedSizeStats = make(map[string]*sizeStats)
+	sizeStatsMu     sync.Mutex
+)
+
+// handleSizeStats reports how much space post bodies take up. The
+// result is cached for -stats-ttl so frequent polling doesn't rescan
+// every post.
+func handleSizeStats(w http.ResponseWriter, r *http.Request) {
+	sizeStatsMu.Lock()
+	defer sizeStatsMu.Unlock()
+
+	tenant := tenantOf(r)
+	stats, ok := cachedSizeStats[tenant]
+	if !ok || time.Since(stats.at) >= *statsTTL {
+		stats = computeSizeStats(r)
+		cachedSizeStats[tenant] = stats
+	}
+	respond(w, r, http.StatusOK, stats)
+}
+
+func computeSizeStats(r *http.Request) *sizeStats {
+	ps := readPostSet(r).store.List()
+	postsMu.RUnlock()
+
+	now := time.Now()
+	s := &sizeStats{
+		Posts:      len(ps),
+		ComputedAt: now.UTC().Format(time.RFC3339),
+		at:         now,
+	}
+	first := true
+	for _, p := range ps {
+		n := len(p.Body)
+		s.TotalBytes += n
+		if first || n < s.MinBytes {
+			s.MinBytes = n
+		}
+		// Ties go to the lowest ID so the answer doesn't depend on map
+		// order.
+		if first || n > s.MaxBytes || (n == s.MaxBytes && p.ID.less(s.LargestID)) {
+			s.MaxBytes = n
+			s.LargestID = p.ID
+		}
+		first = false
+	}
+	if s.Posts > 0 {
+		s.AvgBytes = float64(s.TotalBytes) / float64(s.Posts)
+	}
+	return s
+}
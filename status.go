@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+//--------------SERVICE STATUS================
+
+// serviceStatus is an operator-set banner telling clients that the
+// API is degraded. Anyone may read it, but only admins may set or
+// clear it (see withAdmin). Unless AUTH_SECRET and ADMIN_USERS are
+// both set there are no admins, so nobody can set it at all: PUT and
+// DELETE answer 403 and the banner stays empty. It lives in memory
+// only, so a restart clears it.
+type serviceStatus struct {
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+}
+
+var (
+	status   serviceStatus
+	statusMu sync.RWMutex
+)
+
+var validSeverities = map[string]bool{
+	"info":     true,
+	"warning":  true,
+	"critical": true,
+}
+
+// withServiceStatus adds an X-Service-Status header to every response
+// while a status message is set, e.g. "warning; Writes are delayed".
+func withServiceStatus(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statusMu.RLock()
+		s := status
+		statusMu.RUnlock()
+
+		if s.Message != "" {
+			w.Header().Set("X-Service-Status", s.Severity+"; "+s.Message)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleGetStatus returns the current banner, if any.
+func handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	statusMu.RLock()
+	s := status
+	statusMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// handlePutStatus sets the banner shown to clients.
+func handlePutStatus(w http.ResponseWriter, r *http.Request) {
+	var s serviceStatus
+	if err := decodeJSON(r, r.Body, &s); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+		return
+	}
+	if s.Message == "" {
+		writeError(w, r, http.StatusBadRequest, "Status message is required")
+		return
+	}
+	if s.Severity == "" {
+		s.Severity = "info"
+	}
+	if !validSeverities[s.Severity] {
+		writeError(w, r, http.StatusBadRequest, "Severity must be info, warning or critical")
+		return
+	}
+
+	statusMu.Lock()
+	status = s
+	statusMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// handleDeleteStatus clears the banner.
+func handleDeleteStatus(w http.ResponseWriter, r *http.Request) {
+	statusMu.Lock()
+	status = serviceStatus{}
+	statusMu.Unlock()
+
+	// The banner is gone, so don't advertise it on this response
+	// either.
+	w.Header().Del("X-Service-Status")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//--------------STORAGE BACKENDS================
+
+// A postSet does the bookkeeping for its posts (IDs, uniqueness,
+// locking, events and so on) and leaves keeping the posts themselves
+// to a Store. Which Store is used is picked at startup with -store:
+//
+//   - memory keeps posts in a map, so they're gone after a restart.
+//   - file also writes every change to a journal in -data-dir and
+//     replays it on startup, so posts survive restarts.
+//
+// Like the rest of a postSet, a Store is guarded by postsMu.
+type Store interface {
+	// Get returns the post with the given ID. Posts in the trash
+	// are left out of Get, List and Len.
+	Get(id PostID) (Post, bool)
+	// List returns a copy of every post, in no particular order.
+	List() []Post
+	// IDs returns the IDs of the posts in ID order, for walking
+	// through them without copying them all at once.
+	IDs() []PostID
+	// ListAfter returns up to n posts that come after afterID in ID
+	// order (see ids.go), or from the first if afterID is "", for
+	// paging through them in a stable order.
+	ListAfter(afterID PostID, n int) []Post
+	// Create stores a post whose ID isn't in use, in the trash
+	// included.
+	Create(p Post) error
+	// Update replaces the stored post with the same ID. It returns
+	// errNotFound if there isn't one.
+	Update(p Post) error
+	// AddViews adds n to the views of the post with the given ID,
+	// which may be in the trash, without changing anything else. It
+	// returns errNotFound if there isn't one.
+	AddViews(id PostID, n int) error
+	// Delete removes the post with the given ID, its comments and
+	// its revisions. It returns errNotFound if there isn't one.
+	Delete(id PostID) error
+	// Len returns how many posts there are.
+	Len() int
+	// NextID returns an integer ID higher than any ever stored, so
+	// IDs of deleted posts aren't handed out again after a restart.
+	NextID() int
+	// Comments returns the comments on a post, oldest first.
+	Comments(postID PostID) []Comment
+	// AddComment stores c, giving it a new ID unless it already has
+	// one, and returns it.
+	AddComment(c Comment) (Comment, error)
+	// DeleteComment removes a comment from a post. It returns
+	// errCommentNotFound if there isn't one.
+	DeleteComment(postID PostID, id int) error
+	// Trash moves the post with the given ID to the trash, marked
+	// as deleted at the given time, and returns it. Its comments
+	// stay with it. It returns errNotFound if there isn't one.
+	Trash(id PostID, at time.Time) (Post, error)
+	// GetTrashed returns the post with the given ID from the trash.
+	GetTrashed(id PostID) (Post, bool)
+	// ListTrashed returns a copy of every post in the trash.
+	ListTrashed() []Post
+	// Restore moves a post out of the trash and returns it. It
+	// returns errNotFound if the trash doesn't hold it.
+	Restore(id PostID) (Post, error)
+	// Purge removes a post from the trash for good, comments,
+	// revisions and all. It returns errNotFound if the trash doesn't hold it.
+	Purge(id PostID) error
+	// Revisions returns the revisions kept of a post, oldest first.
+	Revisions(postID PostID) []Revision
+	// AddRevision appends rev to its post's history, numbering it
+	// after the last one unless it already has a number, and drops
+	// the oldest beyond -max-revisions. It returns the revision.
+	AddRevision(rev Revision) (Revision, error)
+	// DropRevisions removes a post's revisions numbered after n.
+	DropRevisions(postID PostID, n int) error
+	// Check reports whether the store can still save changes, for
+	// GET /readyz.
+	Check() error
+	// Close makes sure every change is saved. The store isn't used
+	// afterwards.
+	Close() error
+}
+
+var (
+	storeKind = flag.String("store", "memory", "where posts are kept: memory, or file to keep them in -data-dir across restarts")
+	dataDir   = flag.String("data-dir", "data", "directory for the journals of -store=file")
+)
+
+var errExists = errors.New("post already exists")
+
+// newStore opens the store for a tenant's posts.
+func newStore(tenant string) (Store, error) {
+	switch *storeKind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return openFileStore(journalPath(tenant))
+	default:
+		return nil, fmt.Errorf("unknown -store %q (want memory or file)", *storeKind)
+	}
+}
+
+// loadStores opens the stores of every tenant with posts on disk, so
+// a bad journal stops the server at startup rather than failing some
+// request later.
+func loadStores() error {
+	if *storeKind != "file" {
+		// Still catch a bad -store now.
+		_, err := newStore("")
+		return err
+	}
+
+	names, err := filepath.Glob(filepath.Join(*dataDir, "posts*.jsonl"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		tenant, ok := tenantOfJournal(filepath.Base(name))
+		if !ok {
+			continue
+		}
+		st, err := newStore(tenant)
+		if err != nil {
+			return err
+		}
+		tenants[tenant] = newPostSet(tenant, st)
+	}
+	return nil
+}
+
+// closeStores closes every tenant's store when the server stops,
+// saving the views counted since the last flush first.
+func closeStores() error {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	var firstErr error
+	for _, s := range tenants {
+		s.flushViews()
+		if err := s.store.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//--------------MEMORY STORE================
+
+// memoryStore keeps posts in a map. Bodies over -compress-bodies-over
+// are kept compressed; see compress.go.
+type memoryStore struct {
+	posts  map[PostID]Post
+	trash  map[PostID]Post
+	nextID int
+
+	comments      map[PostID][]Comment
+	nextCommentID int
+
+	revisions map[PostID][]Revision
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		posts:         make(map[PostID]Post),
+		trash:         make(map[PostID]Post),
+		nextID:        1,
+		comments:      make(map[PostID][]Comment),
+		nextCommentID: 1,
+		revisions:     make(map[PostID][]Revision),
+	}
+}
+
+func (m *memoryStore) Get(id PostID) (Post, bool) {
+	p, ok := m.posts[id]
+	if !ok {
+		return Post{}, false
+	}
+	return unpack(p), true
+}
+
+func (m *memoryStore) List() []Post {
+	ps := make([]Post, 0, len(m.posts))
+	for _, p := range m.posts {
+		ps = append(ps, unpack(p))
+	}
+	return ps
+}
+
+func (m *memoryStore) IDs() []PostID {
+	ids := make([]PostID, 0, len(m.posts))
+	for id := range m.posts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	return ids
+}
+
+func (m *memoryStore) ListAfter(afterID PostID, n int) []Post {
+	var ids []PostID
+	for id := range m.posts {
+		if afterID == "" || afterID.less(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	ps := make([]Post, len(ids))
+	for i, id := range ids {
+		ps[i] = unpack(m.posts[id])
+	}
+	return ps
+}
+
+func (m *memoryStore) Create(p Post) error {
+	if m.inUse(p.ID) {
+		return errExists
+	}
+	m.posts[p.ID] = pack(p)
+	if n, ok := p.ID.asInt(); ok && n >= m.nextID {
+		m.nextID = n + 1
+	}
+	return nil
+}
+
+func (m *memoryStore) Update(p Post) error {
+	if _, ok := m.posts[p.ID]; !ok {
+		return errNotFound
+	}
+	m.posts[p.ID] = pack(p)
+	return nil
+}
+
+func (m *memoryStore) AddViews(id PostID, n int) error {
+	if p, ok := m.posts[id]; ok {
+		p.Views += n
+		m.posts[id] = p
+		return nil
+	}
+	if p, ok := m.trash[id]; ok {
+		p.Views += n
+		m.trash[id] = p
+		return nil
+	}
+	return errNotFound
+}
+
+func (m *memoryStore) Delete(id PostID) error {
+	if _, ok := m.posts[id]; !ok {
+		return errNotFound
+	}
+	delete(m.posts, id)
+	delete(m.comments, id)
+	delete(m.revisions, id)
+	return nil
+}
+
+func (m *memoryStore) Len() int {
+	return len(m.posts)
+}
+
+func (m *memoryStore) NextID() int {
+	return m.nextID
+}
+
+func (m *memoryStore) Comments(postID PostID) []Comment {
+	return append([]Comment(nil), m.comments[postID]...)
+}
+
+func (m *memoryStore) AddComment(c Comment) (Comment, error) {
+	if _, ok := m.posts[c.PostID]; !ok {
+		return Comment{}, errNotFound
+	}
+	if c.ID == 0 {
+		c.ID = m.nextCommentID
+	}
+	if c.ID >= m.nextCommentID {
+		m.nextCommentID = c.ID + 1
+	}
+
+	// Keep them in ID order, which is also oldest first, even when
+	// a rolled back batch puts old comments back.
+	cs := m.comments[c.PostID]
+	i := sort.Search(len(cs), func(i int) bool { return cs[i].ID >= c.ID })
+	if i < len(cs) && cs[i].ID == c.ID {
+		return Comment{}, errExists
+	}
+	cs = append(cs, Comment{})
+	copy(cs[i+1:], cs[i:])
+	cs[i] = c
+	m.comments[c.PostID] = cs
+	return c, nil
+}
+
+func (m *memoryStore) DeleteComment(postID PostID, id int) error {
+	cs := m.comments[postID]
+	for i, c := range cs {
+		if c.ID == id {
+			m.comments[postID] = append(cs[:i:i], cs[i+1:]...)
+			return nil
+		}
+	}
+	return errCommentNotFound
+}
+
+func (m *memoryStore) Trash(id PostID, at time.Time) (Post, error) {
+	p, ok := m.posts[id]
+	if !ok {
+		return Post{}, errNotFound
+	}
+	p.DeletedAt = &at
+	delete(m.posts, id)
+	m.trash[id] = p
+	return unpack(p), nil
+}
+
+func (m *memoryStore) GetTrashed(id PostID) (Post, bool) {
+	p, ok := m.trash[id]
+	if !ok {
+		return Post{}, false
+	}
+	return unpack(p), true
+}
+
+func (m *memoryStore) ListTrashed() []Post {
+	ps := make([]Post, 0, len(m.trash))
+	for _, p := range m.trash {
+		ps = append(ps, unpack(p))
+	}
+	return ps
+}
+
+func (m *memoryStore) Restore(id PostID) (Post, error) {
+	p, ok := m.trash[id]
+	if !ok {
+		return Post{}, errNotFound
+	}
+	p.DeletedAt = nil
+	delete(m.trash, id)
+	m.posts[id] = p
+	return unpack(p), nil
+}
+
+func (m *memoryStore) Purge(id PostID) error {
+	if _, ok := m.trash[id]; !ok {
+		return errNotFound
+	}
+	delete(m.trash, id)
+	delete(m.comments, id)
+	delete(m.revisions, id)
+	return nil
+}
+
+func (m *memoryStore) Revisions(postID PostID) []Revision {
+	return append([]Revision(nil), m.revisions[postID]...)
+}
+
+func (m *memoryStore) AddRevision(rev Revision) (Revision, error) {
+	if !m.inUse(rev.PostID) {
+		return Revision{}, errNotFound
+	}
+	revs := m.revisions[rev.PostID]
+	if rev.N == 0 {
+		rev.N = 1
+		if len(revs) > 0 {
+			rev.N = revs[len(revs)-1].N + 1
+		}
+	}
+	revs = append(revs, rev)
+	if *maxRevisions > 0 && len(revs) > *maxRevisions {
+		revs = append([]Revision(nil), revs[len(revs)-*maxRevisions:]...)
+	}
+	m.revisions[rev.PostID] = revs
+	return rev, nil
+}
+
+func (m *memoryStore) DropRevisions(postID PostID, n int) error {
+	revs := m.revisions[postID]
+	i := sort.Search(len(revs), func(i int) bool { return revs[i].N > n })
+	m.revisions[postID] = revs[:i:i]
+	return nil
+}
+
+// inUse reports whether a post, live or trashed, has the given ID.
+func (m *memoryStore) inUse(id PostID) bool {
+	_, live := m.posts[id]
+	_, trashed := m.trash[id]
+	return live || trashed
+}
+
+func (m *memoryStore) Check() error {
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+//--------------FILE STORE================
+
+// fileStore keeps posts in memory like memoryStore, and appends every
+// change to a journal, one JSON record per line:
+//
+//	{"op":"put","post":{"id":1,"body":"..."}}
+//	{"op":"views","id":1,"views":12}
+//	{"op":"delete","id":1}
+//	{"op":"next_id","id":7}
+//	{"op":"comment","comment":{"id":3,"post_id":1,"body":"..."}}
+//	{"op":"delete_comment","post_id":1,"id":3}
+//	{"op":"next_comment_id","id":4}
+//	{"op":"trash","id":1,"deleted_at":"2024-06-01T12:00:00Z"}
+//	{"op":"restore","id":1}
+//	{"op":"purge","id":1}
+//	{"op":"revision","revision":{"n":2,"post_id":1,"body":"..."}}
+//	{"op":"drop_revisions","post_id":1,"id":2}
+//
+// Opening the store replays the journal and then rewrites it with just
+// the current posts, so it doesn't grow forever across restarts. Each
+// change is written before it's applied in memory, so a failed write
+// leaves both unchanged. Writes aren't synced to disk one by one: a
+// crash of the server loses nothing, but a crash of the machine can
+// lose the last few changes.
+type fileStore struct {
+	*memoryStore
+	path    string
+	journal *os.File
+}
+
+type journalRecord struct {
+	Op        string     `json:"op"`
+	ID        PostID     `json:"id,omitempty"`
+	PostID    PostID     `json:"post_id,omitempty"`
+	Post      *Post      `json:"post,omitempty"`
+	Comment   *Comment   `json:"comment,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Revision  *Revision  `json:"revision,omitempty"`
+	Views     int        `json:"views,omitempty"`
+}
+
+// journalPath is where a tenant's journal lives: posts.jsonl without
+// -multi-tenant, posts-<tenant>.jsonl with it.
+func journalPath(tenant string) string {
+	name := "posts.jsonl"
+	if tenant != "" {
+		name = "posts-" + tenant + ".jsonl"
+	}
+	return filepath.Join(*dataDir, name)
+}
+
+func tenantOfJournal(name string) (string, bool) {
+	if name == "posts.jsonl" {
+		return "", true
+	}
+	tenant := strings.TrimSuffix(strings.TrimPrefix(name, "posts-"), ".jsonl")
+	return tenant, validTenant.MatchString(tenant) && name == "posts-"+tenant+".jsonl"
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	fs := &fileStore{memoryStore: newMemoryStore(), path: path}
+	if err := fs.replay(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if err := fs.compact(); err != nil {
+		return nil, fmt.Errorf("compacting %s: %w", path, err)
+	}
+	return fs, nil
+}
+
+// replay loads the posts recorded in the journal, if there is one.
+func (fs *fileStore) replay() error {
+	f, err := os.Open(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var rec journalRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch {
+		case rec.Op == "put" && rec.Post != nil:
+			if _, ok := fs.posts[rec.Post.ID]; ok {
+				fs.memoryStore.Update(*rec.Post)
+			} else {
+				fs.memoryStore.Create(*rec.Post)
+			}
+		case rec.Op == "views":
+			fs.memoryStore.AddViews(rec.ID, rec.Views)
+		case rec.Op == "delete":
+			fs.memoryStore.Delete(rec.ID)
+		case rec.Op == "next_id":
+			if n, _ := rec.ID.asInt(); n > fs.nextID {
+				fs.nextID = n
+			}
+		case rec.Op == "comment" && rec.Comment != nil:
+			fs.memoryStore.AddComment(*rec.Comment)
+		case rec.Op == "delete_comment":
+			id, _ := rec.ID.asInt()
+			fs.memoryStore.DeleteComment(rec.PostID, id)
+		case rec.Op == "next_comment_id":
+			if n, _ := rec.ID.asInt(); n > fs.nextCommentID {
+				fs.nextCommentID = n
+			}
+		case rec.Op == "trash" && rec.DeletedAt != nil:
+			fs.memoryStore.Trash(rec.ID, *rec.DeletedAt)
+		case rec.Op == "restore":
+			fs.memoryStore.Restore(rec.ID)
+		case rec.Op == "purge":
+			fs.memoryStore.Purge(rec.ID)
+		case rec.Op == "revision" && rec.Revision != nil:
+			fs.memoryStore.AddRevision(*rec.Revision)
+		case rec.Op == "drop_revisions":
+			n, _ := rec.ID.asInt()
+			fs.memoryStore.DropRevisions(rec.PostID, n)
+		default:
+			return fmt.Errorf("bad journal record %+v", rec)
+		}
+	}
+}
+
+// compact replaces the journal with one holding just the current
+// posts, and opens it for appending. A trashed post is written like a
+// live one and then trashed, so its comments load with it.
+func (fs *fileStore) compact() error {
+	if err := os.MkdirAll(filepath.Dir(fs.path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	posts := append(fs.memoryStore.List(), fs.memoryStore.ListTrashed()...)
+	for _, p := range posts {
+		deletedAt := p.DeletedAt
+		p.DeletedAt = nil
+		recs := []journalRecord{{Op: "put", Post: &p}}
+		for _, c := range fs.comments[p.ID] {
+			recs = append(recs, journalRecord{Op: "comment", Comment: &c})
+		}
+		for _, rev := range fs.revisions[p.ID] {
+			recs = append(recs, journalRecord{Op: "revision", Revision: &rev})
+		}
+		if deletedAt != nil {
+			recs = append(recs, journalRecord{Op: "trash", ID: p.ID, DeletedAt: deletedAt})
+		}
+		for _, rec := range recs {
+			if err := enc.Encode(rec); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	enc.Encode(journalRecord{Op: "next_id", ID: intID(fs.nextID)})
+	enc.Encode(journalRecord{Op: "next_comment_id", ID: intID(fs.nextCommentID)})
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		return err
+	}
+
+	fs.journal, err = os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	return err
+}
+
+func (fs *fileStore) write(rec journalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = fs.journal.Write(append(line, '\n'))
+	return err
+}
+
+func (fs *fileStore) Create(p Post) error {
+	if fs.inUse(p.ID) {
+		return errExists
+	}
+	if err := fs.write(journalRecord{Op: "put", Post: &p}); err != nil {
+		return err
+	}
+	return fs.memoryStore.Create(p)
+}
+
+func (fs *fileStore) Update(p Post) error {
+	if _, ok := fs.posts[p.ID]; !ok {
+		return errNotFound
+	}
+	if err := fs.write(journalRecord{Op: "put", Post: &p}); err != nil {
+		return err
+	}
+	return fs.memoryStore.Update(p)
+}
+
+func (fs *fileStore) AddViews(id PostID, n int) error {
+	if !fs.inUse(id) {
+		return errNotFound
+	}
+	if err := fs.write(journalRecord{Op: "views", ID: id, Views: n}); err != nil {
+		return err
+	}
+	return fs.memoryStore.AddViews(id, n)
+}
+
+func (fs *fileStore) AddComment(c Comment) (Comment, error) {
+	if _, ok := fs.posts[c.PostID]; !ok {
+		return Comment{}, errNotFound
+	}
+	if c.ID == 0 {
+		c.ID = fs.nextCommentID
+	}
+	if err := fs.write(journalRecord{Op: "comment", Comment: &c}); err != nil {
+		return Comment{}, err
+	}
+	return fs.memoryStore.AddComment(c)
+}
+
+func (fs *fileStore) DeleteComment(postID PostID, id int) error {
+	found := false
+	for _, c := range fs.comments[postID] {
+		found = found || c.ID == id
+	}
+	if !found {
+		return errCommentNotFound
+	}
+	if err := fs.write(journalRecord{Op: "delete_comment", PostID: postID, ID: intID(id)}); err != nil {
+		return err
+	}
+	return fs.memoryStore.DeleteComment(postID, id)
+}
+
+func (fs *fileStore) Trash(id PostID, at time.Time) (Post, error) {
+	if _, ok := fs.posts[id]; !ok {
+		return Post{}, errNotFound
+	}
+	if err := fs.write(journalRecord{Op: "trash", ID: id, DeletedAt: &at}); err != nil {
+		return Post{}, err
+	}
+	return fs.memoryStore.Trash(id, at)
+}
+
+func (fs *fileStore) Restore(id PostID) (Post, error) {
+	if _, ok := fs.trash[id]; !ok {
+		return Post{}, errNotFound
+	}
+	if err := fs.write(journalRecord{Op: "restore", ID: id}); err != nil {
+		return Post{}, err
+	}
+	return fs.memoryStore.Restore(id)
+}
+
+func (fs *fileStore) Purge(id PostID) error {
+	if _, ok := fs.trash[id]; !ok {
+		return errNotFound
+	}
+	if err := fs.write(journalRecord{Op: "purge", ID: id}); err != nil {
+		return err
+	}
+	return fs.memoryStore.Purge(id)
+}
+
+func (fs *fileStore) AddRevision(rev Revision) (Revision, error) {
+	if !fs.inUse(rev.PostID) {
+		return Revision{}, errNotFound
+	}
+	if rev.N == 0 {
+		rev.N = 1
+		if revs := fs.revisions[rev.PostID]; len(revs) > 0 {
+			rev.N = revs[len(revs)-1].N + 1
+		}
+	}
+	if err := fs.write(journalRecord{Op: "revision", Revision: &rev}); err != nil {
+		return Revision{}, err
+	}
+	return fs.memoryStore.AddRevision(rev)
+}
+
+func (fs *fileStore) DropRevisions(postID PostID, n int) error {
+	if err := fs.write(journalRecord{Op: "drop_revisions", PostID: postID, ID: intID(n)}); err != nil {
+		return err
+	}
+	return fs.memoryStore.DropRevisions(postID, n)
+}
+
+// Check makes sure the journal is still there to append to.
+func (fs *fileStore) Check() error {
+	if _, err := fs.journal.Stat(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(fs.path); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	return nil
+}
+
+// Close syncs the journal to disk, which writes don't do one by one.
+func (fs *fileStore) Close() error {
+	if err := fs.journal.Sync(); err != nil {
+		fs.journal.Close()
+		return err
+	}
+	return fs.journal.Close()
+}
+
+func (fs *fileStore) Delete(id PostID) error {
+	if _, ok := fs.posts[id]; !ok {
+		return errNotFound
+	}
+	if err := fs.write(journalRecord{Op: "delete", ID: id}); err != nil {
+		return err
+	}
+	return fs.memoryStore.Delete(id)
+}
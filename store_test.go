@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// restart saves everything like a shutdown would and loads it back
+// like a start, with a fresh handler.
+func (ts *testServer) restart() {
+	ts.t.Helper()
+	if err := closeStores(); err != nil {
+		ts.t.Fatalf("closing stores: %v", err)
+	}
+	resetState(ts.t)
+	if err := loadStores(); err != nil {
+		ts.t.Fatalf("loading stores: %v", err)
+	}
+	if err := loadUsers(); err != nil {
+		ts.t.Fatalf("loading users: %v", err)
+	}
+	ts.h = newHandler()
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	ts := newTestServer(t, "-store=file", "-data-dir="+t.TempDir())
+	t.Cleanup(func() { closeStores() })
+
+	ts.createPost(`{"body":"kept","tags":["go"]}`)
+	ts.createPost(`{"body":"trashed"}`)
+	ts.createPost(`{"body":"purged"}`)
+	wantStatus(t, ts.do("PUT", "/posts/1", `{"body":"kept, edited","tags":["go"]}`), http.StatusOK)
+	wantStatus(t, ts.do("POST", "/posts/1/comments", `{"body":"nice"}`), http.StatusCreated)
+	wantStatus(t, ts.do("DELETE", "/posts/2", ""), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/3", ""), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/trash/3", ""), http.StatusOK)
+	wantStatus(t, ts.do("POST", "/users", `{"name":"ann"}`), http.StatusCreated)
+	for range 3 {
+		wantStatus(t, ts.do("GET", "/posts/1?no_count=1", ""), http.StatusOK)
+		wantStatus(t, ts.do("GET", "/posts/1", ""), http.StatusOK)
+	}
+	before := decodeResponse[Post](t, ts.do("GET", "/posts/1?no_count=1", ""))
+
+	ts.restart()
+
+	after := decodeResponse[Post](t, ts.do("GET", "/posts/1?no_count=1", ""))
+	if after.Body != "kept, edited" || len(after.Tags) != 1 || !after.UpdatedAt.Equal(before.UpdatedAt) {
+		t.Errorf("post after restart %+v, want %+v", after, before)
+	}
+	if after.Views != 3 {
+		t.Errorf("views %d, want 3", after.Views)
+	}
+	if list := decodeResponse[[]Post](t, ts.do("GET", "/posts", "")); len(list) != 1 {
+		t.Errorf("GET /posts has %d posts, want 1", len(list))
+	}
+	if list := decodeResponse[[]Post](t, ts.do("GET", "/posts?tag=go", "")); len(list) != 1 {
+		t.Errorf("the tag index wasn't rebuilt: %+v", list)
+	}
+	if cs := decodeResponse[[]Comment](t, ts.do("GET", "/posts/1/comments", "")); len(cs) != 1 || cs[0].Body != "nice" {
+		t.Errorf("comments %+v", cs)
+	}
+	if revs := decodeResponse[[]Revision](t, ts.do("GET", "/posts/1/revisions", "")); len(revs) == 0 {
+		t.Error("no revisions")
+	}
+	if trash := decodeResponse[[]Post](t, ts.do("GET", "/posts/trash", "")); len(trash) != 1 || trash[0].ID != "2" {
+		t.Errorf("trash %+v, want just post 2", trash)
+	}
+	if u := decodeResponse[User](t, ts.do("GET", "/users/1", "")); u.Name != "ann" {
+		t.Errorf("user %+v", u)
+	}
+
+	// Post 2 can come back from the trash, and new posts don't reuse
+	// the IDs of the old ones.
+	wantStatus(t, ts.do("POST", "/posts/2/restore", ""), http.StatusOK)
+	if p := ts.createPost(`{"body":"new"}`); p.ID == "1" || p.ID == "2" {
+		t.Errorf("new post got ID %s", p.ID)
+	}
+}
+
+func TestMemoryStoreStartsEmpty(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createPost(`{"body":"gone"}`)
+	ts.restart()
+	if list := decodeResponse[[]Post](t, ts.do("GET", "/posts", "")); len(list) != 0 {
+		t.Errorf("-store=memory kept %d posts", len(list))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//--------------TAGS================
+
+// Tags are short labels on a post, e.g. "go" or "release-notes". They
+// are lower-cased and de-duplicated when a post is saved, and limited
+// to maxTags of at most maxTagLen letters, digits, - and _.
+const (
+	maxTags   = 10
+	maxTagLen = 32
+)
+
+var validTag = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+var errInvalidTags = errors.New("invalid tags")
+
+// normalizeTags cleans up tags as described above, or returns
+// errInvalidTags.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if len(t) > maxTagLen || !validTag.MatchString(t) {
+			return nil, errInvalidTags
+		}
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	if len(out) > maxTags {
+		return nil, errInvalidTags
+	}
+	return out, nil
+}
+
+// A postSet's tagIndex maps each tag to the IDs of the posts that have
+// it, so ?tag= and /tags don't have to look at every post.
+
+func (s *postSet) indexTags(p Post) {
+	for _, t := range p.Tags {
+		ids, ok := s.tagIndex[t]
+		if !ok {
+			ids = make(map[PostID]bool)
+			s.tagIndex[t] = ids
+		}
+		ids[p.ID] = true
+	}
+}
+
+func (s *postSet) unindexTags(p Post) {
+	for _, t := range p.Tags {
+		delete(s.tagIndex[t], p.ID)
+		if len(s.tagIndex[t]) == 0 {
+			delete(s.tagIndex, t)
+		}
+	}
+}
+
+// rebuildTagIndex recomputes tagIndex from posts.
+func (s *postSet) rebuildTagIndex() {
+	s.tagIndex = make(map[string]map[PostID]bool)
+	for _, p := range s.store.List() {
+		s.indexTags(p)
+	}
+}
+
+// taggedPosts returns the posts with the given tag, in no particular
+// order.
+func (s *postSet) taggedPosts(tag string) []Post {
+	ids := s.tagIndex[tag]
+	ps := make([]Post, 0, len(ids))
+	for id := range ids {
+		if p, ok := s.store.Get(id); ok {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+func hasAllTags(p Post, tags []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, t := range p.Tags {
+			found = found || t == want
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// handleGetTags lists every tag in use with how many posts have it,
+// most used first.
+func handleGetTags(w http.ResponseWriter, r *http.Request) {
+	s := readPostSet(r)
+	counts := make([]tagCount, 0, len(s.tagIndex))
+	for t, ids := range s.tagIndex {
+		counts = append(counts, tagCount{Tag: t, Count: len(ids)})
+	}
+	postsMu.RUnlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Tag < counts[j].Tag
+	})
+	respond(w, r, http.StatusOK, counts)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+//--------------TENANTS================
+
+var multiTenant = flag.Bool("multi-tenant", false, "keep a separate set of posts per X-Tenant-ID header, which every posts request must send")
+
+// postSet is everything stored for one tenant: its posts and the
+// state kept alongside them. Without -multi-tenant there is a single
+// postSet for everyone. Like the posts in it, a postSet is guarded by
+// postsMu.
+type postSet struct {
+	tenant string
+	// store keeps the posts themselves; see store.go.
+	store  Store
+	nextID int
+
+	// version is bumped by every change to posts; see etag.go.
+	version uint64
+	// bodyBytes totals the body lengths; see memguard.go.
+	bodyBytes int64
+	// authorBodies backs -unique-per-author; see unique.go.
+	authorBodies map[authorBody]PostID
+	// tombstones backs -gone-retention; see gone.go.
+	tombstones map[PostID]time.Time
+	// freeIDs backs -reuse-ids; see reuse.go.
+	freeIDs idHeap
+	// tagIndex backs ?tag= and /tags; see tags.go.
+	tagIndex map[string]map[PostID]bool
+	// textIndex backs /posts/search, and indexGen tells its
+	// rebuilds apart; see search.go.
+	textIndex invertedIndex
+	indexGen  int
+	// views counts views not yet in store; see views.go.
+	views viewCounts
+}
+
+// newPostSet makes the postSet for a tenant whose posts are in store,
+// which may already hold some from an earlier run.
+func newPostSet(tenant string, store Store) *postSet {
+	s := &postSet{
+		tenant:       tenant,
+		store:        store,
+		nextID:       store.NextID(),
+		authorBodies: make(map[authorBody]PostID),
+		tombstones:   make(map[PostID]time.Time),
+		tagIndex:     make(map[string]map[PostID]bool),
+	}
+	s.rebuildDerived()
+	return s
+}
+
+// tenants maps each tenant ID to its posts, created by the first
+// write for it. Reading a tenant that isn't here sees no posts and
+// leaves nothing behind, so a stream of made-up X-Tenant-IDs can't
+// fill up memory or, with -store=file, the data directory.
+// Guarded by postsMu.
+var tenants = make(map[string]*postSet)
+
+// validTenant limits tenant IDs to something safe to log and echo.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type (
+	tenantKey struct{}
+	storeKey  struct{}
+)
+
+// tenanted makes a handler serve the posts of the tenant named by the
+// X-Tenant-ID header. With -multi-tenant a missing or malformed header
+// is a 400; without it the header is ignored.
+//
+// The tenant's postSet goes in the request's context, if it has one
+// yet, for handlers to get with storeFromContext rather than looking
+// it up in tenants. The settings stay in the flags, which are the same
+// for every request.
+func tenanted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := ""
+		if *multiTenant {
+			tenant = r.Header.Get("X-Tenant-ID")
+			if !validTenant.MatchString(tenant) {
+				writeError(w, r, http.StatusBadRequest, "X-Tenant-ID header is required (letters, digits, _ and -, at most 64)")
+				return
+			}
+			// Responses differ per tenant, so caches must key on it.
+			w.Header().Add("Vary", "X-Tenant-ID")
+		}
+
+		ctx := context.WithValue(r.Context(), tenantKey{}, tenant)
+		if s := lookupPostSet(tenant); s != nil {
+			ctx = context.WithValue(ctx, storeKey{}, s)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// storeFromContext returns the posts of the request's tenant, with
+// their store, as put in ctx by tenanted, or nil on routes without it
+// and for tenants without posts yet.
+// Like any postSet it's guarded by postsMu.
+func storeFromContext(ctx context.Context) *postSet {
+	s, _ := ctx.Value(storeKey{}).(*postSet)
+	return s
+}
+
+// tenantOf returns the request's tenant ID, "" without -multi-tenant.
+func tenantOf(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return tenant
+}
+
+// postSetFor returns the posts of the request's tenant, for changing
+// them, creating them on first use. Callers must hold postsMu for
+// writing.
+func postSetFor(r *http.Request) (*postSet, error) {
+	if s := storeFromContext(r.Context()); s != nil {
+		return s, nil
+	}
+	return tenantPostSet(tenantOf(r))
+}
+
+// tenantPostSet returns the posts of the named tenant, creating them
+// on first use. Callers must hold postsMu for writing.
+func tenantPostSet(tenant string) (*postSet, error) {
+	if s, ok := tenants[tenant]; ok {
+		return s, nil
+	}
+	// Every tenant with a journal was opened by loadStores, so this
+	// one's store starts out empty and opening it can only fail if
+	// the data directory itself is broken.
+	store, err := newStore(tenant)
+	if err != nil {
+		slog.Error("opening a new tenant's posts", "tenant", tenant, "err", err)
+		return nil, err
+	}
+	s := newPostSet(tenant, store)
+	tenants[tenant] = s
+	return s, nil
+}
+
+// readPostSet read-locks postsMu and returns the posts of the
+// request's tenant, or, for a tenant without any yet, an empty set
+// that isn't kept. The caller must RUnlock postsMu when done.
+func readPostSet(r *http.Request) *postSet {
+	s := storeFromContext(r.Context())
+	postsMu.RLock()
+	if s == nil {
+		s = tenants[tenantOf(r)]
+	}
+	if s == nil {
+		s = newPostSet(tenantOf(r), newMemoryStore())
+	}
+	return s
+}
+
+// lookupPostSet returns the posts of the named tenant, or nil if it
+// has none yet. It takes postsMu itself, so callers mustn't hold it.
+// Tenants are never removed, and their postSets never replaced, so
+// the result stays theirs once the lock is let go.
+func lookupPostSet(tenant string) *postSet {
+	postsMu.RLock()
+	defer postsMu.RUnlock()
+	return tenants[tenant]
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	ts := newTestServer(t, "-multi-tenant=true", "-response-cache-size=100")
+	a, b := []string{"X-Tenant-ID", "a"}, []string{"X-Tenant-ID", "b"}
+
+	// Each tenant numbers its posts from 1.
+	if p := ts.createPost(`{"body":"apple pie","tags":["fruit"]}`, a...); p.ID != "1" {
+		t.Fatalf("a's first post is %s", p.ID)
+	}
+	ts.createPost(`{"body":"apricot"}`, a...)
+	if p := ts.createPost(`{"body":"banana bread","tags":["bread"]}`, b...); p.ID != "1" {
+		t.Fatalf("b's first post is %s", p.ID)
+	}
+	wantStatus(t, ts.do("POST", "/posts/1/comments", `{"body":"a's comment"}`, a...), http.StatusCreated)
+	// Filling the response cache with a's list first.
+	wantStatus(t, ts.do("GET", "/posts", "", a...), http.StatusOK)
+
+	tests := []struct {
+		name   string
+		tenant []string
+		method string
+		path   string
+		want   int
+		// contains and lacks are checked against the response body.
+		contains, lacks string
+	}{
+		{"list", b, "GET", "/posts", http.StatusOK, "banana", "apple"},
+		{"post", b, "GET", "/posts/1", http.StatusOK, "banana", "apple"},
+		{"other tenant's ID", b, "GET", "/posts/2", http.StatusNotFound, "", "apricot"},
+		{"search", b, "GET", "/posts/search?q=apple", http.StatusOK, "", "apple"},
+		{"tags", b, "GET", "/tags", http.StatusOK, "bread", "fruit"},
+		{"tag filter", b, "GET", "/posts?tag=fruit", http.StatusOK, "", "apple"},
+		{"comments", b, "GET", "/posts/1/comments", http.StatusOK, "", "a's comment"},
+		{"update other tenant's ID", b, "PUT", "/posts/2", http.StatusNotFound, "", ""},
+		{"delete other tenant's ID", b, "DELETE", "/posts/2", http.StatusNotFound, "", ""},
+		{"no tenant", nil, "GET", "/posts", http.StatusBadRequest, "X-Tenant-ID", "apple"},
+		{"bad tenant", []string{"X-Tenant-ID", "a/../b"}, "GET", "/posts", http.StatusBadRequest, "", "apple"},
+		{"new tenant", []string{"X-Tenant-ID", "c"}, "GET", "/posts", http.StatusOK, "[]", "apple"},
+	}
+	for _, tt := range tests {
+		body := ""
+		if tt.method == "PUT" {
+			body = `{"body":"taken over"}`
+		}
+		rec := ts.do(tt.method, tt.path, body, tt.tenant...)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+		if got := rec.Body.String(); !strings.Contains(got, tt.contains) || (tt.lacks != "" && strings.Contains(got, tt.lacks)) {
+			t.Errorf("%s: body %s, want %q and not %q", tt.name, got, tt.contains, tt.lacks)
+		}
+		if tt.want == http.StatusOK && !slices.Contains(rec.Header().Values("Vary"), "X-Tenant-ID") {
+			t.Errorf("%s: Vary %q", tt.name, rec.Header().Values("Vary"))
+		}
+	}
+
+	// b's deletes and empty trash leave a's posts alone.
+	wantStatus(t, ts.do("DELETE", "/posts/1", "", b...), http.StatusOK)
+	wantStatus(t, ts.do("DELETE", "/posts/trash", "", b...), http.StatusOK)
+	if list := decodeResponse[[]Post](t, ts.do("GET", "/posts", "", a...)); len(list) != 2 {
+		t.Errorf("a has %d posts after b's deletes, want 2", len(list))
+	}
+	if got := ts.do("GET", "/posts/1", "", a...); got.Code != http.StatusOK || !strings.Contains(got.Body.String(), "apple") {
+		t.Errorf("a's post 1 after b deleted theirs: %d %s", got.Code, got.Body)
+	}
+
+	// The same ETag means something else to each tenant.
+	etag := ts.do("GET", "/posts", "", a...).Header().Get("ETag")
+	if rec := ts.do("GET", "/posts", "", append(b, "If-None-Match", etag)...); rec.Code == http.StatusNotModified {
+		t.Errorf("b's list matched a's ETag %s", etag)
+	}
+}
+
+func TestTenantedPutsStoreInContext(t *testing.T) {
+	newTestServer(t, "-multi-tenant=true")
+
+	var got *postSet
+	h := tenanted(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = storeFromContext(r.Context())
+		if r.Method == "POST" {
+			postsMu.Lock()
+			postSetFor(r)
+			postsMu.Unlock()
+		}
+	}))
+	for _, tt := range []struct {
+		method, tenant string
+		// Whether the tenant has posts by the time of the request.
+		exists bool
+	}{
+		{"GET", "a", false},
+		{"POST", "a", false},
+		{"GET", "a", true},
+		{"GET", "b", false},
+	} {
+		r := httptest.NewRequest(tt.method, "/posts", nil)
+		r.Header.Set("X-Tenant-ID", tt.tenant)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		postsMu.RLock()
+		want := tenants[tt.tenant]
+		postsMu.RUnlock()
+		if !tt.exists {
+			if got != nil {
+				t.Errorf("%s for new tenant %s: store %p, want none", tt.method, tt.tenant, got)
+			}
+			continue
+		}
+		if got == nil || got != want || got.tenant != tt.tenant {
+			t.Errorf("%s for tenant %s: store %p, want %p", tt.method, tt.tenant, got, want)
+		}
+	}
+
+	if s := storeFromContext(httptest.NewRequest("GET", "/", nil).Context()); s != nil {
+		t.Errorf("store %p outside tenanted", s)
+	}
+}
+
+func TestReadsDontCreateTenants(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t, "-multi-tenant=true", "-store=file", "-data-dir="+dir)
+
+	for _, tenant := range []string{"a", "b", "c"} {
+		h := []string{"X-Tenant-ID", tenant}
+		if rec := ts.do("GET", "/posts", "", h...); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+			t.Errorf("GET /posts for %s: %d %s", tenant, rec.Code, rec.Body)
+		}
+		wantStatus(t, ts.do("GET", "/posts/1", "", h...), http.StatusNotFound)
+		wantStatus(t, ts.do("GET", "/tags", "", h...), http.StatusOK)
+	}
+	if journals, _ := filepath.Glob(filepath.Join(dir, "*")); len(journals) != 0 {
+		t.Errorf("reads left %v", journals)
+	}
+	postsMu.RLock()
+	n := len(tenants)
+	postsMu.RUnlock()
+	if n != 0 {
+		t.Errorf("reads made %d tenants", n)
+	}
+
+	// The first write does.
+	ts.createPost(`{"body":"first"}`, "X-Tenant-ID", "a")
+	if _, err := os.Stat(filepath.Join(dir, "posts-a.jsonl")); err != nil {
+		t.Errorf("after a write: %v", err)
+	}
+}
+
+func TestNewTenantStoreError(t *testing.T) {
+	// A file where the data directory should be.
+	file := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, "-multi-tenant=true", "-store=file", "-data-dir="+file)
+
+	h := []string{"X-Tenant-ID", "a"}
+	wantStatus(t, ts.do("POST", "/posts", `{"body":"first"}`, h...), http.StatusInternalServerError)
+	rec := ts.do("POST", "/batch", `{"operations":[{"op":"create","post":{"body":"first"}}]}`, h...)
+	wantStatus(t, rec, http.StatusOK)
+	if res := decodeResponse[batchResponse](t, rec).Results; len(res) != 1 || res[0].Status != http.StatusInternalServerError {
+		t.Errorf("batch results %+v", res)
+	}
+	wantStatus(t, ts.do("GET", "/posts", "", h...), http.StatusOK)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+//--------------TLS================
+
+// With -tls-cert and -tls-key the server speaks HTTPS itself, so it
+// can face the internet without a reverse proxy. -redirect-addr adds a
+// plain HTTP listener, usually :80, that sends everyone to HTTPS.
+//
+// Instead of -tls-cert and -tls-key, -acme-domains gets certificates
+// for the given hostnames from Let's Encrypt (or the ACME server at
+// -acme-directory) on the first request for each, and renews them
+// before they expire, without a restart. Giving -acme-domains is
+// taken as agreeing to the CA's terms of service. Certificates and
+// the account key are kept in -acme-cache-dir; without it every
+// restart would ask for new ones and soon hit Let's Encrypt's rate
+// limits. The CA checks that the server really answers for a hostname
+// either over TLS on :443 or over plain HTTP on :80, so the server
+// must be reachable on one of them: -addr=:443, or -redirect-addr=:80,
+// which answers the CA's challenges and redirects everything else.
+var (
+	tlsCert      = flag.String("tls-cert", "", "PEM certificate file (with any intermediates) to serve HTTPS")
+	tlsKey       = flag.String("tls-key", "", "PEM private key file for -tls-cert")
+	redirectAddr = flag.String("redirect-addr", "", "with TLS, also listen here for plain HTTP, e.g. :80, and redirect it to HTTPS")
+
+	acmeDomains   = flag.String("acme-domains", "", "comma separated hostnames to get certificates for automatically from Let's Encrypt, instead of -tls-cert")
+	acmeCacheDir  = flag.String("acme-cache-dir", "acme", "directory to keep -acme-domains certificates and the account key in")
+	acmeEmail     = flag.String("acme-email", "", "contact address for the -acme-domains account, for expiry and problem notices")
+	acmeDirectory = flag.String("acme-directory", autocert.DefaultACMEDirectory, "ACME directory URL, e.g. Let's Encrypt's staging one for trying -acme-domains out")
+)
+
+// Compliance rules often say which TLS versions and cipher suites may
+// be used, so both can be set. The defaults are what's considered
+// secure today: TLS 1.2 or later, and with 1.2 only suites with
+// forward secrecy (ECDHE) and authenticated encryption (AES-GCM or
+// ChaCha20-Poly1305). TLS 1.3 suites are all of that already, and Go
+// doesn't let them be picked. The server refuses to start with
+// anything weaker: TLS 1.0 or 1.1, or a suite Go counts as insecure.
+var (
+	tlsMinVersion = flag.String("tls-min-version", "1.2", "oldest TLS version to accept: 1.2 or 1.3")
+	tlsCiphers    = flag.String("tls-ciphers", strings.Join(defaultCipherSuites, ","), "comma separated cipher suites to allow with TLS 1.2")
+)
+
+var defaultCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsEnabled() bool {
+	return *tlsCert != "" || acmeEnabled()
+}
+
+func acmeEnabled() bool {
+	return *acmeDomains != ""
+}
+
+func checkTLSFlags() error {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if *redirectAddr != "" && !tlsEnabled() {
+		return errors.New("-redirect-addr needs -tls-cert and -tls-key, or -acme-domains")
+	}
+	if acmeEnabled() {
+		if *tlsCert != "" {
+			return errors.New("-acme-domains and -tls-cert can't be used together")
+		}
+		if *acmeCacheDir == "" {
+			return errors.New("-acme-domains needs -acme-cache-dir")
+		}
+		if _, err := parseACMEDomains(*acmeDomains); err != nil {
+			return err
+		}
+	}
+	_, err := tlsConfig()
+	return err
+}
+
+// parseACMEDomains splits -acme-domains into hostnames. Certificates
+// are for names only: no ports, schemes, paths or IP addresses.
+func parseACMEDomains(s string) ([]string, error) {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "":
+			return nil, errors.New("-acme-domains: empty hostname")
+		case strings.ContainsAny(d, ":/ "):
+			return nil, fmt.Errorf("-acme-domains: %q isn't a hostname", d)
+		case net.ParseIP(d) != nil:
+			return nil, fmt.Errorf("-acme-domains: %q is an IP address, which Let's Encrypt won't certify", d)
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// newCertManager gets and renews the -acme-domains certificates for
+// cfg, and returns the manager so the -redirect-addr listener can
+// answer the CA's challenges too. checkTLSFlags has made sure the
+// flags are sound.
+func newCertManager(cfg *tls.Config) *autocert.Manager {
+	domains, _ := parseACMEDomains(*acmeDomains)
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(*acmeCacheDir),
+		Email:      *acmeEmail,
+		Client:     &acme.Client{DirectoryURL: *acmeDirectory},
+	}
+	cfg.GetCertificate = m.GetCertificate
+	// acme.ALPNProto is how the CA checks a hostname over TLS.
+	cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	return m
+}
+
+// tlsConfig builds the server's TLS settings from -tls-min-version and
+// -tls-ciphers.
+func tlsConfig() (*tls.Config, error) {
+	version, ok := tlsVersions[*tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("-tls-min-version %q isn't allowed (want 1.2 or 1.3)", *tlsMinVersion)
+	}
+
+	suites := make(map[string]*tls.CipherSuite)
+	for _, cs := range tls.CipherSuites() {
+		suites[cs.Name] = cs
+	}
+	insecure := make(map[string]bool)
+	for _, cs := range tls.InsecureCipherSuites() {
+		insecure[cs.Name] = true
+	}
+
+	var ids []uint16
+	http2Capable := false
+	for _, name := range strings.Split(*tlsCiphers, ",") {
+		name = strings.TrimSpace(name)
+		cs, ok := suites[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("-tls-ciphers: %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("-tls-ciphers: unknown cipher suite %q", name)
+		}
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("-tls-ciphers: %s is a TLS 1.3 suite, which can't be picked", name)
+		}
+		ids = append(ids, cs.ID)
+		http2Capable = http2Capable || cs.ID == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || cs.ID == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	}
+	if version < tls.VersionTLS13 && !http2Capable {
+		return nil, errors.New("-tls-ciphers must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which HTTP/2 needs")
+	}
+	return &tls.Config{MinVersion: version, CipherSuites: ids}, nil
+}
+
+// serve runs srv on ln, over TLS if it's configured. With
+// -acme-domains both files are empty, and the certificates come from
+// srv.TLSConfig.GetCertificate.
+func serve(srv *http.Server, ln net.Listener) error {
+	if tlsEnabled() {
+		return srv.ServeTLS(ln, *tlsCert, *tlsKey)
+	}
+	return srv.Serve(ln)
+}
+
+// startRedirectServer starts the -redirect-addr listener, if any, and
+// returns it so it can be shut down with the main server. With certs,
+// it also answers the CA's HTTP challenges for them.
+func startRedirectServer(certs *autocert.Manager) *http.Server {
+	if *redirectAddr == "" {
+		return nil
+	}
+
+	_, httpsPort, _ := net.SplitHostPort(*addr)
+	handler := redirectToHTTPS(httpsPort)
+	if certs != nil {
+		handler = certs.HTTPHandler(handler)
+	}
+	srv := &http.Server{
+		Addr:        *redirectAddr,
+		Handler:     handler,
+		ReadTimeout: *readTimeout,
+		IdleTimeout: *idleTimeout,
+		ErrorLog:    serverErrorLog(),
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return srv
+}
+
+// redirectToHTTPS sends every request to the same URL over HTTPS on
+// httpsPort. GET and HEAD get a 301; other methods a 308, so clients
+// repeat them with the same method and body.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
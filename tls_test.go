@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTLSFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags map[string]string
+		ok    bool
+	}{
+		{"none", nil, true},
+		{"cert and key", map[string]string{"tls-cert": "cert.pem", "tls-key": "key.pem"}, true},
+		{"cert alone", map[string]string{"tls-cert": "cert.pem"}, false},
+		{"redirect without TLS", map[string]string{"redirect-addr": ":80"}, false},
+		{"acme", map[string]string{"acme-domains": "example.com, www.example.com", "redirect-addr": ":80"}, true},
+		{"acme and a cert", map[string]string{"acme-domains": "example.com", "tls-cert": "cert.pem", "tls-key": "key.pem"}, false},
+		{"acme without a cache", map[string]string{"acme-domains": "example.com", "acme-cache-dir": ""}, false},
+		{"acme with an empty name", map[string]string{"acme-domains": "example.com,"}, false},
+		{"acme with a port", map[string]string{"acme-domains": "example.com:443"}, false},
+		{"acme with a URL", map[string]string{"acme-domains": "https://example.com"}, false},
+		{"acme with an IP", map[string]string{"acme-domains": "192.0.2.1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.flags {
+				setFlag(t, name, value)
+			}
+			if err := checkTLSFlags(); (err == nil) != tt.ok {
+				t.Errorf("checkTLSFlags() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCertManager(t *testing.T) {
+	setFlag(t, "acme-domains", "Example.com,www.example.com")
+	setFlag(t, "acme-cache-dir", t.TempDir())
+	setFlag(t, "acme-directory", "http://127.0.0.1:1/directory")
+	cfg, err := tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newCertManager(cfg)
+
+	if cfg.GetCertificate == nil || len(cfg.NextProtos) != 3 {
+		t.Fatalf("TLS config not set up for ACME: %+v", cfg.NextProtos)
+	}
+	for host, ok := range map[string]bool{"example.com": true, "www.example.com": true, "evil.example": false} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != ok {
+			t.Errorf("HostPolicy(%q) = %v", host, err)
+		}
+	}
+	// Names that aren't ours are refused before asking the CA anything.
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.example"}); err == nil {
+		t.Error("got a certificate for evil.example")
+	}
+
+	// The redirect listener answers challenges and redirects the rest.
+	h := m.HTTPHandler(redirectToHTTPS("443"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/posts", nil))
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://example.com/posts" {
+		t.Errorf("GET /posts: %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/.well-known/acme-challenge/token", nil))
+	if rec.Code == http.StatusMovedPermanently {
+		t.Error("challenge redirected to HTTPS")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//--------------THE TRASH================
+
+var trashRetention = flag.Duration("trash-retention", 0, "purge posts that have been in the trash this long (0 keeps them until purged by hand)")
+
+// Deleting a post moves it to the trash instead of dropping it: it's
+// marked with deleted_at and left out of everything else, but can be
+// brought back until it's purged.
+//
+//	GET    /posts/trash          posts in the trash, latest deleted first
+//	POST   /posts/{id}/restore   put a post back
+//	DELETE /posts/trash/{id}     purge one post
+//	DELETE /posts/trash          purge every post you may change
+//
+// A purged post's ID is what -reuse-ids hands out again, not a
+// trashed one's, since restoring the post needs it.
+
+func handleGetTrash(w http.ResponseWriter, r *http.Request) {
+	ps := readPostSet(r).store.ListTrashed()
+	postsMu.RUnlock()
+
+	sort.Slice(ps, func(i, j int) bool {
+		if !ps[i].DeletedAt.Equal(*ps[j].DeletedAt) {
+			return ps[i].DeletedAt.After(*ps[j].DeletedAt)
+		}
+		return ps[i].ID < ps[j].ID
+	})
+	respond(w, r, http.StatusOK, ps)
+}
+
+func handleRestorePost(w http.ResponseWriter, r *http.Request, id PostID) {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	if err := s.checkOwner(r, id); err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	p, err := s.restorePost(id)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, p)
+}
+
+func handlePurgePost(w http.ResponseWriter, r *http.Request, id PostID) {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	err = s.checkOwner(r, id)
+	if err == nil {
+		err = s.purgePost(id)
+	}
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleEmptyTrash purges the trash, leaving other users' posts alone
+// when auth is on.
+func handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	purged := 0
+	for _, p := range s.store.ListTrashed() {
+		if s.checkOwner(r, p.ID) != nil {
+			continue
+		}
+		if err := s.purgePost(p.ID); err != nil {
+			writePostError(w, r, err)
+			return
+		}
+		purged++
+	}
+
+	respond(w, r, http.StatusOK, map[string]int{"purged": purged})
+}
+
+// withTrashID is withID for /posts/trash/{id}.
+func withTrashID(h func(w http.ResponseWriter, r *http.Request, id PostID)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		segment := r.URL.Path[len("/posts/trash/"):]
+		id, ok := parsePostID(segment)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "Invalid post ID")
+			return
+		}
+		h(w, r, id)
+	}
+}
+
+// restorePost moves the post with the given ID out of the trash.
+// Callers must hold postsMu.
+func (s *postSet) restorePost(id PostID) (Post, error) {
+	p, ok := s.store.GetTrashed(id)
+	if !ok {
+		return Post{}, errNotFound
+	}
+	// Another post may have taken its body in the meantime.
+	if err := s.checkUniqueBody(p); err != nil {
+		return Post{}, err
+	}
+
+	p, err := s.store.Restore(id)
+	if err != nil {
+		return Post{}, err
+	}
+	// Coming back is a change, so ?modified_since= picks it up.
+	p.UpdatedAt = time.Now().UTC()
+	if err := s.store.Update(p); err != nil {
+		slog.Warn("restored post keeps its old updated_at", "id", id, "err", err)
+	}
+	s.version++
+	s.bodyBytes += int64(len(p.Body))
+	delete(s.tombstones, id)
+	s.indexBody(p)
+	s.indexTags(p)
+	s.textIndex.add(p)
+	s.emitEvent("post.restored", p)
+	return p, nil
+}
+
+// deletedPost stands in for a deleted post in a ?modified_since= list.
+type deletedPost struct {
+	ID        PostID    `json:"id"`
+	Deleted   bool      `json:"deleted"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// deletedSince returns a post with only the ID and deleted_at set for
+// every post deleted after t, from the trash and, once purged, from
+// the -gone-retention tombstones. A post purged without a tombstone,
+// or after it's pruned, is missed. Callers must hold postsMu.
+func (s *postSet) deletedSince(t time.Time) []Post {
+	var ps []Post
+	trashed := make(map[PostID]bool)
+	for _, p := range s.store.ListTrashed() {
+		trashed[p.ID] = true
+		if p.DeletedAt.After(t) {
+			ps = append(ps, Post{ID: p.ID, UpdatedAt: *p.DeletedAt, DeletedAt: p.DeletedAt})
+		}
+	}
+	for id, at := range s.tombstones {
+		if !trashed[id] && at.After(t) {
+			at := at.UTC()
+			ps = append(ps, Post{ID: id, UpdatedAt: at, DeletedAt: &at})
+		}
+	}
+	return ps
+}
+
+// purgePost removes a post from the trash for good. Callers must hold
+// postsMu.
+func (s *postSet) purgePost(id PostID) error {
+	p, ok := s.store.GetTrashed(id)
+	if !ok {
+		return errNotFound
+	}
+	if err := s.store.Purge(id); err != nil {
+		return err
+	}
+	s.releaseID(id)
+	s.emitEvent("post.purged", p)
+	return nil
+}
+
+// purgeExpiredTrash purges posts that have been in the trash for
+// -trash-retention, checking once per interval.
+func purgeExpiredTrash(interval time.Duration) {
+	for range time.Tick(interval) {
+		postsMu.Lock()
+		for _, s := range tenants {
+			for _, p := range s.store.ListTrashed() {
+				if time.Since(*p.DeletedAt) >= *trashRetention {
+					s.purgePost(p.ID)
+				}
+			}
+		}
+		postsMu.Unlock()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"flag"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//--------------WEB UI================
+
+var serveUI = flag.Bool("ui", true, "serve the admin web UI at /")
+
+// The UI in ui/ is a single page that lists posts and creates, edits
+// and deletes them through the API, so the server can be used from a
+// browser. It's built into the binary, so there's nothing to deploy
+// alongside it.
+//
+// index.html refers to its assets with ?v=<hash of the file>, so the
+// assets can be cached for good: a new build with changed assets
+// changes the URLs. index.html itself is revalidated every time, which
+// its ETag makes cheap.
+
+//go:embed ui
+var uiFiles embed.FS
+
+type uiAsset struct {
+	content     []byte
+	contentType string
+	etag        string
+	version     string // first hex digits of the content hash
+}
+
+// uiAssets holds every file under ui/, by path under /ui/, and
+// uiIndex the index.html with versioned asset URLs.
+var (
+	uiAssets = make(map[string]*uiAsset)
+	uiIndex  *uiAsset
+)
+
+// loadUI reads the embedded files once at startup.
+func loadUI() error {
+	err := fs.WalkDir(uiFiles, "ui", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := uiFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		uiAssets["/"+name] = newUIAsset(b, path.Ext(name))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	index := uiAssets["/ui/index.html"].content
+	for name, a := range uiAssets {
+		index = bytes.ReplaceAll(index, []byte(`"`+name+`"`), []byte(`"`+name+"?v="+a.version+`"`))
+	}
+	uiIndex = newUIAsset(index, ".html")
+	return nil
+}
+
+func newUIAsset(b []byte, ext string) *uiAsset {
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &uiAsset{content: b, contentType: contentType, etag: `"` + hash[:32] + `"`, version: hash[:12]}
+}
+
+// handleRoot serves the UI at / and answers 404 for any other path
+// that no route claims.
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" || !*serveUI {
+		writeError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	methods{"GET": func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		serveUIAsset(w, r, uiIndex)
+	}}.ServeHTTP(w, r)
+}
+
+// handleUIAsset serves the files index.html uses.
+func handleUIAsset(w http.ResponseWriter, r *http.Request) {
+	a, ok := uiAssets[r.URL.Path]
+	if !ok || !*serveUI || strings.HasSuffix(r.URL.Path, ".html") {
+		writeError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.URL.Query().Get("v") == a.version {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	serveUIAsset(w, r, a)
+}
+
+func serveUIAsset(w http.ResponseWriter, r *http.Request, a *uiAsset) {
+	w.Header().Set("Content-Type", a.contentType)
+	w.Header().Set("ETag", a.etag)
+	// Only our own scripts and styles, and only our own API.
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// ServeContent answers If-None-Match with 304, and handles Range.
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(a.content))
+}
@@ -0,0 +1,215 @@
+// The admin UI: lists posts and creates, edits and deletes them
+// through the same API as any other client.
+"use strict";
+
+const pageSize = 20;
+let offset = 0;
+let editing = null; // the post being edited, or null for a new one
+
+const $ = (id) => document.getElementById(id);
+
+// api sends a request, with the saved token and tenant, and returns
+// the decoded JSON body, or throws an Error with the server's message.
+async function api(method, path, body) {
+  const headers = { Accept: "application/json" };
+  const token = localStorage.getItem("token");
+  if (token) headers.Authorization = "Bearer " + token;
+  const tenant = $("tenant").value.trim();
+  if (tenant) headers["X-Tenant-ID"] = tenant;
+  if (body !== undefined) headers["Content-Type"] = "application/json";
+
+  const resp = await fetch(path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  const text = await resp.text();
+  let data = null;
+  try {
+    data = text ? JSON.parse(text) : null;
+  } catch {
+    // Some errors are plain text.
+  }
+  if (!resp.ok) {
+    let msg = (data && (data.error || data.detail)) || text || resp.statusText;
+    if (data && data.fields) {
+      msg += ": " + data.fields.map((f) => f.field + " " + f.message).join(", ");
+    }
+    if (resp.status === 401) showLogin(true);
+    throw new Error(msg);
+  }
+  return data;
+}
+
+function say(msg, isError) {
+  $("message").textContent = msg;
+  $("message").className = isError ? "error" : "";
+}
+
+async function load() {
+  try {
+    const q = new URLSearchParams({ limit: pageSize, offset });
+    const search = $("search").value.trim();
+    if (search) q.set("q", search);
+    const page = await api("GET", "/posts?" + q);
+    render(page.data);
+    $("count").textContent = page.total + " posts";
+    $("prev").disabled = offset === 0;
+    $("next").disabled = offset + page.data.length >= page.total;
+  } catch (err) {
+    say(err.message, true);
+  }
+}
+
+function render(posts) {
+  const tbody = $("posts");
+  tbody.replaceChildren();
+  for (const p of posts) {
+    const tr = document.createElement("tr");
+    if (p.locked) tr.className = "locked";
+    const cells = [
+      p.id,
+      p.body,
+      p.author || "",
+      (p.tags || []).join(", "),
+      p.views,
+      new Date(p.updated_at).toLocaleString(),
+    ];
+    cells.forEach((value, i) => {
+      const td = document.createElement("td");
+      td.textContent = value;
+      if (i === 1) td.className = "body";
+      tr.appendChild(td);
+    });
+
+    const actions = document.createElement("td");
+    actions.className = "actions";
+    actions.append(button("Edit", () => edit(p)), " ", button("Delete", () => remove(p)));
+    tr.appendChild(actions);
+    tbody.appendChild(tr);
+  }
+}
+
+function button(label, onClick) {
+  const b = document.createElement("button");
+  b.type = "button";
+  b.textContent = label;
+  b.addEventListener("click", onClick);
+  return b;
+}
+
+function edit(p) {
+  editing = p;
+  $("editor-title").textContent = "Edit post " + p.id;
+  $("body").value = p.body;
+  $("author").value = p.author || "";
+  $("tags").value = (p.tags || []).join(", ");
+  $("save").textContent = "Save";
+  $("cancel").hidden = false;
+  $("body").focus();
+}
+
+function resetEditor() {
+  editing = null;
+  $("editor").reset();
+  $("editor-title").textContent = "New post";
+  $("save").textContent = "Create";
+  $("cancel").hidden = true;
+}
+
+async function save(event) {
+  event.preventDefault();
+  const post = {
+    body: $("body").value,
+    author: $("author").value.trim(),
+    tags: $("tags").value.split(",").map((t) => t.trim()).filter(Boolean),
+  };
+  try {
+    if (editing) {
+      const p = await api("PUT", "/posts/" + editing.id, post);
+      say("Saved post " + p.id + ".");
+    } else {
+      const p = await api("POST", "/posts", post);
+      say("Created post " + p.id + ".");
+    }
+    resetEditor();
+    load();
+  } catch (err) {
+    say(err.message, true);
+  }
+}
+
+async function remove(p) {
+  if (!confirm("Delete post " + p.id + "? It goes to the trash.")) return;
+  try {
+    await api("DELETE", "/posts/" + p.id);
+    say("Deleted post " + p.id + ".");
+    if (editing && editing.id === p.id) resetEditor();
+    load();
+  } catch (err) {
+    say(err.message, true);
+  }
+}
+
+function showLogin(show) {
+  $("login").hidden = !show;
+  $("logout").hidden = show || !localStorage.getItem("token");
+}
+
+async function login(event) {
+  event.preventDefault();
+  try {
+    const resp = await api("POST", "/auth/login", {
+      username: $("username").value,
+      password: $("password").value,
+    });
+    localStorage.setItem("token", resp.token);
+    $("password").value = "";
+    showLogin(false);
+    say("Logged in.");
+  } catch (err) {
+    say(err.message, true);
+  }
+}
+
+function logout() {
+  localStorage.removeItem("token");
+  checkSession();
+}
+
+// checkSession asks the server whether writes need a login.
+async function checkSession() {
+  try {
+    const caps = await api("GET", "/capabilities");
+    showLogin(!caps.can_create);
+  } catch (err) {
+    say(err.message, true);
+  }
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  $("tenant").value = localStorage.getItem("tenant") || "";
+  $("tenant").addEventListener("change", () => {
+    localStorage.setItem("tenant", $("tenant").value.trim());
+    offset = 0;
+    load();
+  });
+  $("session").addEventListener("submit", login);
+  $("logout").addEventListener("click", logout);
+  $("editor").addEventListener("submit", save);
+  $("cancel").addEventListener("click", resetEditor);
+  $("search").addEventListener("input", () => {
+    offset = 0;
+    load();
+  });
+  $("prev").addEventListener("click", () => {
+    offset = Math.max(0, offset - pageSize);
+    load();
+  });
+  $("next").addEventListener("click", () => {
+    offset += pageSize;
+    load();
+  });
+  checkSession();
+  load();
+});
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+//--------------UNIQUE BODIES PER AUTHOR================
+
+var uniquePerAuthor = flag.Bool("unique-per-author", false, "reject a post whose body matches another post by the same author")
+
+type authorBody struct {
+	author string
+	body   string
+}
+
+// A postSet's authorBodies map each (author, normalized body) pair to
+// the ID of the post holding it. It's only kept up to date with
+// -unique-per-author.
+
+// bodyKey normalizes p's body so that case and whitespace differences
+// don't make two bodies distinct.
+func bodyKey(p Post) authorBody {
+	body := strings.ToLower(strings.Join(strings.Fields(p.Body), " "))
+	return authorBody{author: p.Author, body: body}
+}
+
+// checkUniqueBody returns errDuplicate if another post by p's author
+// has the same body. A post never conflicts with itself.
+func (s *postSet) checkUniqueBody(p Post) error {
+	if !*uniquePerAuthor {
+		return nil
+	}
+	if id, ok := s.authorBodies[bodyKey(p)]; ok && id != p.ID {
+		return errDuplicate
+	}
+	return nil
+}
+
+func (s *postSet) indexBody(p Post) {
+	if *uniquePerAuthor {
+		s.authorBodies[bodyKey(p)] = p.ID
+	}
+}
+
+func (s *postSet) unindexBody(p Post) {
+	if !*uniquePerAuthor {
+		return
+	}
+	if k := bodyKey(p); s.authorBodies[k] == p.ID {
+		delete(s.authorBodies, k)
+	}
+}
+
+// rebuildBodyIndex recomputes authorBodies from posts, e.g. after a
+// rolled back batch restores an earlier posts map.
+func (s *postSet) rebuildBodyIndex() {
+	s.authorBodies = make(map[authorBody]PostID)
+	for _, p := range s.store.List() {
+		s.indexBody(p)
+	}
+}
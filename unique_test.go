@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestUniquePerAuthor(t *testing.T) {
+	tests := []struct {
+		name, first, second string
+		flag                bool
+		want                int
+	}{
+		{"same author", `{"body":"hello","author":"ann"}`, `{"body":"hello","author":"ann"}`, true, http.StatusConflict},
+		{"same author, case and spaces", `{"body":"Hello  world","author":"ann"}`, `{"body":"hello world ","author":"ann"}`, true, http.StatusConflict},
+		{"no author twice", `{"body":"hello"}`, `{"body":"hello"}`, true, http.StatusConflict},
+		{"different authors", `{"body":"hello","author":"ann"}`, `{"body":"hello","author":"bob"}`, true, http.StatusCreated},
+		{"author and none", `{"body":"hello","author":"ann"}`, `{"body":"hello"}`, true, http.StatusCreated},
+		{"authors differing in case", `{"body":"hello","author":"ann"}`, `{"body":"hello","author":"Ann"}`, true, http.StatusCreated},
+		{"same author, other body", `{"body":"hello","author":"ann"}`, `{"body":"goodbye","author":"ann"}`, true, http.StatusCreated},
+		{"flag off", `{"body":"hello","author":"ann"}`, `{"body":"hello","author":"ann"}`, false, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, "-unique-per-author="+strconv.FormatBool(tt.flag))
+			ts.createPost(tt.first)
+			wantStatus(t, ts.do("POST", "/posts", tt.second), tt.want)
+		})
+	}
+}
+
+func TestUniquePerAuthorOnChanges(t *testing.T) {
+	ts := newTestServer(t, "-unique-per-author=true")
+	ts.createPost(`{"body":"hello","author":"ann"}`)
+	ts.createPost(`{"body":"goodbye","author":"ann"}`)
+	ts.createPost(`{"body":"hello","author":"bob"}`)
+
+	// Editing a post into another's body conflicts, but saving it
+	// unchanged doesn't.
+	wantStatus(t, ts.do("PATCH", "/posts/2", `{"body":"hello"}`), http.StatusConflict)
+	wantStatus(t, ts.do("PUT", "/posts/1", `{"body":"hello","author":"ann"}`), http.StatusOK)
+	// Nor does taking a body another author has.
+	wantStatus(t, ts.do("PATCH", "/posts/3", `{"author":"ann"}`), http.StatusConflict)
+	wantStatus(t, ts.do("PATCH", "/posts/3", `{"author":"cat"}`), http.StatusOK)
+
+	// Deleting a post frees its body, and then it can't be restored
+	// while another post has it.
+	wantStatus(t, ts.do("DELETE", "/posts/1", ""), http.StatusOK)
+	ts.createPost(`{"body":"hello","author":"ann"}`)
+	wantStatus(t, ts.do("POST", "/posts/1/restore", ""), http.StatusConflict)
+}
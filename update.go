@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+)
+
+//--------------UPDATING POSTS================
+
+// PUT /posts/{id} replaces a post and PATCH /posts/{id} changes part
+// of it. Either way only the body and author are up to the client;
+// the ID, timestamps, view count and lock state are kept by the
+// server, as with the "update" batch operation. Updating a reserved
+// post finalizes it.
+//
+// Both honor If-Match with the post's ETag from GET /posts/{id},
+// answering 412 if the post changed in between.
+
+func handlePutPost(w http.ResponseWriter, r *http.Request, id PostID) {
+	body, ok := readRequiredBody(w, r)
+	if !ok {
+		return
+	}
+	var p Post
+	if err := decodeBody(r, body, &p); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	old, err := s.getPost(id)
+	if err == nil {
+		err = s.checkOwner(r, id)
+	}
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	if !checkIfMatch(w, r, old) {
+		return
+	}
+	p, err = s.updatePost(id, p)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", postETag(p))
+	respond(w, r, http.StatusOK, p)
+}
+
+// handlePatchPost applies a JSON Merge Patch (RFC 7386): fields in the
+// patch replace the post's, null removes them, and fields left out are
+// kept. So {"author":null} clears the author but leaves the body.
+//
+// Like POST /posts, the Content-Type isn't checked, except that a JSON
+// Patch (RFC 6902) is refused rather than misread as a merge patch.
+func handlePatchPost(w http.ResponseWriter, r *http.Request, id PostID) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json-patch+json" {
+		writeError(w, r, http.StatusUnsupportedMediaType, "JSON Patch isn't supported, send a JSON Merge Patch (application/merge-patch+json)")
+		return
+	}
+
+	body, ok := readRequiredBody(w, r)
+	if !ok {
+		return
+	}
+	var patch interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+		return
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		writeError(w, r, http.StatusBadRequest, "Patch must be a JSON object")
+		return
+	}
+
+	postsMu.Lock()
+	defer postsMu.Unlock()
+
+	s, err := postSetFor(r)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	old, err := s.getPost(id)
+	if err == nil {
+		err = s.checkOwner(r, id)
+	}
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	if !checkIfMatch(w, r, old) {
+		return
+	}
+
+	var target interface{}
+	current, _ := json.Marshal(old)
+	json.Unmarshal(current, &target)
+	merged, _ := json.Marshal(mergePatch(target, patch))
+
+	// Decoding the result like any other request body means unknown
+	// fields in the patch are rejected under -strict-fields.
+	var p Post
+	if err := decodeJSON(r, bytes.NewReader(merged), &p); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	p, err = s.updatePost(id, p)
+	if err != nil {
+		writePostError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", postETag(p))
+	respond(w, r, http.StatusOK, p)
+}
+
+// mergePatch applies patch to target as RFC 7386 describes.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergePatch(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
+
+// readRequiredBody reads the whole request body, answering 400 and
+// returning false if there isn't one.
+func readRequiredBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Body == nil {
+		writeError(w, r, http.StatusBadRequest, "Request body is required")
+		return nil, false
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Error reading request body")
+		return nil, false
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		writeError(w, r, http.StatusBadRequest, "Request body is required")
+		return nil, false
+	}
+	return body, true
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------USERS================
+
+// Users are the people posts belong to. A post's author_id is set when
+// it's created and never changes. With authentication on (see auth.go)
+// it's the user whose name the client logged in as, made the first
+// time that login creates a post if there's no such user yet, and
+// only that user can then update, lock, unlock or delete the post.
+// Posts without an author_id, from before authentication was turned
+// on, stay open to every logged in user. Without
+// authentication clients may set author_id themselves, but it has to
+// name an existing user.
+//
+// A user's name is what ties their posts to a login, so with
+// authentication on only the user themselves or an admin (see
+// ADMIN_USERS in auth.go) may rename or delete them. Otherwise anyone
+// could rename somebody's user to their own login and take the posts.
+//
+// Users are shared by all tenants. With -store=file they're saved to
+// users.json in -data-dir.
+
+type User struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	users      = make(map[int]User)
+	nextUserID = 1
+	usersMu    sync.Mutex
+)
+
+// validUserName matches the names AUTH_USERS can hold.
+var validUserName = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+
+var (
+	errUnknownUser = errors.New("unknown user")
+	errForbidden   = errors.New("not the post's author")
+)
+
+//--------------USER ENDPOINTS================
+
+func handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	usersMu.Lock()
+	list := make([]User, 0, len(users))
+	for _, u := range users {
+		list = append(list, u)
+	}
+	usersMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	respond(w, r, http.StatusOK, list)
+}
+
+func handlePostUsers(w http.ResponseWriter, r *http.Request) {
+	var u User
+	if err := decodeJSON(r, r.Body, &u); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+		return
+	}
+	if !validUserName.MatchString(u.Name) {
+		writeError(w, r, http.StatusBadRequest, "Name is required (letters, digits, _ . @ and -, at most 64)")
+		return
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	if _, taken := userByName(u.Name); taken {
+		writeError(w, r, http.StatusConflict, "Name is already taken")
+		return
+	}
+	u.ID = nextUserID
+	u.CreatedAt = time.Now().UTC()
+	users[u.ID] = u
+	nextUserID++
+	if err := saveUsers(); err != nil {
+		delete(users, u.ID)
+		nextUserID--
+		writeError(w, r, http.StatusInternalServerError, "Error saving user")
+		return
+	}
+	respond(w, r, http.StatusCreated, u)
+}
+
+func handleGetUser(w http.ResponseWriter, r *http.Request, id int) {
+	usersMu.Lock()
+	u, ok := users[id]
+	usersMu.Unlock()
+
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	respond(w, r, http.StatusOK, u)
+}
+
+// handlePutUser renames a user. Logins go by name, so with
+// authentication on the new name needs an AUTH_USERS entry too.
+func handlePutUser(w http.ResponseWriter, r *http.Request, id int) {
+	var req User
+	if err := decodeJSON(r, r.Body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+		return
+	}
+	if !validUserName.MatchString(req.Name) {
+		writeError(w, r, http.StatusBadRequest, "Name is required (letters, digits, _ . @ and -, at most 64)")
+		return
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	u, ok := users[id]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	if other, taken := userByName(req.Name); taken && other.ID != id {
+		writeError(w, r, http.StatusConflict, "Name is already taken")
+		return
+	}
+	old := u
+	u.Name = req.Name
+	users[id] = u
+	if err := saveUsers(); err != nil {
+		users[id] = old
+		writeError(w, r, http.StatusInternalServerError, "Error saving user")
+		return
+	}
+	respond(w, r, http.StatusOK, u)
+}
+
+// handleDeleteUser removes a user. Their posts keep the author_id, so
+// they stay with nobody able to claim them, but are then open to every
+// logged in user like posts without one.
+func handleDeleteUser(w http.ResponseWriter, r *http.Request, id int) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	u, ok := users[id]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	delete(users, id)
+	if err := saveUsers(); err != nil {
+		users[id] = u
+		writeError(w, r, http.StatusInternalServerError, "Error saving user")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetUserPosts lists the user's posts in the request's tenant.
+func handleGetUserPosts(w http.ResponseWriter, r *http.Request, id int) {
+	usersMu.Lock()
+	_, ok := users[id]
+	usersMu.Unlock()
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+
+	all := listable(readPostSet(r).store.List())
+	postsMu.RUnlock()
+
+	ps := all[:0]
+	for _, p := range all {
+		if p.AuthorID == id {
+			ps = append(ps, p)
+		}
+	}
+	sortByID(ps)
+	respond(w, r, http.StatusOK, ps)
+}
+
+// selfOrAdmin lets h change the user with the given ID only if r is
+// logged in as that user or as an admin. Without authentication
+// anyone may, as with posts. Users that don't exist are left for h to
+// report.
+func selfOrAdmin(h func(w http.ResponseWriter, r *http.Request, id int)) func(w http.ResponseWriter, r *http.Request, id int) {
+	return func(w http.ResponseWriter, r *http.Request, id int) {
+		if authEnabled() && !adminUsers[userOf(r)] {
+			usersMu.Lock()
+			u, ok := users[id]
+			usersMu.Unlock()
+			if ok && u.Name != userOf(r) {
+				writeError(w, r, http.StatusForbidden, "Only the user themselves or an admin may do this")
+				return
+			}
+		}
+		h(w, r, id)
+	}
+}
+
+// withUserID is withID for /users/{id}.
+func withUserID(h func(w http.ResponseWriter, r *http.Request, id int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		segment, _, _ := strings.Cut(r.URL.Path[len("/users/"):], "/")
+		id, err := strconv.Atoi(segment)
+		if err != nil || !allDigits(segment) {
+			writeError(w, r, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		h(w, r, id)
+	}
+}
+
+// userRoutes serves /users/{id} and /users/{id}/posts.
+type userRoutes struct {
+	user, posts http.Handler
+}
+
+func (u userRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch _, rest, _ := strings.Cut(r.URL.Path[len("/users/"):], "/"); rest {
+	case "":
+		u.user.ServeHTTP(w, r)
+	case "posts":
+		u.posts.ServeHTTP(w, r)
+	default:
+		writeError(w, r, http.StatusNotFound, "Not found")
+	}
+}
+
+//--------------OWNERSHIP================
+
+// userByName finds a user by name. Callers must hold usersMu.
+func userByName(name string) (User, bool) {
+	for _, u := range users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// authorIDFor decides the author_id of a post r creates: the logged
+// in user, or with authentication off, the one asked for, which must
+// exist.
+func authorIDFor(r *http.Request, requested int) (int, error) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	if authEnabled() {
+		return loginUserID(userOf(r))
+	}
+	if _, ok := users[requested]; requested != 0 && !ok {
+		return 0, errUnknownUser
+	}
+	return requested, nil
+}
+
+// loginUserID returns the ID of the user named login, making one if
+// there isn't one yet, so every post created with authentication on
+// has an owner. Callers must hold usersMu.
+func loginUserID(login string) (int, error) {
+	if login == "" {
+		// withAuth lets no write through without a login.
+		return 0, errors.New("no logged in user")
+	}
+	if u, ok := userByName(login); ok {
+		return u.ID, nil
+	}
+	u := User{ID: nextUserID, Name: login, CreatedAt: time.Now().UTC()}
+	users[u.ID] = u
+	nextUserID++
+	if err := saveUsers(); err != nil {
+		delete(users, u.ID)
+		nextUserID--
+		return 0, err
+	}
+	return u.ID, nil
+}
+
+// checkOwner returns errForbidden if authentication is on and the
+// post with the given ID, which may be in the trash, belongs to
+// someone other than r's user. Posts that don't exist are left for the
+// caller to report. Callers must hold postsMu.
+func (s *postSet) checkOwner(r *http.Request, id PostID) error {
+	if !authEnabled() {
+		return nil
+	}
+	p, ok := s.store.Get(id)
+	if !ok {
+		p, ok = s.store.GetTrashed(id)
+	}
+	if !ok || p.AuthorID == 0 {
+		return nil
+	}
+
+	usersMu.Lock()
+	owner, ok := users[p.AuthorID]
+	usersMu.Unlock()
+	if ok && owner.Name != userOf(r) {
+		return errForbidden
+	}
+	return nil
+}
+
+//--------------SAVING USERS================
+
+func usersPath() string {
+	return filepath.Join(*dataDir, "users.json")
+}
+
+// loadUsers reads the users saved by an earlier run, with -store=file.
+func loadUsers() error {
+	if *storeKind != "file" {
+		return nil
+	}
+	data, err := os.ReadFile(usersPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved struct {
+		NextID int    `json:"next_id"`
+		Users  []User `json:"users"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return errors.New(usersPath() + ": " + err.Error())
+	}
+	for _, u := range saved.Users {
+		users[u.ID] = u
+	}
+	nextUserID = saved.NextID
+	return nil
+}
+
+// saveUsers rewrites users.json, with -store=file. Users change rarely
+// enough that writing them all each time is fine. Callers must hold
+// usersMu.
+func saveUsers() error {
+	if *storeKind != "file" {
+		return nil
+	}
+
+	saved := struct {
+		NextID int    `json:"next_id"`
+		Users  []User `json:"users"`
+	}{NextID: nextUserID}
+	for _, u := range users {
+		saved.Users = append(saved.Users, u)
+	}
+	sort.Slice(saved.Users, func(i, j int) bool { return saved.Users[i].ID < saved.Users[j].ID })
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*dataDir, 0o700); err != nil {
+		return err
+	}
+	tmp := usersPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, usersPath())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLogin(t *testing.T) {
+	withTestAuth(t, []string{"ann"})
+	ts := newTestServer(t)
+
+	wantStatus(t, ts.do("POST", "/auth/login", `{"username":"ann","password":"nope"}`), http.StatusUnauthorized)
+	wantStatus(t, ts.do("POST", "/auth/login", `{"username":"bob","password":"pw"}`), http.StatusUnauthorized)
+
+	rec := ts.do("POST", "/auth/login", `{"username":"ann","password":"pw"}`)
+	wantStatus(t, rec, http.StatusOK)
+	login := decodeResponse[loginResponse](t, rec)
+	if login.Token == "" {
+		t.Fatal("no token")
+	}
+	wantStatus(t, ts.do("POST", "/posts", `{"body":"hi"}`, "Authorization", "Bearer "+login.Token), http.StatusCreated)
+}
+
+func TestWritesNeedAToken(t *testing.T) {
+	withTestAuth(t, []string{"ann"})
+	ts := newTestServer(t)
+
+	rec := ts.do("POST", "/posts", `{"body":"hi"}`)
+	wantStatus(t, rec, http.StatusUnauthorized)
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 without WWW-Authenticate")
+	}
+	wantStatus(t, ts.do("POST", "/posts", `{"body":"hi"}`, "Authorization", "Bearer forged"), http.StatusUnauthorized)
+	// Reads don't need one.
+	wantStatus(t, ts.do("GET", "/posts", ""), http.StatusOK)
+}
+
+func TestPostOwnership(t *testing.T) {
+	withTestAuth(t, []string{"ann", "bob"})
+	ts := newTestServer(t)
+
+	rec := ts.as("ann", "POST", "/posts", `{"body":"ann's"}`)
+	wantStatus(t, rec, http.StatusCreated)
+	p := decodeResponse[Post](t, rec)
+	if p.AuthorID == 0 {
+		t.Fatal("post has no author_id")
+	}
+	// ann's first post made her a user.
+	if u := decodeResponse[User](t, ts.do("GET", "/users/1", "")); u.Name != "ann" || u.ID != p.AuthorID {
+		t.Errorf("user %+v, want ann with ID %d", u, p.AuthorID)
+	}
+
+	tests := []struct {
+		login, method, body string
+		want                int
+	}{
+		{"bob", "PUT", `{"body":"bob's now"}`, http.StatusForbidden},
+		{"bob", "PATCH", `{"body":"bob's now"}`, http.StatusForbidden},
+		{"bob", "DELETE", "", http.StatusForbidden},
+		{"ann", "PATCH", `{"body":"still ann's"}`, http.StatusOK},
+		{"ann", "DELETE", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := ts.as(tt.login, tt.method, "/posts/1", tt.body); rec.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d: %s", tt.login, tt.method, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+func TestUserChanges(t *testing.T) {
+	withTestAuth(t, []string{"ann", "bob", "root"}, "root")
+	ts := newTestServer(t)
+	wantStatus(t, ts.as("ann", "POST", "/users", `{"name":"ann"}`), http.StatusCreated)
+	wantStatus(t, ts.as("bob", "POST", "/users", `{"name":"bob"}`), http.StatusCreated)
+
+	tests := []struct {
+		login, method, path, body string
+		want                      int
+	}{
+		// Renaming ann to bob would hand bob ann's posts.
+		{"bob", "PUT", "/users/1", `{"name":"bob"}`, http.StatusForbidden},
+		{"bob", "DELETE", "/users/1", "", http.StatusForbidden},
+		{"ann", "PUT", "/users/1", `{"name":"ann"}`, http.StatusOK},
+		{"root", "PUT", "/users/2", `{"name":"robert"}`, http.StatusOK},
+		{"root", "DELETE", "/users/2", "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if rec := ts.as(tt.login, tt.method, tt.path, tt.body); rec.Code != tt.want {
+			t.Errorf("%s %s %s: status %d, want %d: %s", tt.login, tt.method, tt.path, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+func TestStatusIsAdminOnly(t *testing.T) {
+	withTestAuth(t, []string{"ann", "root"}, "root")
+	ts := newTestServer(t)
+
+	wantStatus(t, ts.as("ann", "PUT", "/admin/status", `{"message":"down"}`), http.StatusForbidden)
+	wantStatus(t, ts.as("ann", "DELETE", "/admin/status", ""), http.StatusForbidden)
+	if rec := ts.do("GET", "/healthz", ""); rec.Header().Get("X-Service-Status") != "" {
+		t.Error("ann set the status")
+	}
+
+	wantStatus(t, ts.as("root", "PUT", "/admin/status", `{"message":"down","severity":"warning"}`), http.StatusOK)
+	if got := ts.do("GET", "/healthz", "").Header().Get("X-Service-Status"); got != "warning; down" {
+		t.Errorf("X-Service-Status %q", got)
+	}
+	wantStatus(t, ts.do("GET", "/admin/status", ""), http.StatusOK)
+}
+
+func TestStatusNeedsAdmins(t *testing.T) {
+	// Auth on but no ADMIN_USERS, and auth off: nobody is an admin.
+	withTestAuth(t, []string{"ann"})
+	ts := newTestServer(t)
+	wantStatus(t, ts.as("ann", "PUT", "/admin/status", `{"message":"down"}`), http.StatusForbidden)
+
+	authSecret = nil
+	ts = newTestServer(t)
+	wantStatus(t, ts.do("PUT", "/admin/status", `{"message":"down"}`), http.StatusForbidden)
+	wantStatus(t, ts.do("DELETE", "/admin/status", ""), http.StatusForbidden)
+	if got := ts.do("GET", "/healthz", "").Header().Get("X-Service-Status"); got != "" {
+		t.Errorf("X-Service-Status %q", got)
+	}
+}
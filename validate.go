@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//--------------VALIDATING POSTS================
+
+// createPost and updatePost validate what the client sent before
+// touching anything, so every way in (POST, PUT, PATCH, /batch, /ws)
+// gets the same rules. A post that breaks any of them is refused with
+// 422 and every problem at once, one per field:
+//
+//	{"error":"Validation failed","fields":[{"field":"body","message":"is required"}]}
+//
+// With problem details the list is the "fields" member. Unknown
+// fields in a JSON or YAML body are reported the same way, unless
+// -strict-fields=false or X-Strict-Fields: false lets them through.
+
+var maxPostLength = flag.Int("max-post-length", 10000, "longest post body accepted, in characters")
+
+// maxAuthorLength bounds author names, which are shown next to every
+// post.
+const maxAuthorLength = 100
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError lists everything wrong with a post.
+type validationError struct {
+	fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, len(e.fields))
+	for i, f := range e.fields {
+		msgs[i] = f.Field + " " + f.Message
+	}
+	return "invalid post: " + strings.Join(msgs, "; ")
+}
+
+func (e *validationError) add(field, format string, args ...interface{}) {
+	e.fields = append(e.fields, fieldError{field, fmt.Sprintf(format, args...)})
+}
+
+// orNil returns e if it found anything, as a plain error so that "no
+// problems" compares equal to nil.
+func (e *validationError) orNil() error {
+	if len(e.fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validatePost checks p, already normalized, as sent to create a post
+// (id "") or update the post with the given id.
+func validatePost(p Post, id PostID) error {
+	var e validationError
+	switch {
+	case id == "" && p.ID != "":
+		e.add("id", "is assigned by the server and can't be set")
+	case id != "" && p.ID != "" && p.ID != id:
+		e.add("id", "must match the ID of the post being updated")
+	}
+
+	switch n := utf8.RuneCountInString(p.Body); {
+	case strings.TrimSpace(p.Body) == "":
+		e.add("body", "is required")
+	case n > *maxPostLength:
+		e.add("body", "must be at most %d characters, not %d", *maxPostLength, n)
+	}
+	if n := utf8.RuneCountInString(p.Author); n > maxAuthorLength {
+		e.add("author", "must be at most %d characters", maxAuthorLength)
+	}
+	if _, err := normalizeTags(p.Tags); err != nil {
+		e.add("tags", "must be at most %d tags, each up to %d letters, digits, - or _", maxTags, maxTagLen)
+	}
+	return e.orNil()
+}
+
+// unknownFieldError turns the decoder's complaint about an unknown
+// field into a validationError, and returns anything else as it is.
+func unknownFieldError(err error) error {
+	rest, ok := strings.CutPrefix(err.Error(), "json: unknown field ")
+	if !ok {
+		return err
+	}
+	field, uerr := strconv.Unquote(rest)
+	if uerr != nil {
+		field = rest
+	}
+	e := &validationError{}
+	e.add(field, "is not a field of a post")
+	return e
+}
+
+// writeBodyError answers a request body that couldn't be decoded:
+// 422 for unknown fields, 400 for anything else.
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var verr *validationError
+	if errors.As(unknownFieldError(err), &verr) {
+		writeValidationError(w, r, verr)
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, "Error parsing request body: "+err.Error())
+}
+
+func writeValidationError(w http.ResponseWriter, r *http.Request, e *validationError) {
+	if wantsProblem(r) {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "Validation failed", map[string]interface{}{"fields": e.fields})
+		return
+	}
+	body := map[string]interface{}{"error": "Validation failed", "fields": e.fields}
+	if id := requestIDOf(r); id != "" {
+		body["request_id"] = id
+	}
+	respond(w, r, http.StatusUnprocessableEntity, body)
+}
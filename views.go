@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//--------------VIEW COUNTS================
+
+var viewsFlushInterval = flag.Duration("views-flush-interval", 10*time.Second, "how often the views counted by GET /posts/{id} are added to the stored posts (0 only adds them on shutdown)")
+
+// Every GET /posts/{id} is a view, so counting them through the store
+// would make every read take the write lock, and with -store=file
+// journal the whole post each time. Instead a view only bumps a
+// counter, under the read lock, and the counters are added to the
+// stored posts every -views-flush-interval, and on shutdown, with one
+// small journal record per viewed post.
+//
+// GET /posts/{id} shows the counted views straight away. Everything
+// else that shows views, like lists and ?order=views, goes by the
+// stored posts, so it can be up to -views-flush-interval behind.
+
+// viewCounts holds the views of a tenant's posts that aren't in the
+// store yet, as a *atomic.Int64 per post ID. Counting only needs the
+// read lock on postsMu; taking counts out needs the write lock, so
+// nobody can be adding to one as it goes.
+type viewCounts struct {
+	m sync.Map
+}
+
+// add counts a view of the post with the given ID and returns how
+// many it now has that aren't in the store.
+func (v *viewCounts) add(id PostID) int {
+	c, ok := v.m.Load(id)
+	if !ok {
+		c, _ = v.m.LoadOrStore(id, new(atomic.Int64))
+	}
+	return int(c.(*atomic.Int64).Add(1))
+}
+
+// pending returns the views of the post with the given ID that aren't
+// in the store.
+func (v *viewCounts) pending(id PostID) int {
+	if c, ok := v.m.Load(id); ok {
+		return int(c.(*atomic.Int64).Load())
+	}
+	return 0
+}
+
+// forget drops the views of the post with the given ID, for an ID
+// that's handed out again. Callers must hold postsMu for writing.
+func (v *viewCounts) forget(id PostID) {
+	v.m.Delete(id)
+}
+
+// flushViews adds the counted views to the stored posts. Views of
+// posts deleted since are dropped. Callers must hold postsMu for
+// writing.
+func (s *postSet) flushViews() {
+	s.views.m.Range(func(key, value interface{}) bool {
+		id := key.(PostID)
+		s.views.m.Delete(id)
+		n := int(value.(*atomic.Int64).Load())
+		if err := s.store.AddViews(id, n); err != nil && err != errNotFound {
+			slog.Error("saving views", "tenant", s.tenant, "post", id, "err", err)
+		}
+		return true
+	})
+}
+
+// flushAllViews flushes the views of every tenant.
+func flushAllViews() {
+	postsMu.Lock()
+	defer postsMu.Unlock()
+	for _, s := range tenants {
+		s.flushViews()
+	}
+}
+
+// flushViewsEvery calls flushAllViews once per interval.
+func flushViewsEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		flushAllViews()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//--------------WARMUP================
+
+var warmupPaths = flag.String("warmup-paths", "", "comma separated GET paths, like /posts or /posts?order=views, to request for every tenant after startup so -response-cache-size starts warm; /readyz fails until they're done")
+
+// After a restart the response cache (see respcache.go) is empty, so
+// the first clients to ask for the popular pages all wait for them to
+// be filtered, sorted and encoded at once. With -warmup-paths the
+// server asks for those pages itself, as JSON, for every tenant with
+// posts, and so fills the cache before clients come.
+//
+// The server takes requests while it warms up, so that a long warmup
+// can't hold up a restart; /readyz fails with a warmup check until it's
+// done, so a load balancer keeps sending clients elsewhere meanwhile.
+// The other indexes of the posts are built as the stores are loaded,
+// except the search index of a tenant with many posts, which is built
+// in the background (see search.go); /readyz waits for that as well.
+//
+// Warmup requests skip the middleware, so don't show up in the request
+// log, /metrics or the rate limits. They do count as views if they ask
+// for a single post without ?no_count=true.
+
+// warmupDone is set once the warmup has finished, or if there's none.
+var warmupDone atomic.Bool
+
+func init() {
+	warmupDone.Store(true)
+}
+
+// warmUp requests every -warmup-paths path of every tenant from h.
+func warmUp(h http.Handler) {
+	defer warmupDone.Store(true)
+	start := time.Now()
+
+	postsMu.RLock()
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	postsMu.RUnlock()
+	sort.Strings(names)
+
+	n := 0
+	for _, tenant := range names {
+		for _, path := range strings.Split(*warmupPaths, ",") {
+			if path = strings.TrimSpace(path); path == "" {
+				continue
+			}
+			r, err := http.NewRequest("GET", path, nil)
+			if err != nil {
+				slog.Warn("warmup", "path", path, "err", err)
+				continue
+			}
+			r.Header.Set("Accept", "application/json")
+			if tenant != "" {
+				r.Header.Set("X-Tenant-ID", tenant)
+			}
+			w := &discardWriter{header: make(http.Header)}
+			h.ServeHTTP(w, r)
+			if w.code != http.StatusOK {
+				slog.Warn("warmup", "path", path, "tenant", tenant, "status", w.code)
+			}
+			n++
+		}
+	}
+	slog.Info("warmed up", "requests", n, "duration", time.Since(start))
+}
+
+// checkWarmup fails until the warmup is done.
+func checkWarmup() error {
+	if !warmupDone.Load() {
+		return errors.New("still warming up")
+	}
+	return nil
+}
+
+// discardWriter is a ResponseWriter that only keeps the status.
+type discardWriter struct {
+	header http.Header
+	code   int
+}
+
+func (d *discardWriter) Header() http.Header { return d.header }
+
+func (d *discardWriter) WriteHeader(code int) {
+	if d.code == 0 {
+		d.code = code
+	}
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	d.WriteHeader(http.StatusOK)
+	return io.Discard.Write(b)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	ts := newTestServer(t, "-multi-tenant=true", "-response-cache-size=100", "-warmup-paths=/posts, /posts?order=views")
+	for _, tenant := range []string{"a", "b"} {
+		ts.createPost(`{"body":"hi"}`, "X-Tenant-ID", tenant)
+	}
+
+	warmupDone.Store(false)
+	t.Cleanup(func() { warmupDone.Store(true) })
+	rec := ts.do("GET", "/readyz", "")
+	wantStatus(t, rec, http.StatusServiceUnavailable)
+	if c := decodeResponse[healthReport](t, rec).Checks["warmup"]; c.Status != "fail" {
+		t.Errorf("warmup check %+v", c)
+	}
+
+	misses := responseCacheMisses.Load()
+	warmUp(routes())
+	if got := responseCacheMisses.Load() - misses; got != 4 {
+		t.Errorf("warmup made %d cache misses, want 2 paths for 2 tenants", got)
+	}
+	wantStatus(t, ts.do("GET", "/readyz", ""), http.StatusOK)
+
+	// Clients now find the pages cached.
+	hits := responseCacheHits.Load()
+	for _, tenant := range []string{"a", "b"} {
+		wantStatus(t, ts.do("GET", "/posts", "", "X-Tenant-ID", tenant, "Accept", "application/json"), http.StatusOK)
+		wantStatus(t, ts.do("GET", "/posts?order=views", "", "X-Tenant-ID", tenant, "Accept", "application/json"), http.StatusOK)
+	}
+	if got := responseCacheHits.Load() - hits; got != 4 {
+		t.Errorf("%d cache hits after warmup, want 4", got)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+//--------------WORD COUNTS================
+
+type wordCount struct {
+	Posts    int            `json:"posts"`
+	Words    int            `json:"words"`
+	ByAuthor map[string]int `json:"by_author"`
+}
+
+// handleWordCount counts the words in every listed post, or the
+// subset picked out by the usual list filters, in a single pass.
+func handleWordCount(w http.ResponseWriter, r *http.Request) {
+	filter, err := parsePostFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ps := readPostSet(r).store.List()
+	postsMu.RUnlock()
+
+	wc := wordCount{ByAuthor: make(map[string]int)}
+	for _, p := range filter.apply(listable(ps)) {
+		n := len(strings.Fields(p.Body))
+		wc.Posts++
+		wc.Words += n
+		wc.ByAuthor[p.Author] += n
+	}
+
+	respond(w, r, http.StatusOK, wc)
+}
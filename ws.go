@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//--------------WEBSOCKET================
+
+// /ws is a WebSocket (RFC 6455) for clients that both watch and change
+// posts, say an editor several people have open at once. Every message
+// is a JSON text frame. A client sends the same operations as /batch,
+// plus subscribe and unsubscribe, with an optional ref to match up the
+// reply:
+//
+//	{"ref":"1","op":"create","post":{"body":"hi"}}
+//	{"ref":"2","op":"update","id":7,"post":{"body":"hello"}}
+//	{"ref":"3","op":"subscribe"}
+//
+// and the server answers each with a result, status codes and errors
+// being what the REST request would have given:
+//
+//	{"type":"result","ref":"1","op":"create","status":201,"post":{...}}
+//
+// After subscribing, the client also gets the events of GET /events:
+//
+//	{"type":"event","event":"post.created","id":7,"time":"..."}
+//
+// A connection counts against -max-subscribers (see sse.go) until it
+// closes. Operations count against the rate limits like requests do.
+// With auth on, writes need the bearer token sent with the upgrade
+// request, and stop working once it expires.
+
+// wsGUID is the fixed key suffix from RFC 6455, section 1.3.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC11B65"
+
+// maxWSMessage caps a message, after joining its fragments.
+const maxWSMessage = 1 << 20
+
+// wsPingInterval is how often an idle connection is pinged, which
+// keeps proxies from closing it.
+const wsPingInterval = 30 * time.Second
+
+// Frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Close codes.
+const (
+	wsNormalClosure   = 1000
+	wsGoingAway       = 1001
+	wsProtocolError   = 1002
+	wsUnsupportedData = 1003
+	wsTooBig          = 1009
+)
+
+// wsRequest is a message from the client.
+type wsRequest struct {
+	Ref string `json:"ref,omitempty"`
+	batchOp
+}
+
+// wsResult answers a wsRequest.
+type wsResult struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref,omitempty"`
+	batchResult
+}
+
+// wsEvent passes on a postEvent to a subscribed client.
+type wsEvent struct {
+	Type string `json:"type"`
+	postEvent
+}
+
+var errWSTooBig = errors.New("message too big")
+
+// wsConn is the server end of a WebSocket. Only the handleWS loop
+// writes to it.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// The message being read so far, kept here since control
+	// frames can come between its fragments. Only the reading
+	// goroutine uses these.
+	opcode  byte
+	message []byte
+}
+
+func handleWS(w http.ResponseWriter, r *http.Request) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		writeError(w, r, http.StatusUpgradeRequired, "WebSocket upgrade required")
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, r, http.StatusUpgradeRequired, "Unsupported WebSocket version")
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		writeError(w, r, http.StatusBadRequest, "Invalid Sec-WebSocket-Key")
+		return
+	}
+	// A connection is a stream for -max-subscribers whether or not
+	// it subscribes, since it holds a broker channel either way.
+	if !joinOrReject(w, r) {
+		return
+	}
+	defer broker.leave()
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "WebSocket not supported here")
+		return
+	}
+	defer conn.Close()
+	// The server's timeouts were meant for requests, not for a
+	// connection that stays open.
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	ws := &wsConn{conn: conn, br: brw.Reader}
+	ws.serve(r)
+}
+
+// serve runs the connection until either side closes it. Frames are
+// read on their own goroutine so that events can be sent while the
+// client is quiet.
+func (ws *wsConn) serve(r *http.Request) {
+	type frame struct {
+		opcode  byte
+		payload []byte
+		err     error
+	}
+	frames := make(chan frame)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			opcode, payload, err := ws.readMessage()
+			select {
+			case frames <- frame{opcode, payload, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Subscribing to the broker from the start means a shutdown
+	// closes this connection too; events are only passed on once
+	// the client asks for them.
+	events := broker.subscribe(tenantOf(r))
+	defer broker.unsubscribe(events)
+	subscribed := false
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case f := <-frames:
+			switch {
+			case errors.Is(f.err, errWSTooBig):
+				ws.close(wsTooBig, f.err.Error())
+				return
+			case f.err != nil:
+				ws.close(wsProtocolError, f.err.Error())
+				return
+			}
+			switch f.opcode {
+			case wsClose:
+				ws.close(wsNormalClosure, "")
+				return
+			case wsPing:
+				ws.writeFrame(wsPong, f.payload)
+			case wsPong:
+			case wsBinary:
+				ws.close(wsUnsupportedData, "messages must be JSON text")
+				return
+			case wsText:
+				res := ws.handleMessage(r, f.payload, &subscribed)
+				if err := ws.writeJSON(res); err != nil {
+					return
+				}
+			}
+		case e, ok := <-events:
+			if !ok {
+				ws.close(wsGoingAway, "server shutting down")
+				return
+			}
+			if subscribed {
+				if err := ws.writeJSON(wsEvent{"event", e.postEvent}); err != nil {
+					return
+				}
+			}
+		case <-ping.C:
+			if err := ws.writeFrame(wsPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleMessage runs one client message and returns the reply.
+func (ws *wsConn) handleMessage(r *http.Request, msg []byte, subscribed *bool) wsResult {
+	var req wsRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return wsResult{"result", "", fail(batchResult{}, http.StatusBadRequest, "Error parsing message: "+err.Error())}
+	}
+	res := wsResult{Type: "result", Ref: req.Ref}
+
+	switch req.Op {
+	case "subscribe", "unsubscribe":
+		*subscribed = req.Op == "subscribe"
+		res.batchResult = batchResult{Op: req.Op, Status: http.StatusOK}
+		return res
+	}
+
+	write := req.Op != "get"
+	if rate, burst := currentRateLimits.Load().limit(write); rate > 0 {
+		if wait := takeToken(bucketKey{write, clientIP(r)}, rate, burst, time.Now()); wait > 0 {
+			res.batchResult = fail(batchResult{Op: req.Op}, http.StatusTooManyRequests, fmt.Sprintf("Rate limit exceeded, retry in %s", wait.Round(time.Millisecond)))
+			return res
+		}
+	}
+	if write {
+		// Checked again for every write, so an expired token
+		// stops working without reconnecting.
+		if _, err := authenticate(r); !mayWrite(err) {
+			res.batchResult = fail(batchResult{Op: req.Op}, http.StatusUnauthorized, "Authentication required: "+err.Error())
+			return res
+		}
+	}
+
+	if !write {
+		// A get needn't create the tenant's posts.
+		s := readPostSet(r)
+		defer postsMu.RUnlock()
+		res.batchResult = s.applyBatchOp(r, req.batchOp)
+		return res
+	}
+	postsMu.Lock()
+	defer postsMu.Unlock()
+	s, err := postSetFor(r)
+	if err != nil {
+		res.batchResult = failErr(batchResult{Op: req.Op, ID: req.ID}, err)
+		return res
+	}
+	res.batchResult = s.applyBatchOp(r, req.batchOp)
+	return res
+}
+
+// readMessage reads the next message, joining fragments, or the next
+// control frame.
+func (ws *wsConn) readMessage() (byte, []byte, error) {
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if op >= wsClose {
+			// Control frames may come between fragments.
+			return op, payload, nil
+		}
+		switch {
+		case op == wsContinuation && ws.opcode == 0:
+			return 0, nil, errors.New("continuation without a message")
+		case op != wsContinuation && ws.opcode != 0:
+			return 0, nil, errors.New("new message before the last one ended")
+		case op != wsContinuation:
+			ws.opcode = op
+		}
+		if len(ws.message)+len(payload) > maxWSMessage {
+			return 0, nil, errWSTooBig
+		}
+		ws.message = append(ws.message, payload...)
+		if fin {
+			opcode, message := ws.opcode, ws.message
+			ws.opcode, ws.message = 0, nil
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (ws *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("reserved bits set")
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("client frames must be masked")
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (length > 125 || !fin) {
+		return false, 0, nil, errors.New("invalid control frame")
+	}
+	if length > maxWSMessage {
+		return false, 0, nil, errWSTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends payload as a single unmasked frame.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	ws.conn.SetWriteDeadline(time.Now().Add(wsPingInterval))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+func (ws *wsConn) writeJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(wsText, b)
+}
+
+// close sends a close frame. The connection itself is closed by
+// handleWS once serve returns.
+func (ws *wsConn) close(code int, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	ws.writeFrame(wsClose, append(payload, reason...))
+}
+
+// wsAccept is the Sec-WebSocket-Accept answer to key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether the comma separated header name
+// lists token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}